@@ -21,46 +21,56 @@ ENV CGO_ENABLED=0
 WORKDIR /build
 
 # Copy Go source and dependencies
-COPY endpoint.go .
+COPY *.go ./
+COPY endpoint/ endpoint/
 COPY go.mod .
 COPY go.sum .
 
+# This Dockerfile matches *.go but is not Go source
+RUN rm -f Dockerfile.go
+
+# Build metadata stamped into the binaries, reported by -version
+ARG VERSION=dev
+ARG COMMIT=unknown
+ARG BUILD_DATE=unknown
+ENV VERSION_LDFLAGS="-X zerotrust-dns/endpoint.version=${VERSION} -X zerotrust-dns/endpoint.commit=${COMMIT} -X zerotrust-dns/endpoint.buildDate=${BUILD_DATE}"
+
 # Download Go dependencies
 RUN go mod download && go mod verify
 
 # Build Windows x64 binaries
 RUN GOOS=windows GOARCH=amd64 go build \
-    -ldflags="-s -w -H=windowsgui" \
+    -ldflags="-s -w -H=windowsgui ${VERSION_LDFLAGS}" \
     -trimpath \
     -o ZeroTrust-Client-x64.exe \
-    endpoint.go
+    .
 
 RUN cp ZeroTrust-Client-x64.exe ZeroTrust-Service-x64.exe
 
 # Build Windows ARM64 binaries
 RUN GOOS=windows GOARCH=arm64 go build \
-    -ldflags="-s -w -H=windowsgui" \
+    -ldflags="-s -w -H=windowsgui ${VERSION_LDFLAGS}" \
     -trimpath \
     -o ZeroTrust-Client-ARM64.exe \
-    endpoint.go
+    .
 
 RUN cp ZeroTrust-Client-ARM64.exe ZeroTrust-Service-ARM64.exe
 
 # Build Linux x86_64 binaries
 RUN GOOS=linux GOARCH=amd64 go build \
-    -ldflags="-s -w" \
+    -ldflags="-s -w ${VERSION_LDFLAGS}" \
     -trimpath \
     -o ZeroTrust-Client-x86_64 \
-    endpoint.go
+    .
 
 RUN cp ZeroTrust-Client-x86_64 ZeroTrust-Service-x86_64
 
 # Build Linux ARM64 binaries
 RUN GOOS=linux GOARCH=arm64 go build \
-    -ldflags="-s -w" \
+    -ldflags="-s -w ${VERSION_LDFLAGS}" \
     -trimpath \
     -o ZeroTrust-Client-arm64 \
-    endpoint.go
+    .
 
 RUN cp ZeroTrust-Client-arm64 ZeroTrust-Service-arm64
 
@@ -0,0 +1,55 @@
+package endpoint
+
+import (
+	"log/slog"
+	"net"
+	"time"
+)
+
+// logStartup logs the settings the endpoint is running with, once it is
+// listening on listening, as one record operators can check against what
+// they meant to configure. Nothing secret is in it: no keys, passwords or
+// tokens. Durations are strings so the JSON format shows them as the flags
+// take them.
+func logStartup(logger *slog.Logger, config *Config, listening []*net.UDPAddr, now time.Time) {
+	listen := make([]string, len(listening))
+	for i, addr := range listening {
+		listen[i] = addr.String()
+	}
+	transport := config.Transport
+	if transport == "" {
+		transport = "dot"
+	}
+	expires := "never"
+	if !config.expiresAt.IsZero() {
+		expires = config.expiresAt.Format(time.RFC3339)
+		if !now.Before(config.expiresAt) {
+			expires += " (expired)"
+		}
+	}
+
+	logger.Info("DNS endpoint ready",
+		"listen", listen,
+		"type", config.Type,
+		"upstreams", config.upstreams(),
+		"transport", transport,
+		"domain_upstreams", config.DomainUpstreams,
+		"proxy", config.Proxy,
+		"domains", config.Domains,
+		"public_dns", config.publicResolvers(),
+		slog.Group("cache",
+			"entries", defaultCacheSize,
+			"min_ttl", minTTL.String(),
+			"max_ttl", maxTTL.String(),
+			"serve_stale", serveStale.String(),
+			"prefetch_hits", *prefetchHits,
+			"file", *cacheFile,
+		),
+		slog.Group("timeouts",
+			"upstream", upstreamTimeout.String(),
+			"public", publicTimeout.String(),
+			"query", queryTimeout.String(),
+		),
+		"expires", expires,
+	)
+}
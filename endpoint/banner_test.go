@@ -0,0 +1,64 @@
+package endpoint
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogStartup(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&out, nil))
+	config := &Config{
+		Type:      "service",
+		Servers:   []string{"10.0.0.1:853", "10.0.0.2:853"},
+		Domains:   []string{"corp.example"},
+		PublicDNS: []string{"192.0.2.53:53"},
+		Expires:   "2030-01-01T00:00:00Z",
+		expiresAt: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	listening := []*net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+	logStartup(logger, config, listening, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	if n := strings.Count(out.String(), "\n"); n != 1 {
+		t.Fatalf("logged %d records, want one:\n%s", n, out.String())
+	}
+	var record struct {
+		Msg       string
+		Listen    []string
+		Type      string
+		Upstreams []string
+		Transport string
+		Domains   []string
+		Cache     struct{ Entries int }
+		Timeouts  struct{ Upstream string }
+		Expires   string
+	}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Type != "service" || !slices.Equal(record.Upstreams, config.Servers) {
+		t.Errorf("banner has type %q and upstreams %v, want the config's", record.Type, record.Upstreams)
+	}
+	if !slices.Equal(record.Listen, []string{"127.0.0.1:53"}) || record.Transport != "dot" || !slices.Equal(record.Domains, config.Domains) {
+		t.Errorf("banner %+v", record)
+	}
+	if record.Cache.Entries != defaultCacheSize || record.Timeouts.Upstream != upstreamTimeout.String() {
+		t.Errorf("banner cache %+v and timeouts %+v", record.Cache, record.Timeouts)
+	}
+	if record.Expires != "2030-01-01T00:00:00Z" {
+		t.Errorf("banner expires %q", record.Expires)
+	}
+
+	// An expired config says so
+	out.Reset()
+	logStartup(logger, config, listening, time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC))
+	if !strings.Contains(out.String(), `"expires":"2030-01-01T00:00:00Z (expired)"`) {
+		t.Errorf("expired config logged as %s", out.String())
+	}
+}
@@ -0,0 +1,134 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// maxBreakerCooldown caps the exponential backoff of an open breaker.
+const maxBreakerCooldown = time.Minute
+
+// breaker stops queries going to an upstream that keeps failing. After
+// -breaker-threshold consecutive failures it opens for a cooldown, then
+// lets a single probe query through: success closes it, failure reopens
+// it for twice as long.
+type breaker struct {
+	server string
+
+	mu        sync.Mutex
+	failures  int
+	cooldown  time.Duration
+	openUntil time.Time
+	probing   bool
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*breaker)
+)
+
+func breakerFor(server string) *breaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	b, ok := breakers[server]
+	if !ok {
+		b = &breaker{server: server}
+		breakers[server] = b
+	}
+	return b
+}
+
+// allow reports whether a query may be sent to the upstream now, and
+// whether that query is the probe of an open breaker.
+func (b *breaker) allow(now time.Time) (ok, probe bool) {
+	if *breakerThreshold <= 0 {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < *breakerThreshold {
+		return true, false
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false, false
+	}
+	b.probing = true
+	return true, true
+}
+
+// record feeds the outcome of an exchange allowed by allow back into the
+// breaker. Only unreachable upstreams count as failures, and exchanges
+// abandoned through ctx count as nothing.
+func (b *breaker) record(ctx context.Context, probe bool, err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	if !errors.Is(err, errUnreachable) {
+		if *breakerThreshold > 0 && b.failures >= *breakerThreshold {
+			slog.Info("Upstream recovered, closing circuit breaker", "upstream", b.server)
+		}
+		b.failures = 0
+		b.cooldown = 0
+		breakerOpen.WithLabelValues(b.server).Set(0)
+		return
+	}
+
+	b.failures++
+	if *breakerThreshold <= 0 || b.failures < *breakerThreshold {
+		return
+	}
+	switch {
+	case b.cooldown == 0:
+		b.cooldown = *breakerCooldown
+	case probe:
+		b.cooldown = min(2*b.cooldown, maxBreakerCooldown)
+	}
+	b.openUntil = now.Add(b.cooldown)
+	breakerOpen.WithLabelValues(b.server).Set(1)
+	slog.Warn("Upstream keeps failing, opening circuit breaker", "upstream", b.server, "failures", b.failures, "cooldown", b.cooldown)
+}
+
+// consecutiveFailures returns how many exchanges in a row have failed to
+// reach the upstream.
+func (b *breaker) consecutiveFailures() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures
+}
+
+// isOpen reports whether the breaker is currently refusing queries.
+func (b *breaker) isOpen(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return *breakerThreshold > 0 && b.failures >= *breakerThreshold && now.Before(b.openUntil)
+}
+
+// allBreakersOpen reports whether every one of servers is cut off.
+func allBreakersOpen(servers []string, now time.Time) bool {
+	for _, server := range servers {
+		if !breakerFor(server).isOpen(now) {
+			return false
+		}
+	}
+	return len(servers) > 0
+}
+
+// resetBreakers forgets every upstream's failure history.
+func resetBreakers() {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	breakers = make(map[string]*breaker)
+	breakerOpen.Reset()
+}
@@ -0,0 +1,168 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// useTestBreakers sets the breaker flags and gives the test fresh breakers.
+func useTestBreakers(t *testing.T, threshold int, cooldown time.Duration) {
+	t.Helper()
+	setForTest(t, breakerThreshold, threshold)
+	setForTest(t, breakerCooldown, cooldown)
+	resetBreakers()
+	t.Cleanup(resetBreakers)
+}
+
+// failBreaker records an unreachable failure of an allowed exchange on b.
+func failBreaker(t *testing.T, b *breaker, now time.Time) {
+	t.Helper()
+	ok, probe := b.allow(now)
+	if !ok {
+		t.Fatalf("exchange at %s refused", now)
+	}
+	b.record(context.Background(), probe, unreachable("connection refused"), now)
+}
+
+func TestBreakerTrips(t *testing.T) {
+	useTestBreakers(t, 3, time.Second)
+	b := breakerFor("trip.example:853")
+	now := time.Now()
+
+	failBreaker(t, b, now)
+	failBreaker(t, b, now)
+	if b.isOpen(now) {
+		t.Fatal("open below the threshold")
+	}
+	failBreaker(t, b, now)
+	if !b.isOpen(now) {
+		t.Fatal("closed after reaching the threshold")
+	}
+	if ok, _ := b.allow(now); ok {
+		t.Fatal("open breaker allowed a query")
+	}
+	if v := testutil.ToFloat64(breakerOpen.WithLabelValues("trip.example:853")); v != 1 {
+		t.Errorf("breaker open gauge %v, want 1", v)
+	}
+	if !allBreakersOpen([]string{"trip.example:853"}, now) || allBreakersOpen([]string{"trip.example:853", "other.example:853"}, now) {
+		t.Error("allBreakersOpen wrong")
+	}
+
+	// Malformed answers and cancelled exchanges mean the server is up
+	useTestBreakers(t, 2, time.Second)
+	b = breakerFor("up.example:853")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for range 5 {
+		b.record(context.Background(), false, malformed("short response"), now)
+		b.record(ctx, false, unreachable("cancelled"), now)
+	}
+	if n := b.consecutiveFailures(); n != 0 {
+		t.Fatalf("%d failures counted, want none", n)
+	}
+
+	// A threshold of 0 disables the breaker
+	useTestBreakers(t, 0, time.Second)
+	b = breakerFor("disabled.example:853")
+	for range 10 {
+		failBreaker(t, b, now)
+	}
+	if b.isOpen(now) {
+		t.Fatal("disabled breaker opened")
+	}
+}
+
+func TestBreakerCooldown(t *testing.T) {
+	useTestBreakers(t, 1, time.Second)
+	b := breakerFor("cooldown.example:853")
+	now := time.Now()
+	failBreaker(t, b, now)
+
+	if ok, _ := b.allow(now.Add(999 * time.Millisecond)); ok {
+		t.Fatal("allowed before the cooldown ran out")
+	}
+	now = now.Add(time.Second)
+	ok, probe := b.allow(now)
+	if !ok || !probe {
+		t.Fatalf("after the cooldown allow = %v, %v, want a probe", ok, probe)
+	}
+	// Only one probe at a time
+	if ok, _ := b.allow(now); ok {
+		t.Fatal("second probe allowed while the first is out")
+	}
+
+	// Each failed probe doubles the cooldown, up to the cap
+	b.record(context.Background(), probe, unreachable("still down"), now)
+	for _, want := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		if ok, _ := b.allow(now.Add(want - time.Millisecond)); ok {
+			t.Fatalf("allowed before the %s cooldown ran out", want)
+		}
+		now = now.Add(want)
+		failBreaker(t, b, now)
+	}
+	for range 10 {
+		now = now.Add(maxBreakerCooldown)
+		failBreaker(t, b, now)
+	}
+	if !b.isOpen(now.Add(maxBreakerCooldown-time.Millisecond)) || b.isOpen(now.Add(maxBreakerCooldown)) {
+		t.Fatalf("cooldown not capped at %s", maxBreakerCooldown)
+	}
+}
+
+func TestBreakerRecovers(t *testing.T) {
+	useTestBreakers(t, 2, time.Second)
+	b := breakerFor("recover.example:853")
+	now := time.Now()
+	failBreaker(t, b, now)
+	failBreaker(t, b, now)
+
+	now = now.Add(time.Second)
+	ok, probe := b.allow(now)
+	if !ok || !probe {
+		t.Fatal("no probe after the cooldown")
+	}
+	b.record(context.Background(), probe, nil, now)
+	if b.isOpen(now) || b.consecutiveFailures() != 0 {
+		t.Fatal("still open after a successful probe")
+	}
+	if ok, probe := b.allow(now); !ok || probe {
+		t.Fatalf("after recovering allow = %v, %v, want an ordinary query", ok, probe)
+	}
+	if v := testutil.ToFloat64(breakerOpen.WithLabelValues("recover.example:853")); v != 0 {
+		t.Errorf("breaker open gauge %v, want 0", v)
+	}
+	// The backoff starts over
+	failBreaker(t, b, now)
+	failBreaker(t, b, now)
+	if b.isOpen(now.Add(time.Second)) {
+		t.Fatal("cooldown not reset by the recovery")
+	}
+}
+
+func TestForwardToServersStopsAtOpenBreaker(t *testing.T) {
+	resetUpstreamState(t)
+	useTestBreakers(t, 2, time.Minute)
+	p := newTestPKI(t)
+	query := buildTestQuery(1, "breaker.example", typeA)
+
+	for range 2 {
+		if _, err := forwardToServers(context.Background(), query, []string{"127.0.0.1:1"}, "", p.clientTLS(t)); err == nil {
+			t.Fatal("unreachable upstream answered")
+		}
+	}
+	_, err := forwardToServers(context.Background(), query, []string{"127.0.0.1:1"}, "", p.clientTLS(t))
+	if !errors.Is(err, errUnreachable) || !strings.Contains(err.Error(), "circuit breaker open") {
+		t.Fatalf("got %v, want the open breaker", err)
+	}
+
+	// Other upstreams are still tried
+	server := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	if _, err := forwardToServers(context.Background(), query, []string{"127.0.0.1:1", server.addr()}, "", p.clientTLS(t)); err != nil {
+		t.Fatalf("failover past the open breaker: %v", err)
+	}
+}
@@ -0,0 +1,353 @@
+package endpoint
+
+import (
+	"cmp"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCacheSize = 4096
+
+const (
+	// maxNegativeTTL caps how long NXDOMAIN/NODATA answers are cached
+	// whatever the zone's SOA says
+	maxNegativeTTL = 3600
+	// servFailTTL briefly caches upstream SERVFAILs so a broken zone isn't
+	// retried for every client query (RFC 2308 section 7.1)
+	servFailTTL = 5
+	// prefetchFraction is the share of an entry's lifetime left at which a
+	// popular entry is refreshed ahead of expiry
+	prefetchFraction = 10
+)
+
+const (
+	// cacheShards is how many independently locked parts the cache is
+	// split into, so concurrent queries rarely wait on each other
+	cacheShards = 16
+	// minShardEntries keeps shards from getting so small that evicting
+	// per shard strays far from evicting the least recently used overall
+	minShardEntries = 64
+)
+
+// dnsCache is a size-bounded LRU of raw DNS responses keyed on the query's
+// question. Positive answers expire after their smallest answer TTL and
+// negative ones after the TTL derived from the zone's SOA. Keys are spread
+// over shards by hash, each its own LRU under its own lock.
+type dnsCache struct {
+	seed   maphash.Seed
+	shards []*cacheShard
+}
+
+type cacheShard struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+type cacheEntry struct {
+	key      string
+	response []byte
+	stored   time.Time
+	expires  time.Time
+	// hits counts lookups served from the entry, prefetching is set once a
+	// refresh of it has been started
+	hits        int
+	prefetching bool
+}
+
+var responseCache = newDNSCache(defaultCacheSize)
+
+func newDNSCache(maxEntries int) *dnsCache {
+	return newShardedCache(maxEntries, max(1, min(cacheShards, maxEntries/minShardEntries)))
+}
+
+// newShardedCache returns a cache of maxEntries split into n shards.
+func newShardedCache(maxEntries, n int) *dnsCache {
+	c := &dnsCache{seed: maphash.MakeSeed(), shards: make([]*cacheShard, n)}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			// Rounded up, so the shards together hold at least maxEntries
+			maxEntries: (maxEntries + n - 1) / n,
+			entries:    make(map[string]*list.Element),
+			lru:        list.New(),
+		}
+	}
+	return c
+}
+
+// shard returns the shard holding key.
+func (c *dnsCache) shard(key string) *cacheShard {
+	return c.shards[maphash.String(c.seed, key)%uint64(len(c.shards))]
+}
+
+// cacheKey derives the cache key from the first question of a query: the
+// expanded, lower-cased wire-format name followed by QTYPE and QCLASS, so
+// the same question hits the cache however it was compressed. The DO and
+// CD bits are part of the key too: an answer with DNSSEC records mustn't
+// go to a client that didn't ask for them, nor an unvalidated one to a
+// client relying on the upstream to validate.
+func cacheKey(query []byte) (string, error) {
+	if len(query) < dnsHeaderLen {
+		return "", fmt.Errorf("query shorter than header")
+	}
+	if qd, _, _, _ := msgCounts(query); qd != 1 {
+		return "", fmt.Errorf("expected 1 question, got %d", qd)
+	}
+	name, off, err := expandName(query, dnsHeaderLen)
+	if err != nil {
+		return "", err
+	}
+	if off+4 > len(query) {
+		return "", fmt.Errorf("truncated question")
+	}
+	var dnssec byte
+	if ednsDO(query) {
+		dnssec |= 1
+	}
+	if msgFlags(query)&flagCD != 0 {
+		dnssec |= 2
+	}
+	return string(append(append(name, query[off:off+4]...), dnssec)), nil
+}
+
+// Get returns a copy of the cached response for key with its transaction ID
+// rewritten to match query and its TTLs reduced by the time spent in the
+// cache, or nil on a miss.
+func (c *dnsCache) Get(key string, query []byte, now time.Time) []byte {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		// Kept for GetStale until the -serve-stale window has passed too
+		if !now.Before(entry.expires.Add(*serveStale)) {
+			s.lru.Remove(elem)
+			delete(s.entries, key)
+		}
+		return nil
+	}
+	s.lru.MoveToFront(elem)
+	entry.hits++
+
+	response := make([]byte, len(entry.response))
+	copy(response, entry.response)
+	setMsgID(response, msgID(query))
+	// RD is copied from the query (RFC 1035 4.1.1), which may differ from
+	// the one that was cached. AD is relayed as the upstream set it.
+	flags := msgFlags(response)&^flagRD | msgFlags(query)&flagRD
+	binary.BigEndian.PutUint16(response[2:4], flags)
+	// Walking can't fail, Set and Load only store responses that walk
+	decrementTTLs(response, uint32(now.Sub(entry.stored)/time.Second))
+	return response
+}
+
+// claimPrefetch reports whether the entry under key has been served at
+// least minHits times and is in the last tenth of its lifetime, so it
+// should be refreshed now. It reports true once per entry.
+func (c *dnsCache) claimPrefetch(key string, now time.Time, minHits int) bool {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.prefetching || entry.hits < minHits {
+		return false
+	}
+	if entry.expires.Sub(now) > entry.expires.Sub(entry.stored)/prefetchFraction {
+		return false
+	}
+	entry.prefetching = true
+	return true
+}
+
+// cacheTTL returns how long response may be cached, or ok false if it
+// must not be.
+func cacheTTL(response []byte) (ttl uint32, ok bool) {
+	if len(response) < dnsHeaderLen || msgFlags(response)&flagTC != 0 {
+		return 0, false
+	}
+
+	switch msgRcode(response) {
+	case rcodeSuccess:
+		if ttl, ok := minAnswerTTL(response); ok {
+			return clampTTL(ttl), true
+		}
+		// NOERROR without answers is NODATA, a negative answer
+		fallthrough
+	case rcodeNXDomain:
+		ttl, ok := negativeTTL(response)
+		return clampTTL(min(ttl, maxNegativeTTL)), ok
+	case rcodeServFail:
+		return servFailTTL, true
+	}
+	return 0, false
+}
+
+// clampTTL raises ttl to -min-ttl and lowers it to -max-ttl, when set.
+func clampTTL(ttl uint32) uint32 {
+	ttl = max(ttl, uint32(*minTTL/time.Second))
+	if *maxTTL > 0 {
+		ttl = min(ttl, uint32(*maxTTL/time.Second))
+	}
+	return ttl
+}
+
+// clampTTLs applies clampTTL to every record in msg, in place, so clients
+// see the TTLs the cache goes by. The OPT pseudo-record is skipped.
+func clampTTLs(msg []byte) error {
+	return forEachRecord(msg, func(rr resourceRecord) bool {
+		if rr.Type != typeOPT {
+			binary.BigEndian.PutUint32(msg[rr.RDataOffset-6:rr.RDataOffset-2], clampTTL(rr.TTL))
+		}
+		return true
+	})
+}
+
+// wellFormed reports whether msg has a question that parses and records
+// that walk to its end, as Get and Dump rely on for every stored response.
+func wellFormed(msg []byte) bool {
+	if _, _, _, err := parseQuestion(msg); err != nil {
+		return false
+	}
+	return forEachRecord(msg, func(resourceRecord) bool { return true }) == nil
+}
+
+// Set stores response under key if it is cacheable and well-formed.
+func (c *dnsCache) Set(key string, response []byte, now time.Time) {
+	ttl, ok := cacheTTL(response)
+	if !ok || ttl == 0 || !wellFormed(response) {
+		return
+	}
+
+	// A cookie a client exchanged with a public resolver is between the
+	// two of them, not for whoever hits the entry next
+	stored := slices.Clone(response)
+	if _, ok := ednsOption(stored, optionCookie); ok {
+		stored = setEDNSOption(stored, optionCookie, nil)
+	}
+	entry := &cacheEntry{
+		key:      key,
+		response: stored,
+		stored:   now,
+		expires:  now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.insert(entry)
+}
+
+// insert adds or replaces entry as the most recently used one in its
+// shard, evicting the shard's least recently used beyond its maxEntries.
+func (c *dnsCache) insert(entry *cacheEntry) {
+	s := c.shard(entry.key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[entry.key]; ok {
+		elem.Value = entry
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.entries[entry.key] = s.lru.PushFront(entry)
+	for s.lru.Len() > s.maxEntries {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Len returns the number of cached responses, including expired ones not
+// yet evicted.
+func (c *dnsCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Flush drops every cached response.
+func (c *dnsCache) Flush() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.entries = make(map[string]*list.Element)
+		s.lru.Init()
+		s.mu.Unlock()
+	}
+}
+
+// cachedAnswer describes one cache entry for the cache dump command.
+type cachedAnswer struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Rcode string `json:"rcode"`
+	TTL   int    `json:"ttl"`
+	Hits  int    `json:"hits"`
+}
+
+// Dump lists the entries unexpired at now, sorted by name and type, with
+// the seconds each has left.
+func (c *dnsCache) Dump(now time.Time) []cachedAnswer {
+	answers := []cachedAnswer{}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for elem := s.lru.Front(); elem != nil; elem = elem.Next() {
+			entry := elem.Value.(*cacheEntry)
+			if !now.Before(entry.expires) {
+				continue
+			}
+			// Set and Load only store well-formed responses, the question
+			// parses
+			name, qtype, _, _ := parseQuestion(entry.response)
+			answers = append(answers, cachedAnswer{
+				Name:  name,
+				Type:  typeString(qtype),
+				Rcode: rcodeString(msgRcode(entry.response)),
+				TTL:   int(entry.expires.Sub(now) / time.Second),
+				Hits:  entry.hits,
+			})
+		}
+		s.mu.Unlock()
+	}
+	slices.SortStableFunc(answers, func(a, b cachedAnswer) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), strings.Compare(a.Type, b.Type))
+	})
+	return answers
+}
+
+// FlushName evicts every entry for name, whatever its type, and returns
+// how many there were.
+func (c *dnsCache) FlushName(name string) int {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	flushed := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key, elem := range s.entries {
+			if qname, _, _, err := parseQuestion(elem.Value.(*cacheEntry).response); err == nil && qname == name {
+				s.lru.Remove(elem)
+				delete(s.entries, key)
+				flushed++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return flushed
+}
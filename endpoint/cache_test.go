@@ -0,0 +1,520 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheTestAnswer returns the cache key and an answer with ttl for name.
+func cacheTestAnswer(t testing.TB, name string, ttl uint32) (string, []byte) {
+	t.Helper()
+	query := buildTestQuery(1, name, typeA)
+	key, err := cacheKey(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, buildTestAnswer(query, ttl, [4]byte{192, 0, 2, 1})
+}
+
+func TestCacheTTLExpiry(t *testing.T) {
+	c := newDNSCache(16)
+	now := time.Now()
+	key, resp := cacheTestAnswer(t, "ttl.example", 30)
+	c.Set(key, resp, now)
+
+	query := buildTestQuery(2, "ttl.example", typeA)
+	if c.Get(key, query, now.Add(29*time.Second)) == nil {
+		t.Fatal("entry gone before its TTL")
+	}
+	if c.Get(key, query, now.Add(30*time.Second)) != nil {
+		t.Fatal("entry served once its TTL ran out")
+	}
+
+	key, resp = cacheTestAnswer(t, "zero.example", 0)
+	c.Set(key, resp, now)
+	if c.Get(key, query, now) != nil {
+		t.Fatal("TTL 0 answer cached")
+	}
+}
+
+func TestCacheRejectsMalformedResponses(t *testing.T) {
+	c := newDNSCache(16)
+	now := time.Now()
+	key, resp := cacheTestAnswer(t, "bad.example", 300)
+
+	// A good answer claiming a second additional record that isn't there
+	extra := appendRecord(bytes.Clone(resp), sectionAdditional, questionOwner, typeA, classIN, 300, []byte{192, 0, 2, 2})
+	binary.BigEndian.PutUint16(extra[10:12], 2)
+	// A SERVFAIL without its question
+	noQuestion := errorResponse(buildTestQuery(1, "bad.example", typeA), rcodeServFail)[:dnsHeaderLen]
+	binary.BigEndian.PutUint16(noQuestion[4:6], 0)
+
+	for name, response := range map[string][]byte{"missing record": extra, "no question": noQuestion} {
+		c.Set(key, response, now)
+		if n := c.Len(); n != 0 {
+			t.Errorf("%s: %d entries cached", name, n)
+		}
+	}
+	if got := c.Dump(now); len(got) != 0 {
+		t.Errorf("dump listed %+v", got)
+	}
+}
+
+func TestCacheRewritesID(t *testing.T) {
+	c := newDNSCache(16)
+	now := time.Now()
+	key, resp := cacheTestAnswer(t, "id.example", 60)
+	c.Set(key, resp, now)
+
+	// Same question in another case, from another client
+	got := c.Get(key, buildTestQuery(0xbeef, "ID.Example", typeA), now)
+	if got == nil {
+		t.Fatal("miss")
+	}
+	if msgID(got) != 0xbeef {
+		t.Fatalf("ID %#x, want the query's 0xbeef", msgID(got))
+	}
+	// The stored copy keeps its own ID
+	if got := c.Get(key, buildTestQuery(7, "id.example", typeA), now); msgID(got) != 7 {
+		t.Fatalf("ID %#x on the second hit, want 7", msgID(got))
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	a, err := cacheKey(buildTestQuery(1, "Example.COM", typeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := cacheKey(buildTestQuery(2, "example.com.", typeA)); b != a {
+		t.Error("same question, different keys")
+	}
+	for name, query := range map[string][]byte{
+		"other type": buildTestQuery(1, "example.com", typeAAAA),
+		"other name": buildTestQuery(1, "example.org", typeA),
+	} {
+		if b, _ := cacheKey(query); b == a {
+			t.Errorf("%s: same key", name)
+		}
+	}
+	if _, err := cacheKey([]byte{0, 1, 2}); err == nil {
+		t.Error("key for a truncated query")
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newDNSCache(2)
+	now := time.Now()
+	keyA, respA := cacheTestAnswer(t, "a.example", 60)
+	keyB, respB := cacheTestAnswer(t, "b.example", 60)
+	keyC, respC := cacheTestAnswer(t, "c.example", 60)
+
+	c.Set(keyA, respA, now)
+	c.Set(keyB, respB, now)
+	// Using a makes b the least recently used
+	c.Get(keyA, respA, now)
+	c.Set(keyC, respC, now)
+
+	if c.Len() != 2 {
+		t.Fatalf("%d entries, want 2", c.Len())
+	}
+	if c.Get(keyB, respB, now) != nil {
+		t.Error("least recently used entry kept")
+	}
+	if c.Get(keyA, respA, now) == nil || c.Get(keyC, respC, now) == nil {
+		t.Error("recently used entry evicted")
+	}
+}
+
+func TestCacheConcurrentUse(t *testing.T) {
+	c := newDNSCache(64)
+	now := time.Now()
+	keys := make([]string, 100)
+	resps := make([][]byte, 100)
+	for i := range keys {
+		keys[i], resps[i] = cacheTestAnswer(t, fmt.Sprintf("n%d.example", i), 60)
+	}
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				n := (g*200 + i) % len(keys)
+				c.Set(keys[n], resps[n], now)
+				c.Get(keys[n], resps[n], now)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := c.Len(); n > 64 {
+		t.Fatalf("%d entries, more than the 64 allowed", n)
+	}
+}
+
+// negativeTestAnswer returns a response to query with rcode and, unless
+// soaTTL is 0, an authority SOA record with soaTTL and MINIMUM minimum.
+func negativeTestAnswer(query []byte, rcode int, soaTTL, minimum uint32) []byte {
+	resp := errorResponse(query, rcode)
+	if soaTTL == 0 {
+		return resp
+	}
+	// Root MNAME and RNAME, then serial, refresh, retry, expire, minimum
+	soa := []byte{0, 0}
+	for _, v := range []uint32{1, 3600, 600, 86400, minimum} {
+		soa = binary.BigEndian.AppendUint32(soa, v)
+	}
+	return appendRecord(resp, sectionAuthority, questionOwner, typeSOA, classIN, soaTTL, soa)
+}
+
+func TestCacheNegativeAnswers(t *testing.T) {
+	now := time.Now()
+	for name, tc := range map[string]struct {
+		rcode           int
+		soaTTL, minimum uint32
+		want            time.Duration
+	}{
+		"NXDOMAIN":              {rcode: rcodeNXDomain, soaTTL: 300, minimum: 60, want: 60 * time.Second},
+		"NODATA":                {rcode: rcodeSuccess, soaTTL: 300, minimum: 60, want: 60 * time.Second},
+		"SOA TTL below minimum": {rcode: rcodeNXDomain, soaTTL: 30, minimum: 600, want: 30 * time.Second},
+		"capped":                {rcode: rcodeNXDomain, soaTTL: 86400, minimum: 86400, want: maxNegativeTTL * time.Second},
+		"SERVFAIL":              {rcode: rcodeServFail, want: servFailTTL * time.Second},
+	} {
+		c := newDNSCache(16)
+		query := buildTestQuery(1, "missing.example", typeA)
+		key, err := cacheKey(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Set(key, negativeTestAnswer(query, tc.rcode, tc.soaTTL, tc.minimum), now)
+
+		repeat := buildTestQuery(0x7777, "missing.example", typeA)
+		got := c.Get(key, repeat, now.Add(tc.want-time.Second))
+		if got == nil {
+			t.Errorf("%s: not served before %s", name, tc.want)
+			continue
+		}
+		if msgID(got) != 0x7777 || msgRcode(got) != tc.rcode {
+			t.Errorf("%s: served with ID %#x rcode %d", name, msgID(got), msgRcode(got))
+		}
+		if c.Get(key, repeat, now.Add(tc.want)) != nil {
+			t.Errorf("%s: served after %s", name, tc.want)
+		}
+	}
+
+	// Without an SOA there is no TTL to cache a negative answer for
+	c := newDNSCache(16)
+	query := buildTestQuery(1, "nosoa.example", typeA)
+	key, _ := cacheKey(query)
+	c.Set(key, negativeTestAnswer(query, rcodeNXDomain, 0, 0), now)
+	if c.Len() != 0 {
+		t.Error("NXDOMAIN without an SOA cached")
+	}
+}
+
+// recordTTLs returns the TTLs of the records in msg by section, without
+// the OPT record.
+func recordTTLs(t *testing.T, msg []byte) map[int][]uint32 {
+	t.Helper()
+	ttls := make(map[int][]uint32)
+	err := forEachRecord(msg, func(rr resourceRecord) bool {
+		if rr.Type != typeOPT {
+			ttls[rr.Section] = append(ttls[rr.Section], rr.TTL)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ttls
+}
+
+func TestCacheDecrementsTTLs(t *testing.T) {
+	c := newDNSCache(16)
+	now := time.Now()
+	query := buildTestQuery(1, "age.example", typeA)
+	key, _ := cacheKey(query)
+	resp := buildTestAnswer(query, 300, [4]byte{192, 0, 2, 1})
+	resp = appendRecord(resp, sectionAnswer, questionOwner, typeA, classIN, 400, []byte{192, 0, 2, 2})
+	resp = appendRecord(resp, sectionAuthority, questionOwner, typeNS, classIN, 3600, []byte{0})
+	resp = appendRecord(resp, sectionAdditional, questionOwner, typeA, classIN, 120, []byte{192, 0, 2, 3})
+	resp = withTestOPT(resp, 1232)
+	c.Set(key, resp, now)
+
+	got := c.Get(key, query, now.Add(42*time.Second))
+	if got == nil {
+		t.Fatal("miss")
+	}
+	want := map[int][]uint32{
+		sectionAnswer:     {258, 358},
+		sectionAuthority:  {3558},
+		sectionAdditional: {78},
+	}
+	ttls := recordTTLs(t, got)
+	for section, ttl := range want {
+		if !slices.Equal(ttls[section], ttl) {
+			t.Errorf("section %d TTLs %v after 42s, want %v", section, ttls[section], ttl)
+		}
+	}
+	if ednsPayloadSize(got) != 1232 {
+		t.Error("OPT record changed")
+	}
+
+	// Past a record's TTL it stops at zero
+	got = c.Get(key, query, now.Add(299*time.Second))
+	if ttls := recordTTLs(t, got); ttls[sectionAdditional][0] != 0 || ttls[sectionAnswer][0] != 1 {
+		t.Errorf("TTLs %v after 299s", ttls)
+	}
+	// The stored copy keeps its original TTLs
+	if ttls := recordTTLs(t, c.Get(key, query, now)); ttls[sectionAnswer][0] != 300 {
+		t.Errorf("answer TTL %d when fresh, want 300", ttls[sectionAnswer][0])
+	}
+}
+
+func TestCacheKeyCompressedQuestion(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+	header := buildTestQuery(1, "x", typeA)[:dnsHeaderLen]
+	for name, question := range map[string][]byte{
+		// A pointer at the header would read the ID and counts as labels
+		"pointer into header":  {0xc0, 0, 0, 1, 0, 1},
+		"label then header":    {3, 'w', 'w', 'w', 0xc0, 4, 0, 1, 0, 1},
+		"pointer to itself":    {0xc0, dnsHeaderLen, 0, 1, 0, 1},
+		"label loop":           {1, 'a', 0xc0, dnsHeaderLen, 0, 1, 0, 1},
+		"out of bounds":        {0xc0, 0xff, 0, 1, 0, 1},
+		"cut off after labels": {3, 'w', 'w', 'w'},
+	} {
+		query := append(bytes.Clone(header), question...)
+		if _, err := cacheKey(query); err == nil {
+			t.Errorf("%s: cache key computed", name)
+		}
+		w := &queryWriter{}
+		handleDNSQuery(context.Background(), w, query, config, p.clientTLS(t))
+		if w.response != nil {
+			t.Errorf("%s: answered", name)
+		}
+	}
+	if n := upstream.queries.Load(); n != 0 {
+		t.Errorf("upstream got %d malformed queries", n)
+	}
+	if n := responseCache.Len(); n != 0 {
+		t.Errorf("%d entries cached for malformed queries", n)
+	}
+
+	// Well-formed questions that differ only in case share the key the
+	// expanded name gives them
+	a, _ := cacheKey(buildTestQuery(1, "WWW.example.com", typeA))
+	b, _ := cacheKey(buildTestQuery(2, "www.EXAMPLE.com", typeA))
+	if a == "" || a != b {
+		t.Error("same question, different keys")
+	}
+}
+
+func TestPrefetchRefreshesPopularEntry(t *testing.T) {
+	resetUpstreamState(t)
+	initQuerySlots()
+	setForTest(t, prefetchHits, 2)
+	p := newTestPKI(t)
+	refreshed := make(chan struct{}, 1)
+	upstream := startMockDoT(t, p, 0, func(query []byte) []byte {
+		time.Sleep(200 * time.Millisecond)
+		defer func() { refreshed <- struct{}{} }()
+		return answerA(60, [4]byte{10, 0, 0, 2})(query)
+	})
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+
+	// Stored 55s ago with a 60s TTL, so under a tenth of it is left
+	query := buildTestQuery(1, "hot.example", typeA)
+	key, _ := cacheKey(query)
+	responseCache.Set(key, buildTestAnswer(query, 60, [4]byte{10, 0, 0, 1}), time.Now().Add(-55*time.Second))
+	cold := buildTestQuery(1, "cold.example", typeA)
+	coldKey, _ := cacheKey(cold)
+	responseCache.Set(coldKey, buildTestAnswer(cold, 60, [4]byte{10, 0, 0, 1}), time.Now().Add(-55*time.Second))
+
+	serve := func(query []byte) net.IP {
+		t.Helper()
+		w := &queryWriter{}
+		start := time.Now()
+		handleDNSQuery(context.Background(), w, query, config, p.clientTLS(t))
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("cached answer took %s, waited for the refresh", elapsed)
+		}
+		return firstA(t, w.response)
+	}
+	// Served once each: not popular enough yet
+	serve(query)
+	serve(cold)
+	time.Sleep(300 * time.Millisecond)
+	if n := upstream.queries.Load(); n != 0 {
+		t.Fatalf("%d prefetches before the entry was popular", n)
+	}
+
+	// The second hit answers from the cache and refreshes it behind
+	if ip := serve(query); !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("answered %v, want the cached 10.0.0.1", ip)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no background refresh")
+	}
+	// Wait for the refresh to be stored
+	for try := 0; ; try++ {
+		if resp := responseCache.Get(key, query, time.Now()); resp != nil && firstA(t, resp).Equal(net.IPv4(10, 0, 0, 2)) {
+			break
+		}
+		if try == 50 {
+			t.Fatal("refreshed answer not cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The refreshed entry has its whole TTL ahead, so no more prefetches
+	serve(query)
+	time.Sleep(300 * time.Millisecond)
+	if n := upstream.queries.Load(); n != 1 {
+		t.Fatalf("upstream got %d queries, want the one refresh", n)
+	}
+}
+
+func TestDNSSECThroughCache(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	var sawDO []bool
+	var mu sync.Mutex
+	// A validating upstream: AD on answers to DO queries
+	upstream := startMockDoT(t, p, 0, func(query []byte) []byte {
+		do := ednsDO(query)
+		mu.Lock()
+		sawDO = append(sawDO, do)
+		mu.Unlock()
+		resp := answerA(60, [4]byte{10, 0, 0, 1})(query)
+		if do {
+			binary.BigEndian.PutUint16(resp[2:4], msgFlags(resp)|flagAD)
+			resp = withTestOPT(resp, 1232)
+			resp[len(resp)-4] |= 0x80
+		}
+		return resp
+	})
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+	query := func(do bool) []byte {
+		q := buildTestQuery(1, "signed.example", typeA)
+		if do {
+			q = withTestOPT(q, 1232)
+			q[len(q)-4] |= 0x80 // DO, in the OPT record's TTL
+		}
+		w := &queryWriter{}
+		handleDNSQuery(context.Background(), w, q, config, p.clientTLS(t))
+		if w.response == nil {
+			t.Fatal("no answer")
+		}
+		return w.response
+	}
+
+	// DO goes upstream and AD comes back, also when answered from the cache
+	for i := range 2 {
+		if resp := query(true); msgFlags(resp)&flagAD == 0 || !ednsDO(resp) {
+			t.Errorf("DO answer %d: flags %#04x, DO %v, want AD and DO", i, msgFlags(resp), ednsDO(resp))
+		}
+	}
+	if len(sawDO) != 1 || !sawDO[0] {
+		t.Fatalf("upstream saw DO %v, want one query with it", sawDO)
+	}
+
+	// A client without DO gets its own answer, not the DNSSEC one
+	if resp := query(false); msgFlags(resp)&flagAD != 0 {
+		t.Errorf("non-DO query got the AD answer, flags %#04x", msgFlags(resp))
+	}
+	if len(sawDO) != 2 || sawDO[1] {
+		t.Errorf("upstream saw DO %v, want the non-DO query forwarded without it", sawDO)
+	}
+}
+
+// BenchmarkCacheParallel measures cache throughput under parallel load,
+// nine lookups to every store, unsharded against sharded as the endpoint
+// runs it. Compare across -cpu 1,4,8.
+func BenchmarkCacheParallel(b *testing.B) {
+	const names = 1024
+	keys := make([]string, names)
+	responses := make([][]byte, names)
+	for i := range names {
+		keys[i], responses[i] = cacheTestAnswer(b, fmt.Sprintf("bench%d.example", i), 300)
+	}
+	query := buildTestQuery(1, "bench.example", typeA)
+
+	for _, shards := range []int{1, cacheShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := newShardedCache(defaultCacheSize, shards)
+			now := time.Now()
+			for i := range names {
+				c.Set(keys[i], responses[i], now)
+			}
+			var next atomic.Uint32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine walks the names from its own offset
+				i := int(next.Add(names / 8))
+				for pb.Next() {
+					i = (i + 1) % names
+					if i%10 == 0 {
+						c.Set(keys[i], responses[i], now)
+					} else if c.Get(keys[i], query, now) == nil {
+						b.Fatal("cache miss")
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestTTLClamp(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, minTTL, 30*time.Second)
+	setForTest(t, maxTTL, time.Hour)
+	p := newTestPKI(t)
+	ttls := map[string]uint32{"zero.example": 0, "huge.example": 1 << 30, "fine.example": 300}
+	upstream := startMockDoT(t, p, 0, func(query []byte) []byte {
+		name, _, _, _ := parseQuestion(query)
+		if name == "gone.example" {
+			return negativeTestAnswer(removeOPT(query), rcodeNXDomain, 5, 1)
+		}
+		return answerA(ttls[name], [4]byte{10, 0, 0, 1})(query)
+	})
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+
+	for name, want := range map[string]struct {
+		section int
+		ttl     uint32
+	}{
+		"zero.example": {sectionAnswer, 30},
+		"huge.example": {sectionAnswer, 3600},
+		"fine.example": {sectionAnswer, 300},
+		"gone.example": {sectionAuthority, 30},
+	} {
+		query := buildTestQuery(1, name, typeA)
+		w := &queryWriter{}
+		handleDNSQuery(context.Background(), w, query, config, p.clientTLS(t))
+		if got := recordTTLs(t, w.response)[want.section]; len(got) != 1 || got[0] != want.ttl {
+			t.Errorf("%s: client saw TTLs %v, want %d", name, got, want.ttl)
+		}
+		// and the cache goes by the same TTL
+		key, _ := cacheKey(query)
+		if ttl, ok := cacheTTL(w.response); !ok || ttl != want.ttl {
+			t.Errorf("%s: cacheable for %ds, want %d", name, ttl, want.ttl)
+		}
+		if responseCache.Get(key, query, time.Now().Add(time.Duration(want.ttl-1)*time.Second)) == nil {
+			t.Errorf("%s: gone from the cache before %ds", name, want.ttl)
+		}
+		if responseCache.Get(key, query, time.Now().Add(time.Duration(want.ttl+1)*time.Second)) != nil {
+			t.Errorf("%s: still cached after %ds", name, want.ttl)
+		}
+	}
+}
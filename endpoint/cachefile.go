@@ -0,0 +1,129 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The cache can be saved on shutdown and reloaded on startup so endpoints
+// that restart often keep a warm cache. Entries keep their original store
+// time, so TTLs count down across the restart and anything that expired
+// while the endpoint was down is dropped on load. Expired entries still
+// inside the -serve-stale window are saved and loaded too, so a restart
+// while the upstreams are down keeps the stale answers to serve.
+
+// savedEntry is one cache entry in the cache file.
+type savedEntry struct {
+	Key      []byte    `json:"key"`
+	Response []byte    `json:"response"`
+	Stored   time.Time `json:"stored"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Save writes the entries unexpired at now, or within the -serve-stale
+// window, to w, each shard's least recently used first, so loading them
+// back restores the LRU order.
+func (c *dnsCache) Save(w io.Writer, now time.Time) error {
+	var saved []savedEntry
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for elem := s.lru.Back(); elem != nil; elem = elem.Prev() {
+			entry := elem.Value.(*cacheEntry)
+			if now.Before(entry.expires.Add(*serveStale)) {
+				saved = append(saved, savedEntry{
+					Key:      []byte(entry.key),
+					Response: entry.response,
+					Stored:   entry.stored,
+					Expires:  entry.expires,
+				})
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	return json.NewEncoder(w).Encode(saved)
+}
+
+// Load adds the entries saved in r that are unexpired at now, or within
+// the -serve-stale window, and returns how many there were. Responses are
+// checked like those stored from an upstream, Get relies on them walking,
+// and must answer the question their key was saved under; a file edited
+// or damaged on disk loses its bad entries, not the cache.
+func (c *dnsCache) Load(r io.Reader, now time.Time) (int, error) {
+	var saved []savedEntry
+	if err := json.NewDecoder(r).Decode(&saved); err != nil {
+		return 0, err
+	}
+
+	loaded := 0
+	for _, s := range saved {
+		if !now.Before(s.Expires.Add(*serveStale)) || !cacheableResponse(s.Response) {
+			continue
+		}
+		if key, err := cacheKey(s.Response); err != nil || key != string(s.Key) {
+			continue
+		}
+		c.insert(&cacheEntry{
+			key:      string(s.Key),
+			response: s.Response,
+			stored:   s.Stored,
+			expires:  s.Expires,
+		})
+		loaded++
+	}
+	return loaded, nil
+}
+
+// cacheableResponse reports whether response is a well-formed message that
+// may be cached, as anything inserted into the cache must be.
+func cacheableResponse(response []byte) bool {
+	if _, ok := cacheTTL(response); !ok {
+		return false
+	}
+	return wellFormed(response)
+}
+
+// saveCacheFile writes the response cache to path, replacing it
+// atomically so a crash mid-write never leaves a truncated file.
+func saveCacheFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save cache: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := responseCache.Save(tmp, time.Now()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save cache: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save cache: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save cache: %v", err)
+	}
+	return nil
+}
+
+// loadCacheFile fills the response cache from path. A missing file, as on
+// the first start, isn't an error.
+func loadCacheFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to load cache: %v", err)
+	}
+	defer f.Close()
+
+	n, err := responseCache.Load(f, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to load cache %s: %v", path, err)
+	}
+	return n, nil
+}
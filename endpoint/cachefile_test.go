@@ -0,0 +1,123 @@
+package endpoint
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheSaveLoad(t *testing.T) {
+	setForTest(t, serveStale, 0)
+	now := time.Now()
+	c := newDNSCache(16)
+	liveKey, live := cacheTestAnswer(t, "live.example", 300)
+	shortKey, short := cacheTestAnswer(t, "short.example", 30)
+	c.Set(liveKey, live, now)
+	c.Set(shortKey, short, now)
+
+	var file bytes.Buffer
+	if err := c.Save(&file, now.Add(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	// Down for a minute: short.example expired meanwhile
+	restarted := newDNSCache(16)
+	n, err := restarted.Load(bytes.NewReader(file.Bytes()), now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || restarted.Len() != 1 {
+		t.Fatalf("loaded %d entries, %d cached, want live.example only", n, restarted.Len())
+	}
+	got := restarted.Get(liveKey, buildTestQuery(9, "live.example", typeA), now.Add(time.Minute))
+	if got == nil {
+		t.Fatal("saved entry lost in the restart")
+	}
+	// The TTL kept counting down while the endpoint was down
+	if ttl := recordTTLs(t, got)[sectionAnswer][0]; ttl != 240 {
+		t.Errorf("TTL %d a minute after storing, want 240", ttl)
+	}
+	if restarted.Get(shortKey, short, now.Add(time.Minute)) != nil {
+		t.Error("expired entry loaded")
+	}
+
+	// Within -serve-stale, expired entries come back to be served stale
+	setForTest(t, serveStale, time.Hour)
+	restarted = newDNSCache(16)
+	if n, err := restarted.Load(bytes.NewReader(file.Bytes()), now.Add(time.Minute)); err != nil || n != 2 {
+		t.Fatalf("loaded %d entries with -serve-stale, %v, want 2", n, err)
+	}
+}
+
+func TestCacheFileRestart(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, serveStale, 0)
+	path := filepath.Join(t.TempDir(), "cache.json")
+	if n, err := loadCacheFile(path); err != nil || n != 0 {
+		t.Fatalf("missing file loaded %d entries, %v", n, err)
+	}
+
+	key, resp := cacheTestAnswer(t, "restart.example", 300)
+	responseCache.Set(key, resp, time.Now())
+	expiredKey, expired := cacheTestAnswer(t, "gone.example", 1)
+	responseCache.Set(expiredKey, expired, time.Now().Add(-time.Minute))
+	if err := saveCacheFile(path); err != nil {
+		t.Fatal(err)
+	}
+	responseCache.Flush()
+
+	n, err := loadCacheFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || responseCache.Get(key, resp, time.Now()) == nil {
+		t.Fatalf("loaded %d entries, want restart.example back", n)
+	}
+
+	// A damaged file is an error, not a crash
+	if err := os.WriteFile(path, []byte(`[{"key": 12`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCacheFile(path); err == nil {
+		t.Error("damaged cache file loaded")
+	}
+	// A damaged entry is dropped, the rest loads
+	file := `[{"key":"eA==","response":"AAEC","stored":"2026-01-01T00:00:00Z","expires":"2099-01-01T00:00:00Z"}]`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := loadCacheFile(path); err != nil || n != 0 {
+		t.Errorf("damaged entry: loaded %d, %v", n, err)
+	}
+}
+
+func TestCacheLoadKeyMismatch(t *testing.T) {
+	setForTest(t, serveStale, 0)
+	now := time.Now()
+	key, resp := cacheTestAnswer(t, "right.example", 300)
+	_, other := cacheTestAnswer(t, "other.example", 300)
+
+	// A file pairing a key with the answer to another question must not
+	// serve that answer for it
+	file, err := json.Marshal([]savedEntry{
+		{Key: []byte(key), Response: other, Stored: now, Expires: now.Add(5 * time.Minute)},
+		{Key: []byte(key), Response: resp, Stored: now, Expires: now.Add(5 * time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newDNSCache(16)
+	n, err := c.Load(bytes.NewReader(file), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || c.Len() != 1 {
+		t.Fatalf("loaded %d entries, %d cached, want the matching pair only", n, c.Len())
+	}
+	got := c.Get(key, buildTestQuery(1, "right.example", typeA), now)
+	if got == nil || !sameQuestion(resp, got) {
+		t.Errorf("key answered with %v, want right.example's response", got)
+	}
+}
@@ -0,0 +1,157 @@
+package endpoint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// With -capture set, every query and response is appended to a pcap file
+// as a UDP datagram between the client's address and port 53 on loopback,
+// whatever transport it actually came over, so Wireshark or tcpdump -r
+// decode it as DNS. The file holds full query contents, which is why it is
+// off by default.
+
+const (
+	// linktypeRaw marks packets as starting at the IP header, with no
+	// link-layer header (pcap LINKTYPE_RAW)
+	linktypeRaw = 101
+	// maxCaptureLen is the most of a message a captured datagram holds,
+	// what fits in an IPv6 packet with its UDP header
+	maxCaptureLen = 65535 - 40 - 8
+)
+
+// captureWriter appends packets to a pcap file.
+type captureWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// capture is nil unless -capture is set.
+var capture *captureWriter
+
+// openCapture opens path for capturing, writing the pcap header if the
+// file is new so restarts keep appending to the same capture.
+func openCapture(path string) (*captureWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat capture file: %v", err)
+	}
+	if info.Size() == 0 {
+		// Magic, version 2.4, UTC, timestamp accuracy, snapshot length
+		// and link type
+		header := binary.LittleEndian.AppendUint32(nil, 0xa1b2c3d4)
+		header = binary.LittleEndian.AppendUint16(header, 2)
+		header = binary.LittleEndian.AppendUint16(header, 4)
+		header = binary.LittleEndian.AppendUint32(header, 0)
+		header = binary.LittleEndian.AppendUint32(header, 0)
+		header = binary.LittleEndian.AppendUint32(header, 65535)
+		header = binary.LittleEndian.AppendUint32(header, linktypeRaw)
+		if _, err := file.Write(header); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to write capture file: %v", err)
+		}
+	}
+	return &captureWriter{file: file}, nil
+}
+
+// captureMessage records msg, a query from client or a response to it,
+// when capturing is enabled.
+func captureMessage(client net.Addr, msg []byte, response bool) {
+	if capture == nil {
+		return
+	}
+	ip, port := addrIP(client), 0
+	switch addr := client.(type) {
+	case *net.UDPAddr:
+		port = addr.Port
+	case *net.TCPAddr:
+		port = addr.Port
+	}
+	if ip == nil {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	capture.write(time.Now(), ip, port, msg, response)
+}
+
+func (c *captureWriter) write(now time.Time, client net.IP, clientPort int, msg []byte, response bool) {
+	msg = msg[:min(len(msg), maxCaptureLen)]
+	src, dst := client, net.IPv6loopback
+	srcPort, dstPort := clientPort, 53
+	if client4 := client.To4(); client4 != nil {
+		src, dst = client4, net.IPv4(127, 0, 0, 1).To4()
+	}
+	if response {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	udp := binary.BigEndian.AppendUint16(nil, uint16(srcPort))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(dstPort))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(8+len(msg)))
+	udp = binary.BigEndian.AppendUint16(udp, 0)
+	udp = append(udp, msg...)
+	// The checksum covers a pseudo-header of the addresses, protocol and
+	// length (RFC 768, RFC 8200 section 8.1)
+	pseudo := append(append([]byte(nil), src...), dst...)
+	pseudo = append(pseudo, 0, 17)
+	pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(udp)))
+	sum := checksum(append(pseudo, udp...))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:8], sum)
+
+	var packet []byte
+	if len(src) == net.IPv4len {
+		packet = []byte{0x45, 0}
+		packet = binary.BigEndian.AppendUint16(packet, uint16(20+len(udp)))
+		packet = append(packet, 0, 0, 0x40, 0, 64, 17, 0, 0)
+		packet = append(packet, src...)
+		packet = append(packet, dst...)
+		binary.BigEndian.PutUint16(packet[10:12], checksum(packet))
+	} else {
+		packet = []byte{0x60, 0, 0, 0}
+		packet = binary.BigEndian.AppendUint16(packet, uint16(len(udp)))
+		packet = append(packet, 17, 64)
+		packet = append(packet, src...)
+		packet = append(packet, dst...)
+	}
+	packet = append(packet, udp...)
+
+	record := binary.LittleEndian.AppendUint32(nil, uint32(now.Unix()))
+	record = binary.LittleEndian.AppendUint32(record, uint32(now.Nanosecond()/1000))
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(packet)))
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(packet)))
+	record = append(record, packet...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.file.Write(record); err != nil {
+		slog.Error("Failed to write capture file", "error", err)
+	}
+}
+
+// checksum is the Internet checksum of data (RFC 1071).
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
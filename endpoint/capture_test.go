@@ -0,0 +1,94 @@
+package endpoint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// capturedPacket is one UDP datagram read back from a capture file.
+type capturedPacket struct {
+	srcPort, dstPort int
+	payload          []byte
+}
+
+// readTestCapture parses the pcap file at path, checking its header and
+// the IPv4 and UDP checksums of every packet.
+func readTestCapture(t *testing.T, path string) []capturedPacket {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 24 || binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(data[20:]) != linktypeRaw {
+		t.Fatalf("no pcap header for raw IP: %x", data[:min(len(data), 24)])
+	}
+	var packets []capturedPacket
+	for rest := data[24:]; len(rest) > 0; {
+		if len(rest) < 16 {
+			t.Fatalf("truncated record header %x", rest)
+		}
+		n := int(binary.LittleEndian.Uint32(rest[8:]))
+		if int(binary.LittleEndian.Uint32(rest[12:])) != n || len(rest) < 16+n {
+			t.Fatalf("bad record lengths in %x", rest[:16])
+		}
+		packet := rest[16 : 16+n]
+		rest = rest[16+n:]
+
+		if packet[0] != 0x45 || packet[9] != 17 || checksum(packet[:20]) != 0 {
+			t.Fatalf("not a valid IPv4 UDP header: %x", packet[:20])
+		}
+		udp := packet[20:]
+		pseudo := append(bytes.Clone(packet[12:20]), 0, 17)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(udp)))
+		if checksum(append(pseudo, udp...)) != 0 {
+			t.Errorf("bad UDP checksum in %x", udp[:8])
+		}
+		packets = append(packets, capturedPacket{
+			srcPort: int(binary.BigEndian.Uint16(udp)),
+			dstPort: int(binary.BigEndian.Uint16(udp[2:])),
+			payload: udp[8:],
+		})
+	}
+	return packets
+}
+
+func TestCaptureFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.pcap")
+	c, err := openCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, &capture, c)
+	bound := serveTestListeners(t, "127.0.0.1:0")
+
+	query := buildTestQuery(0x5150, "capture.example", typeA)
+	resp := exchangeTestUDP(t, bound[0].addr().String(), query)
+	c.file.Close()
+
+	packets := readTestCapture(t, path)
+	if len(packets) != 2 {
+		t.Fatalf("captured %d packets, want the query and response", len(packets))
+	}
+	q, r := packets[0], packets[1]
+	if !bytes.Equal(q.payload, query) || q.dstPort != 53 {
+		t.Errorf("captured query %x to port %d, want %x to 53", q.payload, q.dstPort, query)
+	}
+	if !bytes.Equal(r.payload, resp) || r.srcPort != 53 || r.dstPort != q.srcPort {
+		t.Errorf("captured response %x from port %d to %d, want %x back to %d", r.payload, r.srcPort, r.dstPort, resp, q.srcPort)
+	}
+
+	// Reopened after a restart, the capture is appended to
+	c, err = openCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.write(time.Now(), bound[0].addr().IP, 5353, query, false)
+	c.file.Close()
+	if packets := readTestCapture(t, path); len(packets) != 3 || !bytes.Equal(packets[2].payload, query) {
+		t.Errorf("after reopening read %d packets, want 3", len(packets))
+	}
+}
@@ -0,0 +1,107 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// runCheck loads the provisioning bundle the way startup does, handshakes
+// with the first upstream and writes a summary to w. It never starts the
+// listener, so operators can validate a bundle before deploying it.
+func runCheck(w io.Writer, paths filePaths) error {
+	ca, err := loadCA(paths.CA, paths.ExtraCA)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfig(paths, ca)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := setupTLS(config, paths, ca)
+	if err != nil {
+		return err
+	}
+	server := config.upstreams()[0]
+	tlsConfig = serverTLSConfig(tlsConfig, server)
+	cert, err := tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *upstreamTimeout)
+	defer cancel()
+	state, err := checkHandshake(ctx, server, config.Transport, tlsConfig)
+	if err != nil {
+		if _, hint := diagnoseConnectError(err); hint != "" {
+			return fmt.Errorf("failed to handshake with %s: %v (%s)", server, err, hint)
+		}
+		return fmt.Errorf("failed to handshake with %s: %v", server, err)
+	}
+
+	domains := strings.Join(config.Domains, ", ")
+	if domains == "" {
+		domains = "(all)"
+	}
+	expires := config.Expires
+	if expires == "" {
+		expires = "never"
+	}
+	transport := config.Transport
+	if transport == "" {
+		transport = "dot"
+	}
+	fmt.Fprintf(w, "Server:      %s\n", strings.Join(config.upstreams(), ", "))
+	fmt.Fprintf(w, "Transport:   %s\n", transport)
+	fmt.Fprintf(w, "Type:        %s\n", config.Type)
+	fmt.Fprintf(w, "Domains:     %s\n", domains)
+	fmt.Fprintf(w, "Expires:     %s\n", expires)
+	fmt.Fprintf(w, "Client cert: %s (expires %s)\n", cert.Leaf.Subject, cert.Leaf.NotAfter.Format("2006-01-02"))
+	fmt.Fprintf(w, "Upstream:    %s, handshake OK\n", state.PeerCertificates[0].Subject)
+	fmt.Fprintf(w, "TLS:         %s\n", tls.VersionName(state.Version))
+	if state.NegotiatedProtocol != "" {
+		fmt.Fprintf(w, "ALPN:        %s\n", state.NegotiatedProtocol)
+	}
+	return nil
+}
+
+// checkHandshake completes one TLS handshake with server over transport
+// and returns the resulting connection state.
+func checkHandshake(ctx context.Context, server, transport string, tlsConfig *tls.Config) (*tls.ConnectionState, error) {
+	switch transport {
+	case "doh":
+		u, err := url.Parse(dohURL(server))
+		if err != nil {
+			return nil, err
+		}
+		return dialTLSState(ctx, withDefaultPort(u.Host, "443"), tlsConfig)
+	case "doq":
+		tlsConf := tlsConfig.Clone()
+		tlsConf.NextProtos = []string{doqALPN}
+		conn, err := quic.DialAddr(ctx, server, tlsConf, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.CloseWithError(0, "")
+		state := conn.ConnectionState().TLS
+		return &state, nil
+	default:
+		return dialTLSState(ctx, server, dotTLSConfig(tlsConfig))
+	}
+}
+
+func dialTLSState(ctx context.Context, addr string, tlsConfig *tls.Config) (*tls.ConnectionState, error) {
+	dialer := newTLSDialer(tlsConfig)
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	state := conn.(*tls.Conn).ConnectionState()
+	return &state, nil
+}
@@ -0,0 +1,93 @@
+package endpoint
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestRunCheck(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	config := map[string]any{"server": upstream.addr(), "server_name": testServerName, "type": "service", "domains": []string{"internal.corp"}}
+	useTestBundle(t, p, writeTestToken(t, p, config, jwt.RegisteredClaims{}))
+
+	var out bytes.Buffer
+	if err := runCheck(&out, flagPaths()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Server:      " + upstream.addr(),
+		"Type:        service",
+		"Domains:     internal.corp",
+		"Expires:     never",
+		"Client cert: CN=endpoint",
+		"Upstream:    CN=" + testServerName + ", handshake OK",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("summary lacks %q:\n%s", want, &out)
+		}
+	}
+	if n := upstream.queries.Load(); n != 0 {
+		t.Errorf("check sent %d queries, want a handshake only", n)
+	}
+
+	// Signed by another CA than the bundle's
+	other := newTestPKI(t)
+	useTestBundle(t, p, writeTestToken(t, other, config, jwt.RegisteredClaims{}))
+	if err := runCheck(&out, flagPaths()); err == nil {
+		t.Error("token from another CA passed")
+	}
+	// Nothing listening
+	useTestBundle(t, p, writeTestToken(t, p, map[string]any{"server": "127.0.0.1:1"}, jwt.RegisteredClaims{}))
+	if err := runCheck(&out, flagPaths()); err == nil || !strings.Contains(err.Error(), "failed to handshake") {
+		t.Errorf("got %v, want the failed handshake", err)
+	}
+}
+
+// TestCheckExitStatus runs -check in a child process, which is this test
+// binary calling Main with the arguments in $ZT_TEST_MAIN_ARGS.
+func TestCheckExitStatus(t *testing.T) {
+	if args := os.Getenv("ZT_TEST_MAIN_ARGS"); args != "" {
+		os.Args = append(os.Args[:1], strings.Split(args, "\n")...)
+		Main()
+		os.Exit(0)
+	}
+
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	useTestBundle(t, p, writeTestToken(t, p, map[string]any{"server": upstream.addr(), "server_name": testServerName}, jwt.RegisteredClaims{}))
+	check := func(ca string) error {
+		args := []string{"-check", "-config-path", *configPath, "-ca-path", ca, "-cert-path", *certPath, "-key-path", *keyPath}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCheckExitStatus$")
+		cmd.Env = append(os.Environ(), "ZT_TEST_MAIN_ARGS="+strings.Join(args, "\n"))
+		out, err := cmd.CombinedOutput()
+		t.Logf("%s", out)
+		return err
+	}
+
+	if err := check(*caPath); err != nil {
+		t.Fatalf("valid bundle: %v", err)
+	}
+	badCA := filepath.Join(t.TempDir(), "bad.crt")
+	if err := os.WriteFile(badCA, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for name, ca := range map[string]string{
+		"unparsable CA": badCA,
+		"missing CA":    filepath.Join(t.TempDir(), "missing.crt"),
+	} {
+		var exit *exec.ExitError
+		if err := check(ca); !errors.As(err, &exit) || exit.ExitCode() == 0 {
+			t.Errorf("%s: got %v, want a non-zero exit", name, err)
+		}
+	}
+}
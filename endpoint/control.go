@@ -0,0 +1,209 @@
+package endpoint
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The control socket is a local command interface for endpoints whose
+// metrics port isn't exposed. A client writes one command per line and
+// gets one JSON object back per command, e.g.
+//
+//	echo stats | nc -U /run/ztdns.sock
+
+// controlTimeout bounds how long a control client may sit idle.
+const controlTimeout = 30 * time.Second
+
+// controlCommands maps each command to the function producing its reply
+// from the command's arguments. Commands that change state are safe to
+// offer because the socket is only open to the endpoint's own user.
+var controlCommands = map[string]func(args []string) any{
+	"stats": func([]string) any { return collectStats(time.Now()) },
+	"cache": cacheCommand,
+}
+
+// cacheCommand handles "cache dump", listing cached answers, and "cache
+// flush [name]", evicting every answer or those for one name.
+func cacheCommand(args []string) any {
+	switch {
+	case len(args) == 1 && args[0] == "dump":
+		return map[string]any{"entries": responseCache.Dump(time.Now())}
+	case len(args) == 1 && args[0] == "flush":
+		flushed := responseCache.Len()
+		responseCache.Flush()
+		slog.Info("Cache flushed from the control socket", "entries", flushed)
+		return map[string]int{"flushed": flushed}
+	case len(args) == 2 && args[0] == "flush":
+		flushed := responseCache.FlushName(args[1])
+		slog.Info("Cache flushed from the control socket", "name", args[1], "entries", flushed)
+		return map[string]int{"flushed": flushed}
+	}
+	return map[string]string{"error": "usage: cache dump | cache flush [name]"}
+}
+
+// startControlSocket listens on the unix socket at path in the background.
+// The socket is only accessible to the endpoint's own user.
+func startControlSocket(path string) error {
+	// A socket left behind by an earlier run would make Listen fail
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	// The socket is created with the process umask, narrow it to the
+	// endpoint's user before accepting anything
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return err
+	}
+
+	go func() {
+		slog.Info("Control socket listening", "path", path)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Error("Error accepting control connection", "error", err)
+				continue
+			}
+			go serveControl(conn)
+		}
+	}()
+	return nil
+}
+
+func serveControl(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(controlTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var reply any
+		if fn, ok := controlCommands[fields[0]]; ok {
+			reply = fn(fields[1:])
+		} else {
+			reply = map[string]string{"error": "unknown command " + fields[0]}
+		}
+		if err := enc.Encode(reply); err != nil {
+			return
+		}
+	}
+}
+
+// endpointStats is the reply to the stats command.
+type endpointStats struct {
+	Queries  float64            `json:"queries"`
+	Dropped  map[string]float64 `json:"dropped"`
+	Blocked  float64            `json:"blocked"`
+	Cache    cacheStats         `json:"cache"`
+	Upstream upstreamStats      `json:"upstream"`
+	Expires  string             `json:"config_expires,omitempty"`
+}
+
+type cacheStats struct {
+	Entries  int     `json:"entries"`
+	Hits     float64 `json:"hits"`
+	Misses   float64 `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+type upstreamStats struct {
+	Ready        bool       `json:"ready"`
+	NotReady     string     `json:"not_ready,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	Errors       float64    `json:"errors"`
+	OpenBreakers []string   `json:"open_breakers"`
+	// Health is each upstream's last probe outcome, with -probe-interval
+	Health map[string]probeStatus `json:"health,omitempty"`
+}
+
+func collectStats(now time.Time) endpointStats {
+	counters := gatherCounters()
+	stats := endpointStats{
+		Queries: counters["ztdns_queries_total"][""],
+		Dropped: counters["ztdns_queries_dropped_total"],
+		Blocked: counters["ztdns_queries_blocked_total"][""],
+		Cache: cacheStats{
+			Entries: responseCache.Len(),
+			Hits:    counters["ztdns_cache_lookups_total"]["hit"],
+			Misses:  counters["ztdns_cache_lookups_total"]["miss"],
+		},
+		Upstream: upstreamStats{OpenBreakers: []string{}},
+	}
+	if lookups := stats.Cache.Hits + stats.Cache.Misses; lookups > 0 {
+		stats.Cache.HitRatio = stats.Cache.Hits / lookups
+	}
+	if stats.Dropped == nil {
+		stats.Dropped = map[string]float64{}
+	}
+
+	if err := readiness(now, *readyWindow); err != nil {
+		stats.Upstream.NotReady = err.Error()
+	} else {
+		stats.Upstream.Ready = true
+	}
+	if last := lastUpstreamSuccess.Load(); last != 0 {
+		t := time.Unix(0, last).UTC()
+		stats.Upstream.LastSuccess = &t
+	}
+	for _, errs := range counters["ztdns_upstream_errors_total"] {
+		stats.Upstream.Errors += errs
+	}
+	if state := currentState(); state != nil {
+		for _, server := range state.config.upstreams() {
+			if breakerFor(server).isOpen(now) {
+				stats.Upstream.OpenBreakers = append(stats.Upstream.OpenBreakers, server)
+			}
+		}
+		if health := upstreamHealthStatus(); len(health) > 0 {
+			stats.Upstream.Health = health
+		}
+		stats.Expires = state.config.Expires
+	}
+	return stats
+}
+
+// gatherCounters reads the endpoint's counters from the default Prometheus
+// registry, keyed by metric name and then by comma-joined label values.
+func gatherCounters() map[string]map[string]float64 {
+	counters := make(map[string]map[string]float64)
+	families, _ := prometheus.DefaultGatherer.Gather()
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "ztdns_") {
+			continue
+		}
+		values := make(map[string]float64)
+		for _, metric := range family.GetMetric() {
+			if metric.GetCounter() == nil {
+				continue
+			}
+			var labels []string
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, label.GetValue())
+			}
+			values[strings.Join(labels, ",")] = metric.GetCounter().GetValue()
+		}
+		counters[family.GetName()] = values
+	}
+	return counters
+}
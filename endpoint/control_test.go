@@ -0,0 +1,157 @@
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// controlClient connects to the control socket at path and returns a
+// function sending one command and decoding its reply into v.
+func controlClient(t *testing.T, path string) func(command string, v any) {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	reader := bufio.NewReader(conn)
+	return func(command string, v any) {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(command + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+		if err := json.Unmarshal(line, v); err != nil {
+			t.Fatalf("%s: reply %q: %v", command, line, err)
+		}
+	}
+}
+
+func TestControlSocketStats(t *testing.T) {
+	resetUpstreamState(t)
+	keepActiveState(t)
+	keepUpstreamOutcome(t)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true, Expires: "2030-01-01T00:00:00Z", expiresAt: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	activeState.Store(&endpointState{config: config, tlsConfig: p.clientTLS(t)})
+	// A miss, then a hit
+	for range 2 {
+		handleDNSQuery(context.Background(), &queryWriter{}, buildTestQuery(1, "stats.example", typeA), config, p.clientTLS(t))
+	}
+
+	path := filepath.Join(t.TempDir(), "ztdns.sock")
+	if err := startControlSocket(path); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm&0o077 != 0 {
+			t.Errorf("socket permissions %v, open to other users", perm)
+		}
+	}
+	send := controlClient(t, path)
+
+	var stats endpointStats
+	send("stats", &stats)
+	if stats.Queries < 2 {
+		t.Errorf("%v queries counted, want at least 2", stats.Queries)
+	}
+	if stats.Cache.Entries != 1 || stats.Cache.Hits < 1 || stats.Cache.HitRatio <= 0 || stats.Cache.HitRatio > 1 {
+		t.Errorf("cache stats %+v", stats.Cache)
+	}
+	if !stats.Upstream.Ready || stats.Upstream.LastSuccess == nil || len(stats.Upstream.OpenBreakers) != 0 {
+		t.Errorf("upstream stats %+v", stats.Upstream)
+	}
+	if stats.Expires != config.Expires {
+		t.Errorf("config expires %q, want %q", stats.Expires, config.Expires)
+	}
+
+	// Further commands on the same connection
+	var flushed map[string]int
+	send("cache flush", &flushed)
+	if flushed["flushed"] != 1 || responseCache.Len() != 0 {
+		t.Errorf("cache flush replied %v, %d entries left", flushed, responseCache.Len())
+	}
+	var reply map[string]string
+	send("restart now", &reply)
+	if reply["error"] == "" {
+		t.Errorf("unknown command replied %v", reply)
+	}
+}
+
+func TestControlCacheDumpFlush(t *testing.T) {
+	resetUpstreamState(t)
+	now := time.Now()
+	// Set in order, so the dump lists them most recently used first
+	for _, e := range []struct {
+		name string
+		ttl  uint32
+	}{{"a.example", 300}, {"b.example", 60}} {
+		key, resp := cacheTestAnswer(t, e.name, e.ttl)
+		responseCache.Set(key, resp, now)
+	}
+	// An AAAA answer for a.example too
+	query := buildTestQuery(1, "a.example", typeAAAA)
+	key, err := cacheKey(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseCache.Set(key, negativeResponse(query, rcodeSuccess, "example", 300), now)
+
+	path := filepath.Join(t.TempDir(), "ztdns.sock")
+	if err := startControlSocket(path); err != nil {
+		t.Fatal(err)
+	}
+	send := controlClient(t, path)
+	dump := func() []cachedAnswer {
+		t.Helper()
+		var reply struct{ Entries []cachedAnswer }
+		send("cache dump", &reply)
+		return reply.Entries
+	}
+
+	entries := dump()
+	if len(entries) != 3 {
+		t.Fatalf("dump listed %+v, want 3 entries", entries)
+	}
+	for i, want := range []cachedAnswer{{Name: "a.example", Type: "A", TTL: 300}, {Name: "a.example", Type: "AAAA", TTL: 300}, {Name: "b.example", Type: "A", TTL: 60}} {
+		got := entries[i]
+		if got.Name != want.Name || got.Type != want.Type || got.Rcode != "NOERROR" || got.TTL > want.TTL || got.TTL < want.TTL-5 {
+			t.Errorf("entry %d is %+v, want %s %s with about %ds left", i, got, want.Name, want.Type, want.TTL)
+		}
+	}
+
+	// Flushing a name evicts all its types, in any case
+	var flushed map[string]int
+	send("cache flush A.Example.", &flushed)
+	if flushed["flushed"] != 2 {
+		t.Errorf("flush replied %v, want 2 evicted", flushed)
+	}
+	if entries := dump(); len(entries) != 1 || entries[0].Name != "b.example" {
+		t.Errorf("after flushing a.example dump listed %+v", entries)
+	}
+	send("cache flush missing.example", &flushed)
+	if flushed["flushed"] != 0 || responseCache.Len() != 1 {
+		t.Errorf("flushing an uncached name replied %v, %d entries left", flushed, responseCache.Len())
+	}
+	var reply map[string]string
+	send("cache drop", &reply)
+	if reply["error"] == "" {
+		t.Errorf("unknown cache command replied %v", reply)
+	}
+}
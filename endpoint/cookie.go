@@ -0,0 +1,83 @@
+package endpoint
+
+import (
+	"bytes"
+	"crypto/rand"
+	"sync"
+)
+
+// DNS Cookies (RFC 7873) for queries to public resolvers. Plain DNS over
+// UDP is easy to spoof; with a cookie an off-path attacker also has to
+// guess the 64-bit client cookie, and a resolver that has sent a server
+// cookie before must keep doing so.
+
+const optionCookie = 10
+
+// resolverCookie is the cookie state kept for one public resolver for the
+// life of the process.
+type resolverCookie struct {
+	mu     sync.Mutex
+	client [8]byte
+	server []byte
+}
+
+var (
+	resolverCookiesMu sync.Mutex
+	resolverCookies   = make(map[string]*resolverCookie)
+)
+
+func cookieFor(resolver string) *resolverCookie {
+	resolverCookiesMu.Lock()
+	defer resolverCookiesMu.Unlock()
+
+	c, ok := resolverCookies[resolver]
+	if !ok {
+		c = &resolverCookie{}
+		rand.Read(c.client[:])
+		resolverCookies[resolver] = c
+	}
+	return c
+}
+
+// withCookie returns query carrying the COOKIE option for resolver. check
+// reports whether a response passes the cookie check, learning the
+// resolver's server cookie from it, and restore takes back out of the
+// response whatever the client didn't ask for. A query that already
+// carries a cookie is the client's own exchange with the resolver: it goes
+// out untouched and the response comes back as sent, for the client to
+// check.
+func withCookie(query []byte, resolver string) (out []byte, check func(response []byte) bool, restore func(response []byte) []byte) {
+	if _, ok := ednsOption(query, optionCookie); ok {
+		return query, func([]byte) bool { return true }, func(response []byte) []byte { return response }
+	}
+
+	c := cookieFor(resolver)
+	c.mu.Lock()
+	data := append(c.client[:len(c.client):len(c.client)], c.server...)
+	c.mu.Unlock()
+
+	check = func(response []byte) bool {
+		got, ok := ednsOption(response, optionCookie)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if !ok {
+			// Fine from a resolver without cookie support, suspect from
+			// one that has answered with a cookie before
+			return c.server == nil
+		}
+		// 8 bytes of client cookie, then an 8 to 32 byte server cookie
+		if len(got) < 16 || len(got) > 40 || !bytes.Equal(got[:8], c.client[:]) {
+			return false
+		}
+		c.server = bytes.Clone(got[8:])
+		return true
+	}
+
+	_, hadOPT := findOPT(query)
+	return setEDNSOption(query, optionCookie, data), check, func(response []byte) []byte {
+		if !hadOPT {
+			return removeOPT(response)
+		}
+		return setEDNSOption(response, optionCookie, nil)
+	}
+}
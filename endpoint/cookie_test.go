@@ -0,0 +1,100 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withTestCookie returns response carrying the COOKIE option data.
+func withTestCookie(response, data []byte) []byte {
+	return setEDNSOption(response, optionCookie, data)
+}
+
+func TestWithCookie(t *testing.T) {
+	resolver := "cookie-unit.example:53"
+	query := buildTestQuery(1, "cookie.example", typeA)
+	out, check, restore := withCookie(query, resolver)
+	sent, ok := ednsOption(out, optionCookie)
+	if !ok || len(sent) != 8 {
+		t.Fatalf("query carries cookie %x, want an 8 byte client cookie", sent)
+	}
+	answer := buildTestAnswer(query, 60, [4]byte{192, 0, 2, 1})
+
+	// A resolver without cookie support is fine until it has sent one
+	if !check(answer) {
+		t.Error("answer without a cookie rejected from a new resolver")
+	}
+	server := []byte("srvcooki")
+	if !check(withTestCookie(answer, append(bytes.Clone(sent), server...))) {
+		t.Fatal("answer with the client cookie rejected")
+	}
+	if resp := restore(withTestCookie(answer, append(bytes.Clone(sent), server...))); !bytes.Equal(resp, answer) {
+		t.Error("cookie left in the answer to a client that sent no OPT")
+	}
+
+	// The server cookie learned goes out with the next query, and from now
+	// on an answer without it is suspect
+	out, check, _ = withCookie(query, resolver)
+	if next, _ := ednsOption(out, optionCookie); !bytes.Equal(next, append(bytes.Clone(sent), server...)) {
+		t.Errorf("next query carries cookie %x, want client and server cookie", next)
+	}
+	if check(answer) {
+		t.Error("answer without a cookie accepted after the resolver sent one")
+	}
+	wrong := append([]byte("notmine!"), server...)
+	if check(withTestCookie(answer, wrong)) {
+		t.Error("answer echoing another client cookie accepted")
+	}
+	if check(withTestCookie(answer, sent)) {
+		t.Error("answer without a server cookie accepted")
+	}
+
+	// A client's own cookie goes out as it is
+	own := withTestCookie(withTestOPT(query, 1232), []byte("clientcc"))
+	if out, _, _ := withCookie(own, resolver); !bytes.Equal(out, own) {
+		t.Error("client's own cookie replaced")
+	}
+}
+
+func TestPublicDNSCookies(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, dnsCookies, true)
+	setForTest(t, publicTimeout, 200*time.Millisecond)
+	var sendCookie atomic.Bool
+	sendCookie.Store(true)
+	var seen atomic.Int32
+	public := startMockPublic(t, func(query []byte) []byte {
+		cookie, ok := ednsOption(query, optionCookie)
+		if ok && len(cookie) >= 8 {
+			seen.Add(1)
+		}
+		resp := answerA(60, [4]byte{192, 0, 2, 1})(query)
+		if sendCookie.Load() && ok {
+			resp = withTestCookie(withTestOPT(resp, 1232), append(cookie[:8:8], "server-cookie!"...))
+		}
+		return resp
+	})
+
+	query := buildTestQuery(1, "cookie.example", typeA)
+	resp, err := queryPublicResolver(context.Background(), query, public.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen.Load() != 1 || !firstA(t, resp).Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("cookie sent %d times, answer %x", seen.Load(), resp)
+	}
+	if _, ok := findOPT(resp); ok {
+		t.Error("cookie OPT relayed to a client that sent none")
+	}
+
+	// The resolver now answers without the cookie it sent before, as a
+	// spoofer not on the path would
+	sendCookie.Store(false)
+	if resp, err := queryPublicResolver(context.Background(), query, public.addr); err == nil {
+		t.Errorf("answer missing the expected cookie accepted: %x", resp)
+	}
+}
@@ -0,0 +1,591 @@
+package endpoint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Minimal DNS wire-format helpers (RFC 1035). Only what the endpoint needs
+// to inspect queries and responses and to build the few answers it gives
+// itself; messages are otherwise relayed as-is.
+
+const dnsHeaderLen = 12
+
+const (
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+	flagAD = 1 << 5
+	flagCD = 1 << 4
+
+	opcodeMask = 0x7800
+	rcodeMask  = 0x000f
+)
+
+const (
+	rcodeSuccess  = 0
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeRefused  = 5
+)
+
+const (
+	typeA     = 1
+	typeNS    = 2
+	typeCNAME = 5
+	typeSOA   = 6
+	typePTR   = 12
+	typeMX    = 15
+	typeTXT   = 16
+	typeAAAA  = 28
+	typeSRV   = 33
+	typeOPT   = 41
+)
+
+const (
+	classIN = 1
+	classCH = 3 // CHAOS, used for server diagnostics like version.bind
+)
+
+func msgID(msg []byte) uint16 {
+	return binary.BigEndian.Uint16(msg[0:2])
+}
+
+func setMsgID(msg []byte, id uint16) {
+	binary.BigEndian.PutUint16(msg[0:2], id)
+}
+
+// sameID reports whether response carries the transaction ID of query.
+func sameID(query, response []byte) bool {
+	return len(query) >= 2 && len(response) >= 2 && msgID(query) == msgID(response)
+}
+
+// sameQuestion reports whether response answers the question of query:
+// the same name, ignoring case and compression, type and class. Error
+// responses may leave the question out.
+func sameQuestion(query, response []byte) bool {
+	if qd, _, _, _ := msgCounts(response); qd == 0 {
+		return msgRcode(response) != rcodeSuccess
+	}
+	qName, qOff, err := expandName(query, dnsHeaderLen)
+	if err != nil || qOff+4 > len(query) {
+		// Nothing to compare against, the query was never understood
+		return true
+	}
+	rName, rOff, err := expandName(response, dnsHeaderLen)
+	if err != nil || rOff+4 > len(response) {
+		return false
+	}
+	return bytes.Equal(qName, rName) && bytes.Equal(query[qOff:qOff+4], response[rOff:rOff+4])
+}
+
+func msgFlags(msg []byte) uint16 {
+	return binary.BigEndian.Uint16(msg[2:4])
+}
+
+func msgRcode(msg []byte) int {
+	return int(msgFlags(msg) & rcodeMask)
+}
+
+// msgCounts returns QDCOUNT, ANCOUNT, NSCOUNT and ARCOUNT.
+func msgCounts(msg []byte) (qd, an, ns, ar int) {
+	return int(binary.BigEndian.Uint16(msg[4:6])),
+		int(binary.BigEndian.Uint16(msg[6:8])),
+		int(binary.BigEndian.Uint16(msg[8:10])),
+		int(binary.BigEndian.Uint16(msg[10:12]))
+}
+
+// skipName returns the offset just past the (possibly compressed) name
+// starting at off.
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, fmt.Errorf("name overflows message")
+		}
+		c := int(msg[off])
+		switch c & 0xc0 {
+		case 0x00:
+			if c == 0 {
+				return off + 1, nil
+			}
+			off += 1 + c
+		case 0xc0:
+			// A pointer always ends the name
+			if off+2 > len(msg) {
+				return 0, fmt.Errorf("truncated compression pointer")
+			}
+			return off + 2, nil
+		default:
+			return 0, fmt.Errorf("unsupported label type 0x%02x", c)
+		}
+	}
+}
+
+// skipQuestions returns the offset of the first resource record after the
+// question section.
+func skipQuestions(msg []byte) (int, error) {
+	if len(msg) < dnsHeaderLen {
+		return 0, fmt.Errorf("message shorter than header")
+	}
+	qd, _, _, _ := msgCounts(msg)
+	off := dnsHeaderLen
+	for i := 0; i < qd; i++ {
+		var err error
+		if off, err = skipName(msg, off); err != nil {
+			return 0, err
+		}
+		off += 4 // QTYPE + QCLASS
+		if off > len(msg) {
+			return 0, fmt.Errorf("truncated question")
+		}
+	}
+	return off, nil
+}
+
+const (
+	sectionAnswer = iota
+	sectionAuthority
+	sectionAdditional
+)
+
+// resourceRecord locates one record inside a message. Offsets index into
+// the message the record was read from.
+type resourceRecord struct {
+	Section     int
+	Offset      int // start of the owner name
+	Type        uint16
+	Class       uint16
+	TTL         uint32
+	RDataOffset int
+	RDataLen    int
+}
+
+// forEachRecord calls fn for every answer, authority and additional record
+// in msg. Iteration stops early when fn returns false.
+func forEachRecord(msg []byte, fn func(rr resourceRecord) bool) error {
+	off, err := skipQuestions(msg)
+	if err != nil {
+		return err
+	}
+	_, an, ns, ar := msgCounts(msg)
+	counts := [3]int{an, ns, ar}
+	for section, count := range counts {
+		for i := 0; i < count; i++ {
+			start := off
+			if off, err = skipName(msg, off); err != nil {
+				return err
+			}
+			if off+10 > len(msg) {
+				return fmt.Errorf("truncated resource record")
+			}
+			rr := resourceRecord{
+				Section:     section,
+				Offset:      start,
+				Type:        binary.BigEndian.Uint16(msg[off : off+2]),
+				Class:       binary.BigEndian.Uint16(msg[off+2 : off+4]),
+				TTL:         binary.BigEndian.Uint32(msg[off+4 : off+8]),
+				RDataOffset: off + 10,
+				RDataLen:    int(binary.BigEndian.Uint16(msg[off+8 : off+10])),
+			}
+			off = rr.RDataOffset + rr.RDataLen
+			if off > len(msg) {
+				return fmt.Errorf("record data overflows message")
+			}
+			if !fn(rr) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// minAnswerTTL returns the smallest TTL among the answer records. ok is
+// false when the message has no answers or cannot be walked.
+func minAnswerTTL(msg []byte) (ttl uint32, ok bool) {
+	err := forEachRecord(msg, func(rr resourceRecord) bool {
+		if rr.Section != sectionAnswer {
+			return false
+		}
+		if !ok || rr.TTL < ttl {
+			ttl = rr.TTL
+			ok = true
+		}
+		return true
+	})
+	if err != nil {
+		return 0, false
+	}
+	return ttl, ok
+}
+
+// negativeTTL returns how long a negative answer may be cached per RFC 2308
+// section 5: the lesser of the authority SOA record's TTL and its MINIMUM
+// field. ok is false when there is no SOA to derive it from.
+func negativeTTL(msg []byte) (ttl uint32, ok bool) {
+	err := forEachRecord(msg, func(rr resourceRecord) bool {
+		if rr.Section != sectionAuthority || rr.Type != typeSOA {
+			return rr.Section <= sectionAuthority
+		}
+		// MINIMUM is the last field of the SOA RDATA
+		if rr.RDataLen < 20 {
+			return false
+		}
+		end := rr.RDataOffset + rr.RDataLen
+		ttl = min(rr.TTL, binary.BigEndian.Uint32(msg[end-4:end]))
+		ok = true
+		return false
+	})
+	if err != nil {
+		return 0, false
+	}
+	return ttl, ok
+}
+
+// decrementTTLs lowers the TTL of every record in msg by age seconds, in
+// place, stopping at zero. The OPT pseudo-record is skipped since its TTL
+// field carries EDNS flags rather than a lifetime.
+func decrementTTLs(msg []byte, age uint32) error {
+	return forEachRecord(msg, func(rr resourceRecord) bool {
+		if rr.Type == typeOPT {
+			return true
+		}
+		ttl := rr.TTL - min(rr.TTL, age)
+		binary.BigEndian.PutUint32(msg[rr.RDataOffset-6:rr.RDataOffset-2], ttl)
+		return true
+	})
+}
+
+// setTTLs sets the TTL of every record in msg to ttl, in place, skipping
+// the OPT pseudo-record like decrementTTLs.
+func setTTLs(msg []byte, ttl uint32) error {
+	return forEachRecord(msg, func(rr resourceRecord) bool {
+		if rr.Type != typeOPT {
+			binary.BigEndian.PutUint32(msg[rr.RDataOffset-6:rr.RDataOffset-2], ttl)
+		}
+		return true
+	})
+}
+
+// ednsFlagDO is the DNSSEC OK bit in the flags half of an OPT record's TTL
+// field (RFC 3225).
+const ednsFlagDO = 1 << 15
+
+// ednsDO reports whether msg carries an OPT record with the DO bit set.
+func ednsDO(msg []byte) bool {
+	opt, ok := findOPT(msg)
+	return ok && opt.TTL&ednsFlagDO != 0
+}
+
+// ednsPayloadSize returns the UDP payload size advertised in the OPT record
+// of msg (RFC 6891 6.2.3), or 512 when there is none.
+func ednsPayloadSize(msg []byte) int {
+	size := 512
+	forEachRecord(msg, func(rr resourceRecord) bool {
+		if rr.Section == sectionAdditional && rr.Type == typeOPT {
+			// Values below 512 are treated as 512
+			if int(rr.Class) > size {
+				size = int(rr.Class)
+			}
+			return false
+		}
+		return true
+	})
+	return size
+}
+
+// questionOnly returns a copy of msg's header and question section with
+// the record counts zeroed. An unparseable question is dropped as well.
+func questionOnly(msg []byte) []byte {
+	end, err := skipQuestions(msg)
+	if err != nil {
+		end = dnsHeaderLen
+	}
+	out := make([]byte, end)
+	copy(out, msg[:end])
+	if err != nil {
+		binary.BigEndian.PutUint16(out[4:6], 0)
+	}
+	binary.BigEndian.PutUint16(out[6:8], 0)
+	binary.BigEndian.PutUint16(out[8:10], 0)
+	binary.BigEndian.PutUint16(out[10:12], 0)
+	return out
+}
+
+// truncateResponse reduces resp to its header and question with the TC bit
+// set, telling the client to retry over TCP. An OPT record is kept, without
+// its options, since EDNS clients expect one in every response (RFC 6891
+// section 7).
+func truncateResponse(resp []byte) []byte {
+	truncated := questionOnly(resp)
+	binary.BigEndian.PutUint16(truncated[2:4], msgFlags(truncated)|flagTC)
+
+	forEachRecord(resp, func(rr resourceRecord) bool {
+		if rr.Section != sectionAdditional || rr.Type != typeOPT {
+			return true
+		}
+		// Root owner name, then TYPE, CLASS (payload size), TTL (extended
+		// rcode and flags) and an empty RDLENGTH
+		truncated = append(truncated, 0)
+		truncated = binary.BigEndian.AppendUint16(truncated, typeOPT)
+		truncated = binary.BigEndian.AppendUint16(truncated, rr.Class)
+		truncated = binary.BigEndian.AppendUint32(truncated, rr.TTL)
+		truncated = binary.BigEndian.AppendUint16(truncated, 0)
+		binary.BigEndian.PutUint16(truncated[10:12], 1)
+		return false
+	})
+	return truncated
+}
+
+// setRecursionAvailable sets RA in a response relayed to a client. The
+// endpoint recurses on its clients' behalf, even when the server that
+// answered is authoritative-only and left RA clear.
+func setRecursionAvailable(msg []byte) {
+	if len(msg) >= dnsHeaderLen {
+		binary.BigEndian.PutUint16(msg[2:4], msgFlags(msg)|flagRA)
+	}
+}
+
+// errorResponse builds an answer to query carrying only its question and
+// rcode, for when the endpoint has to answer without an upstream.
+func errorResponse(query []byte, rcode int) []byte {
+	resp := questionOnly(query)
+	flags := msgFlags(query)&(opcodeMask|flagRD|flagCD) | flagQR | flagRA | uint16(rcode)
+	binary.BigEndian.PutUint16(resp[2:4], flags)
+	return resp
+}
+
+// questionOwner is a compression pointer to the question name, for records
+// owned by it.
+var questionOwner = []byte{0xc0, dnsHeaderLen}
+
+// appendRecord appends one resource record to msg and bumps the count of
+// its section. Records must be appended in section order, answers first.
+func appendRecord(msg []byte, section int, owner []byte, rtype, class uint16, ttl uint32, rdata []byte) []byte {
+	msg = append(msg, owner...)
+	msg = binary.BigEndian.AppendUint16(msg, rtype)
+	msg = binary.BigEndian.AppendUint16(msg, class)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	msg = append(msg, rdata...)
+
+	count := msg[6+2*section : 8+2*section]
+	binary.BigEndian.PutUint16(count, binary.BigEndian.Uint16(count)+1)
+	return msg
+}
+
+// recordResponse builds a NOERROR answer to query holding one record of
+// the given type and class, owned by the question name.
+func recordResponse(query []byte, qtype, qclass uint16, rdata []byte, ttl uint32) []byte {
+	resp := errorResponse(query, rcodeSuccess)
+	return appendRecord(resp, sectionAnswer, questionOwner, qtype, qclass, ttl, rdata)
+}
+
+// negativeResponse builds an answer to query with the given rcode, usually
+// NXDOMAIN or NOERROR/NODATA, and an SOA for zone in the authority section
+// so clients can cache it for ttl seconds (RFC 2308).
+func negativeResponse(query []byte, rcode int, zone string, ttl uint32) []byte {
+	resp := errorResponse(query, rcode)
+	owner, err := encodeName(zone)
+	if err != nil {
+		return resp
+	}
+	return appendRecord(resp, sectionAuthority, owner, typeSOA, classIN, ttl, soaRData(owner, ttl))
+}
+
+// soaRData builds the RDATA of a synthetic SOA for the zone apex owner. The
+// timers are nominal, except MINIMUM which bounds negative caching.
+func soaRData(owner []byte, minimum uint32) []byte {
+	var rdata []byte
+	rdata = append(rdata, owner...)                 // MNAME
+	rdata = append(rdata, 0)                        // RNAME, the root
+	rdata = binary.BigEndian.AppendUint32(rdata, 1) // SERIAL
+	rdata = binary.BigEndian.AppendUint32(rdata, 3600)
+	rdata = binary.BigEndian.AppendUint32(rdata, 600)
+	rdata = binary.BigEndian.AppendUint32(rdata, 86400)
+	return binary.BigEndian.AppendUint32(rdata, minimum)
+}
+
+// encodeName converts a dotted name to uncompressed wire format. "" and
+// "." are the root.
+func encodeName(name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	var wire []byte
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid label in name %q", name)
+			}
+			wire = append(wire, byte(len(label)))
+			wire = append(wire, label...)
+		}
+	}
+	wire = append(wire, 0)
+	if len(wire) > maxNameLen {
+		return nil, fmt.Errorf("name %q longer than %d octets", name, maxNameLen)
+	}
+	return wire, nil
+}
+
+// addressResponse answers query with one A or AAAA record for ip.
+func addressResponse(query []byte, qtype uint16, ip []byte, ttl uint32) []byte {
+	return recordResponse(query, qtype, classIN, ip, ttl)
+}
+
+// txtResponse answers query with one TXT record of class qclass holding
+// text, which is cut to the 255 octets a single string can carry.
+func txtResponse(query []byte, qclass uint16, text string, ttl uint32) []byte {
+	if len(text) > 255 {
+		text = text[:255]
+	}
+	rdata := append([]byte{byte(len(text))}, text...)
+	return recordResponse(query, typeTXT, qclass, rdata, ttl)
+}
+
+// maxPointerHops bounds how many compression pointers expandName follows,
+// which stops pointer loops in hostile messages.
+const maxPointerHops = 16
+
+// maxNameLen is the longest a name may be in wire format (RFC 1035
+// section 2.3.4).
+const maxNameLen = 255
+
+// expandName decodes the (possibly compressed) name at off. It returns the
+// name in uncompressed, lower-cased wire format, so names that differ only
+// in case or compression compare equal, and the offset just past the name
+// in the original message.
+func expandName(msg []byte, off int) ([]byte, int, error) {
+	var name []byte
+	next := -1
+	hops := 0
+	for {
+		if off >= len(msg) {
+			return nil, 0, fmt.Errorf("name overflows message")
+		}
+		c := int(msg[off])
+		switch c & 0xc0 {
+		case 0x00:
+			if c == 0 {
+				if next == -1 {
+					next = off + 1
+				}
+				return append(name, 0), next, nil
+			}
+			if off+1+c > len(msg) {
+				return nil, 0, fmt.Errorf("label overflows message")
+			}
+			if len(name)+1+c >= maxNameLen {
+				return nil, 0, fmt.Errorf("name exceeds %d octets", maxNameLen)
+			}
+			name = append(name, byte(c))
+			for _, b := range msg[off+1 : off+1+c] {
+				if 'A' <= b && b <= 'Z' {
+					b += 'a' - 'A'
+				}
+				name = append(name, b)
+			}
+			off += 1 + c
+		case 0xc0:
+			if off+2 > len(msg) {
+				return nil, 0, fmt.Errorf("truncated compression pointer")
+			}
+			if hops++; hops > maxPointerHops {
+				return nil, 0, fmt.Errorf("too many compression pointers")
+			}
+			ptr := int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3fff)
+			// Pointers must refer to an earlier name, which can't be in
+			// the header
+			if ptr < dnsHeaderLen {
+				return nil, 0, fmt.Errorf("compression pointer into header")
+			}
+			if ptr >= off {
+				return nil, 0, fmt.Errorf("forward compression pointer")
+			}
+			if next == -1 {
+				next = off + 2
+			}
+			off = ptr
+		default:
+			return nil, 0, fmt.Errorf("unsupported label type 0x%02x", c)
+		}
+	}
+}
+
+// readName decodes the (possibly compressed) name at off. It returns the
+// lower-cased name without the trailing dot ("" for the root) and the
+// offset just past the name in the original message.
+func readName(msg []byte, off int) (string, int, error) {
+	wire, next, err := expandName(msg, off)
+	if err != nil {
+		return "", 0, err
+	}
+	var name strings.Builder
+	for i := 0; wire[i] != 0; i += 1 + int(wire[i]) {
+		if name.Len() > 0 {
+			name.WriteByte('.')
+		}
+		name.Write(wire[i+1 : i+1+int(wire[i])])
+	}
+	return name.String(), next, nil
+}
+
+// parseQuestion decodes the name, type and class of the first question in
+// query.
+func parseQuestion(query []byte) (qname string, qtype, qclass uint16, err error) {
+	if len(query) < dnsHeaderLen {
+		return "", 0, 0, fmt.Errorf("message shorter than header")
+	}
+	if qd, _, _, _ := msgCounts(query); qd == 0 {
+		return "", 0, 0, fmt.Errorf("message has no question")
+	}
+	qname, off, err := readName(query, dnsHeaderLen)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if off+4 > len(query) {
+		return "", 0, 0, fmt.Errorf("truncated question")
+	}
+	return qname, binary.BigEndian.Uint16(query[off : off+2]), binary.BigEndian.Uint16(query[off+2 : off+4]), nil
+}
+
+var typeNames = map[uint16]string{
+	1:   "A",
+	2:   "NS",
+	5:   "CNAME",
+	6:   "SOA",
+	12:  "PTR",
+	15:  "MX",
+	16:  "TXT",
+	28:  "AAAA",
+	33:  "SRV",
+	41:  "OPT",
+	64:  "SVCB",
+	65:  "HTTPS",
+	255: "ANY",
+}
+
+var rcodeNames = map[int]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+func rcodeString(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+func typeString(qtype uint16) string {
+	if name, ok := typeNames[qtype]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
+}
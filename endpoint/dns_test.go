@@ -0,0 +1,228 @@
+package endpoint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseQuestion(t *testing.T) {
+	query := buildTestQuery(1, "WWW.Example.com", typeAAAA)
+	qname, qtype, qclass, err := parseQuestion(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qname != "www.example.com" || qtype != typeAAAA || qclass != classIN {
+		t.Fatalf("got %q type %d class %d", qname, qtype, qclass)
+	}
+
+	root, _, _, err := parseQuestion(buildTestQuery(1, ".", typeNS))
+	if err != nil || root != "" {
+		t.Fatalf("root parsed as %q, %v", root, err)
+	}
+}
+
+func TestParseQuestionTruncated(t *testing.T) {
+	query := buildTestQuery(1, "www.example.com", typeA)
+	for n := range len(query) {
+		if _, _, _, err := parseQuestion(query[:n]); err == nil {
+			t.Errorf("query cut to %d of %d bytes parsed", n, len(query))
+		}
+	}
+
+	noQuestion := bytes.Clone(query[:dnsHeaderLen])
+	noQuestion[5] = 0
+	if _, _, _, err := parseQuestion(noQuestion); err == nil {
+		t.Error("query without a question parsed")
+	}
+}
+
+func TestParseQuestionPointers(t *testing.T) {
+	header := buildTestQuery(1, "x", typeA)[:dnsHeaderLen]
+	for name, question := range map[string][]byte{
+		"pointer to itself":   {0xc0, 12, 0, 1, 0, 1},
+		"pointer cycle":       {0xc0, 14, 0xc0, 12, 0, 1, 0, 1},
+		"forward pointer":     {0xc0, 14, 0, 1, 0, 1, 0},
+		"pointer into header": {0xc0, 4, 0, 1, 0, 1},
+		"cut off pointer":     {0xc0},
+		"reserved label type": {0x80, 0, 0, 1, 0, 1},
+	} {
+		msg := append(bytes.Clone(header), question...)
+		if _, _, _, err := parseQuestion(msg); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+
+	// A name longer than 255 octets in wire format
+	long := bytes.Clone(header)
+	for range 5 {
+		long = append(long, 63)
+		long = append(long, bytes.Repeat([]byte("a"), 63)...)
+	}
+	long = append(long, 0, 0, 1, 0, 1)
+	if _, _, _, err := parseQuestion(long); err == nil {
+		t.Error("overlong name parsed")
+	}
+}
+
+func TestReadNameCompressed(t *testing.T) {
+	query := buildTestQuery(1, "example.com", typeA)
+	// www followed by a pointer back to example.com in the question
+	msg := append(bytes.Clone(query), 3, 'W', 'w', 'W', 0xc0, dnsHeaderLen)
+	name, next, err := readName(msg, len(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "www.example.com" || next != len(msg) {
+		t.Fatalf("got %q ending at %d, want www.example.com ending at %d", name, next, len(msg))
+	}
+
+	// Compression doesn't change the expanded form
+	plain := buildTestQuery(1, "www.example.com", typeA)
+	a, _, _ := expandName(msg, len(query))
+	b, _, _ := expandName(plain, dnsHeaderLen)
+	if !bytes.Equal(a, b) {
+		t.Fatalf("expanded %q and %q differ", a, b)
+	}
+}
+
+func TestEDNSPayloadSize(t *testing.T) {
+	query := buildTestQuery(1, "edns.example", typeA)
+	if size := ednsPayloadSize(query); size != 512 {
+		t.Errorf("payload %d without OPT, want 512", size)
+	}
+	for advertised, want := range map[uint16]int{
+		0:     512,
+		100:   512,
+		512:   512,
+		1232:  1232,
+		4096:  4096,
+		65535: 65535,
+	} {
+		if size := ednsPayloadSize(withTestOPT(query, advertised)); size != want {
+			t.Errorf("payload %d for OPT advertising %d, want %d", size, advertised, want)
+		}
+	}
+}
+
+func TestTruncateResponse(t *testing.T) {
+	query := buildTestQuery(1, "edns.example", typeA)
+	truncated := truncateResponse(buildTestAnswer(query, 60, [4]byte{192, 0, 2, 1}))
+	if msgFlags(truncated)&flagTC == 0 {
+		t.Error("TC clear")
+	}
+	if !bytes.Equal(truncated[dnsHeaderLen:], query[dnsHeaderLen:]) {
+		t.Error("question not kept as asked")
+	}
+	if _, an, ns, ar := msgCounts(truncated); an != 0 || ns != 0 || ar != 0 {
+		t.Errorf("%d answer, %d authority and %d additional records left", an, ns, ar)
+	}
+
+	// The OPT record stays, with its payload size
+	withOPT := withTestOPT(buildTestAnswer(query, 60, [4]byte{192, 0, 2, 1}), 1232)
+	truncated = truncateResponse(withOPT)
+	if _, an, _, ar := msgCounts(truncated); an != 0 || ar != 1 {
+		t.Fatalf("%d answer and %d additional records left, want the OPT record only", an, ar)
+	}
+	if size := ednsPayloadSize(truncated); size != 1232 {
+		t.Errorf("truncated response advertises %d, want 1232", size)
+	}
+}
+
+func TestSameQuestion(t *testing.T) {
+	query := buildTestQuery(1, "www.example.com", typeA)
+	answer := func(q []byte) []byte { return buildTestAnswer(q, 60, [4]byte{192, 0, 2, 1}) }
+	otherClass := answer(query)
+	binary.BigEndian.PutUint16(otherClass[len(query)-2:], classCH)
+	noQuestion := errorResponse(query, rcodeServFail)[:dnsHeaderLen]
+	noQuestion[5] = 0
+	noQuestionOK := bytes.Clone(noQuestion)
+	noQuestionOK[3] &^= 0x0f
+
+	for name, tc := range map[string]struct {
+		response []byte
+		want     bool
+	}{
+		"same":                  {response: answer(query), want: true},
+		"other case":            {response: answer(buildTestQuery(1, "WWW.Example.COM", typeA)), want: true},
+		"other name":            {response: answer(buildTestQuery(1, "www.example.org", typeA))},
+		"parent name":           {response: answer(buildTestQuery(1, "example.com", typeA))},
+		"other type":            {response: answer(buildTestQuery(1, "www.example.com", typeAAAA))},
+		"other class":           {response: otherClass},
+		"SERVFAIL, no question": {response: noQuestion, want: true},
+		"NOERROR, no question":  {response: noQuestionOK},
+		"cut off question":      {response: answer(query)[:len(query)-1]},
+	} {
+		if got := sameQuestion(query, tc.response); got != tc.want {
+			t.Errorf("%s: sameQuestion %v, want %v", name, got, tc.want)
+		}
+	}
+}
+
+// parseTestMessage parses msg with a standard DNS library, failing the test
+// unless every section reads back cleanly.
+func parseTestMessage(t *testing.T, msg []byte) dnsmessage.Message {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		t.Fatalf("message %x does not parse: %v", msg, err)
+	}
+	return m
+}
+
+func TestSynthesizedAnswersParse(t *testing.T) {
+	query := buildTestQuery(0x4242, "Synth.Example", typeA)
+	binary.BigEndian.PutUint16(query[2:4], flagRD)
+
+	check := func(name string, m dnsmessage.Message, rcode dnsmessage.RCode) {
+		t.Helper()
+		if m.ID != 0x4242 || !m.Response || !m.RecursionDesired || !m.RecursionAvailable || m.RCode != rcode {
+			t.Errorf("%s: header %+v, want the query's ID and RD with QR, RA and %v", name, m.Header, rcode)
+		}
+		if len(m.Questions) != 1 || m.Questions[0].Name.String() != "Synth.Example." {
+			t.Errorf("%s: question %v, want the query's", name, m.Questions)
+		}
+	}
+
+	m := parseTestMessage(t, addressResponse(query, typeA, []byte{192, 0, 2, 7}, 300))
+	check("A", m, dnsmessage.RCodeSuccess)
+	if len(m.Answers) != 1 || m.Answers[0].Header.TTL != 300 || m.Answers[0].Header.Name.String() != "Synth.Example." {
+		t.Fatalf("A answers %v", m.Answers)
+	}
+	if a, ok := m.Answers[0].Body.(*dnsmessage.AResource); !ok || a.A != [4]byte{192, 0, 2, 7} {
+		t.Errorf("A record %v", m.Answers[0].Body)
+	}
+
+	ip := net.ParseIP("2001:db8::7")
+	m = parseTestMessage(t, addressResponse(query, typeAAAA, ip, 60))
+	check("AAAA", m, dnsmessage.RCodeSuccess)
+	if aaaa, ok := m.Answers[0].Body.(*dnsmessage.AAAAResource); !ok || !net.IP(aaaa.AAAA[:]).Equal(ip) {
+		t.Errorf("AAAA record %v", m.Answers[0].Body)
+	}
+
+	m = parseTestMessage(t, txtResponse(query, classCH, "zerotrust-dns 1.2.3", 0))
+	check("TXT", m, dnsmessage.RCodeSuccess)
+	txt, ok := m.Answers[0].Body.(*dnsmessage.TXTResource)
+	if !ok || len(txt.TXT) != 1 || txt.TXT[0] != "zerotrust-dns 1.2.3" || m.Answers[0].Header.Class != dnsmessage.Class(classCH) {
+		t.Errorf("TXT record %v", m.Answers[0])
+	}
+
+	m = parseTestMessage(t, negativeResponse(query, rcodeNXDomain, "example.", 3600))
+	check("NXDOMAIN", m, dnsmessage.RCodeNameError)
+	if len(m.Answers) != 0 || len(m.Authorities) != 1 {
+		t.Fatalf("NXDOMAIN sections %d answers, %d authorities", len(m.Answers), len(m.Authorities))
+	}
+	soa, ok := m.Authorities[0].Body.(*dnsmessage.SOAResource)
+	if !ok || m.Authorities[0].Header.Name.String() != "example." || soa.NS.String() != "example." || soa.MinTTL != 3600 {
+		t.Errorf("SOA %v", m.Authorities[0])
+	}
+
+	m = parseTestMessage(t, errorResponse(query, rcodeServFail))
+	check("SERVFAIL", m, dnsmessage.RCodeServerFailure)
+	if len(m.Answers)+len(m.Authorities)+len(m.Additionals) != 0 {
+		t.Errorf("SERVFAIL carries records: %+v", m)
+	}
+}
@@ -0,0 +1,103 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// dohClients holds one HTTP client per TLS config so DoH queries reuse
+// connections instead of handshaking every time.
+var (
+	dohClientsMu sync.Mutex
+	dohClients   = make(map[*tls.Config]*http.Client)
+)
+
+func dohClientFor(tlsConfig *tls.Config) *http.Client {
+	dohClientsMu.Lock()
+	defer dohClientsMu.Unlock()
+
+	client, ok := dohClients[tlsConfig]
+	if !ok {
+		// Requests carry their own deadline, see forwardToServerDoH
+		client = &http.Client{
+			Transport: &http.Transport{
+				DialContext:       newDialer("tcp").DialContext,
+				TLSClientConfig:   tlsConfig.Clone(),
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		}
+		dohClients[tlsConfig] = client
+	}
+	return client
+}
+
+// dohURL turns an upstream server into a DoH endpoint. A bare host:port gets the
+// RFC 8484 default path.
+func dohURL(server string) string {
+	if strings.HasPrefix(server, "https://") {
+		return server
+	}
+	return "https://" + server + "/dns-query"
+}
+
+func forwardToServerDoH(ctx context.Context, query []byte, server string, tlsConfig *tls.Config) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, *upstreamTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dohURL(server), bytes.NewReader(query))
+	if err != nil {
+		return nil, unreachable("failed to build DoH request: %v", err)
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := dohClientFor(tlsConfig).Do(req)
+	if err != nil {
+		return nil, connectError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, unreachable("DoH server returned status %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dnsMessageType {
+		return nil, malformed("unexpected content type %q", ct)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535+1))
+	if err != nil {
+		return nil, unreachable("failed to read DoH response: %v", err)
+	}
+	if len(body) < dnsHeaderLen || len(body) > 65535 {
+		return nil, malformed("invalid DoH response length: %d", len(body))
+	}
+	if !sameID(query, body) {
+		return nil, malformed("response ID does not match query")
+	}
+	if !sameQuestion(query, body) {
+		return nil, malformed("response question does not match query")
+	}
+
+	return body, nil
+}
+
+// resetDoHClients drops the cached DoH clients and their idle connections.
+func resetDoHClients() {
+	dohClientsMu.Lock()
+	clients := dohClients
+	dohClients = make(map[*tls.Config]*http.Client)
+	dohClientsMu.Unlock()
+
+	for _, client := range clients {
+		client.CloseIdleConnections()
+	}
+}
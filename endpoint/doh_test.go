@@ -0,0 +1,169 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestDoH serves DoH over mTLS with certificates from p until the
+// test ends, answering every query at /dns-query with handler.
+func startTestDoH(t *testing.T, p *testPKI, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", handler)
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = p.serverTLS(t)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// echoDoH answers a DoH POST with the canned A record 192.0.2.53.
+func echoDoH(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageType {
+		http.Error(w, "not a DoH POST", http.StatusBadRequest)
+		return
+	}
+	query, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Write(buildTestAnswer(removeOPT(query), 60, [4]byte{192, 0, 2, 53}))
+}
+
+func TestForwardToServerDoH(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	server := startTestDoH(t, p, echoDoH)
+	tlsConfig := p.clientTLS(t)
+
+	// A bare host:port gets the default path
+	for _, upstream := range []string{server.URL + "/dns-query", strings.TrimPrefix(server.URL, "https://")} {
+		query := buildTestQuery(0x1234, "doh.example", typeA)
+		resp, err := forwardToServerDoH(context.Background(), query, upstream, tlsConfig)
+		if err != nil {
+			t.Fatalf("%s: %v", upstream, err)
+		}
+		if msgID(resp) != 0x1234 || !firstA(t, resp).Equal(net.IPv4(192, 0, 2, 53)) {
+			t.Fatalf("%s: unexpected response", upstream)
+		}
+	}
+}
+
+func TestForwardToServerDoHErrors(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	query := buildTestQuery(1, "doh.example", typeA)
+
+	for name, tc := range map[string]struct {
+		handler http.HandlerFunc
+		want    error
+	}{
+		"server error": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+			},
+			want: errUnreachable,
+		},
+		"wrong content type": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write(buildTestAnswer(query, 60, [4]byte{192, 0, 2, 53}))
+			},
+			want: errMalformed,
+		},
+		"other ID": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", dnsMessageType)
+				w.Write(buildTestAnswer(buildTestQuery(2, "doh.example", typeA), 60, [4]byte{192, 0, 2, 53}))
+			},
+			want: errMalformed,
+		},
+		"other question": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", dnsMessageType)
+				w.Write(buildTestAnswer(buildTestQuery(1, "other.example", typeA), 60, [4]byte{192, 0, 2, 53}))
+			},
+			want: errMalformed,
+		},
+		"short body": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", dnsMessageType)
+				w.Write([]byte{0, 1})
+			},
+			want: errMalformed,
+		},
+	} {
+		server := startTestDoH(t, p, tc.handler)
+		_, err := forwardToServerDoH(context.Background(), query, server.URL+"/dns-query", p.clientTLS(t))
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", name, err, tc.want)
+		}
+	}
+}
+
+func TestForwardToServerDoHRequiresClientCert(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	server := startTestDoH(t, p, echoDoH)
+
+	tlsConfig := p.clientTLS(t)
+	tlsConfig.Certificates = nil
+	_, err := forwardToServerDoH(context.Background(), buildTestQuery(1, "doh.example", typeA), server.URL+"/dns-query", tlsConfig)
+	if !errors.Is(err, errUnreachable) {
+		t.Fatalf("got %v without a client certificate, want an unreachable upstream", err)
+	}
+}
+
+func TestResolveQueryOverDoH(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	var requests atomic.Int32
+	server := startTestDoH(t, p, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		echoDoH(w, r)
+	})
+	config := &Config{Server: server.URL + "/dns-query", Transport: "doh", NoPublicDNS: true}
+
+	resp, path, err := resolveQuery(context.Background(), buildTestQuery(5, "doh.example", typeA), config, p.clientTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != pathUpstream || !firstA(t, resp).Equal(net.IPv4(192, 0, 2, 53)) {
+		t.Fatalf("answered %v by %s", firstA(t, resp), path)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("DoH server got %d requests, want 1", n)
+	}
+}
+
+func TestForwardToServerDoHHonorsCancel(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, upstreamTimeout, 30*time.Second)
+	p := newTestPKI(t)
+	done := make(chan struct{})
+	server := startTestDoH(t, p, func(w http.ResponseWriter, r *http.Request) {
+		// Reading the body lets the server notice the client going away
+		io.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	})
+	t.Cleanup(func() { close(done) })
+	checkCancelAborts(t, "forwardToServerDoH", func(ctx context.Context) {
+		if _, err := forwardToServerDoH(ctx, buildTestQuery(1, "slow.example", typeA), server.URL+"/dns-query", p.clientTLS(t)); err == nil {
+			t.Error("answered")
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package endpoint
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// With -doh-listen set, the endpoint also answers DNS-over-HTTPS (RFC 8484)
+// on /dns-query, so a browser pointed at https://<addr>/dns-query resolves
+// through it like any local client. Queries go through handleDNSQuery, the
+// same as those arriving over UDP and TCP.
+
+const dohPath = "/dns-query"
+
+// startDoHServer serves DoH on addr in the background, presenting the
+// keypair in certFile and keyFile, or a self-signed certificate for
+// localhost when they are empty.
+func startDoHServer(addr, certFile, keyFile string) error {
+	var cert tls.Certificate
+	var err error
+	if certFile != "" {
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return fmt.Errorf("failed to load DoH certificate: %v", err)
+		}
+	} else {
+		if cert, err = selfSignedCert(addr); err != nil {
+			return fmt.Errorf("failed to generate DoH certificate: %v", err)
+		}
+		fingerprint := sha256.Sum256(cert.Certificate[0])
+		slog.Warn("Serving DoH with a self-signed certificate, browsers must be told to trust it or use -doh-cert", "sha256", hex.EncodeToString(fingerprint[:]))
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for DoH: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, serveDoH)
+	server := &http.Server{
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	go func() {
+		slog.Info("DoH listening", "addr", listener.Addr().String(), "path", dohPath)
+		if err := server.ServeTLS(listener, "", ""); err != nil {
+			slog.Error("DoH server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// serveDoH answers a DoH query, sent as the base64url dns parameter of a
+// GET or as the body of a POST (RFC 8484 section 4.1).
+func serveDoH(w http.ResponseWriter, r *http.Request) {
+	var query []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		if query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns")); err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dnsMessageType {
+			http.Error(w, "content type must be "+dnsMessageType, http.StatusUnsupportedMediaType)
+			return
+		}
+		if query, err = io.ReadAll(io.LimitReader(r.Body, 65535+1)); err != nil {
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(query) > 65535 {
+		http.Error(w, "query too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if _, _, _, err := parseQuestion(query); err != nil {
+		droppedQueries.WithLabelValues("malformed").Inc()
+		http.Error(w, "malformed query", http.StatusBadRequest)
+		return
+	}
+
+	// Like TCP clients, HTTP clients wait for a free slot
+	select {
+	case querySlots <- struct{}{}:
+	case <-r.Context().Done():
+		return
+	}
+	dw := &dohResponseWriter{remote: dohClientAddr(r)}
+	state := currentState()
+	handleDNSQuery(shutdownCtx, dw, query, state.config, state.tlsConfig)
+	<-querySlots
+
+	if dw.response == nil {
+		http.Error(w, "query not answered, see the endpoint log", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	// HTTP caches may keep the answer as long as a DNS cache would (RFC
+	// 8484 section 5.1)
+	if ttl, ok := cacheTTL(dw.response); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(dw.response)))
+	w.Write(dw.response)
+}
+
+// dohResponseWriter collects the response to a DoH query.
+type dohResponseWriter struct {
+	remote   net.Addr
+	response []byte
+}
+
+func (w *dohResponseWriter) WriteResponse(resp []byte) error {
+	captureMessage(w.remote, resp, true)
+	w.response = resp
+	return nil
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+// dohClientAddr returns the address a DoH request came from.
+func dohClientAddr(r *http.Request) net.Addr {
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+// selfSignedCert generates a certificate valid for a year for localhost,
+// the loopback addresses and the IP of addr, if it names one.
+func selfSignedCert(addr string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+			ips = append(ips, ip)
+		}
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,120 @@
+package endpoint
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useDoHState makes queries arriving over DoH resolve through a mock
+// upstream answering 10.0.0.1 for every name.
+func useDoHState(t *testing.T) {
+	t.Helper()
+	resetUpstreamState(t)
+	keepActiveState(t)
+	initQuerySlots()
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(300, [4]byte{10, 0, 0, 1}))
+	activeState.Store(&endpointState{config: &Config{Server: upstream.addr(), NoPublicDNS: true}, tlsConfig: p.clientTLS(t)})
+}
+
+func TestServeDoH(t *testing.T) {
+	useDoHState(t)
+	query := buildTestQuery(7, "doh.example", typeA)
+	get := httptest.NewRequest(http.MethodGet, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	post := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(query))
+	post.Header.Set("Content-Type", dnsMessageType)
+	for name, r := range map[string]*http.Request{"GET": get, "POST": post} {
+		w := httptest.NewRecorder()
+		serveDoH(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != dnsMessageType {
+			t.Fatalf("%s: status %d, content type %q", name, w.Code, w.Header().Get("Content-Type"))
+		}
+		if resp := w.Body.Bytes(); msgID(resp) != 7 || !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Errorf("%s: unexpected response %x", name, resp)
+		}
+		// Cached for no longer than the answer's TTL
+		if cc := w.Header().Get("Cache-Control"); cc != "max-age=300" && cc != "max-age=299" {
+			t.Errorf("%s: Cache-Control %q", name, cc)
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		method, target, contentType string
+		body                        []byte
+		want                        int
+	}{
+		"bad base64":   {method: http.MethodGet, target: dohPath + "?dns=!!", want: http.StatusBadRequest},
+		"malformed":    {method: http.MethodGet, target: dohPath + "?dns=AAAA", want: http.StatusBadRequest},
+		"content type": {method: http.MethodPost, target: dohPath, contentType: "text/plain", body: query, want: http.StatusUnsupportedMediaType},
+		"method":       {method: http.MethodPut, target: dohPath, want: http.StatusMethodNotAllowed},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, bytes.NewReader(tc.body))
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+		w := httptest.NewRecorder()
+		serveDoH(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", name, w.Code, tc.want)
+		}
+	}
+}
+
+func TestDoHServerGet(t *testing.T) {
+	useDoHState(t)
+	// Bind and release a port for the DoH server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if err := startDoHServer(addr, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The self-signed certificate is only trusted once told to, so check it
+	// is valid for the address it was made for
+	var presented *x509.Certificate
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				presented = cs.PeerCertificates[0]
+				return nil
+			},
+		}},
+	}
+	query := buildTestQuery(8, "browser.example", typeA)
+	resp, err := client.Get("https://" + addr + dohPath + "?dns=" + base64.RawURLEncoding.EncodeToString(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != dnsMessageType {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if msgID(body) != 8 || !firstA(t, body).Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("unexpected response %x", body)
+	}
+	if err := presented.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	if err := presented.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+
+	if err := startDoHServer("127.0.0.1:0", "missing.crt", "missing.key"); err == nil {
+		t.Error("DoH served without its certificate")
+	}
+}
@@ -0,0 +1,174 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DNS over QUIC (RFC 9250). Each query gets its own stream on a shared
+// connection, so one lost packet only delays the query it belongs to.
+
+const doqALPN = "doq"
+
+var (
+	doqConnsMu sync.Mutex
+	doqConns   = make(map[poolKey]quic.Connection)
+	// doqDialing holds a channel per server being dialed, closed when the
+	// dial is done, so queries arriving meanwhile wait for its connection
+	// rather than each dialing one of their own
+	doqDialing = make(map[poolKey]chan struct{})
+)
+
+// doqConn returns the open QUIC connection to server, dialing one if there
+// is none. fresh reports whether it was just dialed.
+func doqConn(ctx context.Context, server string, tlsConfig *tls.Config) (conn quic.Connection, fresh bool, err error) {
+	key := poolKey{addr: server, tlsConfig: tlsConfig}
+
+	for {
+		doqConnsMu.Lock()
+		conn, ok := doqConns[key]
+		if ok && conn.Context().Err() == nil {
+			doqConnsMu.Unlock()
+			return conn, false, nil
+		}
+		dialing, ok := doqDialing[key]
+		if !ok {
+			break
+		}
+		doqConnsMu.Unlock()
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+	done := make(chan struct{})
+	doqDialing[key] = done
+	doqConnsMu.Unlock()
+
+	tlsConf := tlsConfig.Clone()
+	tlsConf.NextProtos = []string{doqALPN}
+	conn, err = dialQUIC(ctx, server, tlsConf, &quic.Config{
+		MaxIdleTimeout:  30 * time.Second,
+		KeepAlivePeriod: 15 * time.Second,
+	})
+
+	doqConnsMu.Lock()
+	defer doqConnsMu.Unlock()
+	delete(doqDialing, key)
+	close(done)
+	if err != nil {
+		return nil, false, err
+	}
+	// Keep a live connection stored while we dialed, closing it would
+	// fail the queries already on it
+	if old, ok := doqConns[key]; ok && old != conn {
+		if old.Context().Err() == nil {
+			conn.CloseWithError(0, "")
+			return old, false, nil
+		}
+		old.CloseWithError(0, "")
+	}
+	doqConns[key] = conn
+	return conn, true, nil
+}
+
+// dropDoQConn forgets conn so the next query to server dials afresh.
+func dropDoQConn(server string, tlsConfig *tls.Config, conn quic.Connection) {
+	key := poolKey{addr: server, tlsConfig: tlsConfig}
+
+	doqConnsMu.Lock()
+	if doqConns[key] == conn {
+		delete(doqConns, key)
+	}
+	doqConnsMu.Unlock()
+	conn.CloseWithError(0, "")
+}
+
+func forwardToServerDoQ(ctx context.Context, query []byte, server string, tlsConfig *tls.Config) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, *upstreamTimeout)
+	defer cancel()
+
+	conn, fresh, err := doqConn(ctx, server, tlsConfig)
+	if err != nil {
+		return nil, connectError(ctx, err)
+	}
+
+	resp, err := exchangeDoQ(ctx, conn, query)
+	if err != nil && !fresh {
+		// The cached connection may have gone idle on the server side,
+		// retry once on a new one
+		dropDoQConn(server, tlsConfig, conn)
+		if conn, _, err = doqConn(ctx, server, tlsConfig); err != nil {
+			return nil, connectError(ctx, err)
+		}
+		resp, err = exchangeDoQ(ctx, conn, query)
+	}
+	return resp, err
+}
+
+// exchangeDoQ sends query on a new stream of conn and reads the response.
+// DoQ requires a message ID of 0 on the wire, the caller's ID is restored
+// on the response.
+func exchangeDoQ(ctx context.Context, conn quic.Connection, query []byte) ([]byte, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, unreachable("failed to open stream: %v", err)
+	}
+	defer stream.CancelRead(0)
+	defer bindContext(ctx, stream)()
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg[0:2], uint16(len(query)))
+	copy(msg[2:], query)
+	setMsgID(msg[2:], 0)
+
+	if _, err := stream.Write(msg); err != nil {
+		return nil, unreachable("failed to send DNS query: %v", err)
+	}
+	// Closing the send side tells the server the query is complete
+	if err := stream.Close(); err != nil {
+		return nil, unreachable("failed to send DNS query: %v", err)
+	}
+
+	respLenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(stream, respLenBuf); err != nil {
+		return nil, unreachable("failed to read DNS response length: %v", err)
+	}
+	respLen := int(binary.BigEndian.Uint16(respLenBuf))
+	if respLen < dnsHeaderLen {
+		return nil, malformed("invalid DNS response length: %d", respLen)
+	}
+
+	resp := make([]byte, respLen)
+	if _, err := io.ReadFull(stream, resp); err != nil {
+		return nil, unreachable("failed to read DNS response: %v", err)
+	}
+	if msgID(resp) != 0 {
+		return nil, malformed("response ID %d is not 0", msgID(resp))
+	}
+	if !sameQuestion(query, resp) {
+		return nil, malformed("response question does not match query")
+	}
+	setMsgID(resp, msgID(query))
+	return resp, nil
+}
+
+// resetDoQConns closes every cached DoQ connection.
+func resetDoQConns() {
+	doqConnsMu.Lock()
+	conns := doqConns
+	doqConns = make(map[poolKey]quic.Connection)
+	doqDialing = make(map[poolKey]chan struct{})
+	doqConnsMu.Unlock()
+
+	for _, conn := range conns {
+		conn.CloseWithError(0, "")
+	}
+}
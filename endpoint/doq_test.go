@@ -0,0 +1,194 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+// mockDoQ is a DNS-over-QUIC upstream answering with a function of the
+// query.
+type mockDoQ struct {
+	ln      *quic.Listener
+	conns   atomic.Int32
+	queries atomic.Int32
+	// nonZeroIDs counts queries that arrived with an ID other than 0
+	nonZeroIDs atomic.Int32
+}
+
+// startMockDoQ serves DoQ with mTLS certificates from p until the test
+// ends, one query per stream as RFC 9250 has it.
+func startMockDoQ(t *testing.T, p *testPKI, answer func(query []byte) []byte) *mockDoQ {
+	t.Helper()
+	tlsConfig := p.serverTLS(t)
+	tlsConfig.NextProtos = []string{doqALPN}
+	ln, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	m := &mockDoQ{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			m.conns.Add(1)
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go m.serveStream(stream, answer)
+				}
+			}()
+		}
+	}()
+	return m
+}
+
+func (m *mockDoQ) serveStream(stream quic.Stream, answer func([]byte) []byte) {
+	defer stream.Close()
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return
+	}
+	query := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, query); err != nil {
+		return
+	}
+	m.queries.Add(1)
+	if msgID(query) != 0 {
+		m.nonZeroIDs.Add(1)
+	}
+	resp := answer(query)
+	stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+}
+
+func (m *mockDoQ) addr() string {
+	return m.ln.Addr().String()
+}
+
+func TestForwardToServerDoQ(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	server := startMockDoQ(t, p, answerA(60, [4]byte{10, 0, 0, 9}))
+	tlsConfig := p.clientTLS(t)
+
+	for _, id := range []uint16{100, 101, 102} {
+		resp, err := forwardToServerDoQ(context.Background(), buildTestQuery(id, "doq.example", typeA), server.addr(), tlsConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgID(resp) != id || !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 9)) {
+			t.Fatalf("query %d: answered ID %d with %v", id, msgID(resp), firstA(t, resp))
+		}
+	}
+	if n := server.nonZeroIDs.Load(); n != 0 {
+		t.Errorf("%d queries sent with a non-zero ID", n)
+	}
+	if n := server.conns.Load(); n != 1 {
+		t.Errorf("%d connections for 3 queries, want one with a stream each", n)
+	}
+
+	// A closed connection is dialed again
+	resetDoQConns()
+	if _, err := forwardToServerDoQ(context.Background(), buildTestQuery(5, "doq.example", typeA), server.addr(), tlsConfig); err != nil {
+		t.Fatalf("after the connection closed: %v", err)
+	}
+	if n := server.conns.Load(); n != 2 {
+		t.Errorf("%d connections, want a second after the first closed", n)
+	}
+}
+
+func TestForwardToServerDoQConcurrentDial(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	server := startMockDoQ(t, p, answerA(60, [4]byte{10, 0, 0, 9}))
+	tlsConfig := p.clientTLS(t)
+
+	// Queries racing to an upstream with no connection yet share one dial
+	// instead of closing each other's connections
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := forwardToServerDoQ(context.Background(), buildTestQuery(uint16(i), "doq.example", typeA), server.addr(), tlsConfig)
+			if err == nil && msgID(resp) != uint16(i) {
+				err = fmt.Errorf("query %d answered with ID %d", i, msgID(resp))
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := server.conns.Load(); n != 1 {
+		t.Errorf("%d connections for 16 concurrent first queries, want 1", n)
+	}
+}
+
+func TestForwardToServerDoQErrors(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	query := buildTestQuery(1, "doq.example", typeA)
+
+	withID := startMockDoQ(t, p, func(query []byte) []byte {
+		resp := answerA(60, [4]byte{10, 0, 0, 9})(query)
+		setMsgID(resp, 7)
+		return resp
+	})
+	if _, err := forwardToServerDoQ(context.Background(), query, withID.addr(), p.clientTLS(t)); !errors.Is(err, errMalformed) {
+		t.Errorf("got %v for a response with a non-zero ID, want malformed", err)
+	}
+
+	otherQuestion := startMockDoQ(t, p, func([]byte) []byte {
+		return buildTestAnswer(buildTestQuery(0, "other.example", typeA), 60, [4]byte{10, 0, 0, 9})
+	})
+	if _, err := forwardToServerDoQ(context.Background(), query, otherQuestion.addr(), p.clientTLS(t)); !errors.Is(err, errMalformed) {
+		t.Errorf("got %v for an answer to another question, want malformed", err)
+	}
+
+	answering := startMockDoQ(t, p, answerA(60, [4]byte{10, 0, 0, 9}))
+	noCert := p.clientTLS(t)
+	noCert.Certificates = nil
+	if _, err := forwardToServerDoQ(context.Background(), query, answering.addr(), noCert); err == nil {
+		t.Error("answered without a client certificate")
+	}
+	other := newTestPKI(t).clientTLS(t)
+	if _, err := forwardToServerDoQ(context.Background(), query, answering.addr(), other); !errors.Is(err, errUnreachable) {
+		t.Errorf("got %v for a server from another CA, want unreachable", err)
+	}
+}
+
+func TestResolveQueryOverDoQ(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	server := startMockDoQ(t, p, answerA(60, [4]byte{10, 0, 0, 9}))
+	config := &Config{Server: server.addr(), Transport: "doq", NoPublicDNS: true}
+
+	resp, _, err := resolveQuery(context.Background(), buildTestQuery(3, "doq.example", typeA), config, p.clientTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 9)) || server.queries.Load() != 1 {
+		t.Fatalf("answered %v after %d DoQ queries", firstA(t, resp), server.queries.Load())
+	}
+}
@@ -0,0 +1,238 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// EDNS Client Subnet (RFC 7871) lets the ZeroTrust upstream answer by the
+// client's network. It is off unless --client-subnet is set, is only ever
+// sent to the ZeroTrust servers, never public DNS, and the address is
+// masked to the configured prefix lengths.
+
+const optionClientSubnet = 8
+
+// With -strip-identifying-edns set, the EDNS options a client's resolver
+// could be fingerprinted by are removed from its queries before they are
+// answered or forwarded. An ECS option the endpoint adds itself under
+// -client-subnet is still sent, that takes its own flag to enable.
+const (
+	optionNSID    = 3
+	optionPadding = 12
+)
+
+// identifyingOptions are the option codes -strip-identifying-edns removes.
+var identifyingOptions = []uint16{optionNSID, optionClientSubnet, optionPadding}
+
+// subnetPrefix4 and subnetPrefix6 are the prefix lengths client addresses
+// are masked to, parsed from --client-subnet at startup.
+var subnetPrefix4, subnetPrefix6 int
+
+// parseClientSubnet parses --client-subnet: an IPv4 prefix length,
+// optionally followed by /IPv6 prefix length ("24" or "24/56"). The IPv6
+// length defaults to 56.
+func parseClientSubnet(s string) (v4, v6 int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	v4Str, v6Str, hasV6 := strings.Cut(s, "/")
+	if v4, err = strconv.Atoi(v4Str); err != nil || v4 < 0 || v4 > 32 {
+		return 0, 0, fmt.Errorf("IPv4 prefix length %q not between 0 and 32", v4Str)
+	}
+	v6 = 56
+	if hasV6 {
+		if v6, err = strconv.Atoi(v6Str); err != nil || v6 < 0 || v6 > 128 {
+			return 0, 0, fmt.Errorf("IPv6 prefix length %q not between 0 and 128", v6Str)
+		}
+	}
+	return v4, v6, nil
+}
+
+// clientAddrKey carries the querying client's address in a query's
+// context, for the ECS option.
+type clientAddrKey struct{}
+
+// clientSubnetOption returns the ECS option data to send upstream for a
+// query from addr, or nil if there is none to send. A subnet the client
+// supplied itself is kept, masked no wider than configured; otherwise the
+// client's address is used unless it is loopback, which says nothing about
+// where the client is.
+func clientSubnetOption(query []byte, addr net.Addr) []byte {
+	if *clientSubnet == "" {
+		return nil
+	}
+	if data, ok := ednsOption(query, optionClientSubnet); ok {
+		if len(data) < 4 {
+			return nil
+		}
+		family, prefix := binary.BigEndian.Uint16(data[0:2]), int(data[2])
+		var ip net.IP
+		switch family {
+		case 1:
+			ip = make(net.IP, net.IPv4len)
+		case 2:
+			ip = make(net.IP, net.IPv6len)
+		default:
+			return nil
+		}
+		copy(ip, data[4:])
+		return subnetOption(ip, prefix)
+	}
+
+	ip := addrIP(addr)
+	if ip == nil || ip.IsLoopback() {
+		return nil
+	}
+	return subnetOption(ip, 128)
+}
+
+// subnetOption encodes ip as ECS option data, masked to prefix or the
+// configured length for its family, whichever is shorter.
+func subnetOption(ip net.IP, prefix int) []byte {
+	family := uint16(1)
+	limit := subnetPrefix4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		family, limit = 2, subnetPrefix6
+		ip = ip.To16()
+	}
+	prefix = min(prefix, limit)
+	masked := ip.Mask(net.CIDRMask(prefix, len(ip)*8))
+
+	data := binary.BigEndian.AppendUint16(nil, family)
+	data = append(data, byte(prefix), 0)
+	return append(data, masked[:(prefix+7)/8]...)
+}
+
+// withClientSubnet returns query as it should go to the ZeroTrust
+// upstream, carrying the ECS option for the client in ctx. restore takes
+// back out of the response whatever the client didn't ask for.
+func withClientSubnet(ctx context.Context, query []byte) (out []byte, restore func(response []byte) []byte) {
+	addr, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+	data := clientSubnetOption(query, addr)
+	if data == nil {
+		return query, func(response []byte) []byte { return response }
+	}
+	_, hadOPT := findOPT(query)
+	_, hadECS := ednsOption(query, optionClientSubnet)
+	return setEDNSOption(query, optionClientSubnet, data), func(response []byte) []byte {
+		switch {
+		case !hadOPT:
+			return removeOPT(response)
+		case !hadECS:
+			return setEDNSOption(response, optionClientSubnet, nil)
+		}
+		return response
+	}
+}
+
+// findOPT locates the OPT pseudo-record in msg's additional section.
+func findOPT(msg []byte) (opt resourceRecord, ok bool) {
+	forEachRecord(msg, func(rr resourceRecord) bool {
+		if rr.Section == sectionAdditional && rr.Type == typeOPT {
+			opt, ok = rr, true
+			return false
+		}
+		return true
+	})
+	return opt, ok
+}
+
+// ednsOption returns the data of the first EDNS option with code in msg's
+// OPT record.
+func ednsOption(msg []byte, code uint16) ([]byte, bool) {
+	opt, ok := findOPT(msg)
+	if !ok {
+		return nil, false
+	}
+	rdata := msg[opt.RDataOffset : opt.RDataOffset+opt.RDataLen]
+	for len(rdata) >= 4 {
+		optCode, optLen := binary.BigEndian.Uint16(rdata[0:2]), int(binary.BigEndian.Uint16(rdata[2:4]))
+		if 4+optLen > len(rdata) {
+			break
+		}
+		if optCode == code {
+			return rdata[4 : 4+optLen], true
+		}
+		rdata = rdata[4+optLen:]
+	}
+	return nil, false
+}
+
+// setEDNSOption returns a copy of msg with the EDNS options of code
+// replaced by one holding data, or removed when data is nil. An OPT record
+// is added if msg has none.
+func setEDNSOption(msg []byte, code uint16, data []byte) []byte {
+	opt, ok := findOPT(msg)
+	if !ok {
+		if data == nil {
+			return msg
+		}
+		out := append([]byte(nil), msg...)
+		_, _, _, ar := msgCounts(out)
+		binary.BigEndian.PutUint16(out[10:12], uint16(ar+1))
+		// Root owner, TYPE, 1232 byte payload (RFC 9715), no extended
+		// rcode or flags
+		out = append(out, 0)
+		out = binary.BigEndian.AppendUint16(out, typeOPT)
+		out = binary.BigEndian.AppendUint16(out, 1232)
+		out = binary.BigEndian.AppendUint32(out, 0)
+		out = binary.BigEndian.AppendUint16(out, uint16(4+len(data)))
+		out = binary.BigEndian.AppendUint16(out, code)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(data)))
+		return append(out, data...)
+	}
+
+	var rdata []byte
+	rest := msg[opt.RDataOffset : opt.RDataOffset+opt.RDataLen]
+	for len(rest) >= 4 {
+		optLen := int(binary.BigEndian.Uint16(rest[2:4]))
+		if 4+optLen > len(rest) {
+			break
+		}
+		if binary.BigEndian.Uint16(rest[0:2]) != code {
+			rdata = append(rdata, rest[:4+optLen]...)
+		}
+		rest = rest[4+optLen:]
+	}
+	if data != nil {
+		rdata = binary.BigEndian.AppendUint16(rdata, code)
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(data)))
+		rdata = append(rdata, data...)
+	}
+
+	out := append([]byte(nil), msg[:opt.RDataOffset-2]...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(rdata)))
+	out = append(out, rdata...)
+	return append(out, msg[opt.RDataOffset+opt.RDataLen:]...)
+}
+
+// removeOPT returns a copy of msg without its OPT record.
+func removeOPT(msg []byte) []byte {
+	opt, ok := findOPT(msg)
+	if !ok {
+		return msg
+	}
+	out := append([]byte(nil), msg[:opt.Offset]...)
+	out = append(out, msg[opt.RDataOffset+opt.RDataLen:]...)
+	_, _, _, ar := msgCounts(out)
+	binary.BigEndian.PutUint16(out[10:12], uint16(ar-1))
+	return out
+}
+
+// stripIdentifyingOptions returns query without the EDNS options in
+// identifyingOptions. The OPT record itself stays, the payload size and DO
+// bit say nothing the upstream isn't already told by the endpoint.
+func stripIdentifyingOptions(query []byte) []byte {
+	for _, code := range identifyingOptions {
+		if _, ok := ednsOption(query, code); ok {
+			query = setEDNSOption(query, code, nil)
+		}
+	}
+	return query
+}
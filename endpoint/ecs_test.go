@@ -0,0 +1,207 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// useClientSubnet sets -client-subnet, and the prefix lengths parsed from
+// it at startup, for the rest of the test.
+func useClientSubnet(t *testing.T, s string) {
+	t.Helper()
+	v4, v6, err := parseClientSubnet(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setForTest(t, clientSubnet, s)
+	setForTest(t, &subnetPrefix4, v4)
+	setForTest(t, &subnetPrefix6, v6)
+}
+
+// remoteWriter is a queryWriter for a query from addr.
+type remoteWriter struct {
+	queryWriter
+	addr net.Addr
+}
+
+func (w *remoteWriter) RemoteAddr() net.Addr { return w.addr }
+
+func TestParseClientSubnet(t *testing.T) {
+	for s, want := range map[string][2]int{"": {0, 0}, "24": {24, 56}, "16/48": {16, 48}, "0/0": {0, 0}} {
+		v4, v6, err := parseClientSubnet(s)
+		if err != nil || v4 != want[0] || v6 != want[1] {
+			t.Errorf("%q parsed as %d/%d, %v", s, v4, v6, err)
+		}
+	}
+	for _, s := range []string{"33", "24/129", "x", "24/"} {
+		if _, _, err := parseClientSubnet(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func TestClientSubnetOption(t *testing.T) {
+	query := buildTestQuery(1, "ecs.example", typeA)
+	client := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 77), Port: 5353}
+	if data := clientSubnetOption(query, client); data != nil {
+		t.Fatalf("option %x with -client-subnet unset", data)
+	}
+
+	useClientSubnet(t, "24/56")
+	for name, tc := range map[string]struct {
+		query []byte
+		addr  net.Addr
+		want  []byte
+	}{
+		"IPv4 client": {query: query, addr: client, want: []byte{0, 1, 24, 0, 203, 0, 113}},
+		"IPv6 client": {
+			query: query,
+			addr:  &net.UDPAddr{IP: net.ParseIP("2001:db8:1234:56ff::1")},
+			want:  []byte{0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x34, 0x56},
+		},
+		"loopback": {query: query, addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}},
+		// A subnet the client sent is masked no wider than configured
+		"client /32": {
+			query: setEDNSOption(withTestOPT(query, 1232), optionClientSubnet, []byte{0, 1, 32, 0, 198, 51, 100, 9}),
+			addr:  client,
+			want:  []byte{0, 1, 24, 0, 198, 51, 100},
+		},
+		"client /16": {
+			query: setEDNSOption(withTestOPT(query, 1232), optionClientSubnet, []byte{0, 1, 16, 0, 198, 51}),
+			addr:  client,
+			want:  []byte{0, 1, 16, 0, 198, 51},
+		},
+	} {
+		if data := clientSubnetOption(tc.query, tc.addr); !bytes.Equal(data, tc.want) {
+			t.Errorf("%s: option %x, want %x", name, data, tc.want)
+		}
+	}
+}
+
+func TestClientSubnetForwarded(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	var mu sync.Mutex
+	var upstreamECS, publicECS [][]byte
+	record := func(seen *[][]byte, answer func([]byte) []byte) func([]byte) []byte {
+		return func(query []byte) []byte {
+			data, _ := ednsOption(query, optionClientSubnet)
+			mu.Lock()
+			*seen = append(*seen, data)
+			mu.Unlock()
+			return answer(query)
+		}
+	}
+	upstream := startMockDoT(t, p, 0, record(&upstreamECS, answerA(60, [4]byte{10, 0, 0, 1})))
+	public := startMockPublic(t, record(&publicECS, answerA(60, [4]byte{192, 0, 2, 1})))
+	client := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 77), Port: 5353}
+	query := func(name string, config *Config) []byte {
+		w := &remoteWriter{addr: client}
+		handleDNSQuery(context.Background(), w, buildTestQuery(1, name, typeA), config, p.clientTLS(t))
+		responseCache.Flush()
+		return w.response
+	}
+	seenECS := func(seen *[][]byte) [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(*seen)
+	}
+	toUpstream := &Config{Server: upstream.addr(), NoPublicDNS: true}
+
+	query("off.example", toUpstream)
+	useClientSubnet(t, "24")
+	resp := query("on.example", toUpstream)
+	if seen := seenECS(&upstreamECS); len(seen) != 2 || seen[0] != nil || !bytes.Equal(seen[1], []byte{0, 1, 24, 0, 203, 0, 113}) {
+		t.Fatalf("upstream saw ECS %x, want none then 203.0.113.0/24", seen)
+	}
+	// The client asked without EDNS, so gets no OPT record back
+	if _, ok := findOPT(resp); ok {
+		t.Error("OPT record added to the response")
+	}
+
+	// Public DNS never gets the client's subnet
+	query("public.example", &Config{Type: "service", Server: upstream.addr(), PublicDNS: []string{public.addr}})
+	if seen := seenECS(&publicECS); len(seen) != 1 || seen[0] != nil {
+		t.Fatalf("public DNS saw ECS %x, want none", seen)
+	}
+}
+
+// withIdentifyingOptions returns query with an OPT record carrying NSID,
+// Client Subnet and Padding options and one from the experimental range.
+func withIdentifyingOptions(query []byte) []byte {
+	query = withTestOPT(query, 1232)
+	query = setEDNSOption(query, optionNSID, []byte{})
+	query = setEDNSOption(query, optionClientSubnet, []byte{0, 1, 32, 0, 198, 51, 100, 9})
+	query = setEDNSOption(query, optionPadding, make([]byte, 24))
+	return setEDNSOption(query, 65001, []byte{1, 2})
+}
+
+func TestStripIdentifyingOptions(t *testing.T) {
+	query := stripIdentifyingOptions(withIdentifyingOptions(buildTestQuery(1, "strip.example", typeA)))
+	for _, code := range identifyingOptions {
+		if data, ok := ednsOption(query, code); ok {
+			t.Errorf("option %d left with %x", code, data)
+		}
+	}
+	if data, ok := ednsOption(query, 65001); !ok || !bytes.Equal(data, []byte{1, 2}) {
+		t.Errorf("unrelated option removed, left %x", data)
+	}
+	// The OPT record stays to carry the payload size
+	if _, ok := findOPT(query); !ok {
+		t.Error("OPT record removed")
+	}
+	plain := buildTestQuery(1, "strip.example", typeA)
+	if got := stripIdentifyingOptions(plain); !bytes.Equal(got, plain) {
+		t.Errorf("query without EDNS changed to %x", got)
+	}
+}
+
+func TestStripIdentifyingEDNSForwarded(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	var mu sync.Mutex
+	var seen [][]uint16
+	upstream := startMockDoT(t, p, 0, func(query []byte) []byte {
+		var codes []uint16
+		for _, code := range append(slices.Clone(identifyingOptions), 65001) {
+			if _, ok := ednsOption(query, code); ok {
+				codes = append(codes, code)
+			}
+		}
+		mu.Lock()
+		seen = append(seen, codes)
+		mu.Unlock()
+		return answerA(60, [4]byte{10, 0, 0, 1})(query)
+	})
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+	forward := func(name string) []uint16 {
+		t.Helper()
+		w := &remoteWriter{addr: &net.UDPAddr{IP: net.IPv4(203, 0, 113, 77), Port: 5353}}
+		handleDNSQuery(context.Background(), w, withIdentifyingOptions(buildTestQuery(1, name, typeA)), config, p.clientTLS(t))
+		if w.response == nil {
+			t.Fatalf("%s: no response", name)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return seen[len(seen)-1]
+	}
+
+	// Off by default: the client's options go through
+	setForTest(t, stripEDNS, false)
+	if codes := forward("off.example"); len(codes) != 4 {
+		t.Errorf("upstream saw options %v with the flag unset, want all four", codes)
+	}
+	setForTest(t, stripEDNS, true)
+	if codes := forward("on.example"); !slices.Equal(codes, []uint16{65001}) {
+		t.Errorf("upstream saw options %v, want only 65001", codes)
+	}
+	// A subnet the endpoint was told to send still goes
+	useClientSubnet(t, "24")
+	if codes := forward("subnet.example"); !slices.Equal(codes, []uint16{optionClientSubnet, 65001}) {
+		t.Errorf("upstream saw options %v with -client-subnet, want ECS and 65001", codes)
+	}
+}
@@ -0,0 +1,1684 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+type Config struct {
+	Server string `json:"server"`
+	// Servers lists upstream addresses tried in order, unless weighted by
+	// ServerWeights. When empty, Server is used on its own.
+	Servers []string `json:"servers"`
+	// ServerWeights optionally spreads queries across Servers in proportion
+	// to a weight per address, e.g. {"10.0.0.1:853": 3, "10.0.0.2:853": 1}.
+	// Unlisted servers weigh 1. Without it servers are tried in order.
+	ServerWeights map[string]int `json:"server_weights"`
+	// Proxy is the ZeroTrust proxy/router (host:port) that -proxy-forward
+	// tunnels service traffic through. When set, queries for the ZeroTrust
+	// upstream go through it too, routed to DNSService, rather than
+	// straight to the servers.
+	Proxy string `json:"proxy"`
+	// DNSService is the service name the proxy routes DNS to. Defaults to
+	// "dns".
+	DNSService string `json:"dns_service"`
+	// ServerName is the name upstream certificates are checked against.
+	// When empty it is taken from the servers' host.
+	ServerName string   `json:"server_name"`
+	Type       string   `json:"type"`
+	Domains    []string `json:"domains"`
+	// DomainUpstreams routes names under a domain suffix to a specific
+	// upstream instead of the servers above, e.g. {"corp.internal":
+	// "10.0.0.53:853"}. The longest matching suffix wins. Mapped upstreams
+	// use the configured transport and mTLS settings.
+	DomainUpstreams map[string]string `json:"domain_upstreams"`
+	// PublicDNS lists the resolvers (host or host:port) used for names that
+	// don't go to the ZeroTrust server. Defaults to 1.1.1.1.
+	PublicDNS []string `json:"public_dns"`
+	// NoPublicDNS sends every query to the ZeroTrust servers, overriding
+	// the service type and the domain split.
+	NoPublicDNS bool `json:"no_public_dns"`
+	// ServerFingerprint optionally pins the upstream leaf certificate by
+	// its SHA-256 digest, hex encoded (colons allowed).
+	ServerFingerprint string `json:"server_fingerprint"`
+	// Transport selects the upstream protocol: "dot" (DNS over TLS, the
+	// default), "doh" (DNS over HTTPS, servers given as host:port or URL)
+	// or "doq" (DNS over QUIC, servers given as host:port).
+	Transport string `json:"transport"`
+	// Expires is an RFC 3339 timestamp (e.g. "2028-12-31T23:59:59Z") after
+	// which the endpoint must stop resolving. Empty means no expiry.
+	Expires string `json:"expires"`
+	// UpstreamTLS overrides the TLS settings of single upstreams, keyed by
+	// the address as listed in servers, domain_upstreams or proxy, e.g.
+	// {"10.0.0.2:853": {"server_name": "dns2.corp.internal"}}.
+	UpstreamTLS map[string]UpstreamTLS `json:"upstream_tls"`
+	// Listen optionally lists the host:port addresses to serve DNS on when
+	// -listen isn't given. A reload that changes it moves the listeners.
+	Listen []string `json:"listen"`
+
+	expiresAt time.Time
+	// expiredOnce reports the expiry once rather than for every dropped query
+	expiredOnce sync.Once
+}
+
+// upstreams returns the upstream servers in the order they should be tried.
+func (c *Config) upstreams() []string {
+	if len(c.Servers) > 0 {
+		return c.Servers
+	}
+	return []string{c.Server}
+}
+
+// allUpstreams returns every server the config may send queries to, the
+// domain_upstreams as well as the default ones.
+func (c *Config) allUpstreams() []string {
+	servers := slices.Clone(c.upstreams())
+	for _, server := range c.DomainUpstreams {
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// upstreamOverride returns the upstream mapped to the longest
+// domain_upstreams suffix that qname equals or is a subdomain of.
+func (c *Config) upstreamOverride(qname string) (string, bool) {
+	qname = strings.ToLower(strings.TrimSuffix(qname, "."))
+	var server, match string
+	for suffix, upstream := range c.DomainUpstreams {
+		suffix = strings.ToLower(strings.Trim(suffix, "."))
+		if suffix == "" || len(suffix) <= len(match) {
+			continue
+		}
+		if qname == suffix || strings.HasSuffix(qname, "."+suffix) {
+			server, match = upstream, suffix
+		}
+	}
+	return server, server != ""
+}
+
+// tlsServerName returns the name upstream certificates are verified
+// against: server_name, or else the host shared by every upstream without
+// a server_name of its own in upstream_tls. When the upstreams have
+// different hosts it is empty and each connection checks the host it
+// dials. An upstream with no host at all is an error, there
+// would be nothing to check its certificate against.
+func (c *Config) tlsServerName() (string, error) {
+	if c.ServerName != "" {
+		return c.ServerName, nil
+	}
+	var name string
+	shared := true
+	for _, server := range c.allUpstreams() {
+		if c.UpstreamTLS[server].ServerName != "" {
+			// Checked against its own name, see setupServerTLSConfigs
+			continue
+		}
+		host := upstreamHost(server)
+		if host == "" {
+			return "", fmt.Errorf("upstream %q has no host to verify its certificate against, set server_name", server)
+		}
+		if name == "" {
+			name = host
+		} else if !strings.EqualFold(host, name) {
+			shared = false
+		}
+	}
+	if !shared {
+		return "", nil
+	}
+	return name, nil
+}
+
+// upstreamHost returns the host part of an upstream given as host:port,
+// a bare host or a DoH URL.
+func upstreamHost(server string) string {
+	if u, err := url.Parse(server); err == nil && u.Scheme == "https" {
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		return host
+	}
+	return strings.Trim(server, "[]")
+}
+
+// IsExpired reports whether the provisioned config is no longer valid at now.
+func (c *Config) IsExpired(now time.Time) bool {
+	return !c.expiresAt.IsZero() && !now.Before(c.expiresAt)
+}
+
+var (
+	configPath       = flag.String("config-path", "config.zt", "path to the signed endpoint config, or - for stdin; $ZT_CONFIG is used when not given")
+	caPath           = flag.String("ca-path", "ca.crt", "path to the ZeroTrust CA certificate, or - for stdin; $ZT_CA is used when not given")
+	extraCAPath      = flag.String("extra-ca-path", "", "additional CA certificates trusted alongside -ca-path, e.g. the new CA during a rotation")
+	certPath         = flag.String("cert-path", "endpoint.crt", "path to the endpoint client certificate")
+	keyPath          = flag.String("key-path", "endpoint.key", "path to the endpoint client private key")
+	pkcs12Path       = flag.String("p12-path", "", "PKCS#12 (.p12/.pfx) bundle holding the client certificate and key, used instead of -cert-path and -key-path")
+	pkcs12Password   = flag.String("p12-password", "", "password of the -p12-path bundle, better given as $ZT_P12_PASSWORD")
+	upstreamCertDir  = flag.String("upstream-cert-dir", "", "directory of per-upstream client keypairs, <host>.crt and <host>.key, presented instead of the default one to upstreams on that host")
+	clockSkew        = flag.Duration("clock-skew", 30*time.Second, "tolerance for clock drift when checking token exp/nbf claims")
+	expectedAudience = flag.String("audience", "", "reject tokens whose aud claim doesn't include this value")
+	expectedSubject  = flag.String("subject", "", "reject tokens whose sub claim isn't this value, e.g. the endpoint ID")
+	logLevel         = flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	logFormat        = flag.String("log-format", "text", "log output format: text or json")
+	publicDNS        = flag.String("public-dns", "", "comma-separated public resolvers to use instead of the provisioned list")
+	noPublicDNS      = flag.Bool("no-public-dns", false, "never query public DNS, send every query to the ZeroTrust upstream")
+	clientQPS        = flag.Float64("client-qps", 0, "queries per second each client IP may send before being REFUSED (0 disables)")
+	clientBurst      = flag.Int("client-burst", 0, "queries a client IP may send at once under -client-qps (0 means the QPS rounded down, at least 1)")
+	nonRecursive     = flag.String("non-recursive", "cache", "how to answer queries with RD clear: cache (from the cache only, REFUSED on a miss) or refuse")
+	maxInflight      = flag.Int("max-inflight", 256, "maximum number of queries resolved concurrently")
+	queryLogPath     = flag.String("query-log", "", "file to append a JSONL audit log of queries to (disabled when empty)")
+	queryLogSize     = flag.Int64("query-log-max-size", 100, "size in MB at which the query log is rotated to <file>.1")
+	capturePath      = flag.String("capture", "", "file to append every query and response to in pcap format, for debugging; holds full query contents (disabled when empty)")
+	stripEDNS        = flag.Bool("strip-identifying-edns", false, "remove NSID, Client Subnet and Padding options from client queries before forwarding them, so upstreams can't fingerprint clients by them")
+	dnsCookies       = flag.Bool("dns-cookies", false, "send DNS Cookies (RFC 7873) to public resolvers and discard answers whose cookie doesn't check out")
+	publicTimeout    = flag.Duration("public-timeout", 2*time.Second, "how long to wait for each public resolver")
+	upstreamTimeout  = flag.Duration("upstream-timeout", 5*time.Second, "how long to wait for each ZeroTrust upstream")
+	queryTimeout     = flag.Duration("query-timeout", 10*time.Second, "overall time to answer a query before replying SERVFAIL")
+	tlsMinVersion    = flag.String("tls-min-version", "1.3", "lowest TLS version accepted from ZeroTrust upstreams: 1.3, or 1.2 for older servers")
+	dotALPN          = flag.String("dot-alpn", "dot", "ALPN protocol offered to DNS-over-TLS upstreams (empty offers none)")
+	ocspMode         = flag.String("ocsp", "off", "check the upstream certificate's stapled OCSP status: off, staple (reject if revoked) or require (also reject if none is stapled)")
+	hostsPath        = flag.String("hosts", "", "hosts-format file of names answered with the listed addresses, without asking any upstream (disabled when empty)")
+	denylistPath     = flag.String("denylist", "", "file of domains to block at the endpoint, one per line or hosts format")
+	allowlistPath    = flag.String("allowlist", "", "file of domains never blocked, even when on the denylist")
+	sinkholeAddr     = flag.String("sinkhole", "", "answer blocked A/AAAA queries with this address instead of NXDOMAIN")
+	privatePTR       = flag.String("private-ptr", "nxdomain", "reverse lookups of private addresses: nxdomain (answer locally) or upstream (send to the ZeroTrust upstream, never public DNS)")
+	localZonesList   = flag.String("local-zones", "", "comma-separated zones answered NXDOMAIN instead of forwarded; empty for .local and link-local reverse zones, none for no others (private reverse zones follow -private-ptr)")
+	clientSubnet     = flag.String("client-subnet", "", "send the client's subnet to the ZeroTrust upstream as EDNS Client Subnet, masked to this IPv4[/IPv6] prefix length, e.g. 24/56 (disabled when empty)")
+	cacheFile        = flag.String("cache-file", "", "file the cache is saved to on shutdown and reloaded from on startup (disabled when empty)")
+	minTTL           = flag.Duration("min-ttl", 0, "raise record TTLs in upstream answers to at least this, also for caching them (0 leaves them)")
+	maxTTL           = flag.Duration("max-ttl", 0, "lower record TTLs in upstream answers to at most this, also for caching them (0 leaves them)")
+	serveStale       = flag.Duration("serve-stale", 0, "keep expired cache entries this long and answer with them when the upstreams fail, instead of SERVFAIL (0 disables)")
+	prefetchHits     = flag.Int("prefetch-hits", 0, "refresh cache entries served at least this many times once under 10% of their TTL is left (0 disables)")
+	flattenCNAMEs    = flag.Bool("flatten-cname", false, "answer A/AAAA queries that resolve through a CNAME chain with the final addresses only, owned by the queried name")
+	raceService      = flag.Bool("race-service", false, "for service endpoints, query public DNS and the upstream at once and use the first answer")
+	upstreamIdle     = flag.Duration("upstream-idle-timeout", 30*time.Second, "close pooled upstream connections idle for this long (0 keeps them open)")
+	probeInterval    = flag.Duration("probe-interval", 0, "send every upstream a root SOA query this often and skip those failing it while another is healthy (0 disables)")
+	breakerThreshold = flag.Int("breaker-threshold", 5, "consecutive failures after which an upstream is skipped for a cooldown (0 disables)")
+	breakerCooldown  = flag.Duration("breaker-cooldown", time.Second, "first cooldown of a tripped upstream, doubled on each failed probe up to 1m")
+	listenAddr       = flag.String("listen", "", "comma-separated host:port addresses to serve DNS on, instead of the config's listen; when neither is set 127.0.0.1:53 is tried, then 5353")
+	dohListen        = flag.String("doh-listen", "", "address to also serve DNS-over-HTTPS on at /dns-query, for browsers, e.g. 127.0.0.1:8443 (disabled when empty)")
+	dohCert          = flag.String("doh-cert", "", "certificate file presented by -doh-listen (a self-signed one for localhost is generated when empty)")
+	dohKey           = flag.String("doh-key", "", "key file for -doh-cert")
+	udpReadBuffer    = flag.Int("udp-read-buffer", 0, "bytes of kernel receive buffer to request on DNS UDP sockets, to ride out query bursts (0 keeps the OS default)")
+	udpWriteBuffer   = flag.Int("udp-write-buffer", 0, "bytes of kernel send buffer to request on DNS UDP sockets (0 keeps the OS default)")
+	showVersion      = flag.Bool("version", false, "print the version and exit")
+	queryName        = flag.String("query", "", "resolve this name once as a client query would be, print the answer like dig and exit; a type such as AAAA may follow as an argument")
+	checkOnly        = flag.Bool("check", false, "validate the config, CA and keypair, handshake with the upstream, print a summary and exit")
+	healthAddr       = flag.String("health-addr", "", "address to serve /healthz and /readyz on, e.g. 127.0.0.1:9354 (disabled when empty)")
+	readyWindow      = flag.Duration("ready-window", 60*time.Second, "how long /readyz stays ready after the last successful upstream query once queries fail")
+	metricsAddr      = flag.String("metrics-addr", "", "address to serve Prometheus metrics on, e.g. 127.0.0.1:9353 (disabled when empty)")
+	sourceAddr       = flag.String("source-addr", "", "local IP address to send upstream and public DNS traffic from, on multi-homed hosts")
+	proxyForwards    = flag.String("proxy-forward", "", "comma-separated listen=service pairs of local TCP ports tunnelled through the provisioned proxy, e.g. 127.0.0.1:5432=db.internal.corp")
+	controlSocket    = flag.String("control-socket", "", "unix socket to answer local commands such as stats on, e.g. /run/ztdns.sock (disabled when empty)")
+)
+
+type JWTClaims struct {
+	Data string `json:"data"`
+	jwt.RegisteredClaims
+}
+
+// filePaths locates the provisioning bundle: the signed config, the CA and
+// the endpoint's client keypair, either as PEM files or a PKCS#12 bundle.
+type filePaths struct {
+	Config string
+	CA     string
+	// ExtraCA optionally names a second CA file trusted alongside CA
+	ExtraCA string
+	Cert    string
+	Key     string
+	PKCS12  string
+}
+
+// flagPaths returns the bundle locations from the command line. The
+// config and CA fall back to the ZT_CONFIG and ZT_CA environment variables
+// when their flag isn't given, then to the file names in the working
+// directory.
+func flagPaths() filePaths {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	paths := filePaths{
+		Config:  *configPath,
+		CA:      *caPath,
+		ExtraCA: *extraCAPath,
+		Cert:    *certPath,
+		Key:     *keyPath,
+		PKCS12:  *pkcs12Path,
+	}
+	if !set["config-path"] && os.Getenv("ZT_CONFIG") != "" {
+		paths.Config = envSourcePrefix + "ZT_CONFIG"
+	}
+	if !set["ca-path"] && os.Getenv("ZT_CA") != "" {
+		paths.CA = envSourcePrefix + "ZT_CA"
+	}
+	return paths
+}
+
+// envSourcePrefix marks a bundle path naming an environment variable that
+// holds the contents, e.g. "env:ZT_CONFIG". A path of "-" reads stdin.
+const envSourcePrefix = "env:"
+
+var (
+	stdinOnce sync.Once
+	stdinData []byte
+	stdinErr  error
+)
+
+// readSource returns the contents of a bundle path: a file, an environment
+// variable or stdin. Stdin is read once and replayed on reload.
+func readSource(path string) ([]byte, error) {
+	if path == "-" {
+		stdinOnce.Do(func() { stdinData, stdinErr = io.ReadAll(os.Stdin) })
+		return stdinData, stdinErr
+	}
+	if name, ok := strings.CutPrefix(path, envSourcePrefix); ok {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return []byte(value), nil
+	}
+	return os.ReadFile(path)
+}
+
+// caBundle is the ZeroTrust CA, parsed once and shared by token
+// verification and TLS so both always trust the same certificates. It may
+// hold several independent roots, e.g. old and new CA during a key
+// rotation, and a token or server under any of them is accepted.
+type caBundle struct {
+	Pool  *x509.CertPool
+	Certs []*x509.Certificate
+}
+
+// loadCA reads the CA certificates from each of paths, skipping empty
+// ones.
+func loadCA(paths ...string) (*caBundle, error) {
+	var certs []*x509.Certificate
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		caPEM, err := readSource(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		parsed, err := parseCACertificates(caPEM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA certificate %s: %v", path, err)
+		}
+		certs = append(certs, parsed...)
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return &caBundle{Pool: pool, Certs: certs}, nil
+}
+
+// parseCACertificates accepts the CA as a single raw DER certificate or as
+// one or more PEM CERTIFICATE blocks.
+func parseCACertificates(data []byte) ([]*x509.Certificate, error) {
+	if cert, err := x509.ParseCertificate(data); err == nil {
+		return []*x509.Certificate{cert}, nil
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("neither DER nor PEM encoded")
+	}
+	return certs, nil
+}
+
+func loadConfig(paths filePaths, ca *caBundle) (*Config, error) {
+	// Read JWT token
+	ztToken, err := readSource(paths.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", paths.Config, err)
+	}
+	// Tokens pasted into an environment variable or piped in usually
+	// carry a trailing newline
+	ztToken = bytes.TrimSpace(ztToken)
+
+	// Parse and verify JWT
+	token, err := jwt.ParseWithClaims(string(ztToken), &JWTClaims{}, tokenKeyFunc(ca.Certs),
+		jwt.WithValidMethods(tokenSigningMethods), jwt.WithoutClaimsValidation())
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JWT: %v", err)
+	}
+
+	claims, ok := token.Claims.(*JWTClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	// Time claims are checked here rather than by the jwt library so the
+	// error says why the token was refused
+	if err := validateTokenTimes(claims, time.Now(), *clockSkew); err != nil {
+		return nil, err
+	}
+	if err := validateTokenIdentity(claims, *expectedAudience, *expectedSubject); err != nil {
+		return nil, err
+	}
+
+	// Parse config from JWT data
+	var config Config
+	if err := json.Unmarshal([]byte(claims.Data), &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %v", err)
+	}
+
+	if err := config.validateServerWeights(); err != nil {
+		return nil, err
+	}
+
+	if config.Expires != "" {
+		config.expiresAt, err = time.Parse(time.RFC3339, config.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires timestamp %q: %v", config.Expires, err)
+		}
+		if config.IsExpired(time.Now()) {
+			return nil, fmt.Errorf("config expired at %s", config.expiresAt.Format(time.RFC3339))
+		}
+	}
+
+	return &config, nil
+}
+
+// tokenSigningMethods are the JWT algorithms accepted for provisioning
+// tokens. Anything else, including "none" and HMAC, is refused.
+var tokenSigningMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384"}
+
+// tokenKeyFunc returns the CA public keys for verifying a token. Only keys
+// whose type matches the token's algorithm family are offered, and the
+// token is accepted if any of them verifies it.
+func tokenKeyFunc(caCerts []*x509.Certificate) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		var keys jwt.VerificationKeySet
+		for _, caCert := range caCerts {
+			switch token.Method.(type) {
+			case *jwt.SigningMethodRSA:
+				if key, ok := caCert.PublicKey.(*rsa.PublicKey); ok {
+					keys.Keys = append(keys.Keys, key)
+				}
+			case *jwt.SigningMethodECDSA:
+				if key, ok := caCert.PublicKey.(*ecdsa.PublicKey); ok {
+					keys.Keys = append(keys.Keys, key)
+				}
+			default:
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+		}
+		if len(keys.Keys) == 0 {
+			return nil, fmt.Errorf("signing method %v does not match any CA key type", token.Header["alg"])
+		}
+		return keys, nil
+	}
+}
+
+// validateTokenTimes checks the exp and nbf claims against now, allowing
+// skew either way for clock drift between the endpoint and the CA.
+func validateTokenTimes(claims *JWTClaims, now time.Time, skew time.Duration) error {
+	if claims.ExpiresAt != nil && now.After(claims.ExpiresAt.Add(skew)) {
+		return fmt.Errorf("token expired at %s", claims.ExpiresAt.Format(time.RFC3339))
+	}
+	if claims.NotBefore != nil && now.Add(skew).Before(claims.NotBefore.Time) {
+		return fmt.Errorf("token not valid until %s", claims.NotBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// validateTokenIdentity ties a token to this endpoint: its aud claim must
+// include audience and its sub claim must equal subject, so a token minted
+// for another tenant or endpoint is refused even though the CA signed it.
+func validateTokenIdentity(claims *JWTClaims, audience, subject string) error {
+	if audience != "" && !slices.Contains(claims.Audience, audience) {
+		if len(claims.Audience) == 0 {
+			return fmt.Errorf("token has no audience, expected %q", audience)
+		}
+		return fmt.Errorf("token audience %q does not include %q", []string(claims.Audience), audience)
+	}
+	if subject != "" && claims.Subject != subject {
+		if claims.Subject == "" {
+			return fmt.Errorf("token has no subject, expected %q", subject)
+		}
+		return fmt.Errorf("token subject %q does not match %q", claims.Subject, subject)
+	}
+	return nil
+}
+
+// parseTLSVersion parses -tls-min-version. Versions below 1.2 are refused,
+// they are deprecated (RFC 8996) and no ZeroTrust server needs them.
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.3":
+		return tls.VersionTLS13, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	}
+	return 0, fmt.Errorf("invalid -tls-min-version %q, want 1.2 or 1.3", s)
+}
+
+// tlsSessionCacheSize bounds the resumption tickets kept, roughly one per
+// upstream server and transport.
+const tlsSessionCacheSize = 64
+
+func setupTLS(config *Config, paths filePaths, ca *caBundle) (*tls.Config, error) {
+	// Load client certificate, re-read whenever the files are rotated
+	var keypair *keypairLoader
+	var err error
+	if paths.PKCS12 != "" {
+		keypair, err = newPKCS12Loader(paths.PKCS12, *pkcs12Password)
+	} else {
+		keypair, err = newKeypairLoader(paths.Cert, paths.Key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serverName, err := config.tlsServerName()
+	if err != nil {
+		return nil, err
+	}
+	minVersion, err := parseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetClientCertificate: keypair.GetClientCertificate,
+		RootCAs:              ca.Pool,
+		ServerName:           serverName,
+		MinVersion:           minVersion,
+		// Resume sessions on reconnect instead of a full handshake. Clones
+		// made for DoH and DoQ share the cache.
+		ClientSessionCache: tls.NewLRUClientSessionCache(tlsSessionCacheSize),
+	}
+
+	// Extra checks run after normal chain verification, so they only
+	// narrow what the CA already vouches for. Unlike VerifyPeerCertificate,
+	// VerifyConnection also runs on resumed sessions.
+	var checks []func(tls.ConnectionState) error
+
+	if config.ServerFingerprint != "" {
+		pin, err := parseFingerprint(config.ServerFingerprint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server_fingerprint: %v", err)
+		}
+		// Pinning narrows trust from "any cert the CA issued" to exactly
+		// this one
+		checks = append(checks, func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			if sum := sha256.Sum256(cs.PeerCertificates[0].Raw); !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("server certificate fingerprint %x does not match pinned fingerprint", sum)
+			}
+			return nil
+		})
+	}
+
+	switch *ocspMode {
+	case "off":
+	case "staple", "require":
+		required := *ocspMode == "require"
+		checks = append(checks, func(cs tls.ConnectionState) error {
+			return checkStapledOCSP(cs, required, time.Now())
+		})
+	default:
+		return nil, fmt.Errorf("invalid -ocsp mode %q, want off, staple or require", *ocspMode)
+	}
+
+	if len(checks) > 0 {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, check := range checks {
+				if err := check(cs); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	if err := setupServerTLSConfigs(*upstreamCertDir, config, tlsConfig); err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+// parseFingerprint decodes a hex SHA-256 fingerprint, accepting the
+// colon-separated form printed by openssl.
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	pin, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(pin) != sha256.Size {
+		return nil, fmt.Errorf("expected %d bytes, got %d", sha256.Size, len(pin))
+	}
+	return pin, nil
+}
+
+// maxUDPSize is the largest DNS message the endpoint sends or receives over
+// UDP, matching the 4096 byte cap on the upstream TLS path.
+const maxUDPSize = 4096
+
+// querySlots bounds how many queries are being resolved at once, sized by
+// --max-inflight when first needed.
+var (
+	querySlots     chan struct{}
+	querySlotsOnce sync.Once
+)
+
+func initQuerySlots() {
+	querySlotsOnce.Do(func() { querySlots = make(chan struct{}, *maxInflight) })
+}
+
+// tcpIdleTimeout bounds how long a client TCP connection may sit idle
+// between queries before the endpoint closes it.
+const tcpIdleTimeout = 10 * time.Second
+
+// responseWriter sends a DNS response back over the transport the query
+// arrived on. Implementations capture the response as it goes out, after
+// any truncation, when -capture is set.
+type responseWriter interface {
+	WriteResponse(resp []byte) error
+	RemoteAddr() net.Addr
+}
+
+type udpResponseWriter struct {
+	conn       *net.UDPConn
+	clientAddr *net.UDPAddr
+	// maxSize is the largest response the client accepts over UDP
+	maxSize int
+}
+
+func (w *udpResponseWriter) WriteResponse(resp []byte) error {
+	if len(resp) > w.maxSize {
+		resp = truncateResponse(resp)
+	}
+	// Captured as sent, so a truncated response shows with TC set
+	captureMessage(w.clientAddr, resp, true)
+	n, err := w.conn.WriteToUDP(resp, w.clientAddr)
+	if err == nil && n < len(resp) {
+		err = fmt.Errorf("short write of %d of %d bytes", n, len(resp))
+	}
+	return err
+}
+
+func (w *udpResponseWriter) RemoteAddr() net.Addr {
+	return w.clientAddr
+}
+
+type tcpResponseWriter struct {
+	conn net.Conn
+}
+
+func (w *tcpResponseWriter) WriteResponse(resp []byte) error {
+	if len(resp) > 0xffff {
+		return fmt.Errorf("response of %d bytes too long for TCP", len(resp))
+	}
+	captureMessage(w.conn.RemoteAddr(), resp, true)
+	// DNS over TCP uses a 2-byte length prefix (RFC 1035 4.2.2). Prefix
+	// and message go out in one write, which only returns short with an
+	// error.
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(resp)), uint16(len(resp)))
+	_, err := w.conn.Write(append(msg, resp...))
+	return err
+}
+
+func (w *tcpResponseWriter) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+func startLocalDNS() {
+	config := currentState().config
+	spec := listenSpecFor(config)
+	bound, err := bindListeners(spec)
+	if err != nil {
+		fatal("Failed to bind DNS listeners", "error", err)
+	}
+	if err := checkResolverLoop(config, listenerAddrs(bound)); err != nil {
+		fatal("Refusing to start, queries would loop back to this endpoint", "error", err)
+	}
+	swapListeners(spec, bound)
+	logStartup(slog.Default(), config, listenerAddrs(bound), time.Now())
+
+	// The listeners are served in the background until a signal ends the
+	// process, see watchShutdown
+	select {}
+}
+
+// listenDNS binds UDP on ip:port and, best effort, TCP on the same address
+// so clients can retry truncated answers.
+func listenDNS(ip net.IP, port int) (*dnsListener, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	setUDPBuffers(conn, *udpReadBuffer, *udpWriteBuffer)
+	l := &dnsListener{udp: conn}
+
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+	if err != nil {
+		slog.Warn("Could not bind TCP port, serving UDP only", "addr", conn.LocalAddr().String(), "error", err)
+	} else {
+		l.tcp = tcpListener
+	}
+
+	slog.Info("Local DNS listening", "addr", conn.LocalAddr().String())
+	return l, nil
+}
+
+// serveUDP answers the queries arriving on conn until it is closed, each
+// with the state state returns when it arrives and bounded by ctx.
+func serveUDP(ctx context.Context, conn *net.UDPConn, state func() *endpointState) {
+	buffer := make([]byte, maxUDPSize)
+	for {
+		n, clientAddr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("Error reading from UDP", "error", err)
+			continue
+		}
+
+		w := &udpResponseWriter{
+			conn:       conn,
+			clientAddr: clientAddr,
+			maxSize:    min(ednsPayloadSize(buffer[:n]), maxUDPSize),
+		}
+		// Shed load rather than queue unboundedly; the client will retry
+		select {
+		case querySlots <- struct{}{}:
+		default:
+			droppedQueries.WithLabelValues("overload").Inc()
+			continue
+		}
+
+		// buffer is reused by the next read, the handler needs its own copy
+		query := make([]byte, n)
+		copy(query, buffer[:n])
+
+		s := state()
+		go func() {
+			defer func() { <-querySlots }()
+			handleDNSQuery(ctx, w, query, s.config, s.tlsConfig)
+		}()
+	}
+}
+
+// serveTCP is serveUDP for the connections accepted on listener.
+func serveTCP(ctx context.Context, listener *net.TCPListener, state func() *endpointState) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("Error accepting TCP connection", "error", err)
+			continue
+		}
+
+		go handleTCPConn(ctx, conn, state)
+	}
+}
+
+func handleTCPConn(ctx context.Context, conn net.Conn, state func() *endpointState) {
+	defer conn.Close()
+
+	w := &tcpResponseWriter{conn: conn}
+	lengthBuf := make([]byte, 2)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+
+		if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+			return
+		}
+
+		length := int(lengthBuf[0])<<8 | int(lengthBuf[1])
+		if length == 0 {
+			droppedQueries.WithLabelValues("malformed").Inc()
+			return
+		}
+
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		// TCP clients wait for a free slot, which pushes back on the sender
+		querySlots <- struct{}{}
+		s := state()
+		handleDNSQuery(ctx, w, query, s.config, s.tlsConfig)
+		<-querySlots
+	}
+}
+
+// handleDNSQuery answers query on w under config. Upstream exchanges are
+// bounded by ctx as well as -query-timeout.
+func handleDNSQuery(ctx context.Context, w responseWriter, query []byte, config *Config, tlsConfig *tls.Config) {
+	queriesTotal.Inc()
+	start := time.Now()
+	captureMessage(w.RemoteAddr(), query, false)
+
+	if config.IsExpired(start) {
+		config.reportExpired()
+		return
+	}
+
+	client := w.RemoteAddr().String()
+	logger := slog.With("client", client)
+	// Garbage is dropped rather than forwarded; a response sent to us may
+	// be a reflection attempt and answering it would only feed that
+	qname, qtype, qclass, err := parseQuestion(query)
+	if err == nil && msgFlags(query)&flagQR != 0 {
+		err = fmt.Errorf("message is a response")
+	}
+	if err != nil {
+		logger.Debug("Dropping malformed query", "length", len(query), "error", err)
+		droppedQueries.WithLabelValues("malformed").Inc()
+		return
+	}
+	logger = logger.With("name", qname, "type", typeString(qtype))
+
+	if isOwnQuery(w.RemoteAddr()) {
+		// Answering would only send it round again
+		logger.Error("Resolver loop: received a query the endpoint sent upstream, check public_dns and servers")
+		droppedQueries.WithLabelValues("loop").Inc()
+		writeResponse(w, logger, errorResponse(query, rcodeRefused))
+		return
+	}
+	if ip := addrIP(w.RemoteAddr()); ip != nil && clientRateLimit != nil && !clientRateLimit.allow(ip, start) {
+		logger.Debug("Refusing query over the client rate limit")
+		droppedQueries.WithLabelValues("ratelimit").Inc()
+		writeResponse(w, logger, errorResponse(query, rcodeRefused))
+		return
+	}
+
+	// Answer the conventional version probes ourselves so operators can
+	// tell which build is running: dig CH TXT version.bind
+	if qclass == classCH && qtype == typeTXT && (qname == "version.bind" || qname == "version.server") {
+		response := txtResponse(query, classCH, "ZeroTrust DNS endpoint "+versionString(), 0)
+		logger.Debug("Query answered", "path", pathLocal, "latency", time.Since(start))
+		logQuery(client, qname, qtype, pathLocal, response)
+		writeResponse(w, logger, response)
+		return
+	}
+
+	if hosts := activeHosts.Load(); hosts != nil && qclass == classIN {
+		if ips, ok := hosts.lookup(qname); ok {
+			response := hosts.response(query, qtype, ips)
+			logger.Debug("Query answered", "path", pathHosts, "latency", time.Since(start))
+			logQuery(client, qname, qtype, pathHosts, response)
+			writeResponse(w, logger, response)
+			return
+		}
+	}
+
+	if filter := activeFilter.Load(); filter != nil && filter.blocks(qname) {
+		blockedQueries.Inc()
+		response := filter.response(query, qtype)
+		logger.Debug("Query answered", "path", pathBlocked, "latency", time.Since(start))
+		logQuery(client, qname, qtype, pathBlocked, response)
+		writeResponse(w, logger, response)
+		return
+	}
+
+	if isLocalZone(qname, config) {
+		response := negativeResponse(query, rcodeNXDomain, localZoneApex(qname), localZoneTTL)
+		logger.Debug("Query answered", "path", pathLocal, "latency", time.Since(start))
+		logQuery(client, qname, qtype, pathLocal, response)
+		writeResponse(w, logger, response)
+		return
+	}
+
+	// Only recursive queries are forwarded; RD clear asks what the
+	// endpoint already knows
+	recursive := msgFlags(query)&flagRD != 0
+	if !recursive && *nonRecursive == "refuse" {
+		logger.Debug("Refusing non-recursive query")
+		writeResponse(w, logger, errorResponse(query, rcodeRefused))
+		return
+	}
+
+	if *stripEDNS {
+		query = stripIdentifyingOptions(query)
+	}
+	key, keyErr := cacheKey(query)
+	if subnet := clientSubnetOption(query, w.RemoteAddr()); subnet != nil {
+		// The upstream may answer each subnet differently
+		key += string(subnet)
+	}
+	if keyErr == nil {
+		if response := responseCache.Get(key, query, start); response != nil {
+			cacheLookups.WithLabelValues("hit").Inc()
+			logger.Debug("Query answered", "path", pathCache, "latency", time.Since(start))
+			logQuery(client, qname, qtype, pathCache, response)
+			writeResponse(w, logger, response)
+			if recursive && *prefetchHits > 0 && responseCache.claimPrefetch(key, start, *prefetchHits) {
+				go prefetchQuery(bytes.Clone(query), key, w.RemoteAddr(), config, tlsConfig)
+			}
+			return
+		}
+		cacheLookups.WithLabelValues("miss").Inc()
+	}
+	if !recursive {
+		logger.Debug("Refusing non-recursive query not in the cache")
+		writeResponse(w, logger, errorResponse(query, rcodeRefused))
+		return
+	}
+
+	// Every upstream exchange is bounded by this, so a slow upstream
+	// can't hold the query (and its slot) past the deadline or shutdown
+	ctx, cancel := context.WithTimeout(ctx, *queryTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, clientAddrKey{}, w.RemoteAddr())
+	var response []byte
+	var path string
+	if keyErr == nil {
+		response, path, err = resolveShared(ctx, key, query, config, tlsConfig)
+	} else {
+		response, path, err = resolveQuery(ctx, query, config, tlsConfig)
+		response = relayResponse(response)
+	}
+	if keyErr == nil && *serveStale > 0 && (response == nil || msgRcode(response) == rcodeServFail) {
+		if stale := responseCache.GetStale(key, query, time.Now()); stale != nil {
+			logger.Warn("Query answered from stale cache, upstream failed", "error", err, "latency", time.Since(start))
+			staleAnswers.Inc()
+			logQuery(client, qname, qtype, pathStale, stale)
+			writeResponse(w, logger, stale)
+			return
+		}
+	}
+	if response == nil {
+		if errors.Is(err, errMalformed) {
+			logger.Error("Query failed, upstream sent a malformed response", "error", err, "latency", time.Since(start))
+		} else {
+			logger.Warn("Query failed, upstream unreachable", "error", err, "latency", time.Since(start))
+		}
+		response = errorResponse(query, rcodeServFail)
+		logQuery(client, qname, qtype, pathFailed, response)
+		writeResponse(w, logger, response)
+		return
+	}
+	logger.Debug("Query answered", "path", path, "latency", time.Since(start))
+	logQuery(client, qname, qtype, path, response)
+
+	if keyErr == nil {
+		responseCache.Set(key, response, time.Now())
+	}
+	writeResponse(w, logger, response)
+}
+
+// relayResponse adjusts an upstream answer before it is cached or sent to
+// clients.
+func relayResponse(response []byte) []byte {
+	if response == nil {
+		return nil
+	}
+	setRecursionAvailable(response)
+	if *minTTL > 0 || *maxTTL > 0 {
+		clampTTLs(response)
+	}
+	if *flattenCNAMEs {
+		response = flattenCNAME(response)
+	}
+	return response
+}
+
+// writeResponse sends response to the client, logging and counting a
+// failed write instead of dropping it silently.
+func writeResponse(w responseWriter, logger *slog.Logger, response []byte) {
+	if err := w.WriteResponse(response); err != nil {
+		logger.Warn("Failed to write response to client", "error", err)
+		droppedQueries.WithLabelValues("write").Inc()
+	}
+}
+
+// prefetchQuery refreshes the cache entry under key in the background by
+// resolving query again. It is best effort: it never waits for a query
+// slot, and a failed refresh leaves the entry to expire as usual.
+func prefetchQuery(query []byte, key string, client net.Addr, config *Config, tlsConfig *tls.Config) {
+	select {
+	case querySlots <- struct{}{}:
+	default:
+		return
+	}
+	defer func() { <-querySlots }()
+
+	ctx, cancel := context.WithTimeout(shutdownCtx, *queryTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, clientAddrKey{}, client)
+	response, _, err := resolveQuery(ctx, query, config, tlsConfig)
+	if response == nil || msgRcode(response) == rcodeServFail {
+		slog.Debug("Prefetch failed", "error", err)
+		return
+	}
+	responseCache.Set(key, relayResponse(response), time.Now())
+}
+
+// inflightQueries coalesces concurrent lookups of the same question, keyed
+// like the cache, into one upstream round trip.
+var inflightQueries singleflight.Group
+
+// resolveShared is resolveQuery for a query whose cache key is key. If an
+// identical query is already being resolved it waits for that answer
+// instead of asking again, and gets a copy with its own ID.
+func resolveShared(ctx context.Context, key string, query []byte, config *Config, tlsConfig *tls.Config) ([]byte, string, error) {
+	type result struct {
+		response []byte
+		path     string
+	}
+	v, err, shared := inflightQueries.Do(key, func() (any, error) {
+		response, path, err := resolveQuery(ctx, query, config, tlsConfig)
+		// Before the answer is shared, copies are made of it
+		response = relayResponse(response)
+		return result{response: response, path: path}, err
+	})
+	r := v.(result)
+	if r.response == nil || !shared {
+		return r.response, r.path, err
+	}
+	response := bytes.Clone(r.response)
+	setMsgID(response, msgID(query))
+	return response, r.path, err
+}
+
+// resolveQuery answers query from public DNS or the ZeroTrust upstream and
+// reports which path ("public" or "upstream") produced the response. It
+// gives up when ctx is done. On failure err says why the upstream didn't
+// answer.
+func resolveQuery(ctx context.Context, query []byte, config *Config, tlsConfig *tls.Config) ([]byte, string, error) {
+	qname, _, _, qErr := parseQuestion(query)
+	if qErr == nil {
+		if server, ok := config.upstreamOverride(qname); ok {
+			response, err := forwardToServers(ctx, query, []string{server}, config.Transport, tlsConfig)
+			return response, pathUpstream, err
+		}
+	}
+
+	// Private reverse zones would only leak internal addresses to public
+	// DNS, which can't answer them anyway
+	if config.publicDNSDisabled() || (qErr == nil && isPrivateReverse(qname)) {
+		response, err := forwardUpstream(ctx, query, config, tlsConfig)
+		return response, pathUpstream, err
+	}
+
+	// With a provisioned domain list, only those zones go through the
+	// ZeroTrust server and everything else resolves publicly
+	if len(config.Domains) > 0 {
+		if qErr == nil && !matchesDomain(qname, config.Domains) {
+			if response := tryPublicDNS(ctx, query, config.publicResolvers()); response != nil {
+				return response, pathPublic, nil
+			}
+		}
+		response, err := forwardUpstream(ctx, query, config, tlsConfig)
+		return response, pathUpstream, err
+	}
+
+	// For service endpoints, try public DNS first
+	if config.Type == "service" {
+		if *raceService {
+			return raceServiceQuery(ctx, query, config, tlsConfig)
+		}
+		if response := tryPublicDNS(ctx, query, config.publicResolvers()); response != nil {
+			return response, pathPublic, nil
+		}
+	}
+
+	// Forward to ZeroTrust DNS server via mTLS
+	response, err := forwardUpstream(ctx, query, config, tlsConfig)
+	return response, pathUpstream, err
+}
+
+// raceServiceQuery asks public DNS and the ZeroTrust upstream at once and
+// returns the first answer, cancelling the other lookup.
+func raceServiceQuery(ctx context.Context, query []byte, config *Config, tlsConfig *tls.Config) ([]byte, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		response []byte
+		path     string
+		err      error
+	}
+	results := make(chan result, 2)
+	go func() {
+		response := tryPublicDNS(ctx, query, config.publicResolvers())
+		results <- result{response: response, path: pathPublic}
+	}()
+	go func() {
+		response, err := forwardUpstream(ctx, query, config, tlsConfig)
+		results <- result{response: response, path: pathUpstream, err: err}
+	}()
+
+	var err error
+	for range 2 {
+		r := <-results
+		if r.response != nil {
+			return r.response, r.path, nil
+		}
+		if r.path == pathUpstream {
+			err = r.err
+		}
+	}
+	return nil, pathUpstream, err
+}
+
+// forwardUpstream sends query to the ZeroTrust servers over the configured
+// transport, trying each in turn until one answers. If the config has a
+// proxy it goes through the proxy instead.
+func forwardUpstream(ctx context.Context, query []byte, config *Config, tlsConfig *tls.Config) ([]byte, error) {
+	if config.Proxy != "" {
+		ctx = context.WithValue(ctx, dnsServiceKey{}, config.dnsService())
+		return forwardToServers(ctx, query, []string{config.Proxy}, "proxy", tlsConfig)
+	}
+	return forwardToServers(ctx, query, config.weightedUpstreams(), config.Transport, tlsConfig)
+}
+
+// forwardToServers tries each of servers in turn over transport until one
+// answers. If none does, the error of the last one tried is returned.
+func forwardToServers(ctx context.Context, query []byte, servers []string, transport string, tlsConfig *tls.Config) ([]byte, error) {
+	query, restore := withClientSubnet(ctx, query)
+	err := unreachable("query deadline exceeded")
+	for _, server := range healthyUpstreams(servers) {
+		if ctx.Err() != nil {
+			break
+		}
+		breaker := breakerFor(server)
+		allowed, probe := breaker.allow(time.Now())
+		if !allowed {
+			err = unreachable("circuit breaker open for %s", server)
+			continue
+		}
+		start := time.Now()
+		var response []byte
+		var path string
+		response, path, err = exchangeWithServer(ctx, query, server, transport, tlsConfig)
+		observeUpstream(ctx, path, start, err)
+		breaker.record(ctx, probe, err, time.Now())
+		if err == nil {
+			slog.Debug("Upstream answered", "upstream", server)
+			return restore(response), nil
+		}
+		slog.Debug("Upstream failed, trying next", "upstream", server, "error", err)
+	}
+	return nil, err
+}
+
+// exchangeWithServer sends query to server over transport and returns the
+// response and the path it took (dot, doh, doq or proxy).
+func exchangeWithServer(ctx context.Context, query []byte, server, transport string, tlsConfig *tls.Config) ([]byte, string, error) {
+	tlsConfig = serverTLSConfig(tlsConfig, server)
+	switch transport {
+	case "doh":
+		response, err := forwardToServerDoH(ctx, query, server, tlsConfig)
+		return response, "doh", err
+	case "doq":
+		response, err := forwardToServerDoQ(ctx, query, server, tlsConfig)
+		return response, "doq", err
+	case "proxy":
+		service, _ := ctx.Value(dnsServiceKey{}).(string)
+		response, err := forwardOnPool(ctx, query, proxyPool(server, service, tlsConfig))
+		return response, "proxy", err
+	default:
+		response, err := forwardToServer(ctx, query, server, tlsConfig)
+		return response, "dot", err
+	}
+}
+
+// Upstream failures fall in two classes, wrapped by the errors the
+// forwarding functions return: the server couldn't be reached or didn't
+// answer in time, or it answered with something that isn't a usable
+// response to the query.
+var (
+	errUnreachable = errors.New("upstream unreachable")
+	errMalformed   = errors.New("malformed upstream response")
+)
+
+func unreachable(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errUnreachable, fmt.Sprintf(format, args...))
+}
+
+func malformed(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errMalformed, fmt.Sprintf(format, args...))
+}
+
+// errIDMismatch is the malformed error for a response to some other query
+// than the one sent.
+var errIDMismatch = malformed("response ID does not match query")
+
+// matchesDomain reports whether qname equals or is a subdomain of one of
+// domains. Matching is case-insensitive and ignores trailing dots. An entry
+// of "*.example.com" matches subdomains only and "." matches every name.
+func matchesDomain(qname string, domains []string) bool {
+	qname = strings.ToLower(strings.TrimSuffix(qname, "."))
+	for _, domain := range domains {
+		if domain == "." {
+			return true
+		}
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+		if wildcard, ok := strings.CutPrefix(domain, "*."); ok {
+			if strings.HasSuffix(qname, "."+wildcard) {
+				return true
+			}
+			continue
+		}
+		if domain == "" {
+			continue
+		}
+		if qname == domain || strings.HasSuffix(qname, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultPublicDNS is the fallback resolver used when neither the config
+// nor --public-dns names one.
+const defaultPublicDNS = "1.1.1.1:53"
+
+// defaultDNSService is the service the proxy routes DNS to when the config
+// names none.
+const defaultDNSService = "dns"
+
+// dnsServiceKey carries the service name proxied queries are routed to in
+// their context, from the config that sent them through the proxy.
+type dnsServiceKey struct{}
+
+// dnsService returns the service name the proxy routes DNS to.
+func (c *Config) dnsService() string {
+	if c.DNSService != "" {
+		return c.DNSService
+	}
+	return defaultDNSService
+}
+
+// publicDNSDisabled reports whether public DNS must not be used, by the
+// provisioned config or the --no-public-dns flag.
+func (c *Config) publicDNSDisabled() bool {
+	return c.NoPublicDNS || *noPublicDNS
+}
+
+// publicResolvers returns the public DNS servers to try in order, none
+// when public DNS is disabled. The --public-dns flag takes precedence over
+// the provisioned public_dns list.
+func (c *Config) publicResolvers() []string {
+	if c.publicDNSDisabled() {
+		return nil
+	}
+	resolvers := c.PublicDNS
+	if *publicDNS != "" {
+		resolvers = strings.Split(*publicDNS, ",")
+	}
+
+	var addrs []string
+	for _, resolver := range resolvers {
+		if resolver = strings.TrimSpace(resolver); resolver != "" {
+			addrs = append(addrs, withDefaultPort(resolver, "53"))
+		}
+	}
+	if len(addrs) == 0 {
+		return []string{defaultPublicDNS}
+	}
+	return addrs
+}
+
+// withDefaultPort appends port to addr unless it already carries one.
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// deadliner is a connection or stream whose I/O can be bounded in time.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// bindContext applies ctx's deadline to conn and interrupts blocked I/O if
+// ctx is cancelled first. The returned function detaches conn from ctx.
+func bindContext(ctx context.Context, conn deadliner) (release func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() { stop() }
+}
+
+// tryPublicDNS asks each public resolver in turn and returns the first
+// answer, or nil if none responded before ctx was done.
+func tryPublicDNS(ctx context.Context, query []byte, resolvers []string) []byte {
+	for _, resolver := range resolvers {
+		if ctx.Err() != nil {
+			break
+		}
+		start := time.Now()
+		response, err := queryPublicResolver(ctx, query, resolver)
+		observeUpstream(ctx, "public", start, err)
+		if err == nil {
+			return response
+		}
+		slog.Debug("Public resolver failed", "resolver", resolver, "error", err)
+	}
+	return nil
+}
+
+func queryPublicResolver(ctx context.Context, query []byte, resolver string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, *publicTimeout)
+	defer cancel()
+
+	conn, err := newDialer("udp").DialContext(ctx, "udp", resolver)
+	if err != nil {
+		return nil, unreachable("%v", err)
+	}
+	defer conn.Close()
+	defer trackOutbound(conn)()
+	defer bindContext(ctx, conn)()
+
+	checkCookie := func([]byte) bool { return true }
+	restore := func(response []byte) []byte { return response }
+	if *dnsCookies {
+		query, checkCookie, restore = withCookie(query, resolver)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, unreachable("%v", err)
+	}
+
+	// Keep reading until the deadline so a spoofed datagram with the wrong
+	// transaction ID can't displace the real answer
+	buffer := make([]byte, maxUDPSize)
+	var response []byte
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, unreachable("%v", err)
+		}
+		if n <= dnsHeaderLen { // Not a valid DNS response
+			continue
+		}
+		if !sameID(query, buffer[:n]) {
+			slog.Debug("Discarding public DNS response with mismatched ID", "resolver", resolver)
+			continue
+		}
+		if !sameQuestion(query, buffer[:n]) {
+			slog.Warn("Discarding public DNS response for a different question", "resolver", resolver)
+			continue
+		}
+		if !checkCookie(buffer[:n]) {
+			slog.Warn("Discarding public DNS response with a missing or wrong cookie", "resolver", resolver)
+			continue
+		}
+		response = buffer[:n]
+		break
+	}
+
+	// The answer didn't fit in a datagram, fetch it in full over TCP. If
+	// that fails the truncated answer still tells the client to retry.
+	if msgFlags(response)&flagTC != 0 {
+		full, err := queryPublicResolverTCP(ctx, query, resolver)
+		if err == nil && !checkCookie(full) {
+			err = malformed("missing or wrong cookie")
+		}
+		if err == nil {
+			return restore(full), nil
+		}
+		slog.Debug("TCP retry of truncated public answer failed", "resolver", resolver, "error", err)
+	}
+
+	return restore(response), nil
+}
+
+func queryPublicResolverTCP(ctx context.Context, query []byte, resolver string) ([]byte, error) {
+	conn, err := newDialer("tcp").DialContext(ctx, "tcp", resolver)
+	if err != nil {
+		return nil, unreachable("%v", err)
+	}
+	defer conn.Close()
+	defer trackOutbound(conn)()
+	defer bindContext(ctx, conn)()
+
+	length := uint16(len(query))
+	if _, err := conn.Write(append([]byte{byte(length >> 8), byte(length & 0xff)}, query...)); err != nil {
+		return nil, unreachable("%v", err)
+	}
+
+	respLenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, respLenBuf); err != nil {
+		return nil, unreachable("%v", err)
+	}
+
+	respLen := int(respLenBuf[0])<<8 | int(respLenBuf[1])
+	if respLen <= dnsHeaderLen {
+		return nil, malformed("invalid DNS response length: %d", respLen)
+	}
+
+	resp := make([]byte, respLen)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, unreachable("%v", err)
+	}
+	if !sameID(query, resp) {
+		return nil, malformed("response ID %d does not match query ID %d", msgID(resp), msgID(query))
+	}
+	if !sameQuestion(query, resp) {
+		return nil, malformed("response question does not match query")
+	}
+
+	return resp, nil
+}
+
+func forwardToServer(ctx context.Context, query []byte, server string, tlsConfig *tls.Config) ([]byte, error) {
+	return forwardOnPool(ctx, query, upstreamPool(server, tlsConfig))
+}
+
+// forwardOnPool exchanges query as DNS over TCP on a connection from pool.
+func forwardOnPool(ctx context.Context, query []byte, pool *connPool) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, *upstreamTimeout)
+	defer cancel()
+
+	conn, pooled, err := pool.get(ctx)
+	if err != nil {
+		return nil, connectError(ctx, err)
+	}
+
+	resp, err := exchangeTLS(ctx, conn, query)
+	if err != nil && pooled {
+		// The server may have closed the idle connection since it was
+		// pooled, retry once on a fresh one. An answer with the wrong ID
+		// was left over from an earlier query, so the retry gets a new ID
+		// that no late answer to that one can carry.
+		conn.Close()
+		retry := query
+		if errors.Is(err, errIDMismatch) {
+			retry = bytes.Clone(query)
+			setMsgID(retry, uint16(rand.N(1<<16)))
+		}
+		if conn, err = pool.dial(ctx); err != nil {
+			return nil, connectError(ctx, err)
+		}
+		if resp, err = exchangeTLS(ctx, conn, retry); err == nil {
+			setMsgID(resp, msgID(query))
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	pool.put(conn)
+	return resp, nil
+}
+
+// exchangeTLS sends one length-prefixed query on conn and reads the
+// response (RFC 7858 - DNS over TLS).
+func exchangeTLS(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	release := bindContext(ctx, conn)
+	defer func() {
+		release()
+		conn.SetDeadline(time.Time{})
+	}()
+
+	// Send DNS query with 2-byte length prefix
+	length := uint16(len(query))
+	lengthBytes := []byte{byte(length >> 8), byte(length & 0xff)}
+
+	if _, err := conn.Write(append(lengthBytes, query...)); err != nil {
+		return nil, unreachable("failed to send DNS query: %v", err)
+	}
+
+	// Read length-prefixed DNS response. TLS may split the message across
+	// records, so keep reading until the full length has arrived.
+	respLenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, respLenBuf); err != nil {
+		// Under TLS 1.3 the server checks the client certificate after the
+		// client considers the handshake done, so a rejection only arrives
+		// as an alert on the first read
+		if _, ok := remoteAlert(err); ok {
+			return nil, connectError(ctx, err)
+		}
+		return nil, unreachable("failed to read DNS response length: %v", err)
+	}
+
+	respLen := int(respLenBuf[0])<<8 | int(respLenBuf[1])
+	if respLen <= 0 || respLen > 4096 {
+		return nil, malformed("invalid DNS response length: %d", respLen)
+	}
+
+	resp := make([]byte, respLen)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, unreachable("failed to read DNS response: %v", err)
+	}
+
+	if respLen < dnsHeaderLen {
+		return nil, malformed("response shorter than header")
+	}
+	// A mismatch means the stream is out of step with our queries, e.g. a
+	// stale answer left on a pooled connection
+	if !sameID(query, resp) {
+		return nil, errIDMismatch
+	}
+	if !sameQuestion(query, resp) {
+		return nil, malformed("response question does not match query")
+	}
+
+	return resp, nil
+}
+
+// Main runs the endpoint as configured by the command line and
+// environment. It returns only for the one-shot modes such as -version and
+// -query; otherwise it serves until a signal ends the process.
+func Main() {
+	flag.Parse()
+	if err := applyEnvFlags(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if err := setupLogging(os.Stderr, *logLevel, *logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	paths := flagPaths()
+	if paths.Config == "-" && paths.CA == "-" {
+		fatal("Only one of -config-path and -ca-path can be read from stdin")
+	}
+
+	var err error
+	if sourceIP, err = parseSourceAddr(*sourceAddr); err != nil {
+		fatal("Invalid -source-addr", "error", err)
+	}
+
+	if *checkOnly {
+		if err := runCheck(os.Stdout, paths); err != nil {
+			fatal("Check failed", "error", err)
+		}
+		return
+	}
+
+	slog.Info("Starting ZeroTrust DNS endpoint", "version", version, "commit", commit, "built", buildDate)
+
+	ca, err := loadCA(paths.CA, paths.ExtraCA)
+	if err != nil {
+		fatal("Failed to load CA", "error", err)
+	}
+
+	config, err := loadConfig(paths, ca)
+	if err != nil {
+		fatal("Failed to load config", "error", err)
+	}
+
+	tlsConfig, err := setupTLS(config, paths, ca)
+	if err != nil {
+		fatal("Failed to set up TLS", "error", err)
+	}
+
+	filter, err := loadDomainFilter(*allowlistPath, *denylistPath, *sinkholeAddr)
+	if err != nil {
+		fatal("Failed to load domain lists", "error", err)
+	}
+	activeFilter.Store(filter)
+
+	hosts, err := loadHosts(*hostsPath)
+	if err != nil {
+		fatal("Failed to load hosts file", "error", err)
+	}
+	activeHosts.Store(hosts)
+
+	if subnetPrefix4, subnetPrefix6, err = parseClientSubnet(*clientSubnet); err != nil {
+		fatal("Invalid -client-subnet", "error", err)
+	}
+
+	if *privatePTR != "nxdomain" && *privatePTR != "upstream" {
+		fatal("Invalid -private-ptr, want nxdomain or upstream", "value", *privatePTR)
+	}
+
+	if *nonRecursive != "cache" && *nonRecursive != "refuse" {
+		fatal("Invalid -non-recursive, want cache or refuse", "value", *nonRecursive)
+	}
+
+	if *clientQPS < 0 {
+		fatal("Invalid -client-qps, must not be negative", "value", *clientQPS)
+	}
+	if *clientQPS > 0 {
+		clientRateLimit = newClientLimiter(*clientQPS, *clientBurst)
+	}
+
+	if *minTTL < 0 || *maxTTL < 0 {
+		fatal("Invalid -min-ttl or -max-ttl, must not be negative", "min", *minTTL, "max", *maxTTL)
+	}
+	if *maxTTL > 0 && *minTTL > *maxTTL {
+		fatal("Invalid -min-ttl, must not exceed -max-ttl", "min", *minTTL, "max", *maxTTL)
+	}
+
+	if *serveStale < 0 {
+		fatal("Invalid -serve-stale, must not be negative", "value", *serveStale)
+	}
+
+	if *udpReadBuffer < 0 || *udpWriteBuffer < 0 {
+		fatal("Invalid -udp-read-buffer or -udp-write-buffer, must not be negative", "read", *udpReadBuffer, "write", *udpWriteBuffer)
+	}
+
+	if *maxInflight < 1 {
+		fatal("Invalid -max-inflight, must be at least 1", "value", *maxInflight)
+	}
+	initQuerySlots()
+
+	if *queryName != "" {
+		activeState.Store(&endpointState{config: config, tlsConfig: tlsConfig})
+		if err := runQuery(os.Stdout, *queryName, flag.Arg(0), config, tlsConfig); err != nil {
+			fatal("Query failed", "error", err)
+		}
+		return
+	}
+
+	if *queryLogPath != "" {
+		if queryLog, err = openQueryLog(*queryLogPath, *queryLogSize<<20); err != nil {
+			fatal("Failed to open query log", "error", err)
+		}
+	}
+
+	if *capturePath != "" {
+		if capture, err = openCapture(*capturePath); err != nil {
+			fatal("Failed to open capture file", "error", err)
+		}
+		slog.Warn("Capturing every query and response", "file", *capturePath)
+	}
+
+	if *cacheFile != "" {
+		if n, err := loadCacheFile(*cacheFile); err != nil {
+			slog.Warn("Starting with an empty cache", "error", err)
+		} else {
+			slog.Info("Cache loaded", "entries", n)
+		}
+	}
+
+	activeState.Store(&endpointState{config: config, tlsConfig: tlsConfig})
+	go watchReload()
+	go watchShutdown()
+	go watchExpiry()
+	if *probeInterval > 0 {
+		go watchUpstreamHealth(*probeInterval)
+	}
+
+	if *metricsAddr != "" {
+		startMetricsServer(*metricsAddr)
+	}
+	if *healthAddr != "" {
+		startHealthServer(*healthAddr, *readyWindow)
+	}
+	if *proxyForwards != "" {
+		if config.Proxy == "" {
+			fatal("-proxy-forward needs a proxy in the provisioned config")
+		}
+		if err := startProxyForwards(*proxyForwards); err != nil {
+			fatal("Failed to start proxy forwards", "error", err)
+		}
+	}
+	if *dohListen != "" {
+		if (*dohCert == "") != (*dohKey == "") {
+			fatal("-doh-cert and -doh-key must be given together")
+		}
+		if err := startDoHServer(*dohListen, *dohCert, *dohKey); err != nil {
+			fatal("Failed to start DoH server", "error", err)
+		}
+	}
+	if *controlSocket != "" {
+		if err := startControlSocket(*controlSocket); err != nil {
+			fatal("Failed to open control socket", "error", err)
+		}
+	}
+
+	startLocalDNS()
+}
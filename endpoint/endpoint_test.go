@@ -0,0 +1,1787 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseCACertificatesPEM(t *testing.T) {
+	p := newTestPKI(t)
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.caCert.Raw})
+
+	for name, data := range map[string][]byte{
+		"pem":  encoded,
+		"crlf": bytes.ReplaceAll(encoded, []byte("\n"), []byte("\r\n")),
+		"der":  p.caCert.Raw,
+	} {
+		certs, err := parseCACertificates(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(certs) != 1 || !certs[0].Equal(p.caCert) {
+			t.Errorf("%s: got %d certificates, want the CA back", name, len(certs))
+		}
+	}
+
+	if _, err := parseCACertificates([]byte("not a certificate")); err == nil {
+		t.Error("garbage parsed as a CA")
+	}
+	corrupt := bytes.Replace(encoded, []byte("MII"), []byte("MIJ"), 1)
+	if _, err := parseCACertificates(corrupt); err == nil {
+		t.Error("corrupted PEM body parsed")
+	}
+}
+
+func TestForwardToServerReadsSplitResponse(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", p.serverTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A response too large for one read, with TXT strings filling it out
+	query := buildTestQuery(9, "split.example", typeTXT)
+	want := errorResponse(query, rcodeSuccess)
+	for range 8 {
+		txt := append([]byte{255}, bytes.Repeat([]byte("x"), 255)...)
+		want = appendRecord(want, sectionAnswer, questionOwner, typeTXT, classIN, 60, txt)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, binary.BigEndian.Uint16(length[:]))); err != nil {
+			return
+		}
+		// Three TLS records a moment apart, splitting the length
+		// prefix as well as the message
+		msg := binary.BigEndian.AppendUint16(nil, uint16(len(want)))
+		msg = append(msg, want...)
+		for _, chunk := range [][]byte{msg[:1], msg[1 : len(msg)/2], msg[len(msg)/2:]} {
+			conn.Write(chunk)
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	got, err := forwardToServer(context.Background(), query, ln.Addr().String(), p.clientTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %d bytes, want the %d byte response", len(got), len(want))
+	}
+}
+
+func TestLoadConfigExpires(t *testing.T) {
+	p := newTestPKI(t)
+	now := time.Now()
+	load := func(config map[string]any, claims jwt.RegisteredClaims) (*Config, error) {
+		return loadConfig(filePaths{Config: writeTestToken(t, p, config, claims)}, p.caBundle())
+	}
+
+	future := now.Add(time.Hour).UTC().Format(time.RFC3339)
+	config, err := load(map[string]any{"server": "10.0.0.1:853", "expires": future}, jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.IsExpired(now) || !config.IsExpired(now.Add(time.Hour)) {
+		t.Errorf("IsExpired wrong around %s", future)
+	}
+
+	config, err = load(map[string]any{"server": "10.0.0.1:853"}, jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.IsExpired(now.AddDate(100, 0, 0)) {
+		t.Error("config without expires expired")
+	}
+
+	for name, tc := range map[string]struct {
+		config map[string]any
+		claims jwt.RegisteredClaims
+		want   string
+	}{
+		"expired": {
+			config: map[string]any{"server": "10.0.0.1:853", "expires": now.Add(-time.Minute).UTC().Format(time.RFC3339)},
+			want:   "config expired",
+		},
+		"malformed": {
+			config: map[string]any{"server": "10.0.0.1:853", "expires": "31/12/2028"},
+			want:   "invalid expires timestamp",
+		},
+		"not yet valid": {
+			config: map[string]any{"server": "10.0.0.1:853"},
+			claims: jwt.RegisteredClaims{NotBefore: jwt.NewNumericDate(now.Add(time.Hour))},
+			want:   "not valid until",
+		},
+	} {
+		if _, err := load(tc.config, tc.claims); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want %q", name, err, tc.want)
+		}
+	}
+}
+
+func TestHandleDNSQueryExpiredConfig(t *testing.T) {
+	config := &Config{Server: "127.0.0.1:1", Expires: "2020-01-01T00:00:00Z", expiresAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	w := &queryWriter{}
+	handleDNSQuery(context.Background(), w, buildTestQuery(1, "expired.example", typeA), config, nil)
+	if w.response != nil {
+		t.Fatal("expired config still answers queries")
+	}
+}
+
+func TestMatchesDomain(t *testing.T) {
+	domains := []string{"internal.corp", "*.svc.example", "Mixed.Case."}
+	for qname, want := range map[string]bool{
+		"internal.corp":      true,
+		"db.internal.corp":   true,
+		"DB.Internal.Corp.":  true,
+		"a.b.internal.corp":  true,
+		"notinternal.corp":   false,
+		"corp":               false,
+		"api.svc.example":    true,
+		"svc.example":        false,
+		"mixed.case":         true,
+		"host.mixed.case":    true,
+		"example.com":        false,
+		"":                   false,
+		"internal.corp.evil": false,
+	} {
+		if got := matchesDomain(qname, domains); got != want {
+			t.Errorf("matchesDomain(%q) = %v, want %v", qname, got, want)
+		}
+	}
+
+	// The root matches every name, an empty list none
+	if !matchesDomain("example.com", []string{"."}) || !matchesDomain("", []string{"."}) {
+		t.Error("root domain doesn't match everything")
+	}
+	if matchesDomain("example.com", nil) || matchesDomain("example.com", []string{""}) {
+		t.Error("empty domain list matches")
+	}
+}
+
+func TestResolveQuerySplitsOnDomains(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	public := startMockPublic(t, answerA(60, [4]byte{192, 0, 2, 1}))
+	config := &Config{
+		Server:    upstream.addr(),
+		Domains:   []string{"internal.corp"},
+		PublicDNS: []string{public.addr},
+	}
+	tlsConfig := p.clientTLS(t)
+
+	for name, want := range map[string]string{
+		"db.internal.corp": pathUpstream,
+		"INTERNAL.corp":    pathUpstream,
+		"www.example.com":  pathPublic,
+	} {
+		_, path, err := resolveQuery(context.Background(), buildTestQuery(1, name, typeA), config, tlsConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != want {
+			t.Errorf("%s answered by %s, want %s", name, path, want)
+		}
+	}
+	if upstream.queries.Load() != 2 || public.queries.Load() != 1 {
+		t.Errorf("upstream got %d queries and public DNS %d, want 2 and 1", upstream.queries.Load(), public.queries.Load())
+	}
+}
+
+func TestServeUDPCapsToPayloadSize(t *testing.T) {
+	resetUpstreamState(t)
+	initQuerySlots()
+	p := newTestPKI(t)
+	// TXT answers of about 3000 bytes
+	upstream := startMockDoT(t, p, 0, func(query []byte) []byte {
+		resp := errorResponse(removeOPT(query), rcodeSuccess)
+		for range 12 {
+			txt := append([]byte{240}, bytes.Repeat([]byte("x"), 240)...)
+			resp = appendRecord(resp, sectionAnswer, questionOwner, typeTXT, classIN, 60, txt)
+		}
+		return resp
+	})
+	state := &endpointState{
+		config:    &Config{Server: upstream.addr(), NoPublicDNS: true},
+		tlsConfig: p.clientTLS(t),
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveUDP(context.Background(), conn, func() *endpointState { return state })
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	buf := make([]byte, 65535)
+
+	for name, tc := range map[string]struct {
+		query     []byte
+		truncated bool
+	}{
+		"no OPT":      {query: buildTestQuery(1, "a.udp.example", typeTXT), truncated: true},
+		"1232 bytes":  {query: withTestOPT(buildTestQuery(2, "b.udp.example", typeTXT), 1232), truncated: true},
+		"4096 bytes":  {query: withTestOPT(buildTestQuery(3, "c.udp.example", typeTXT), 4096)},
+		"65535 bytes": {query: withTestOPT(buildTestQuery(4, "d.udp.example", typeTXT), 65535)},
+	} {
+		client.Write(tc.query)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		resp := buf[:n]
+		if msgID(resp) != msgID(tc.query) {
+			t.Fatalf("%s: answered ID %d, want %d", name, msgID(resp), msgID(tc.query))
+		}
+		if limit := min(ednsPayloadSize(tc.query), maxUDPSize); n > limit {
+			t.Errorf("%s: %d byte response over the %d byte limit", name, n, limit)
+		}
+		_, an, _, _ := msgCounts(resp)
+		if truncated := msgFlags(resp)&flagTC != 0; truncated != tc.truncated {
+			t.Errorf("%s: TC %v with %d answers in %d bytes, want %v", name, truncated, an, n, tc.truncated)
+		}
+		if !tc.truncated && an == 0 {
+			t.Errorf("%s: no answers", name)
+		}
+	}
+}
+
+func TestForwardToServersFailsOver(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, upstreamTimeout, 200*time.Millisecond)
+	p := newTestPKI(t)
+	hanging := startMockDoT(t, p, 0, hangingAnswer(t))
+	working := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 2}))
+	tlsConfig := p.clientTLS(t)
+
+	start := time.Now()
+	servers := []string{hanging.addr(), working.addr()}
+	resp, err := forwardToServers(context.Background(), buildTestQuery(1, "failover.example", typeA), servers, "", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Fatalf("answered %v, want the second server's 10.0.0.2", firstA(t, resp))
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("answered after %s, want the first server's 200ms timeout", elapsed)
+	}
+	if hanging.queries.Load() != 1 || working.queries.Load() != 1 {
+		t.Errorf("servers got %d and %d queries, want 1 each", hanging.queries.Load(), working.queries.Load())
+	}
+
+	// Every server timing out fails the query as unreachable
+	_, err = forwardToServers(context.Background(), buildTestQuery(2, "failover.example", typeA), []string{hanging.addr()}, "", tlsConfig)
+	if !errors.Is(err, errUnreachable) {
+		t.Fatalf("got %v, want an unreachable upstream", err)
+	}
+}
+
+func TestConfigUpstreams(t *testing.T) {
+	p := newTestPKI(t)
+	for name, tc := range map[string]struct {
+		config map[string]any
+		want   []string
+	}{
+		"server":  {config: map[string]any{"server": "10.0.0.1:853"}, want: []string{"10.0.0.1:853"}},
+		"servers": {config: map[string]any{"servers": []string{"10.0.0.1:853", "10.0.0.2:853"}}, want: []string{"10.0.0.1:853", "10.0.0.2:853"}},
+		"both":    {config: map[string]any{"server": "10.0.0.9:853", "servers": []string{"10.0.0.1:853"}}, want: []string{"10.0.0.1:853"}},
+	} {
+		config, err := loadConfig(filePaths{Config: writeTestToken(t, p, tc.config, jwt.RegisteredClaims{})}, p.caBundle())
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got := config.upstreams(); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: upstreams %v, want %v", name, got, tc.want)
+		}
+	}
+}
+
+func TestLoadConfigTokenTimes(t *testing.T) {
+	p := newTestPKI(t)
+	now := time.Now()
+	config := map[string]any{"server": "10.0.0.1:853"}
+	for name, tc := range map[string]struct {
+		claims jwt.RegisteredClaims
+		want   string
+	}{
+		"valid": {
+			claims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)), NotBefore: jwt.NewNumericDate(now.Add(-time.Hour))},
+		},
+		"expired": {
+			claims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(-time.Hour))},
+			want:   "token expired at",
+		},
+		"future nbf": {
+			claims: jwt.RegisteredClaims{NotBefore: jwt.NewNumericDate(now.Add(time.Hour))},
+			want:   "token not valid until",
+		},
+		// Within the default 30s of skew either way
+		"just expired": {
+			claims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(-10 * time.Second))},
+		},
+		"nbf just ahead": {
+			claims: jwt.RegisteredClaims{NotBefore: jwt.NewNumericDate(now.Add(10 * time.Second))},
+		},
+	} {
+		_, err := loadConfig(filePaths{Config: writeTestToken(t, p, config, tc.claims)}, p.caBundle())
+		if tc.want == "" && err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%s: got error %v, want %q", name, err, tc.want)
+		}
+	}
+}
+
+func TestValidateTokenTimesSkew(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	exp := &JWTClaims{RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(-time.Minute))}}
+	nbf := &JWTClaims{RegisteredClaims: jwt.RegisteredClaims{NotBefore: jwt.NewNumericDate(now.Add(time.Minute))}}
+	for _, claims := range []*JWTClaims{exp, nbf} {
+		if err := validateTokenTimes(claims, now, 30*time.Second); err == nil {
+			t.Error("minute off accepted with 30s of skew")
+		}
+		if err := validateTokenTimes(claims, now, 2*time.Minute); err != nil {
+			t.Errorf("minute off refused with 2m of skew: %v", err)
+		}
+		if err := validateTokenTimes(claims, now, 0); err == nil {
+			t.Error("minute off accepted without skew")
+		}
+	}
+	if err := validateTokenTimes(&JWTClaims{}, now, 0); err != nil {
+		t.Errorf("token without time claims refused: %v", err)
+	}
+}
+
+func TestLoadConfigSigningMethods(t *testing.T) {
+	p := newTestPKI(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "RSA Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &rsaKey.PublicKey, rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaCA, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es384CA := *p.caCert
+	es384CA.PublicKey = &es384Key.PublicKey
+
+	claims := JWTClaims{Data: `{"server":"10.0.0.1:853"}`}
+	for name, tc := range map[string]struct {
+		method jwt.SigningMethod
+		key    any
+		ca     *x509.Certificate
+		valid  bool
+	}{
+		"ES256":                {method: jwt.SigningMethodES256, key: p.caKey, ca: p.caCert, valid: true},
+		"ES384":                {method: jwt.SigningMethodES384, key: es384Key, ca: &es384CA, valid: true},
+		"RS256":                {method: jwt.SigningMethodRS256, key: rsaKey, ca: rsaCA, valid: true},
+		"HS256":                {method: jwt.SigningMethodHS256, key: []byte("shared secret"), ca: p.caCert},
+		"HS256 with CA key":    {method: jwt.SigningMethodHS256, key: p.caCert.RawSubjectPublicKeyInfo, ca: p.caCert},
+		"none":                 {method: jwt.SigningMethodNone, key: jwt.UnsafeAllowNoneSignatureType, ca: p.caCert},
+		"RS256 for an EC CA":   {method: jwt.SigningMethodRS256, key: rsaKey, ca: p.caCert},
+		"ES256 for an RSA CA":  {method: jwt.SigningMethodES256, key: p.caKey, ca: rsaCA},
+		"ES256 by another key": {method: jwt.SigningMethodES256, key: newTestPKI(t).caKey, ca: p.caCert},
+	} {
+		token, err := jwt.NewWithClaims(tc.method, claims).SignedString(tc.key)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		path := filepath.Join(t.TempDir(), "config.zt")
+		if err := os.WriteFile(path, []byte(token), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadConfig(filePaths{Config: path}, &caBundle{Certs: []*x509.Certificate{tc.ca}})
+		if tc.valid && err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+func TestPublicResolvers(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config *Config
+		flag   string
+		want   []string
+	}{
+		"default":       {config: &Config{}, want: []string{defaultPublicDNS}},
+		"configured":    {config: &Config{PublicDNS: []string{"9.9.9.9", "10.1.1.1:5353", "2620:fe::fe"}}, want: []string{"9.9.9.9:53", "10.1.1.1:5353", "[2620:fe::fe]:53"}},
+		"flag":          {config: &Config{PublicDNS: []string{"9.9.9.9"}}, flag: "8.8.8.8, 8.8.4.4", want: []string{"8.8.8.8:53", "8.8.4.4:53"}},
+		"blank entries": {config: &Config{PublicDNS: []string{" ", ""}}, want: []string{defaultPublicDNS}},
+		"disabled":      {config: &Config{NoPublicDNS: true, PublicDNS: []string{"9.9.9.9"}}},
+	} {
+		setForTest(t, publicDNS, tc.flag)
+		if got := tc.config.publicResolvers(); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: %v, want %v", name, got, tc.want)
+		}
+	}
+}
+
+func TestTryPublicDNSFallsBack(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, publicTimeout, 200*time.Millisecond)
+	silent := startMockPublic(t, func([]byte) []byte { return nil })
+	working := startMockPublic(t, answerA(60, [4]byte{192, 0, 2, 7}))
+
+	resp := tryPublicDNS(context.Background(), buildTestQuery(3, "fallback.example", typeA), []string{silent.addr, working.addr})
+	if resp == nil {
+		t.Fatal("no answer")
+	}
+	if !firstA(t, resp).Equal(net.IPv4(192, 0, 2, 7)) {
+		t.Fatalf("answered %v, want the second resolver's", firstA(t, resp))
+	}
+	if silent.queries.Load() == 0 || working.queries.Load() != 1 {
+		t.Errorf("resolvers got %d and %d queries, want the first tried before the second", silent.queries.Load(), working.queries.Load())
+	}
+	if resp := tryPublicDNS(context.Background(), buildTestQuery(4, "fallback.example", typeA), []string{silent.addr}); resp != nil {
+		t.Error("answer without a working resolver")
+	}
+}
+
+func TestQueryPublicResolverRetriesTruncatedOverTCP(t *testing.T) {
+	resetUpstreamState(t)
+	// A full answer of 40 A records, cut to the bare question over UDP
+	full := func(query []byte) []byte {
+		resp := errorResponse(removeOPT(query), rcodeSuccess)
+		for i := range 40 {
+			resp = appendRecord(resp, sectionAnswer, questionOwner, typeA, classIN, 60, []byte{192, 0, 2, byte(i)})
+		}
+		return resp
+	}
+	public := startMockPublicSplit(t, func(query []byte) []byte { return truncateResponse(full(query)) }, full)
+
+	query := buildTestQuery(0x2020, "big.example", typeA)
+	resp, err := queryPublicResolver(context.Background(), query, public.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgFlags(resp)&flagTC != 0 {
+		t.Fatal("truncated answer returned")
+	}
+	if _, an, _, _ := msgCounts(resp); an != 40 || msgID(resp) != 0x2020 {
+		t.Fatalf("%d answers with ID %#x, want 40 with the query's", an, msgID(resp))
+	}
+	if public.queries.Load() != 2 || public.tcpQueries.Load() != 1 {
+		t.Errorf("%d queries of which %d over TCP, want one each way", public.queries.Load(), public.tcpQueries.Load())
+	}
+
+	// Without TCP the truncated answer still goes back, for the client to
+	// retry
+	udpOnly := startMockPublicSplit(t, func(query []byte) []byte { return truncateResponse(full(query)) }, func([]byte) []byte { return nil })
+	resp, err = queryPublicResolver(context.Background(), query, udpOnly.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgFlags(resp)&flagTC == 0 {
+		t.Fatal("TC cleared on the truncated answer")
+	}
+}
+
+func TestForwardToServerRejectsMismatchedID(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	wrongID := func(query []byte) []byte {
+		resp := answerA(60, [4]byte{10, 0, 0, 1})(query)
+		setMsgID(resp, msgID(query)+1)
+		return resp
+	}
+	server := startMockDoT(t, p, 0, wrongID)
+	_, err := forwardToServer(context.Background(), buildTestQuery(1, "id.example", typeA), server.addr(), p.clientTLS(t))
+	if !errors.Is(err, errIDMismatch) || !errors.Is(err, errMalformed) {
+		t.Fatalf("got %v, want a malformed ID mismatch", err)
+	}
+}
+
+func TestForwardToServerRejectsShortResponse(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	short := func(query []byte) []byte { return query[:dnsHeaderLen-1] }
+	server := startMockDoT(t, p, 0, short)
+	_, err := forwardToServer(context.Background(), buildTestQuery(1, "short.example", typeA), server.addr(), p.clientTLS(t))
+	if !errors.Is(err, errMalformed) || errors.Is(err, errIDMismatch) {
+		t.Fatalf("got %v, want malformed but no ID mismatch", err)
+	}
+}
+
+func TestForwardToServerRetriesStaleAnswer(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	// The second query, on the pooled connection, gets an answer to some
+	// other query, as if left over on the stream
+	var answered atomic.Int32
+	server := startMockDoT(t, p, 0, func(query []byte) []byte {
+		resp := answerA(60, [4]byte{10, 0, 0, 1})(query)
+		if answered.Add(1) == 2 {
+			setMsgID(resp, msgID(query)^0xffff)
+		}
+		return resp
+	})
+	tlsConfig := p.clientTLS(t)
+
+	for _, id := range []uint16{10, 11} {
+		resp, err := forwardToServer(context.Background(), buildTestQuery(id, "stale.example", typeA), server.addr(), tlsConfig)
+		if err != nil {
+			t.Fatalf("query %d: %v", id, err)
+		}
+		if msgID(resp) != id {
+			t.Fatalf("query %d answered with ID %d", id, msgID(resp))
+		}
+	}
+	if server.conns.Load() != 2 || answered.Load() != 3 {
+		t.Fatalf("%d connections and %d answers, want the stale one retried on a new connection", server.conns.Load(), answered.Load())
+	}
+}
+
+func TestForwardToServerRetriesWithFreshID(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	// Answers from the second query on carry a stale ID until healed
+	var mu sync.Mutex
+	var ids []uint16
+	var healed atomic.Bool
+	server := startMockDoT(t, p, 0, func(query []byte) []byte {
+		mu.Lock()
+		ids = append(ids, msgID(query))
+		n := len(ids)
+		mu.Unlock()
+		resp := answerA(60, [4]byte{10, 0, 0, 1})(query)
+		if n >= 2 && !healed.Load() {
+			setMsgID(resp, msgID(query)^0xffff)
+		}
+		return resp
+	})
+	sent := func() []uint16 {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(ids)
+	}
+	tlsConfig := p.clientTLS(t)
+	forward := func(id uint16) ([]byte, error) {
+		return forwardToServer(context.Background(), buildTestQuery(id, "fresh.example", typeA), server.addr(), tlsConfig)
+	}
+	if _, err := forward(20); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retried once on a fresh connection, and the retry failing too is the
+	// end of it
+	if _, err := forward(21); !errors.Is(err, errIDMismatch) {
+		t.Fatalf("got %v, want the retry's ID mismatch", err)
+	}
+	if ids := sent(); server.conns.Load() != 2 || len(ids) != 3 {
+		t.Fatalf("%d connections and %d queries, want a single retry", server.conns.Load(), len(ids))
+	} else if ids[2] == 21 {
+		// The retry goes out under an ID no late answer to the first
+		// attempt can carry
+		t.Errorf("retry resent ID %d", ids[2])
+	}
+
+	healed.Store(true)
+	if _, err := forward(22); err != nil {
+		t.Fatal(err)
+	}
+	// A pooled connection answering fine is not retried
+	resp, err := forward(23)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := sent(); msgID(resp) != 23 || ids[len(ids)-1] != 23 {
+		t.Errorf("answered with ID %d, last sent %d, want 23", msgID(resp), ids[len(ids)-1])
+	}
+}
+
+func TestQueryPublicResolverDiscardsMismatchedID(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, publicTimeout, 300*time.Millisecond)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var genuine atomic.Bool
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, client, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query := bytes.Clone(buf[:n])
+			// A spoofed answer racing ahead of the real one
+			spoofed := buildTestAnswer(query, 60, [4]byte{203, 0, 113, 66})
+			setMsgID(spoofed, msgID(query)+1)
+			conn.WriteToUDP(spoofed, client)
+			if genuine.Load() {
+				conn.WriteToUDP(buildTestAnswer(query, 60, [4]byte{192, 0, 2, 1}), client)
+			}
+		}
+	}()
+
+	query := buildTestQuery(0x5151, "spoof.example", typeA)
+	if _, err := queryPublicResolver(context.Background(), query, conn.LocalAddr().String()); !errors.Is(err, errUnreachable) {
+		t.Fatalf("got %v with only a spoofed answer, want a timeout", err)
+	}
+	genuine.Store(true)
+	resp, err := queryPublicResolver(context.Background(), query, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !firstA(t, resp).Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("answered %v, want the genuine 192.0.2.1", firstA(t, resp))
+	}
+}
+
+func TestServeUDPCapsInflight(t *testing.T) {
+	resetUpstreamState(t)
+	initQuerySlots()
+	// Leave four query slots free
+	const free = 4
+	for range cap(querySlots) - free {
+		querySlots <- struct{}{}
+	}
+	t.Cleanup(func() {
+		for range cap(querySlots) - free {
+			<-querySlots
+		}
+	})
+
+	p := newTestPKI(t)
+	var inflight, peak atomic.Int32
+	upstream := startMockDoT(t, p, 0, func(query []byte) []byte {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for old := peak.Load(); n > old && !peak.CompareAndSwap(old, n); old = peak.Load() {
+		}
+		time.Sleep(100 * time.Millisecond)
+		return answerA(60, [4]byte{10, 0, 0, 1})(query)
+	})
+	state := &endpointState{
+		config:    &Config{Server: upstream.addr(), NoPublicDNS: true},
+		tlsConfig: p.clientTLS(t),
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveUDP(context.Background(), conn, func() *endpointState { return state })
+
+	// A burst of distinct names, so neither the cache nor coalescing
+	// answers any of them
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	const burst = 50
+	for i := range burst {
+		client.WriteTo(buildTestQuery(uint16(i), fmt.Sprintf("q%d.burst.example", i), typeA), conn.LocalAddr())
+	}
+	answered := 0
+	buf := make([]byte, maxUDPSize)
+	for {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := client.ReadFrom(buf); err != nil {
+			break
+		}
+		answered++
+	}
+
+	if n := peak.Load(); n > free {
+		t.Errorf("%d queries resolved at once, more than the %d free slots", n, free)
+	}
+	if answered == 0 || answered >= burst {
+		t.Errorf("%d of %d queries answered, want the excess shed", answered, burst)
+	}
+}
+
+func TestServerFingerprintPinning(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	server := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+
+	conn, err := tls.Dial("tcp", server.addr(), p.clientTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := sha256.Sum256(conn.ConnectionState().PeerCertificates[0].Raw)
+	conn.Close()
+	other := sha256.Sum256(p.caCert.Raw)
+
+	for name, tc := range map[string]struct {
+		fingerprint string
+		ok          bool
+	}{
+		"unpinned": {ok: true},
+		"matching": {fingerprint: hex.EncodeToString(leaf[:]), ok: true},
+		// As openssl x509 -fingerprint -sha256 prints it
+		"matching with colons": {fingerprint: strings.ToUpper(strings.Join(splitPairs(hex.EncodeToString(leaf[:])), ":")), ok: true},
+		"mismatching":          {fingerprint: hex.EncodeToString(other[:])},
+	} {
+		resetUpstreamPools()
+		config := &Config{Server: server.addr(), ServerName: testServerName, ServerFingerprint: tc.fingerprint}
+		tlsConfig, err := setupTestTLS(t, p, config)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		_, err = forwardToServer(context.Background(), buildTestQuery(1, "pin.example", typeA), server.addr(), tlsConfig)
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if !tc.ok && (err == nil || !strings.Contains(err.Error(), "does not match pinned fingerprint")) {
+			t.Errorf("%s: got %v, want a fingerprint mismatch", name, err)
+		}
+	}
+
+	for _, fingerprint := range []string{"not hex", "abcd"} {
+		if _, err := setupTestTLS(t, p, &Config{Server: server.addr(), ServerFingerprint: fingerprint}); err == nil {
+			t.Errorf("fingerprint %q accepted", fingerprint)
+		}
+	}
+}
+
+// splitPairs splits s into two-character strings.
+func splitPairs(s string) []string {
+	var pairs []string
+	for len(s) >= 2 {
+		pairs = append(pairs, s[:2])
+		s = s[2:]
+	}
+	return pairs
+}
+
+func TestLoadCASharedByTokenAndTLS(t *testing.T) {
+	p := newTestPKI(t)
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.caCert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := loadCA(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The one bundle verifies the token and the server certificates
+	config, err := loadConfig(filePaths{Config: writeTestToken(t, p, map[string]any{"server": "127.0.0.1:853"}, jwt.RegisteredClaims{})}, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := p.issue(t, testServerName, testServerName).Leaf
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: ca.Pool}); err != nil {
+		t.Fatalf("server certificate not trusted by the bundle's pool: %v", err)
+	}
+	cert, key := writeTestKeypair(t, t.TempDir(), "endpoint", p.issue(t, "endpoint"))
+	tlsConfig, err := setupTLS(config, filePaths{Cert: cert, Key: key}, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.RootCAs != ca.Pool {
+		t.Error("TLS config doesn't use the bundle's pool")
+	}
+
+	// A malformed CA fails loading before either uses it
+	if err := os.WriteFile(path, []byte("-----BEGIN CERTIFICATE-----\nbm90IGEgY2VydA==\n-----END CERTIFICATE-----\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCA(path); err == nil {
+		t.Fatal("malformed CA loaded")
+	}
+	_, err = NewResolver(ResolverConfig{Config: writeTestToken(t, p, map[string]any{"server": "127.0.0.1:853"}, jwt.RegisteredClaims{}), CA: path, Cert: cert, Key: key})
+	if err == nil || !strings.Contains(err.Error(), "failed to load CA") {
+		t.Fatalf("got %v, want the CA load to fail", err)
+	}
+}
+
+func TestLoadCAEncodings(t *testing.T) {
+	p := newTestPKI(t)
+	token := writeTestToken(t, p, map[string]any{"server": "127.0.0.1:853"}, jwt.RegisteredClaims{})
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"ca.der": p.caCert.Raw,
+		"ca.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.caCert.Raw}),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		ca, err := loadCA(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if _, err := loadConfig(filePaths{Config: token}, ca); err != nil {
+			t.Errorf("%s: token not verified: %v", name, err)
+		}
+	}
+}
+
+func TestLoadConfigTwoCABundle(t *testing.T) {
+	old, current := newTestPKI(t), newTestPKI(t)
+	var bundle []byte
+	for _, p := range []*testPKI{old, current} {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.caCert.Raw})...)
+	}
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(path, bundle, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := loadCA(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ca.Certs) != 2 {
+		t.Fatalf("%d certificates in the bundle, want 2", len(ca.Certs))
+	}
+
+	// Signed by the second key only
+	token := writeTestToken(t, current, map[string]any{"server": "127.0.0.1:853"}, jwt.RegisteredClaims{})
+	if _, err := loadConfig(filePaths{Config: token}, ca); err != nil {
+		t.Fatalf("token signed by the second CA refused: %v", err)
+	}
+	// and by neither
+	token = writeTestToken(t, newTestPKI(t), map[string]any{"server": "127.0.0.1:853"}, jwt.RegisteredClaims{})
+	if _, err := loadConfig(filePaths{Config: token}, ca); err == nil {
+		t.Fatal("token signed by another CA accepted")
+	}
+}
+
+func TestHandleDNSQueryTimeouts(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	tlsConfig := p.clientTLS(t)
+	delayed := func(d time.Duration) func([]byte) []byte {
+		return func(query []byte) []byte {
+			time.Sleep(d)
+			return answerA(60, [4]byte{10, 0, 0, 1})(query)
+		}
+	}
+	fast := startMockDoT(t, p, 0, delayed(50*time.Millisecond))
+	slow := startMockDoT(t, p, 0, delayed(time.Second))
+
+	for name, tc := range map[string]struct {
+		server          string
+		upstreamTimeout time.Duration
+		queryTimeout    time.Duration
+		rcode           int
+	}{
+		"within both":           {server: fast.addr(), upstreamTimeout: 300 * time.Millisecond, queryTimeout: time.Second, rcode: rcodeSuccess},
+		"over upstream timeout": {server: slow.addr(), upstreamTimeout: 300 * time.Millisecond, queryTimeout: 5 * time.Second, rcode: rcodeServFail},
+		"over query timeout":    {server: slow.addr(), upstreamTimeout: 5 * time.Second, queryTimeout: 300 * time.Millisecond, rcode: rcodeServFail},
+	} {
+		setForTest(t, upstreamTimeout, tc.upstreamTimeout)
+		setForTest(t, queryTimeout, tc.queryTimeout)
+		responseCache.Flush()
+		w := &queryWriter{}
+		start := time.Now()
+		handleDNSQuery(context.Background(), w, buildTestQuery(1, "timeout.example", typeA), &Config{Server: tc.server, NoPublicDNS: true}, tlsConfig)
+		elapsed := time.Since(start)
+		if w.response == nil || msgRcode(w.response) != tc.rcode {
+			t.Errorf("%s: got %v, want rcode %d", name, w.response, tc.rcode)
+		}
+		if limit := min(tc.upstreamTimeout, tc.queryTimeout) + 500*time.Millisecond; elapsed > limit {
+			t.Errorf("%s: answered after %s, past the timeouts", name, elapsed)
+		}
+	}
+}
+
+func TestBundleSources(t *testing.T) {
+	p := newTestPKI(t)
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.caCert.Raw})
+	token, err := os.ReadFile(writeTestToken(t, p, map[string]any{"server": "10.0.0.1:853"}, jwt.RegisteredClaims{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(t.TempDir(), "config.zt")
+	if err := os.WriteFile(configFile, token, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// As pasted into an environment, with a trailing newline
+	t.Setenv("TEST_ZT_CONFIG", string(token)+"\n")
+	t.Setenv("TEST_ZT_CA", string(caPEM))
+
+	// Stdin is read once, whichever of config and CA asks first
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(token)
+	w.Close()
+	setForTest(t, &os.Stdin, r)
+	stdinOnce = sync.Once{}
+	t.Cleanup(func() {
+		stdinOnce = sync.Once{}
+		stdinData, stdinErr = nil, nil
+	})
+
+	for name, paths := range map[string]filePaths{
+		"files":          {Config: configFile, CA: caFile},
+		"environment":    {Config: envSourcePrefix + "TEST_ZT_CONFIG", CA: envSourcePrefix + "TEST_ZT_CA"},
+		"stdin":          {Config: "-", CA: caFile},
+		"stdin replayed": {Config: "-", CA: envSourcePrefix + "TEST_ZT_CA"},
+	} {
+		ca, err := loadCA(paths.CA)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		config, err := loadConfig(paths, ca)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if config.Server != "10.0.0.1:853" {
+			t.Errorf("%s: loaded server %q", name, config.Server)
+		}
+	}
+
+	if _, err := readSource(envSourcePrefix + "TEST_ZT_UNSET"); err == nil || !strings.Contains(err.Error(), "TEST_ZT_UNSET is not set") {
+		t.Errorf("got %v for an unset variable", err)
+	}
+}
+
+func TestFlagPathsPrecedence(t *testing.T) {
+	setForTest(t, configPath, "config.zt")
+	setForTest(t, caPath, "ca.crt")
+	t.Setenv("ZT_CONFIG", "")
+	t.Setenv("ZT_CA", "")
+	if paths := flagPaths(); paths.Config != "config.zt" || paths.CA != "ca.crt" {
+		t.Errorf("paths %+v without the variables, want the flag defaults", paths)
+	}
+	t.Setenv("ZT_CONFIG", "token")
+	t.Setenv("ZT_CA", "pem")
+	if paths := flagPaths(); paths.Config != envSourcePrefix+"ZT_CONFIG" || paths.CA != envSourcePrefix+"ZT_CA" {
+		t.Errorf("paths %+v, want the variables over flags not given", paths)
+	}
+}
+
+func TestServeUDPOverlappingQueries(t *testing.T) {
+	addr := serveTestListeners(t, "127.0.0.1:0")[0].addr().String()
+
+	// Many clients at once, each with names of its own, so a handler
+	// reading a buffer the next read overwrote answers the wrong question
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for c := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("udp", addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			buf := make([]byte, maxUDPSize)
+			for i := range 25 {
+				query := buildTestQuery(uint16(c<<8|i), fmt.Sprintf("n%d.c%d.overlap.example", i, c), typeA)
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				if _, err := conn.Write(query); err != nil {
+					errs <- err
+					return
+				}
+				n, err := conn.Read(buf)
+				if err != nil {
+					errs <- fmt.Errorf("client %d query %d: %v", c, i, err)
+					return
+				}
+				if !sameID(query, buf[:n]) || !sameQuestion(query, buf[:n]) {
+					errs <- fmt.Errorf("client %d query %d: answer to another query", c, i)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestForwardToServerFailureClasses(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, upstreamTimeout, 200*time.Millisecond)
+	p := newTestPKI(t)
+	otherQuestion := func(query []byte) []byte {
+		return buildTestAnswer(buildTestQuery(msgID(query), "other.example", typeA), 60, [4]byte{10, 0, 0, 1})
+	}
+	for name, tc := range map[string]struct {
+		server string
+		want   error
+	}{
+		"refused":        {server: "127.0.0.1:1", want: errUnreachable},
+		"timeout":        {server: startMockDoT(t, p, 0, hangingAnswer(t)).addr(), want: errUnreachable},
+		"closed":         {server: startMockDoT(t, p, 0, func([]byte) []byte { return nil }).addr(), want: errUnreachable},
+		"short":          {server: startMockDoT(t, p, 0, func([]byte) []byte { return []byte{1, 2, 3} }).addr(), want: errMalformed},
+		"other question": {server: startMockDoT(t, p, 0, otherQuestion).addr(), want: errMalformed},
+	} {
+		_, err := forwardToServer(context.Background(), buildTestQuery(1, "class.example", typeA), tc.server, p.clientTLS(t))
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", name, err, tc.want)
+		}
+	}
+}
+
+func TestHandleDNSQueryFailureClasses(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	tlsConfig := p.clientTLS(t)
+	malformedServer := startMockDoT(t, p, 0, func([]byte) []byte { return []byte{1, 2, 3} })
+	for name, tc := range map[string]struct {
+		server    string
+		malformed float64
+		log       string
+	}{
+		"unreachable": {server: "127.0.0.1:1", log: "Query failed, upstream unreachable"},
+		"malformed":   {server: malformedServer.addr(), malformed: 1, log: "Query failed, upstream sent a malformed response"},
+	} {
+		logs := captureLogs(t, "info")
+		errorsBefore := testutil.ToFloat64(upstreamErrors.WithLabelValues("dot"))
+		malformedBefore := testutil.ToFloat64(upstreamMalformed.WithLabelValues("dot"))
+
+		w := &queryWriter{}
+		config := &Config{Server: tc.server, NoPublicDNS: true}
+		handleDNSQuery(context.Background(), w, buildTestQuery(1, name+".example", typeA), config, tlsConfig)
+		if w.response == nil || msgRcode(w.response) != rcodeServFail {
+			t.Errorf("%s: answered %v, want SERVFAIL", name, w.response)
+		}
+		if n := testutil.ToFloat64(upstreamErrors.WithLabelValues("dot")) - errorsBefore; n != 1 {
+			t.Errorf("%s: %v upstream errors counted, want 1", name, n)
+		}
+		if n := testutil.ToFloat64(upstreamMalformed.WithLabelValues("dot")) - malformedBefore; n != tc.malformed {
+			t.Errorf("%s: %v malformed responses counted, want %v", name, n, tc.malformed)
+		}
+		if !strings.Contains(logs.String(), tc.log) {
+			t.Errorf("%s: no %q in the logs:\n%s", name, tc.log, logs)
+		}
+	}
+}
+
+func TestRaceServiceQuery(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, raceService, true)
+	p := newTestPKI(t)
+	tlsConfig := p.clientTLS(t)
+	slow := func(answer func([]byte) []byte) func([]byte) []byte {
+		return func(query []byte) []byte {
+			time.Sleep(500 * time.Millisecond)
+			return answer(query)
+		}
+	}
+	slowPublic := startMockPublic(t, slow(answerA(60, [4]byte{192, 0, 2, 1})))
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+
+	// The public side is slow, the upstream answers first
+	config := &Config{Type: "service", Server: upstream.addr(), PublicDNS: []string{slowPublic.addr}}
+	start := time.Now()
+	resp, path, err := resolveQuery(context.Background(), buildTestQuery(1, "race.example", typeA), config, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != pathUpstream || !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("answered %v via %s, want the upstream's 10.0.0.1", firstA(t, resp), path)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Fatalf("took %s, waited for the slow public resolver", elapsed)
+	}
+
+	// And the other way round
+	public := startMockPublic(t, answerA(60, [4]byte{192, 0, 2, 1}))
+	slowUpstream := startMockDoT(t, p, 0, slow(answerA(60, [4]byte{10, 0, 0, 1})))
+	config = &Config{Type: "service", Server: slowUpstream.addr(), PublicDNS: []string{public.addr}}
+	start = time.Now()
+	resp, path, err = resolveQuery(context.Background(), buildTestQuery(2, "race.example", typeA), config, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != pathPublic || !firstA(t, resp).Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("answered %v via %s, want public DNS's 192.0.2.1", firstA(t, resp), path)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Fatalf("took %s, waited for the slow upstream", elapsed)
+	}
+
+	// Off by default: public DNS first, however slow
+	setForTest(t, raceService, false)
+	config = &Config{Type: "service", Server: upstream.addr(), PublicDNS: []string{slowPublic.addr}}
+	_, path, err = resolveQuery(context.Background(), buildTestQuery(3, "serial.example", typeA), config, tlsConfig)
+	if err != nil || path != pathPublic {
+		t.Fatalf("without -race-service answered via %s, %v, want public", path, err)
+	}
+}
+
+func TestNoPublicDNS(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	tlsConfig := p.clientTLS(t)
+	public := startMockPublic(t, answerA(60, [4]byte{192, 0, 2, 1}))
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+
+	for _, viaFlag := range []bool{false, true} {
+		setForTest(t, noPublicDNS, viaFlag)
+		for _, config := range []*Config{
+			// Service endpoints otherwise ask public DNS first
+			{Type: "service", Server: upstream.addr()},
+			{Domains: []string{"internal.corp"}, Server: upstream.addr()},
+			// Nothing answers upstream: SERVFAIL, no public fallback
+			{Type: "service", Server: "127.0.0.1:1"},
+		} {
+			config.PublicDNS = []string{public.addr}
+			config.NoPublicDNS = !viaFlag
+			w := &queryWriter{}
+			handleDNSQuery(context.Background(), w, buildTestQuery(1, "public.example", typeA), config, tlsConfig)
+			want := rcodeSuccess
+			if config.Server == "127.0.0.1:1" {
+				want = rcodeServFail
+			}
+			if w.response == nil || msgRcode(w.response) != want {
+				t.Errorf("flag %v, server %s: answered %v, want rcode %d", viaFlag, config.Server, w.response, want)
+			}
+			responseCache.Flush()
+		}
+	}
+	if n := public.queries.Load(); n != 0 {
+		t.Fatalf("public DNS got %d queries, want none", n)
+	}
+	if n := upstream.queries.Load(); n != 4 {
+		t.Fatalf("upstream got %d queries, want 4", n)
+	}
+
+	// Without the option the service endpoint goes public
+	setForTest(t, noPublicDNS, false)
+	config := &Config{Type: "service", Server: upstream.addr(), PublicDNS: []string{public.addr}}
+	handleDNSQuery(context.Background(), &queryWriter{}, buildTestQuery(1, "public.example", typeA), config, tlsConfig)
+	if n := public.queries.Load(); n != 1 {
+		t.Fatalf("public DNS got %d queries with the fallback on, want 1", n)
+	}
+}
+
+func TestLoadConfigTokenIdentity(t *testing.T) {
+	p := newTestPKI(t)
+	config := map[string]any{"server": "10.0.0.1:853"}
+	for name, tc := range map[string]struct {
+		claims            jwt.RegisteredClaims
+		audience, subject string
+		want              string
+	}{
+		"nothing expected": {claims: jwt.RegisteredClaims{Audience: jwt.ClaimStrings{"tenant-b"}, Subject: "ep-2"}},
+		"matching": {
+			claims:   jwt.RegisteredClaims{Audience: jwt.ClaimStrings{"tenant-b", "tenant-a"}, Subject: "ep-1"},
+			audience: "tenant-a", subject: "ep-1",
+		},
+		"other audience": {
+			claims:   jwt.RegisteredClaims{Audience: jwt.ClaimStrings{"tenant-b"}, Subject: "ep-1"},
+			audience: "tenant-a", subject: "ep-1",
+			want: `does not include "tenant-a"`,
+		},
+		"no audience": {
+			claims:   jwt.RegisteredClaims{Subject: "ep-1"},
+			audience: "tenant-a",
+			want:     "token has no audience",
+		},
+		"other subject": {
+			claims:   jwt.RegisteredClaims{Audience: jwt.ClaimStrings{"tenant-a"}, Subject: "ep-2"},
+			audience: "tenant-a", subject: "ep-1",
+			want: `subject "ep-2" does not match "ep-1"`,
+		},
+		"no subject": {
+			claims:  jwt.RegisteredClaims{},
+			subject: "ep-1",
+			want:    "token has no subject",
+		},
+	} {
+		setForTest(t, expectedAudience, tc.audience)
+		setForTest(t, expectedSubject, tc.subject)
+		_, err := loadConfig(filePaths{Config: writeTestToken(t, p, config, tc.claims)}, p.caBundle())
+		if tc.want == "" && err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%s: got error %v, want %q", name, err, tc.want)
+		}
+	}
+}
+
+func TestUpstreamOverride(t *testing.T) {
+	config := &Config{DomainUpstreams: map[string]string{
+		"corp":          "10.0.0.1:853",
+		"eng.corp.":     "10.0.0.2:853",
+		"API.eng.corp":  "10.0.0.3:853",
+		"":              "10.0.0.9:853",
+		"other.example": "10.0.0.4:853",
+	}}
+	for qname, want := range map[string]string{
+		"corp":               "10.0.0.1:853",
+		"hr.corp":            "10.0.0.1:853",
+		"eng.corp":           "10.0.0.2:853",
+		"build.eng.corp.":    "10.0.0.2:853",
+		"api.eng.corp":       "10.0.0.3:853",
+		"v1.API.Eng.Corp":    "10.0.0.3:853",
+		"xapi.eng.corp":      "10.0.0.2:853",
+		"deep.other.example": "10.0.0.4:853",
+		"notcorp":            "",
+		"example.com":        "",
+		"":                   "",
+	} {
+		server, ok := config.upstreamOverride(qname)
+		if server != want || ok != (want != "") {
+			t.Errorf("%q routed to %q, %v, want %q", qname, server, ok, want)
+		}
+	}
+}
+
+func TestResolveQueryDomainUpstreams(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	tlsConfig := p.clientTLS(t)
+	def := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	corp := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 2}))
+	eng := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 3}))
+	config := &Config{
+		Server:          def.addr(),
+		NoPublicDNS:     true,
+		DomainUpstreams: map[string]string{"corp": corp.addr(), "eng.corp": eng.addr()},
+	}
+	for name, want := range map[string]net.IP{
+		"www.corp":       net.IPv4(10, 0, 0, 2),
+		"ci.eng.corp":    net.IPv4(10, 0, 0, 3),
+		"www.example":    net.IPv4(10, 0, 0, 1),
+		"eng.corp.other": net.IPv4(10, 0, 0, 1),
+	} {
+		resp, _, err := resolveQuery(context.Background(), buildTestQuery(1, name, typeA), config, tlsConfig)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if ip := firstA(t, resp); !ip.Equal(want) {
+			t.Errorf("%s answered %v, want %v", name, ip, want)
+		}
+	}
+	if def.queries.Load() != 2 || corp.queries.Load() != 1 || eng.queries.Load() != 1 {
+		t.Errorf("queries by upstream: default %d, corp %d, eng %d", def.queries.Load(), corp.queries.Load(), eng.queries.Load())
+	}
+}
+
+func TestServeUDPTruncatesCachedAnswer(t *testing.T) {
+	resetUpstreamState(t)
+	initQuerySlots()
+	p := newTestPKI(t)
+	// TXT answers of about 1500 bytes, over what a client without EDNS
+	// can take
+	upstream := startMockDoT(t, p, 0, func(query []byte) []byte {
+		resp := errorResponse(removeOPT(query), rcodeSuccess)
+		for range 6 {
+			txt := append([]byte{240}, bytes.Repeat([]byte("y"), 240)...)
+			resp = appendRecord(resp, sectionAnswer, questionOwner, typeTXT, classIN, 300, txt)
+		}
+		return resp
+	})
+	state := &endpointState{
+		config:    &Config{Server: upstream.addr(), NoPublicDNS: true},
+		tlsConfig: p.clientTLS(t),
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	go serveUDP(context.Background(), udp, func() *endpointState { return state })
+	go serveTCP(context.Background(), tcp, func() *endpointState { return state })
+
+	// The first, large enough query fills the cache
+	big := withTestOPT(buildTestQuery(1, "big.example", typeTXT), 4096)
+	if resp := exchangeTestUDP(t, udp.LocalAddr().String(), big); msgFlags(resp)&flagTC != 0 {
+		t.Fatal("truncated for a 4096 byte buffer")
+	}
+
+	query := buildTestQuery(0x5151, "big.example", typeTXT)
+	resp := exchangeTestUDP(t, udp.LocalAddr().String(), query)
+	if len(resp) > 512 {
+		t.Errorf("%d byte response to a client without EDNS", len(resp))
+	}
+	if msgFlags(resp)&flagTC == 0 {
+		t.Error("TC clear")
+	}
+	if msgID(resp) != 0x5151 || msgFlags(resp)&flagQR == 0 || !bytes.Equal(resp[dnsHeaderLen:], query[dnsHeaderLen:]) {
+		t.Errorf("header or question not kept: %x", resp)
+	}
+	if _, an, _, _ := msgCounts(resp); an != 0 {
+		t.Errorf("%d answers left in the truncated response", an)
+	}
+
+	// The retry over TCP gets the whole answer
+	resp = exchangeTestTCP(t, tcp.Addr().String(), query)
+	if _, an, _, _ := msgCounts(resp); an != 6 || msgFlags(resp)&flagTC != 0 {
+		t.Errorf("%d answers over TCP, TC %v, want all 6", an, msgFlags(resp)&flagTC != 0)
+	}
+	if n := upstream.queries.Load(); n != 1 {
+		t.Errorf("upstream got %d queries, want 1 with the rest from cache", n)
+	}
+}
+
+// checkCancelAborts runs exchange with a context cancelled after 100ms and
+// fails the test unless it returns soon after, well inside the timeouts.
+func checkCancelAborts(t *testing.T, name string, exchange func(ctx context.Context)) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(100*time.Millisecond, cancel)
+	defer timer.Stop()
+	start := time.Now()
+	exchange(ctx)
+	switch elapsed := time.Since(start); {
+	case elapsed < 100*time.Millisecond:
+		t.Errorf("%s: returned after %s, before the context was cancelled", name, elapsed)
+	case elapsed > 2*time.Second:
+		t.Errorf("%s: returned %s after the context was cancelled", name, elapsed)
+	}
+}
+
+func TestForwardingHonorsCancel(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, upstreamTimeout, 30*time.Second)
+	setForTest(t, publicTimeout, 30*time.Second)
+	p := newTestPKI(t)
+	slow := startMockDoT(t, p, 0, hangingAnswer(t))
+	silent := startMockPublic(t, func([]byte) []byte { return nil })
+	query := buildTestQuery(1, "slow.example", typeA)
+
+	checkCancelAborts(t, "forwardToServer", func(ctx context.Context) {
+		if _, err := forwardToServer(ctx, query, slow.addr(), p.clientTLS(t)); err == nil {
+			t.Error("forwardToServer: answered")
+		}
+	})
+	checkCancelAborts(t, "tryPublicDNS", func(ctx context.Context) {
+		if resp := tryPublicDNS(ctx, query, []string{silent.addr}); resp != nil {
+			t.Error("tryPublicDNS: answered")
+		}
+	})
+	// All the way from the client: SERVFAIL once the query's context goes
+	checkCancelAborts(t, "handleDNSQuery", func(ctx context.Context) {
+		w := &queryWriter{}
+		handleDNSQuery(ctx, w, query, &Config{Server: slow.addr(), NoPublicDNS: true}, p.clientTLS(t))
+		if w.response != nil && msgRcode(w.response) != rcodeServFail {
+			t.Errorf("handleDNSQuery: answered rcode %d", msgRcode(w.response))
+		}
+	})
+	if slow.queries.Load() == 0 || silent.queries.Load() == 0 {
+		t.Fatal("queries never reached the slow servers")
+	}
+}
+
+func TestCARotationTrustsBothRoots(t *testing.T) {
+	old, current := newTestPKI(t), newTestPKI(t)
+	// Servers under the new root still accept endpoint certificates from
+	// the old one, as during a rotation
+	current.pool.AddCert(old.caCert)
+	servers := map[*testPKI]*mockDoT{
+		old:     startMockDoT(t, old, 0, answerA(60, [4]byte{10, 0, 0, 1})),
+		current: startMockDoT(t, current, 0, answerA(60, [4]byte{10, 0, 0, 2})),
+	}
+	root := map[*testPKI]string{old: "the old root", current: "the new root"}
+
+	dir := t.TempDir()
+	writeCA := func(name string, pkis ...*testPKI) string {
+		var data []byte
+		for _, p := range pkis {
+			data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.caCert.Raw})...)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	for name, paths := range map[string][]string{
+		"one file":       {writeCA("both.crt", old, current)},
+		"-extra-ca-path": {writeCA("old.crt", old), writeCA("new.crt", current)},
+	} {
+		ca, err := loadCA(paths...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for p, server := range servers {
+			resetUpstreamPools()
+			token := writeTestToken(t, p, map[string]any{"server": server.addr(), "server_name": testServerName}, jwt.RegisteredClaims{})
+			config, err := loadConfig(filePaths{Config: token}, ca)
+			if err != nil {
+				t.Errorf("%s: token from %s refused: %v", name, root[p], err)
+				continue
+			}
+			cert, key := writeTestKeypair(t, t.TempDir(), "endpoint", old.issue(t, "endpoint"))
+			tlsConfig, err := setupTLS(config, filePaths{Cert: cert, Key: key}, ca)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := forwardToServer(context.Background(), buildTestQuery(1, "rotate.example", typeA), server.addr(), tlsConfig); err != nil {
+				t.Errorf("%s: server under %s refused: %v", name, root[p], err)
+			}
+		}
+	}
+
+	// With the old root dropped, its servers are no longer trusted
+	ca, err := loadCA(writeCA("new-only.crt", current))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key := writeTestKeypair(t, dir, "endpoint", old.issue(t, "endpoint"))
+	tlsConfig, err := setupTLS(&Config{Server: servers[old].addr(), ServerName: testServerName}, filePaths{Cert: cert, Key: key}, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetUpstreamPools()
+	if _, err := forwardToServer(context.Background(), buildTestQuery(1, "rotate.example", typeA), servers[old].addr(), tlsConfig); err == nil {
+		t.Error("server under the dropped root accepted")
+	}
+}
+
+func TestWriteErrorsLogged(t *testing.T) {
+	// UDP: the listening socket is gone by the time the answer is ready
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp.Close()
+	udpClient := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	// TCP: the client hung up before reading its answer
+	server, client := net.Pipe()
+	client.Close()
+	defer server.Close()
+
+	for name, w := range map[string]responseWriter{
+		"UDP": &udpResponseWriter{conn: udp, clientAddr: udpClient, maxSize: 512},
+		"TCP": &tcpResponseWriter{conn: server},
+	} {
+		logs := captureLogs(t, "warn")
+		before := testutil.ToFloat64(droppedQueries.WithLabelValues("write"))
+		// Answered locally, so nothing but the write can fail
+		handleDNSQuery(context.Background(), w, buildTestQuery(1, "printer.local", typeA), &Config{Server: "127.0.0.1:1"}, nil)
+
+		if !strings.Contains(logs.String(), "Failed to write response to client") {
+			t.Errorf("%s: write error not logged:\n%s", name, logs)
+		}
+		if addr := w.RemoteAddr().String(); !strings.Contains(logs.String(), addr) {
+			t.Errorf("%s: log lacks the client address %s:\n%s", name, addr, logs)
+		}
+		if n := testutil.ToFloat64(droppedQueries.WithLabelValues("write")) - before; n != 1 {
+			t.Errorf("%s: %v write failures counted, want 1", name, n)
+		}
+	}
+}
+
+func TestTCPResponseWriterWritesWholeMessage(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	resp := buildTestAnswer(buildTestQuery(1, "tcp.example", typeA), 60, [4]byte{10, 0, 0, 1})
+	errc := make(chan error, 1)
+	go func() { errc <- (&tcpResponseWriter{conn: server}).WriteResponse(resp) }()
+
+	// net.Pipe hands over each write in as many reads as the reader takes
+	got := make([]byte, 2+len(resp))
+	for off := 0; off < len(got); {
+		n, err := client.Read(got[off:min(off+3, len(got))])
+		if err != nil {
+			t.Fatal(err)
+		}
+		off += n
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if int(binary.BigEndian.Uint16(got)) != len(resp) || !bytes.Equal(got[2:], resp) {
+		t.Fatalf("wrote %x, want the length-prefixed %x", got, resp)
+	}
+	if err := (&tcpResponseWriter{conn: server}).WriteResponse(make([]byte, 0x10000)); err == nil {
+		t.Error("response over 65535 bytes written")
+	}
+}
+
+func TestConcurrentIdenticalQueriesShareUpstream(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	release := make(chan struct{})
+	upstream := startMockDoT(t, p, 0, func(query []byte) []byte {
+		<-release
+		return answerA(60, [4]byte{10, 0, 0, 1})(query)
+	})
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+	tlsConfig := p.clientTLS(t)
+
+	const n = 20
+	responses := make([][]byte, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &queryWriter{}
+			// Same question, in another case and with its own ID each time
+			name := "shared.example"
+			if i%2 == 1 {
+				name = "SHARED.Example"
+			}
+			handleDNSQuery(context.Background(), w, buildTestQuery(uint16(0x100+i), name, typeA), config, tlsConfig)
+			responses[i] = w.response
+		}()
+	}
+	// Let every query join the one in flight before it is answered
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := upstream.queries.Load(); got != 1 {
+		t.Fatalf("upstream got %d queries for %d identical ones, want 1", got, n)
+	}
+	for i, resp := range responses {
+		if resp == nil {
+			t.Errorf("query %d: no answer", i)
+			continue
+		}
+		if msgID(resp) != uint16(0x100+i) || !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Errorf("query %d: answered ID %#x with %v", i, msgID(resp), firstA(t, resp))
+		}
+	}
+}
+
+func TestMismatchedQuestionRejected(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	// A well-formed answer with the right ID, for AAAA instead of A
+	otherType := func(query []byte) []byte {
+		resp := answerA(60, [4]byte{10, 0, 0, 66})(query)
+		_, off, _ := expandName(resp, dnsHeaderLen)
+		binary.BigEndian.PutUint16(resp[off:], typeAAAA)
+		return resp
+	}
+	upstream := startMockDoT(t, p, 0, otherType)
+	logs := captureLogs(t, "info")
+	w := &queryWriter{}
+	handleDNSQuery(context.Background(), w, buildTestQuery(1, "mismatch.example", typeA), &Config{Server: upstream.addr(), NoPublicDNS: true}, p.clientTLS(t))
+	if w.response == nil || msgRcode(w.response) != rcodeServFail {
+		t.Fatalf("answered %v, want SERVFAIL", w.response)
+	}
+	if !strings.Contains(logs.String(), "malformed response") || !strings.Contains(logs.String(), "question does not match") {
+		t.Errorf("mismatch not logged:\n%s", logs)
+	}
+	if responseCache.Len() != 0 {
+		t.Error("mismatched answer cached")
+	}
+
+	// Public DNS answers for another question are discarded too, leaving
+	// the query to time out
+	setForTest(t, publicTimeout, 200*time.Millisecond)
+	public := startMockPublic(t, otherType)
+	if resp := tryPublicDNS(context.Background(), buildTestQuery(2, "mismatch.example", typeA), []string{public.addr}); resp != nil {
+		t.Fatal("public answer to another question relayed")
+	}
+}
+
+func TestRecursionDesired(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	// An authoritative-only upstream, answering with RA clear
+	upstream := startMockDoT(t, p, 0, func(query []byte) []byte {
+		resp := answerA(60, [4]byte{10, 0, 0, 1})(query)
+		binary.BigEndian.PutUint16(resp[2:4], msgFlags(resp)&^flagRA)
+		return resp
+	})
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+	query := func(name string, rd bool) []byte {
+		q := buildTestQuery(7, name, typeA)
+		if !rd {
+			binary.BigEndian.PutUint16(q[2:4], msgFlags(q)&^flagRD)
+		}
+		w := &queryWriter{}
+		handleDNSQuery(context.Background(), w, q, config, p.clientTLS(t))
+		if w.response == nil {
+			t.Fatalf("%s unanswered", name)
+		}
+		return w.response
+	}
+
+	// RD=1 is forwarded and relayed with RA set
+	resp := query("rd.example", true)
+	if msgRcode(resp) != rcodeSuccess || msgFlags(resp)&(flagRD|flagRA) != flagRD|flagRA {
+		t.Fatalf("recursive query answered %s with flags %#04x, want RD and RA", rcodeString(msgRcode(resp)), msgFlags(resp))
+	}
+
+	// RD=0 is answered from the cache only, with RD as asked
+	resp = query("rd.example", false)
+	if msgRcode(resp) != rcodeSuccess || msgFlags(resp)&flagRD != 0 || msgFlags(resp)&flagRA == 0 {
+		t.Errorf("cached name without RD answered %s with flags %#04x", rcodeString(msgRcode(resp)), msgFlags(resp))
+	}
+	if resp = query("uncached.example", false); msgRcode(resp) != rcodeRefused {
+		t.Errorf("uncached name without RD answered %s, want REFUSED", rcodeString(msgRcode(resp)))
+	}
+	if n := upstream.queries.Load(); n != 1 {
+		t.Errorf("%d queries forwarded, want only the recursive one", n)
+	}
+
+	// -non-recursive refuse refuses them even from the cache
+	setForTest(t, nonRecursive, "refuse")
+	if resp = query("rd.example", false); msgRcode(resp) != rcodeRefused {
+		t.Errorf("with -non-recursive refuse answered %s, want REFUSED", rcodeString(msgRcode(resp)))
+	}
+	if resp = query("rd.example", true); msgRcode(resp) != rcodeSuccess {
+		t.Errorf("recursive query answered %s with -non-recursive refuse", rcodeString(msgRcode(resp)))
+	}
+}
+
+func TestMalformedQueriesDropped(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+	valid := buildTestQuery(1, "valid.example", typeA)
+	response := buildTestAnswer(valid, 60, [4]byte{192, 0, 2, 1})
+	// A header claiming a question that isn't there
+	noQuestion := bytes.Clone(valid[:dnsHeaderLen])
+
+	packets := map[string][]byte{
+		"empty":        {},
+		"too short":    valid[:5],
+		"header only":  make([]byte, dnsHeaderLen),
+		"no question":  noQuestion,
+		"cut question": valid[:len(valid)-3],
+		"response":     response,
+	}
+	dropped := testutil.ToFloat64(droppedQueries.WithLabelValues("malformed"))
+	for name, packet := range packets {
+		w := &queryWriter{}
+		handleDNSQuery(context.Background(), w, packet, config, p.clientTLS(t))
+		if w.response != nil {
+			t.Errorf("%s: answered %x", name, w.response)
+		}
+	}
+	if got := testutil.ToFloat64(droppedQueries.WithLabelValues("malformed")) - dropped; got != float64(len(packets)) {
+		t.Errorf("%v malformed queries counted, want %d", got, len(packets))
+	}
+	if n := upstream.queries.Load(); n != 0 {
+		t.Errorf("%d malformed queries forwarded", n)
+	}
+
+	// A zero length prefix over TCP is dropped and counted too
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleTCPConn(context.Background(), server, currentState)
+		close(done)
+	}()
+	client.Write([]byte{0, 0})
+	<-done
+	client.Close()
+	if got := testutil.ToFloat64(droppedQueries.WithLabelValues("malformed")) - dropped; got != float64(len(packets)+1) {
+		t.Errorf("zero-length TCP query not counted")
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	for _, s := range []string{"1.1", "1.0", "", "TLS1.2"} {
+		if _, err := parseTLSVersion(s); err == nil {
+			t.Errorf("-tls-min-version %q accepted", s)
+		}
+	}
+
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	// An older upstream that only speaks TLS 1.2
+	serverTLS := p.serverTLS(t)
+	serverTLS.MaxVersion = tls.VersionTLS12
+	server := startMockDoTConfig(t, serverTLS, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	certPath, keyPath := writeTestKeypair(t, t.TempDir(), "endpoint", p.issue(t, "endpoint"))
+	config := &Config{Server: server.addr(), ServerName: testServerName}
+	forward := func() error {
+		t.Helper()
+		tlsConfig, err := setupTLS(config, filePaths{Cert: certPath, Key: keyPath}, p.caBundle())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = forwardToServer(context.Background(), buildTestQuery(1, "tls12.example", typeA), server.addr(), tlsConfig)
+		return err
+	}
+
+	if err := forward(); err == nil {
+		t.Fatal("TLS 1.2 upstream accepted by default")
+	}
+	setForTest(t, tlsMinVersion, "1.2")
+	logs := captureLogs(t, "debug")
+	if err := forward(); err != nil {
+		t.Fatalf("TLS 1.2 upstream with -tls-min-version 1.2: %v", err)
+	}
+	if !strings.Contains(logs.String(), `"tls":"TLS 1.2"`) {
+		t.Errorf("negotiated version not logged: %s", logs)
+	}
+}
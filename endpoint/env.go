@@ -0,0 +1,64 @@
+package endpoint
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Every flag can also be set from the environment as ZT_ followed by its
+// name upper-cased with dashes as underscores, e.g. -log-level as
+// ZT_LOG_LEVEL. A flag given on the command line wins over the
+// environment, which wins over the default.
+
+// noEnvFlags are the flags with no environment variable: the one-shot
+// modes, which a variable left in a service's environment would turn into
+// a process that prints and exits instead of serving.
+var noEnvFlags = map[string]bool{
+	"version": true,
+	"query":   true,
+	"check":   true,
+}
+
+// flagAliases maps alternative flag names to the flag they stand for.
+// Aliases have no environment variable of their own.
+var flagAliases = map[string]string{
+	"no-public": "no-public-dns",
+}
+
+func init() {
+	flag.BoolVar(noPublicDNS, "no-public", false, "alias for -no-public-dns")
+}
+
+// envName returns the environment variable bound to the flag name.
+func envName(name string) string {
+	return "ZT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvFlags sets each flag of fs not given on the command line from
+// its environment variable, if that is set, except for noEnvFlags. It
+// must run after fs.Parse.
+func applyEnvFlags(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+		if target, ok := flagAliases[f.Name]; ok {
+			set[target] = true
+		}
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, alias := flagAliases[f.Name]; alias || noEnvFlags[f.Name] || set[f.Name] || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for $%s: %v", value, name, setErr)
+			}
+		}
+	})
+	return err
+}
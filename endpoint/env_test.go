@@ -0,0 +1,96 @@
+package endpoint
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags is a few of the endpoint's flags on their own flag set, parsed
+// from args.
+type testFlags struct {
+	fs          *flag.FlagSet
+	logLevel    *string
+	timeout     *time.Duration
+	noPublicDNS *bool
+}
+
+func parseTestFlags(t *testing.T, args ...string) testFlags {
+	t.Helper()
+	f := testFlags{fs: flag.NewFlagSet("test", flag.ContinueOnError)}
+	f.logLevel = f.fs.String("log-level", "info", "")
+	f.timeout = f.fs.Duration("upstream-timeout", 5*time.Second, "")
+	f.noPublicDNS = f.fs.Bool("no-public-dns", false, "")
+	f.fs.BoolVar(f.noPublicDNS, "no-public", false, "")
+	if err := f.fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestEnvName(t *testing.T) {
+	for name, want := range map[string]string{
+		"log-level":    "ZT_LOG_LEVEL",
+		"p12-password": "ZT_P12_PASSWORD",
+		"listen":       "ZT_LISTEN",
+	} {
+		if got := envName(name); got != want {
+			t.Errorf("%s bound to $%s, want $%s", name, got, want)
+		}
+	}
+}
+
+func TestApplyEnvFlags(t *testing.T) {
+	t.Setenv("ZT_LOG_LEVEL", "debug")
+	t.Setenv("ZT_UPSTREAM_TIMEOUT", "2s")
+	t.Setenv("ZT_NO_PUBLIC_DNS", "false")
+
+	// Without the flags the environment wins over the defaults
+	f := parseTestFlags(t)
+	if err := applyEnvFlags(f.fs); err != nil {
+		t.Fatal(err)
+	}
+	if *f.logLevel != "debug" || *f.timeout != 2*time.Second {
+		t.Errorf("from the environment got -log-level %s -upstream-timeout %s", *f.logLevel, *f.timeout)
+	}
+
+	// Flags on the command line win over the environment, also when given
+	// by an alias
+	f = parseTestFlags(t, "-log-level", "warn", "-no-public")
+	if err := applyEnvFlags(f.fs); err != nil {
+		t.Fatal(err)
+	}
+	if *f.logLevel != "warn" || !*f.noPublicDNS {
+		t.Errorf("with flags given got -log-level %s -no-public-dns %v", *f.logLevel, *f.noPublicDNS)
+	}
+	if *f.timeout != 2*time.Second {
+		t.Errorf("-upstream-timeout %s, want the environment's 2s", *f.timeout)
+	}
+
+	t.Setenv("ZT_UPSTREAM_TIMEOUT", "soon")
+	err := applyEnvFlags(parseTestFlags(t).fs)
+	if err == nil || !strings.Contains(err.Error(), "$ZT_UPSTREAM_TIMEOUT") {
+		t.Errorf("got %v, want the invalid $ZT_UPSTREAM_TIMEOUT", err)
+	}
+}
+
+func TestApplyEnvFlagsSkipsOneShotModes(t *testing.T) {
+	t.Setenv("ZT_VERSION", "true")
+	t.Setenv("ZT_QUERY", "db.internal.corp")
+	t.Setenv("ZT_CHECK", "true")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	version := fs.Bool("version", false, "")
+	query := fs.String("query", "", "")
+	check := fs.Bool("check", false, "")
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEnvFlags(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *version || *query != "" || *check {
+		t.Errorf("from the environment got -version %v -query %q -check %v, want them unset", *version, *query, *check)
+	}
+}
@@ -0,0 +1,83 @@
+package endpoint
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+// expiryWarnings are the remaining lifetimes at which the endpoint warns
+// that its provisioned config is about to expire, longest first.
+var expiryWarnings = []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour}
+
+// expiryCheckInterval is how often watchExpiry looks at the config. Each
+// wait is jittered by up to a tenth so a fleet provisioned together
+// doesn't log in lockstep.
+const expiryCheckInterval = 10 * time.Minute
+
+// reportExpired logs, once per config, that it has expired.
+func (c *Config) reportExpired() {
+	c.expiredOnce.Do(func() {
+		slog.Error("Config expired, no longer forwarding queries; re-provision this endpoint", "expires", c.Expires)
+	})
+}
+
+// expiryStage returns how many of expiryWarnings have been crossed with
+// remaining lifetime left.
+func expiryStage(remaining time.Duration) int {
+	stage := 0
+	for _, threshold := range expiryWarnings {
+		if remaining <= threshold {
+			stage++
+		}
+	}
+	return stage
+}
+
+// formatRemaining renders a lifetime for logs and /healthz, in days once
+// it is more than two of them.
+func formatRemaining(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	}
+	return d.Round(time.Minute).String()
+}
+
+// checkExpiry warns about config's expiry when it has crossed a further
+// threshold than stage, and returns the new stage.
+func checkExpiry(config *Config, stage int, now time.Time) int {
+	if config.expiresAt.IsZero() {
+		return stage
+	}
+	if config.IsExpired(now) {
+		config.reportExpired()
+		return len(expiryWarnings) + 1
+	}
+	remaining := config.expiresAt.Sub(now)
+	next := expiryStage(remaining)
+	if next > stage {
+		slog.Warn("Config expires soon; re-provision this endpoint", "expires", config.Expires, "remaining", formatRemaining(remaining))
+	}
+	return next
+}
+
+// watchExpiry periodically warns ahead of the provisioned config's expiry.
+// Each threshold warns once per loaded config, so a reload with a new
+// expiry starts over.
+func watchExpiry() {
+	var (
+		config *Config
+		stage  int
+	)
+	for {
+		if state := currentState(); state != nil {
+			if state.config != config {
+				config, stage = state.config, 0
+			}
+			stage = checkExpiry(config, stage, time.Now())
+		}
+		jitter := rand.N(expiryCheckInterval / 10)
+		time.Sleep(expiryCheckInterval - expiryCheckInterval/20 + jitter)
+	}
+}
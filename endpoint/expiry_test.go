@@ -0,0 +1,73 @@
+package endpoint
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckExpiry(t *testing.T) {
+	logs := captureLogs(t, "warn")
+	now := time.Now()
+	config := &Config{Expires: "soon", expiresAt: now.Add(30 * time.Minute)}
+
+	// Under an hour left: every threshold crossed, one warning
+	stage := checkExpiry(config, 0, now)
+	if stage != len(expiryWarnings) {
+		t.Fatalf("stage %d with 30m left, want %d", stage, len(expiryWarnings))
+	}
+	if n := strings.Count(logs.String(), "Config expires soon"); n != 1 || !strings.Contains(logs.String(), `"remaining":"30m0s"`) {
+		t.Fatalf("logged %q, want one warning with 30m0s remaining", logs)
+	}
+	// Checked again at the same stage it stays quiet
+	logs.Reset()
+	checkExpiry(config, stage, now.Add(time.Minute))
+	if logs.Len() != 0 {
+		t.Errorf("warned again within the same stage: %s", logs)
+	}
+
+	// Once expired, an error logged once
+	stage = checkExpiry(config, stage, now.Add(time.Hour))
+	checkExpiry(config, stage, now.Add(2*time.Hour))
+	if n := strings.Count(logs.String(), "Config expired"); n != 1 {
+		t.Errorf("expiry logged %d times, want once: %s", n, logs)
+	}
+
+	// Five days out only the week threshold is crossed; no expiry never warns
+	logs.Reset()
+	if stage := checkExpiry(&Config{expiresAt: now.Add(5 * 24 * time.Hour)}, 0, now); stage != 1 {
+		t.Errorf("stage %d with 5d left, want 1", stage)
+	}
+	if stage := checkExpiry(&Config{}, 0, now); stage != 0 {
+		t.Errorf("stage %d without an expiry", stage)
+	}
+	if n := strings.Count(logs.String(), "\n"); n != 1 {
+		t.Errorf("logged %d lines, want the 5d warning only: %s", n, logs)
+	}
+}
+
+func TestHealthzReportsExpiry(t *testing.T) {
+	keepActiveState(t)
+	url := startTestHealthServer(t, time.Minute)
+	body := func() string {
+		t.Helper()
+		resp, err := http.Get(url + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return string(data)
+	}
+
+	activeState.Store(&endpointState{config: &Config{expiresAt: time.Now().Add(72*time.Hour + time.Minute)}})
+	if got := body(); !strings.Contains(got, "config expires in 3d") {
+		t.Errorf("/healthz said %q, want config expires in 3d", got)
+	}
+	activeState.Store(&endpointState{config: &Config{expiresAt: time.Now().Add(-time.Minute)}})
+	if got := body(); !strings.Contains(got, "config expired") {
+		t.Errorf("/healthz said %q after expiry", got)
+	}
+}
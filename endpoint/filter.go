@@ -0,0 +1,103 @@
+package endpoint
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// sinkholeTTL is the TTL of synthesized sinkhole answers, kept short so
+// unblocking a name takes effect quickly on clients.
+const sinkholeTTL = 60
+
+// domainFilter blocks names at the endpoint before they reach any
+// upstream. Entries use matchesDomain syntax. A name on the allowlist is
+// never blocked, so it can carve exceptions out of a broad denylist.
+type domainFilter struct {
+	allow    []string
+	deny     []string
+	sinkhole net.IP
+}
+
+// activeFilter is nil when no denylist is configured.
+var activeFilter atomic.Pointer[domainFilter]
+
+// loadDomainFilter reads the allow and deny lists. It returns nil when
+// there is no denylist, since nothing would be blocked.
+func loadDomainFilter(allowPath, denyPath, sinkhole string) (*domainFilter, error) {
+	if denyPath == "" {
+		return nil, nil
+	}
+
+	f := &domainFilter{}
+	var err error
+	if f.deny, err = readDomainList(denyPath); err != nil {
+		return nil, err
+	}
+	if allowPath != "" {
+		if f.allow, err = readDomainList(allowPath); err != nil {
+			return nil, err
+		}
+	}
+	if sinkhole != "" {
+		if f.sinkhole = net.ParseIP(sinkhole); f.sinkhole == nil {
+			return nil, fmt.Errorf("invalid sinkhole address %q", sinkhole)
+		}
+	}
+	return f, nil
+}
+
+// readDomainList reads one domain per line, ignoring blank lines and #
+// comments. Hosts-file lines ("0.0.0.0 ads.example.com") are accepted so
+// common blocklists can be used as they are.
+func readDomainList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+			domains = append(domains, fields[1:]...)
+		default:
+			domains = append(domains, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return domains, nil
+}
+
+func (f *domainFilter) blocks(qname string) bool {
+	return matchesDomain(qname, f.deny) && !matchesDomain(qname, f.allow)
+}
+
+// response answers a blocked query: NXDOMAIN, or with a sinkhole set, an
+// address record pointing at it. Types the sinkhole can't answer get an
+// empty NOERROR so clients don't fall back to another resolver.
+func (f *domainFilter) response(query []byte, qtype uint16) []byte {
+	if f.sinkhole == nil {
+		return errorResponse(query, rcodeNXDomain)
+	}
+
+	ip4 := f.sinkhole.To4()
+	switch {
+	case qtype == typeA && ip4 != nil:
+		return addressResponse(query, typeA, ip4, sinkholeTTL)
+	case qtype == typeAAAA && ip4 == nil:
+		return addressResponse(query, typeAAAA, f.sinkhole.To16(), sinkholeTTL)
+	}
+	return errorResponse(query, rcodeSuccess)
+}
@@ -0,0 +1,98 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeTestList writes content as a domain list file and returns its path.
+func writeTestList(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadDomainList(t *testing.T) {
+	path := writeTestList(t, "# ads\nads.example\n\n0.0.0.0 tracker.example pixel.example\t# inline\n  *.cdn.example  \n127.0.0.1 localhost.example\n")
+	domains, err := readDomainList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ads.example", "tracker.example", "pixel.example", "*.cdn.example", "localhost.example"}
+	if !slices.Equal(domains, want) {
+		t.Fatalf("read %q, want %q", domains, want)
+	}
+	if _, err := readDomainList(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing list read")
+	}
+}
+
+func TestDomainFilter(t *testing.T) {
+	resetUpstreamState(t)
+	keepActiveState(t)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+	tlsConfig := p.clientTLS(t)
+	deny := writeTestList(t, "blocked.example\n")
+	allow := writeTestList(t, "ok.blocked.example\n")
+
+	query := func(name string, qtype uint16) []byte {
+		t.Helper()
+		w := &queryWriter{}
+		handleDNSQuery(context.Background(), w, buildTestQuery(1, name, qtype), config, tlsConfig)
+		if w.response == nil {
+			t.Fatalf("%s: no answer", name)
+		}
+		return w.response
+	}
+
+	filter, err := loadDomainFilter(allow, deny, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeFilter.Store(filter)
+	if resp := query("ads.blocked.example", typeA); msgRcode(resp) != rcodeNXDomain {
+		t.Errorf("denied name answered with rcode %d, want NXDOMAIN", msgRcode(resp))
+	}
+	if n := upstream.queries.Load(); n != 0 {
+		t.Fatalf("denied name sent upstream")
+	}
+	// The allowlist carves an exception out of the denylist
+	if resp := query("ok.blocked.example", typeA); !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("allowed name answered %v, want the upstream's", firstA(t, resp))
+	}
+	if resp := query("www.example.com", typeA); msgRcode(resp) != rcodeSuccess || upstream.queries.Load() != 2 {
+		t.Errorf("unlisted name not passed through")
+	}
+
+	filter, err = loadDomainFilter("", deny, "10.10.10.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeFilter.Store(filter)
+	if resp := query("blocked.example", typeA); !firstA(t, resp).Equal(net.IPv4(10, 10, 10, 10)) {
+		t.Errorf("sinkholed A answered %v, want 10.10.10.10", firstA(t, resp))
+	}
+	resp := query("blocked.example", typeAAAA)
+	if _, an, _, _ := msgCounts(resp); msgRcode(resp) != rcodeSuccess || an != 0 {
+		t.Errorf("sinkholed AAAA answered rcode %d with %d records, want an empty NOERROR", msgRcode(resp), an)
+	}
+	if n := upstream.queries.Load(); n != 2 {
+		t.Errorf("sinkholed names sent upstream")
+	}
+
+	if _, err := loadDomainFilter("", deny, "not an address"); err == nil {
+		t.Error("invalid sinkhole accepted")
+	}
+	if f, err := loadDomainFilter(allow, "", ""); f != nil || err != nil {
+		t.Error("filter without a denylist")
+	}
+}
@@ -0,0 +1,101 @@
+package endpoint
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// maxCNAMEChain bounds how many CNAMEs flattenCNAME follows, which also
+// stops a looping chain.
+const maxCNAMEChain = 8
+
+// flattenCNAME rewrites an A or AAAA answer that reaches its addresses
+// through a CNAME chain into the addresses alone, owned by the question
+// name, for clients that handle chains poorly. Each address keeps the
+// smallest TTL along its chain. Answers that aren't a complete chain to
+// addresses of the queried type are returned unchanged, as are answers to
+// DO queries, whose signatures wouldn't cover the rewritten records.
+func flattenCNAME(response []byte) []byte {
+	if len(response) < dnsHeaderLen || msgRcode(response) != rcodeSuccess || ednsDO(response) {
+		return response
+	}
+	_, qtype, qclass, err := parseQuestion(response)
+	if err != nil || qclass != classIN || (qtype != typeA && qtype != typeAAAA) {
+		return response
+	}
+	qname, _, err := expandName(response, dnsHeaderLen)
+	if err != nil {
+		return response
+	}
+
+	type address struct {
+		owner []byte
+		ttl   uint32
+		rdata []byte
+	}
+	type alias struct {
+		target []byte
+		ttl    uint32
+	}
+	aliases := make(map[string]alias)
+	var addrs []address
+	var opt *resourceRecord
+	err = forEachRecord(response, func(rr resourceRecord) bool {
+		if rr.Section == sectionAdditional && rr.Type == typeOPT {
+			opt = &rr
+			return true
+		}
+		if rr.Section == sectionAuthority || rr.Class != classIN {
+			return true
+		}
+		owner, _, err := expandName(response, rr.Offset)
+		if err != nil {
+			return true
+		}
+		switch rr.Type {
+		case typeCNAME:
+			if target, _, err := expandName(response, rr.RDataOffset); err == nil {
+				aliases[string(owner)] = alias{target: target, ttl: rr.TTL}
+			}
+		case qtype:
+			addrs = append(addrs, address{owner: owner, ttl: rr.TTL, rdata: response[rr.RDataOffset : rr.RDataOffset+rr.RDataLen]})
+		}
+		return true
+	})
+	if err != nil {
+		return response
+	}
+
+	// Follow the chain from the question name to its final target
+	name, ttl := qname, uint32(0)
+	hops := 0
+	for ; hops <= maxCNAMEChain; hops++ {
+		a, ok := aliases[string(name)]
+		if !ok {
+			break
+		}
+		if hops == 0 || a.ttl < ttl {
+			ttl = a.ttl
+		}
+		name = a.target
+	}
+	if hops == 0 || hops > maxCNAMEChain {
+		return response
+	}
+
+	flat := questionOnly(response)
+	for _, addr := range addrs {
+		if bytes.Equal(addr.owner, name) {
+			flat = appendRecord(flat, sectionAnswer, questionOwner, qtype, classIN, min(ttl, addr.ttl), addr.rdata)
+		}
+	}
+	if an := binary.BigEndian.Uint16(flat[6:8]); an == 0 {
+		// The chain ends without an address, the client has to look it up
+		return response
+	}
+	if opt != nil {
+		flat = append(flat, response[opt.Offset:opt.RDataOffset+opt.RDataLen]...)
+		binary.BigEndian.PutUint16(flat[10:12], 1)
+	}
+	return flat
+}
@@ -0,0 +1,94 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+)
+
+// cnameTestAnswer answers query with a chain of CNAMEs, each name in chain
+// pointing at the next, and the A records addrs on the last one.
+func cnameTestAnswer(t *testing.T, query []byte, chain []string, ttls []uint32, addrs ...[4]byte) []byte {
+	t.Helper()
+	resp := errorResponse(query, rcodeSuccess)
+	owner := questionOwner
+	for i, name := range chain {
+		target, err := encodeName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp = appendRecord(resp, sectionAnswer, owner, typeCNAME, classIN, ttls[i], target)
+		owner = target
+	}
+	for _, addr := range addrs {
+		resp = appendRecord(resp, sectionAnswer, owner, typeA, classIN, 600, addr[:])
+	}
+	return resp
+}
+
+func TestFlattenCNAME(t *testing.T) {
+	query := buildTestQuery(1, "www.example", typeA)
+	chain := cnameTestAnswer(t, query, []string{"edge.cdn.example", "host.cdn.example"}, []uint32{300, 120},
+		[4]byte{192, 0, 2, 10}, [4]byte{192, 0, 2, 11})
+
+	flat := flattenCNAME(chain)
+	var got []string
+	forEachRecord(flat, func(rr resourceRecord) bool {
+		owner, _, _ := readName(flat, rr.Offset)
+		if rr.Type != typeA || owner != "www.example" {
+			t.Errorf("record of type %d owned by %q, want A records of www.example", rr.Type, owner)
+		}
+		if rr.TTL != 120 {
+			t.Errorf("TTL %d, want the chain's smallest 120", rr.TTL)
+		}
+		got = append(got, net.IP(flat[rr.RDataOffset:rr.RDataOffset+rr.RDataLen]).String())
+		return true
+	})
+	if len(got) != 2 || got[0] != "192.0.2.10" || got[1] != "192.0.2.11" {
+		t.Fatalf("flattened to %v, want both addresses", got)
+	}
+	if !sameQuestion(query, flat) || msgID(flat) != 1 {
+		t.Error("flattened answer lost the question")
+	}
+
+	// Left alone: a chain ending without addresses, a looping chain, and
+	// answers to DO queries
+	signed := withTestOPT(chain, 1232)
+	signed[len(signed)-4] |= 0x80 // DO, in the OPT record's TTL
+	if !ednsDO(signed) {
+		t.Fatal("DO not set")
+	}
+	for name, resp := range map[string][]byte{
+		"no address": cnameTestAnswer(t, query, []string{"edge.cdn.example"}, []uint32{300}),
+		"loop":       cnameTestAnswer(t, query, []string{"a.example", "www.example", "a.example"}, []uint32{60, 60, 60}, [4]byte{192, 0, 2, 1}),
+		"DO":         signed,
+	} {
+		if out := flattenCNAME(resp); !bytes.Equal(out, resp) {
+			t.Errorf("%s: rewritten", name)
+		}
+	}
+}
+
+func TestFlattenCNAMEForwarded(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, func(query []byte) []byte {
+		return cnameTestAnswer(t, removeOPT(query), []string{"host.cdn.example"}, []uint32{300}, [4]byte{10, 0, 0, 9})
+	})
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+	query := func(name string) []byte {
+		w := &queryWriter{}
+		handleDNSQuery(context.Background(), w, buildTestQuery(1, name, typeA), config, p.clientTLS(t))
+		return w.response
+	}
+
+	if _, an, _, _ := msgCounts(query("off.example")); an != 2 {
+		t.Errorf("%d answers without -flatten-cname, want the chain relayed", an)
+	}
+	setForTest(t, flattenCNAMEs, true)
+	resp := query("on.example")
+	if _, an, _, _ := msgCounts(resp); an != 1 || !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 9)) {
+		t.Errorf("%d answers with -flatten-cname, want the address alone", an)
+	}
+}
@@ -0,0 +1,46 @@
+package endpoint
+
+import "testing"
+
+// FuzzParseQuestion feeds arbitrary messages to parseQuestion, which sees
+// every packet a client sends. It must return an error or a name that fits
+// in a DNS name, 253 octets in text form, and never panic.
+func FuzzParseQuestion(f *testing.F) {
+	header := []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	seed := func(question ...byte) []byte {
+		return append(append([]byte(nil), header...), question...)
+	}
+
+	// A well-formed question for www.example.com A IN
+	f.Add(seed(3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1))
+	// The root name
+	f.Add(seed(0, 0, 1, 0, 1))
+	// A pointer to itself, and a pair of pointers to each other
+	f.Add(seed(0xc0, 12, 0, 1, 0, 1))
+	f.Add(seed(0xc0, 14, 0xc0, 12, 0, 1, 0, 1))
+	// A pointer forward past itself
+	f.Add(seed(0xc0, 16, 0, 1, 0, 1, 0))
+	// A pointer into the header
+	f.Add(seed(0xc0, 2, 0, 1, 0, 1))
+	// A pointer cut off after its first byte
+	f.Add(seed(0xc0))
+	// A label longer than the message, and a name without its terminator
+	f.Add(seed(63, 'a', 'b'))
+	f.Add(seed(1, 'a'))
+	// A name without its type and class, and with only half of them
+	f.Add(seed(1, 'a', 0))
+	f.Add(seed(1, 'a', 0, 0, 1))
+	// The reserved label types
+	f.Add(seed(0x40, 0, 0, 1, 0, 1))
+	f.Add(seed(0x80, 0, 0, 1, 0, 1))
+	// A header claiming a question that isn't there, and a short header
+	f.Add(seed())
+	f.Add(header[:11])
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		qname, _, _, err := parseQuestion(msg)
+		if err == nil && len(qname) > 253 {
+			t.Fatalf("parseQuestion returned a %d octet name", len(qname))
+		}
+	})
+}
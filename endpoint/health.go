@@ -0,0 +1,90 @@
+package endpoint
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Outcome of the most recent exchange with a ZeroTrust upstream, read by
+// /readyz. Public resolvers don't count, the endpoint is still useful
+// without them.
+var (
+	lastUpstreamSuccess atomic.Int64 // unix nanoseconds, 0 if none yet
+	lastUpstreamFailed  atomic.Bool
+)
+
+func recordUpstreamOutcome(ok bool, now time.Time) {
+	if ok {
+		lastUpstreamSuccess.Store(now.UnixNano())
+	}
+	lastUpstreamFailed.Store(!ok)
+}
+
+// readiness returns why the endpoint isn't ready to serve, or nil. After an
+// upstream failure it stays ready for window past the last success, so one
+// failed exchange doesn't take it out of rotation.
+func readiness(now time.Time, window time.Duration) error {
+	state := currentState()
+	if state == nil {
+		return fmt.Errorf("config not loaded")
+	}
+	if state.config.IsExpired(now) {
+		return fmt.Errorf("config expired at %s", state.config.Expires)
+	}
+	if allBreakersOpen(state.config.upstreams(), now) {
+		return fmt.Errorf("every upstream is failing, circuit breakers open")
+	}
+	if allUpstreamsUnhealthy(state.config.upstreams()) {
+		return fmt.Errorf("every upstream failed its health probe")
+	}
+	if lastUpstreamFailed.Load() {
+		last := lastUpstreamSuccess.Load()
+		if last == 0 || now.Sub(time.Unix(0, last)) > window {
+			return fmt.Errorf("last upstream query failed")
+		}
+	}
+	return nil
+}
+
+// startHealthServer serves /healthz (the process is up) and /readyz on
+// addr in the background.
+func startHealthServer(addr string, window time.Duration) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+		if state := currentState(); state != nil && !state.config.expiresAt.IsZero() {
+			if remaining := time.Until(state.config.expiresAt); remaining > 0 {
+				fmt.Fprintf(w, "config expires in %s\n", formatRemaining(remaining))
+			} else {
+				fmt.Fprintln(w, "config expired")
+			}
+		}
+		status := upstreamHealthStatus()
+		for _, server := range slices.Sorted(maps.Keys(status)) {
+			if s := status[server]; s.Healthy {
+				fmt.Fprintf(w, "upstream %s healthy\n", server)
+			} else {
+				fmt.Fprintf(w, "upstream %s unhealthy: %s\n", server, s.Error)
+			}
+		}
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := readiness(time.Now(), window); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	go func() {
+		slog.Info("Health checks listening", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Health server stopped", "error", err)
+		}
+	}()
+}
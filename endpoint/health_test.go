@@ -0,0 +1,124 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// keepUpstreamOutcome restores the recorded upstream outcome when the test
+// ends.
+func keepUpstreamOutcome(t *testing.T) {
+	success, failed := lastUpstreamSuccess.Load(), lastUpstreamFailed.Load()
+	t.Cleanup(func() {
+		lastUpstreamSuccess.Store(success)
+		lastUpstreamFailed.Store(failed)
+	})
+}
+
+// startTestHealthServer starts the health server on a free port and returns
+// its base URL once it answers.
+func startTestHealthServer(t *testing.T, window time.Duration) string {
+	t.Helper()
+	// Bind and release a port for the health server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	startHealthServer(addr, window)
+	url := "http://" + addr
+	for try := 0; ; try++ {
+		resp, err := http.Get(url + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			return url
+		}
+		if try == 20 {
+			t.Fatalf("health server not up: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func healthStatus(t *testing.T, url string) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReadyzFlipsOnUpstreamFailure(t *testing.T) {
+	resetUpstreamState(t)
+	keepActiveState(t)
+	keepUpstreamOutcome(t)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	tlsConfig := p.clientTLS(t)
+	activeState.Store(&endpointState{config: &Config{Server: upstream.addr(), NoPublicDNS: true}, tlsConfig: tlsConfig})
+	// No grace window, so a single failure shows
+	url := startTestHealthServer(t, 0)
+
+	query := func(server, name string) {
+		config := &Config{Server: server, NoPublicDNS: true}
+		handleDNSQuery(context.Background(), &queryWriter{}, buildTestQuery(1, name, typeA), config, tlsConfig)
+	}
+	query(upstream.addr(), "ok.example")
+	if code := healthStatus(t, url+"/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz %d after a successful query, want 200", code)
+	}
+	// An upstream nothing listens on
+	query("127.0.0.1:1", "fail.example")
+	if code := healthStatus(t, url+"/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz %d after a failed query, want 503", code)
+	}
+	if code := healthStatus(t, url+"/healthz"); code != http.StatusOK {
+		t.Errorf("healthz %d while not ready, want 200", code)
+	}
+	query(upstream.addr(), "again.example")
+	if code := healthStatus(t, url+"/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz %d after recovering, want 200", code)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	keepActiveState(t)
+	keepUpstreamOutcome(t)
+	now := time.Now()
+
+	activeState.Store(nil)
+	if err := readiness(now, time.Minute); err == nil {
+		t.Error("ready without a config")
+	}
+
+	activeState.Store(&endpointState{config: &Config{Server: "127.0.0.1:853"}})
+	recordUpstreamOutcome(true, now)
+	if err := readiness(now, time.Minute); err != nil {
+		t.Errorf("not ready after a success: %v", err)
+	}
+	// A failure within the window of the last success is tolerated
+	recordUpstreamOutcome(false, now.Add(30*time.Second))
+	if err := readiness(now.Add(30*time.Second), time.Minute); err != nil {
+		t.Errorf("not ready within the window: %v", err)
+	}
+	if err := readiness(now.Add(2*time.Minute), time.Minute); err == nil {
+		t.Error("ready past the window after a failure")
+	}
+	// Failing before any success is never ready
+	lastUpstreamSuccess.Store(0)
+	if err := readiness(now, time.Minute); err == nil {
+		t.Error("ready with no success yet")
+	}
+
+	recordUpstreamOutcome(true, now)
+	activeState.Store(&endpointState{config: &Config{Server: "127.0.0.1:853", expiresAt: now.Add(-time.Second)}})
+	if err := readiness(now, time.Minute); err == nil {
+		t.Error("ready with an expired config")
+	}
+}
@@ -0,0 +1,480 @@
+package endpoint
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testServerName is the name test upstream certificates are issued for
+// and test clients check them against.
+const testServerName = "dns-server"
+
+// buildTestQuery returns a recursive query with id for name and qtype in
+// class IN.
+func buildTestQuery(id uint16, name string, qtype uint16) []byte {
+	query := binary.BigEndian.AppendUint16(nil, id)
+	query = binary.BigEndian.AppendUint16(query, flagRD)
+	query = binary.BigEndian.AppendUint16(query, 1)
+	query = append(query, 0, 0, 0, 0, 0, 0)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" {
+			query = append(query, byte(len(label)))
+			query = append(query, label...)
+		}
+	}
+	query = append(query, 0)
+	query = binary.BigEndian.AppendUint16(query, qtype)
+	return binary.BigEndian.AppendUint16(query, classIN)
+}
+
+// buildTestAnswer returns a response to query, which must have no
+// additional records, answering it with one A record of ip.
+func buildTestAnswer(query []byte, ttl uint32, ip [4]byte) []byte {
+	resp := errorResponse(query, rcodeSuccess)
+	return appendRecord(resp, sectionAnswer, questionOwner, typeA, classIN, ttl, ip[:])
+}
+
+// withTestOPT returns msg, which must have no OPT record, with an empty
+// one advertising a UDP payload of size.
+func withTestOPT(msg []byte, size uint16) []byte {
+	out := bytes.Clone(msg)
+	_, _, _, ar := msgCounts(out)
+	binary.BigEndian.PutUint16(out[10:12], uint16(ar+1))
+	out = append(out, 0)
+	out = binary.BigEndian.AppendUint16(out, typeOPT)
+	out = binary.BigEndian.AppendUint16(out, size)
+	return append(out, 0, 0, 0, 0, 0, 0)
+}
+
+// testPKI is a CA issuing certificates for the servers and clients of a
+// test.
+type testPKI struct {
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	pool   *x509.CertPool
+}
+
+var testSerial atomic.Int64
+
+func newTestPKI(t testing.TB) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial.Add(1)),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testPKI{caCert: cert, caKey: key, pool: pool}
+}
+
+// issue returns a keypair for cn, valid for the names dnsNames and the
+// loopback addresses, usable by servers and clients alike.
+func (p *testPKI) issue(t testing.TB, cn string, dnsNames ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial.Add(1)),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.caCert, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// clientTLS returns the endpoint's TLS config for upstreams with
+// certificates from p, as loadTLSConfig builds it.
+func (p *testPKI) clientTLS(t testing.TB) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{p.issue(t, "endpoint")},
+		RootCAs:      p.pool,
+		ServerName:   testServerName,
+		MinVersion:   tls.VersionTLS13,
+	}
+}
+
+// serverTLS returns the TLS config of an upstream that requires client
+// certificates from p.
+func (p *testPKI) serverTLS(t testing.TB) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{p.issue(t, testServerName, testServerName)},
+		ClientCAs:    p.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+// caBundle returns p's CA as loadCA loads it.
+func (p *testPKI) caBundle() *caBundle {
+	return &caBundle{Pool: p.pool, Certs: []*x509.Certificate{p.caCert}}
+}
+
+// writeTestToken writes config as a provisioning token signed by p with
+// claims, and returns the path of the file.
+func writeTestToken(t testing.TB, p *testPKI, config any, claims jwt.RegisteredClaims) string {
+	t.Helper()
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, JWTClaims{Data: string(data), RegisteredClaims: claims}).SignedString(p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.zt")
+	if err := os.WriteFile(path, []byte(token), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// mockDoT is a DNS-over-TLS upstream answering with a function of the
+// query.
+type mockDoT struct {
+	ln      net.Listener
+	conns   atomic.Int32
+	queries atomic.Int32
+}
+
+// startMockDoT serves DoT on loopback until the test ends. answer returns
+// the response to each query, or nil to close the connection instead.
+// With maxPerConn above 0 a connection is closed after that many queries.
+func startMockDoT(t testing.TB, p *testPKI, maxPerConn int, answer func(query []byte) []byte) *mockDoT {
+	t.Helper()
+	return startMockDoTConfig(t, p.serverTLS(t), maxPerConn, answer)
+}
+
+// startMockDoTConfig is startMockDoT serving TLS with serverTLS, for
+// upstreams that differ from p.serverTLS.
+func startMockDoTConfig(t testing.TB, serverTLS *tls.Config, maxPerConn int, answer func(query []byte) []byte) *mockDoT {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	m := &mockDoT{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			m.conns.Add(1)
+			go func() {
+				defer conn.Close()
+				serveTestStream(conn, conn, maxPerConn, func(query []byte) []byte {
+					m.queries.Add(1)
+					return answer(query)
+				})
+			}()
+		}
+	}()
+	return m
+}
+
+// addr returns the address the upstream listens on.
+func (m *mockDoT) addr() string {
+	return m.ln.Addr().String()
+}
+
+// mockPublic is a plain DNS resolver answering over UDP and TCP on the
+// same loopback port, as public DNS does.
+type mockPublic struct {
+	addr    string
+	queries atomic.Int32
+	// tcpQueries counts the queries of queries that came over TCP
+	tcpQueries atomic.Int32
+}
+
+// startMockPublic serves plain DNS until the test ends. answer returns
+// the response to each query, or nil to ignore it.
+func startMockPublic(t testing.TB, answer func(query []byte) []byte) *mockPublic {
+	t.Helper()
+	return startMockPublicSplit(t, answer, answer)
+}
+
+// startMockPublicSplit is startMockPublic answering UDP queries with
+// udpAnswer and TCP ones with tcpAnswer.
+func startMockPublicSplit(t testing.TB, udpAnswer, tcpAnswer func(query []byte) []byte) *mockPublic {
+	t.Helper()
+	var udp *net.UDPConn
+	var tcp net.Listener
+	for try := 0; tcp == nil; try++ {
+		var err error
+		if udp, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+			t.Fatal(err)
+		}
+		if tcp, err = net.Listen("tcp", udp.LocalAddr().String()); err != nil {
+			udp.Close()
+			if try == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	m := &mockPublic{addr: udp.LocalAddr().String()}
+	countedTCP := func(query []byte) []byte {
+		m.queries.Add(1)
+		m.tcpQueries.Add(1)
+		return tcpAnswer(query)
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, client, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			m.queries.Add(1)
+			if resp := udpAnswer(bytes.Clone(buf[:n])); resp != nil {
+				udp.WriteToUDP(resp, client)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serveTestStream(conn, conn, 0, countedTCP)
+			}()
+		}
+	}()
+	return m
+}
+
+// serveTestStream answers length-prefixed queries read from r on w, as a
+// DNS-over-TCP server does, until r ends, answer returns nil or
+// maxPerConn queries have been answered.
+func serveTestStream(r io.Reader, w io.Writer, maxPerConn int, answer func(query []byte) []byte) {
+	for n := 0; maxPerConn <= 0 || n < maxPerConn; n++ {
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(r, query); err != nil {
+			return
+		}
+		resp := answer(query)
+		if resp == nil {
+			return
+		}
+		if _, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// answerA returns an answer function for startMockDoT giving every query
+// one A record of ip.
+func answerA(ttl uint32, ip [4]byte) func([]byte) []byte {
+	return func(query []byte) []byte {
+		return buildTestAnswer(removeOPT(query), ttl, ip)
+	}
+}
+
+// firstA returns the address of the first A record in resp.
+func firstA(t testing.TB, resp []byte) net.IP {
+	t.Helper()
+	var ip net.IP
+	err := forEachRecord(resp, func(rr resourceRecord) bool {
+		if rr.Section == sectionAnswer && rr.Type == typeA && rr.RDataLen == 4 {
+			ip = net.IP(resp[rr.RDataOffset : rr.RDataOffset+4])
+			return false
+		}
+		return true
+	})
+	if err != nil || ip == nil {
+		t.Fatalf("no A record in response: %v", err)
+	}
+	return ip
+}
+
+// resetUpstreamState drops the cached answers, pools, breakers and probe
+// results a test built up talking to upstreams, once it ends.
+func resetUpstreamState(t testing.TB) {
+	t.Cleanup(func() {
+		responseCache.Flush()
+		resetUpstreamPools()
+		resetDoHClients()
+		resetDoQConns()
+		resetBreakers()
+		resetUpstreamHealth()
+	})
+}
+
+// setForTest sets *p, a flag value or other global, to v for the rest of
+// the test.
+func setForTest[T any](t testing.TB, p *T, v T) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// hangingAnswer returns an answer function for startMockDoT that never
+// answers, holding each query until the test ends.
+func hangingAnswer(t testing.TB) func([]byte) []byte {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	return func([]byte) []byte {
+		<-done
+		return nil
+	}
+}
+
+// writeTestKeypair writes cert and its key as PEM files in dir named
+// name.crt and name.key, and returns their paths.
+func writeTestKeypair(t testing.TB, dir, name string, cert tls.Certificate) (certPath, keyPath string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// writeTestBundle writes p's CA and an endpoint keypair it issues to a
+// temporary directory, and returns their paths along with config's.
+func writeTestBundle(t testing.TB, p *testPKI, config string) ResolverConfig {
+	t.Helper()
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.caCert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, key := writeTestKeypair(t, dir, "endpoint", p.issue(t, "endpoint"))
+	return ResolverConfig{Config: config, CA: ca, Cert: cert, Key: key}
+}
+
+// useTestBundle writes a bundle as writeTestBundle does and points the
+// path flags at it, as an endpoint is started.
+func useTestBundle(t testing.TB, p *testPKI, config string) {
+	t.Helper()
+	bundle := writeTestBundle(t, p, config)
+	setForTest(t, configPath, bundle.Config)
+	setForTest(t, caPath, bundle.CA)
+	setForTest(t, certPath, bundle.Cert)
+	setForTest(t, keyPath, bundle.Key)
+}
+
+// exchangeTestUDP sends query to addr over UDP and returns the response.
+func exchangeTestUDP(t testing.TB, addr string, query []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no answer from %s over UDP: %v", addr, err)
+	}
+	return buf[:n]
+}
+
+// exchangeTestTCP sends query to addr over TCP and returns the response.
+func exchangeTestTCP(t testing.TB, addr string, query []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+		t.Fatal(err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		t.Fatalf("no answer from %s over TCP: %v", addr, err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// setupTestTLS runs setupTLS for config with an endpoint keypair issued by
+// p, as the endpoint builds its upstream TLS config at startup.
+func setupTestTLS(t testing.TB, p *testPKI, config *Config) (*tls.Config, error) {
+	t.Helper()
+	cert, key := writeTestKeypair(t, t.TempDir(), "endpoint", p.issue(t, "endpoint"))
+	return setupTLS(config, filePaths{Cert: cert, Key: key}, p.caBundle())
+}
@@ -0,0 +1,83 @@
+package endpoint
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// hostsTTL is the TTL of answers from the hosts file, short so an edit
+// takes effect on clients soon after a reload.
+const hostsTTL = 60
+
+// hostsTable maps names to the addresses a hosts file lists for them.
+// Listed names are answered locally and never reach an upstream.
+type hostsTable struct {
+	addrs map[string][]net.IP
+}
+
+// activeHosts is nil when no hosts file is configured.
+var activeHosts atomic.Pointer[hostsTable]
+
+// loadHosts reads a hosts file in /etc/hosts format: an address followed
+// by the names it answers for, with # comments. It returns nil when path
+// is empty.
+func loadHosts(path string) (*hostsTable, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	defer file.Close()
+
+	h := &hostsTable{addrs: make(map[string][]net.IP)}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("invalid line %d in %s, want an address and names", n, path)
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			h.addrs[name] = append(h.addrs[name], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return h, nil
+}
+
+// lookup returns the addresses listed for qname, matched exactly and
+// case-insensitively.
+func (h *hostsTable) lookup(qname string) ([]net.IP, bool) {
+	ips, ok := h.addrs[strings.ToLower(strings.TrimSuffix(qname, "."))]
+	return ips, ok
+}
+
+// response answers query for a listed name with its addresses of the
+// family qtype asks for. Other types, and a family the name has no
+// address of, get an empty NOERROR so the name doesn't leak upstream.
+func (h *hostsTable) response(query []byte, qtype uint16, ips []net.IP) []byte {
+	resp := errorResponse(query, rcodeSuccess)
+	for _, ip := range ips {
+		ip4 := ip.To4()
+		switch {
+		case qtype == typeA && ip4 != nil:
+			resp = appendRecord(resp, sectionAnswer, questionOwner, typeA, classIN, hostsTTL, ip4)
+		case qtype == typeAAAA && ip4 == nil:
+			resp = appendRecord(resp, sectionAnswer, questionOwner, typeAAAA, classIN, hostsTTL, ip.To16())
+		}
+	}
+	return resp
+}
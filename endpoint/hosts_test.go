@@ -0,0 +1,166 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// writeTestHosts writes data as a hosts file and returns its path.
+func writeTestHosts(t *testing.T, dir, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// answerAddrs returns the addresses in resp's A and AAAA answers.
+func answerAddrs(t *testing.T, resp []byte) []string {
+	t.Helper()
+	var addrs []string
+	for _, rr := range parseTestMessage(t, resp).Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, net.IP(body.AAAA[:]).String())
+		}
+	}
+	return addrs
+}
+
+func TestLoadHosts(t *testing.T) {
+	if h, err := loadHosts(""); h != nil || err != nil {
+		t.Fatalf("no path loaded %v, %v", h, err)
+	}
+	dir := t.TempDir()
+	h, err := loadHosts(writeTestHosts(t, dir, `
+# Local overrides
+10.1.1.1   intranet.corp  Wiki.Corp.   # a comment at the end
+2001:db8::1 intranet.corp
+10.1.1.2   wiki.corp
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][]string{
+		"intranet.corp":     {"10.1.1.1", "2001:db8::1"},
+		"WIKI.corp.":        {"10.1.1.1", "10.1.1.2"},
+		"www.intranet.corp": nil,
+	} {
+		ips, ok := h.lookup(name)
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		if ok != (want != nil) || !slices.Equal(got, want) {
+			t.Errorf("%s looked up as %v, %v, want %v", name, got, ok, want)
+		}
+	}
+
+	for name, data := range map[string]string{
+		"bad address": "10.1.1 host.corp\n",
+		"no names":    "10.1.1.1\n",
+	} {
+		if _, err := loadHosts(writeTestHosts(t, t.TempDir(), data)); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+	if _, err := loadHosts(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing hosts file loaded")
+	}
+}
+
+func TestHostsOverrides(t *testing.T) {
+	resetUpstreamState(t)
+	keepActiveState(t)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	hosts, err := loadHosts(writeTestHosts(t, t.TempDir(), "10.1.1.1 intranet.corp\n2001:db8::1 intranet.corp\n10.1.1.2 v4only.corp\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeHosts.Store(hosts)
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+	query := func(name string, qtype uint16) []byte {
+		t.Helper()
+		w := &queryWriter{}
+		handleDNSQuery(context.Background(), w, buildTestQuery(5, name, qtype), config, p.clientTLS(t))
+		if w.response == nil {
+			t.Fatalf("%s: no response", name)
+		}
+		return w.response
+	}
+
+	for name, tc := range map[string]struct {
+		name  string
+		qtype uint16
+		want  []string
+	}{
+		"A override":       {"intranet.corp", typeA, []string{"10.1.1.1"}},
+		"AAAA override":    {"Intranet.Corp.", typeAAAA, []string{"2001:db8::1"}},
+		"AAAA without one": {"v4only.corp", typeAAAA, nil},
+		"other type":       {"intranet.corp", typeTXT, nil},
+	} {
+		resp := query(tc.name, tc.qtype)
+		if rcode := msgRcode(resp); rcode != rcodeSuccess {
+			t.Errorf("%s: rcode %d", name, rcode)
+		}
+		if got := answerAddrs(t, resp); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: answered %v, want %v", name, got, tc.want)
+		}
+	}
+	if n := upstream.queries.Load(); n != 0 {
+		t.Fatalf("upstream asked %d times for listed names", n)
+	}
+
+	// Names not listed go upstream as ever
+	if got := answerAddrs(t, query("www.example.com", typeA)); !slices.Equal(got, []string{"10.0.0.1"}) {
+		t.Errorf("unlisted name answered %v, want the upstream's", got)
+	}
+	if n := upstream.queries.Load(); n != 1 {
+		t.Errorf("upstream asked %d times, want once for the unlisted name", n)
+	}
+}
+
+func TestHostsReload(t *testing.T) {
+	resetUpstreamState(t)
+	keepActiveState(t)
+	p := newTestPKI(t)
+	config := writeTestToken(t, p, map[string]any{"server": "10.0.0.1:853"}, jwt.RegisteredClaims{})
+	useTestBundle(t, p, config)
+	dir := t.TempDir()
+	setForTest(t, hostsPath, writeTestHosts(t, dir, "10.1.1.1 intranet.corp\n"))
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if ips, _ := activeHosts.Load().lookup("intranet.corp"); len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 1, 1, 1)) {
+		t.Fatalf("loaded %v", ips)
+	}
+
+	writeTestHosts(t, dir, "10.2.2.2 intranet.corp\n")
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if ips, _ := activeHosts.Load().lookup("intranet.corp"); len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 2, 2, 2)) {
+		t.Fatalf("after the reload loaded %v, want the edit", ips)
+	}
+
+	// A broken edit keeps the table loaded before
+	hosts := activeHosts.Load()
+	writeTestHosts(t, dir, "not-an-address intranet.corp\n")
+	if err := reloadConfig(); err == nil {
+		t.Fatal("reload accepted a broken hosts file")
+	}
+	if activeHosts.Load() != hosts {
+		t.Error("hosts table replaced by a failed reload")
+	}
+}
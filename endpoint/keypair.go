@@ -0,0 +1,99 @@
+package endpoint
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// keypairLoader serves the endpoint's client certificate, reloading it
+// from disk when any of its files' modification time changes so a rotated
+// keypair is picked up by the next handshake.
+type keypairLoader struct {
+	// files are watched for changes, parse reads the keypair from them
+	files []string
+	parse func() (tls.Certificate, error)
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	mods []time.Time
+}
+
+// newKeypairLoader loads the client identity from a PEM certificate and
+// key file.
+func newKeypairLoader(certPath, keyPath string) (*keypairLoader, error) {
+	return newLoader([]string{certPath, keyPath}, func() (tls.Certificate, error) {
+		return tls.LoadX509KeyPair(certPath, keyPath)
+	})
+}
+
+// newPKCS12Loader loads the client identity from a PKCS#12 (.p12/.pfx)
+// bundle. Any CA certificates in the bundle are sent as the chain.
+func newPKCS12Loader(path, password string) (*keypairLoader, error) {
+	return newLoader([]string{path}, func() (tls.Certificate, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		cert := tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: key, Leaf: leaf}
+		for _, c := range chain {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+		return cert, nil
+	})
+}
+
+func newLoader(files []string, parse func() (tls.Certificate, error)) (*keypairLoader, error) {
+	l := &keypairLoader{files: files, parse: parse}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// load reads the keypair if it changed since the last load. l.mu must be
+// held, or l not yet shared.
+func (l *keypairLoader) load() error {
+	mods := make([]time.Time, len(l.files))
+	for i, file := range l.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		mods[i] = info.ModTime()
+	}
+	if l.cert != nil && slices.EqualFunc(mods, l.mods, time.Time.Equal) {
+		return nil
+	}
+
+	cert, err := l.parse()
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %v", err)
+	}
+	l.cert = &cert
+	l.mods = mods
+	return nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate. If a
+// reload fails, e.g. because only one of the files has been replaced so
+// far, the previous keypair keeps being used.
+func (l *keypairLoader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.load(); err != nil {
+		slog.Warn("Client certificate reload failed, using the previous one", "cert", l.files[0], "error", err)
+	}
+	return l.cert, nil
+}
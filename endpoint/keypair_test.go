@@ -0,0 +1,259 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// rotateTestKeypair writes cert over the endpoint keypair in dir, moving
+// the files' modification time forward by bump so the change is seen even
+// on filesystems with coarse timestamps.
+func rotateTestKeypair(t *testing.T, dir string, cert tls.Certificate, bump time.Duration) {
+	t.Helper()
+	certPath, keyPath := writeTestKeypair(t, dir, "endpoint", cert)
+	mod := time.Now().Add(bump)
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func presentedCN(t *testing.T, l *keypairLoader) string {
+	t.Helper()
+	cert, err := l.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil {
+		t.Fatal("no leaf certificate")
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestKeypairLoaderReloads(t *testing.T) {
+	p := newTestPKI(t)
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeypair(t, dir, "endpoint", p.issue(t, "first"))
+	l, err := newKeypairLoader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := presentedCN(t, l); cn != "first" {
+		t.Fatalf("presented %q, want first", cn)
+	}
+
+	rotateTestKeypair(t, dir, p.issue(t, "second"), time.Minute)
+	if cn := presentedCN(t, l); cn != "second" {
+		t.Fatalf("presented %q after rotation, want second", cn)
+	}
+
+	// Only the certificate replaced so far: it doesn't match the key, so
+	// the previous keypair stays
+	third := t.TempDir()
+	thirdCert, _ := writeTestKeypair(t, third, "endpoint", p.issue(t, "third"))
+	data, err := os.ReadFile(thirdCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mod := time.Now().Add(2 * time.Minute)
+	os.Chtimes(certPath, mod, mod)
+	if cn := presentedCN(t, l); cn != "second" {
+		t.Fatalf("presented %q with a half-written rotation, want second", cn)
+	}
+
+	if _, err := newKeypairLoader(certPath, filepath.Join(dir, "missing.key")); err == nil {
+		t.Error("loader created without a key")
+	}
+}
+
+func TestRotatedCertPresented(t *testing.T) {
+	p := newTestPKI(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", p.serverTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	presented := make(chan string)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			tc := conn.(*tls.Conn)
+			cn := ""
+			if tc.Handshake() == nil {
+				cn = tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			conn.Close()
+			presented <- cn
+		}
+	}()
+
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeypair(t, dir, "endpoint", p.issue(t, "first"))
+	tlsConfig, err := setupTLS(&Config{Server: ln.Addr().String(), ServerName: testServerName}, filePaths{Cert: certPath, Key: keyPath}, p.caBundle())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A resumed session carries the certificate of the handshake it came
+	// from, so make every connection a full handshake
+	tlsConfig.ClientSessionCache = nil
+	dial := func() string {
+		t.Helper()
+		conn, err := tls.Dial("tcp", ln.Addr().String(), tlsConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		select {
+		case cn := <-presented:
+			return cn
+		case <-time.After(5 * time.Second):
+			t.Fatal("server saw no handshake")
+			return ""
+		}
+	}
+
+	if cn := dial(); cn != "first" {
+		t.Fatalf("server saw %q, want first", cn)
+	}
+	rotateTestKeypair(t, dir, p.issue(t, "second"), time.Minute)
+	if cn := dial(); cn != "second" {
+		t.Fatalf("server saw %q after rotation, want second", cn)
+	}
+}
+
+// writeTestPKCS12 writes cert and p's CA as a PKCS#12 bundle sealed with
+// password and returns its path.
+func writeTestPKCS12(t *testing.T, p *testPKI, cert tls.Certificate, password string) string {
+	t.Helper()
+	data, err := pkcs12.Modern.Encode(cert.PrivateKey, cert.Leaf, []*x509.Certificate{p.caCert}, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "endpoint.p12")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSetupTLSPKCS12(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	server := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	path := writeTestPKCS12(t, p, p.issue(t, "p12-endpoint"), "s3cret")
+	config := &Config{Server: server.addr(), ServerName: testServerName}
+
+	// The password comes from the environment, as the flag help suggests
+	setForTest(t, pkcs12Password, "")
+	t.Setenv("ZT_P12_PASSWORD", "s3cret")
+	if err := applyEnvFlags(flag.CommandLine); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := setupTLS(config, filePaths{PKCS12: path, Cert: "unused.crt", Key: "unused.key"}, p.caBundle())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tlsConfig.GetClientCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := cert.Leaf.Subject.CommonName; cn != "p12-endpoint" || len(cert.Certificate) != 2 {
+		t.Fatalf("loaded %q with %d certificates, want p12-endpoint and the CA", cn, len(cert.Certificate))
+	}
+	if _, err := forwardToServer(context.Background(), buildTestQuery(1, "p12.example", typeA), server.addr(), tlsConfig); err != nil {
+		t.Fatalf("mTLS with the PKCS#12 identity: %v", err)
+	}
+
+	setForTest(t, pkcs12Password, "wrong")
+	if _, err := setupTLS(config, filePaths{PKCS12: path}, p.caBundle()); err == nil {
+		t.Error("bundle opened with the wrong password")
+	}
+	setForTest(t, pkcs12Password, "s3cret")
+	if _, err := setupTLS(config, filePaths{PKCS12: filepath.Join(t.TempDir(), "missing.p12")}, p.caBundle()); err == nil {
+		t.Error("missing bundle loaded")
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config *Config
+		want   string
+		err    bool
+	}{
+		"server_name":     {config: &Config{Server: "10.0.0.1:853", ServerName: "dns.corp"}, want: "dns.corp"},
+		"host:port":       {config: &Config{Server: "dns.corp.example:853"}, want: "dns.corp.example"},
+		"IPv6":            {config: &Config{Server: "[2001:db8::53]:853"}, want: "2001:db8::53"},
+		"DoH URL":         {config: &Config{Server: "https://doh.corp.example/dns-query"}, want: "doh.corp.example"},
+		"shared host":     {config: &Config{Servers: []string{"dns.corp:853", "DNS.corp:8853"}}, want: "dns.corp"},
+		"different hosts": {config: &Config{Servers: []string{"a.corp:853", "b.corp:853"}}},
+		"domain upstream": {config: &Config{Server: "a.corp:853", DomainUpstreams: map[string]string{"lab": "b.corp:853"}}},
+		"no host":         {config: &Config{Server: ":853"}, err: true},
+	} {
+		got, err := tc.config.tlsServerName()
+		if got != tc.want || (err != nil) != tc.err {
+			t.Errorf("%s: got %q, %v, want %q", name, got, err, tc.want)
+		}
+	}
+}
+
+func TestSetupTLSDerivesSNI(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	serverTLS := p.serverTLS(t)
+	serverTLS.Certificates = []tls.Certificate{p.issue(t, "localhost", "localhost")}
+	sni := make(chan string, 1)
+	serverTLS.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		sni <- hello.ServerName
+		return nil, nil
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serveTestStream(conn, conn, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	server := net.JoinHostPort("localhost", port)
+	certPath, keyPath := writeTestKeypair(t, t.TempDir(), "endpoint", p.issue(t, "endpoint"))
+	tlsConfig, err := setupTLS(&Config{Server: server}, filePaths{Cert: certPath, Key: keyPath}, p.caBundle())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.ServerName != "localhost" {
+		t.Errorf("server name %q, want localhost from %s", tlsConfig.ServerName, server)
+	}
+	if _, err := forwardToServer(context.Background(), buildTestQuery(1, "sni.example", typeA), server, tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-sni; got != "localhost" {
+		t.Errorf("SNI %q, want localhost", got)
+	}
+
+	if _, err := setupTLS(&Config{Server: ":853"}, filePaths{Cert: certPath, Key: keyPath}, p.caBundle()); err == nil {
+		t.Error("TLS set up with no name to verify")
+	}
+}
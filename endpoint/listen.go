@@ -0,0 +1,192 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsListener is one address the local DNS server answers on, over UDP
+// and, when the port could be bound for it as well, TCP.
+type dnsListener struct {
+	udp *net.UDPConn
+	tcp *net.TCPListener // nil when only UDP could be bound
+}
+
+func (l *dnsListener) addr() *net.UDPAddr {
+	return l.udp.LocalAddr().(*net.UDPAddr)
+}
+
+// serve answers queries on l in the background, with the state state
+// returns and bounded by ctx.
+func (l *dnsListener) serve(ctx context.Context, state func() *endpointState) {
+	if l.tcp != nil {
+		go serveTCP(ctx, l.tcp, state)
+	}
+	go serveUDP(ctx, l.udp, state)
+}
+
+func (l *dnsListener) close() {
+	l.udp.Close()
+	if l.tcp != nil {
+		l.tcp.Close()
+	}
+}
+
+// The listeners being served and the listen addresses they were bound
+// for, as configured, so a reload can tell whether they changed.
+var (
+	listenersMu sync.Mutex
+	listeners   []*dnsListener
+	listenSpec  string
+)
+
+// listenSpecFor returns the comma-separated addresses to listen on under
+// config: -listen, else the config's listen, else empty for the defaults.
+func listenSpecFor(config *Config) string {
+	if *listenAddr != "" {
+		return *listenAddr
+	}
+	return strings.Join(config.Listen, ",")
+}
+
+// currentListenAddrs returns the addresses the local DNS server is bound
+// to.
+func currentListenAddrs() []*net.UDPAddr {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	return listenerAddrs(listeners)
+}
+
+func listenerAddrs(ls []*dnsListener) []*net.UDPAddr {
+	addrs := make([]*net.UDPAddr, len(ls))
+	for i, l := range ls {
+		addrs[i] = l.addr()
+	}
+	return addrs
+}
+
+// bindListeners binds every address in spec, reusing a listener already
+// being served on it. Every address must bind; on failure the listeners
+// bound here are closed again. An empty spec binds 127.0.0.1 on port 53,
+// else 5353, and the IPv6 loopback on the same port when the host has one.
+// Nothing is served until the listeners are passed to swapListeners.
+func bindListeners(spec string) ([]*dnsListener, error) {
+	listenersMu.Lock()
+	current := listeners
+	listenersMu.Unlock()
+	return bindSpec(spec, current)
+}
+
+// bindSpec is bindListeners reusing the listeners in current.
+func bindSpec(spec string, current []*dnsListener) ([]*dnsListener, error) {
+	var bound []*dnsListener
+	bind := func(ip net.IP, port int) error {
+		for _, l := range current {
+			if addr := l.addr(); addr.Port == port && addr.IP.Equal(ip) {
+				bound = append(bound, l)
+				return nil
+			}
+		}
+		l, err := listenDNS(ip, port)
+		if err != nil {
+			return err
+		}
+		bound = append(bound, l)
+		return nil
+	}
+
+	if spec == "" {
+		var err error
+		port := 53
+		if err = bind(net.IPv4(127, 0, 0, 1), port); err != nil {
+			// Port 53 needs root/admin
+			port = 5353
+			if err := bind(net.IPv4(127, 0, 0, 1), port); err != nil {
+				return nil, fmt.Errorf("failed to bind to any DNS port: %v", err)
+			}
+			slog.Warn("Could not bind to port 53, run as root/admin for port 53", "port", port, "error", err)
+		}
+		if err := bind(net.IPv6loopback, port); err != nil {
+			slog.Warn("Could not bind IPv6 loopback, serving IPv4 only", "port", port, "error", err)
+		}
+		return bound, nil
+	}
+
+	for _, addr := range strings.Split(spec, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err == nil {
+			err = bind(udpAddr.IP, udpAddr.Port)
+		}
+		if err != nil {
+			discardListeners(bound)
+			return nil, fmt.Errorf("failed to bind DNS listen address %s: %v", addr, err)
+		}
+	}
+	if len(bound) == 0 {
+		return nil, fmt.Errorf("no DNS listen address in %q", spec)
+	}
+	return bound, nil
+}
+
+// discardListeners closes the listeners of bound that aren't being
+// served, when they won't be swapped in after all.
+func discardListeners(bound []*dnsListener) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	for _, l := range bound {
+		if !slices.Contains(listeners, l) {
+			l.close()
+		}
+	}
+}
+
+// swapListeners starts serving bound, bound for spec, in place of the
+// current listeners. Listeners that are no longer wanted are closed only
+// once the new ones are up, after a query timeout so queries they
+// received can still be answered on them.
+func swapListeners(spec string, bound []*dnsListener) {
+	listenersMu.Lock()
+	old := listeners
+	listeners, listenSpec = bound, spec
+	listenersMu.Unlock()
+
+	for _, l := range bound {
+		if !slices.Contains(old, l) {
+			l.serve(shutdownCtx, currentState)
+		}
+	}
+	var retired []*dnsListener
+	for _, l := range old {
+		if !slices.Contains(bound, l) {
+			retired = append(retired, l)
+		}
+	}
+	if len(retired) > 0 {
+		slog.Info("Closing old DNS listeners", "addrs", listenerAddrs(retired))
+		time.AfterFunc(*queryTimeout, func() {
+			for _, l := range retired {
+				l.close()
+			}
+		})
+	}
+}
+
+// listenChanged reports whether config asks for other listen addresses
+// than those being served, and returns them.
+func listenChanged(config *Config) (spec string, changed bool) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	spec = listenSpecFor(config)
+	return spec, spec != listenSpec
+}
@@ -0,0 +1,151 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// serveTestListeners binds spec and serves it with a config answering from
+// a mock upstream, with 10.0.0.1 for every name, until the test ends.
+func serveTestListeners(t *testing.T, spec string) []*dnsListener {
+	t.Helper()
+	resetUpstreamState(t)
+	initQuerySlots()
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	state := &endpointState{
+		config:    &Config{Server: upstream.addr(), NoPublicDNS: true},
+		tlsConfig: p.clientTLS(t),
+	}
+	bound, err := bindSpec(spec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		for _, l := range bound {
+			l.close()
+		}
+	})
+	for _, l := range bound {
+		l.serve(ctx, func() *endpointState { return state })
+	}
+	return bound
+}
+
+func TestListenIPv6Loopback(t *testing.T) {
+	if ln, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	} else {
+		ln.Close()
+	}
+	bound := serveTestListeners(t, "127.0.0.1:0, [::1]:0")
+	if len(bound) != 2 {
+		t.Fatalf("%d listeners bound, want 2", len(bound))
+	}
+
+	for _, l := range bound {
+		if l.tcp == nil {
+			t.Fatalf("%s: no TCP listener", l.addr())
+		}
+		// Port 0 binds TCP and UDP to different ports
+		for _, resp := range [][]byte{
+			exchangeTestUDP(t, l.addr().String(), buildTestQuery(6, "v6.example", typeA)),
+			exchangeTestTCP(t, l.tcp.Addr().String(), buildTestQuery(6, "v6.example", typeA)),
+		} {
+			if msgID(resp) != 6 || !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 1)) {
+				t.Errorf("%s: unexpected response", l.addr())
+			}
+		}
+	}
+	if !bound[1].addr().IP.Equal(net.IPv6loopback) {
+		t.Errorf("second listener on %v, want ::1", bound[1].addr())
+	}
+}
+
+func TestListenMultipleAddresses(t *testing.T) {
+	// A second loopback alias where the host routes 127/8 to the loopback
+	// (Linux), else a second port
+	spec := "127.0.0.1:0, 127.0.0.2:0"
+	if conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)}); err != nil {
+		spec = "127.0.0.1:0, 127.0.0.1:0"
+	} else {
+		conn.Close()
+	}
+	bound := serveTestListeners(t, spec)
+	if len(bound) != 2 || bound[0].addr().String() == bound[1].addr().String() {
+		t.Fatalf("bound %v, want two addresses", listenerAddrs(bound))
+	}
+
+	for i, l := range bound {
+		id := uint16(10 + i)
+		for _, resp := range [][]byte{
+			exchangeTestUDP(t, l.addr().String(), buildTestQuery(id, "multi.example", typeA)),
+			exchangeTestTCP(t, l.tcp.Addr().String(), buildTestQuery(id, "multi.example", typeA)),
+		} {
+			if msgID(resp) != id || !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 1)) {
+				t.Errorf("%s: unexpected response", l.addr())
+			}
+		}
+	}
+}
+
+func TestBindSpecErrors(t *testing.T) {
+	for _, spec := range []string{" , ", "not an address", "127.0.0.1:99999"} {
+		if bound, err := bindSpec(spec, nil); err == nil {
+			discardListeners(bound)
+			t.Errorf("%q bound", spec)
+		}
+	}
+}
+
+func TestBindSpecExplicitPort(t *testing.T) {
+	// Bind and release a port to ask for
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := probe.LocalAddr().(*net.UDPAddr)
+	probe.Close()
+
+	bound, err := bindSpec(want.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer discardListeners(bound)
+	if len(bound) != 1 || bound[0].addr().Port != want.Port || !bound[0].addr().IP.Equal(want.IP) {
+		t.Fatalf("bound %v, want exactly %v", listenerAddrs(bound), want)
+	}
+	if tcp := bound[0].tcp.Addr().(*net.TCPAddr); tcp.Port != want.Port {
+		t.Errorf("TCP on port %d, want %d", tcp.Port, want.Port)
+	}
+
+	// The same address again fails rather than falling back elsewhere
+	again, err := bindSpec(want.String(), nil)
+	if err == nil {
+		discardListeners(again)
+		t.Fatalf("%s bound twice, at %v", want, listenerAddrs(again))
+	}
+	// as does a list with it
+	if again, err := bindSpec("127.0.0.1:0,"+want.String(), nil); err == nil {
+		discardListeners(again)
+		t.Fatal("list with a taken address bound")
+	}
+}
+
+func TestListenSpecFor(t *testing.T) {
+	config := &Config{Listen: []string{"127.0.0.1:5300", "[::1]:5300"}}
+	setForTest(t, listenAddr, "")
+	if spec := listenSpecFor(config); spec != "127.0.0.1:5300,[::1]:5300" {
+		t.Errorf("spec %q from the config", spec)
+	}
+	if spec := listenSpecFor(&Config{}); spec != "" {
+		t.Errorf("spec %q without -listen or listen, want the defaults", spec)
+	}
+	setForTest(t, listenAddr, "127.0.0.1:5400")
+	if spec := listenSpecFor(config); spec != "127.0.0.1:5400" {
+		t.Errorf("spec %q, want -listen over the config", spec)
+	}
+}
@@ -0,0 +1,101 @@
+package endpoint
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// defaultLocalZones are special-use zones that only mean something on the
+// local network: mDNS names (RFC 6762) and the reverse zones of link-local
+// addresses (RFC 6303). Forwarding them leaks local names and only ever
+// gets a slow or wrong answer. Private reverse zones are added by
+// localZones whatever -local-zones says.
+func defaultLocalZones() []string {
+	return []string{
+		"local",
+		"254.169.in-addr.arpa",
+		"8.e.f.ip6.arpa",
+		"9.e.f.ip6.arpa",
+		"a.e.f.ip6.arpa",
+		"b.e.f.ip6.arpa",
+	}
+}
+
+// privateReverseZones are the reverse zones of the RFC 1918 IPv4 ranges and
+// IPv6 unique local addresses (fc00::/7).
+func privateReverseZones() []string {
+	zones := []string{
+		"10.in-addr.arpa",
+		"168.192.in-addr.arpa",
+		"c.f.ip6.arpa",
+		"d.f.ip6.arpa",
+	}
+	for i := 16; i <= 31; i++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa", i))
+	}
+	return zones
+}
+
+// localZoneTTL is how long clients may cache the NXDOMAIN for a local
+// zone name. The answer never changes while the endpoint runs.
+const localZoneTTL = 3600
+
+// localZones returns the zones answered NXDOMAIN at the endpoint, from the
+// -local-zones and -private-ptr flags.
+var localZones = sync.OnceValue(func() []string {
+	return parseLocalZones(*localZonesList, *privatePTR)
+})
+
+// parseLocalZones parses a -local-zones list: empty for the defaults,
+// "none" for no zones. Unless privatePTR sends them upstream, the private
+// reverse zones are always among them, so no list can let those lookups
+// reach public DNS.
+func parseLocalZones(list, privatePTR string) []string {
+	var zones []string
+	switch list = strings.TrimSpace(list); list {
+	case "":
+		zones = defaultLocalZones()
+	case "none":
+	default:
+		for _, zone := range strings.Split(list, ",") {
+			if zone = strings.TrimSpace(zone); zone != "" {
+				zones = append(zones, zone)
+			}
+		}
+	}
+	if privatePTR != "upstream" {
+		zones = append(zones, privateReverseZones()...)
+	}
+	return zones
+}
+
+// isPrivateReverse reports whether qname is in a private reverse zone that
+// -private-ptr sends to the ZeroTrust upstream rather than public DNS.
+func isPrivateReverse(qname string) bool {
+	return *privatePTR == "upstream" && matchesDomain(qname, privateReverseZones())
+}
+
+// isLocalZone reports whether qname should be answered locally rather
+// than forwarded. Names the provisioned config routes to the ZeroTrust
+// servers, e.g. an internal reverse zone, are still forwarded.
+func isLocalZone(qname string, config *Config) bool {
+	if !matchesDomain(qname, localZones()) {
+		return false
+	}
+	if _, ok := config.upstreamOverride(qname); ok {
+		return false
+	}
+	return len(config.Domains) == 0 || !matchesDomain(qname, config.Domains)
+}
+
+// localZoneApex returns the local zone qname falls in, the longest match.
+func localZoneApex(qname string) string {
+	var apex string
+	for _, zone := range localZones() {
+		if len(zone) > len(apex) && matchesDomain(qname, []string{zone}) {
+			apex = zone
+		}
+	}
+	return strings.TrimPrefix(apex, "*.")
+}
@@ -0,0 +1,150 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+)
+
+// useLocalZones sets -local-zones and -private-ptr for the rest of the
+// test.
+func useLocalZones(t *testing.T, list, privatePTRMode string) {
+	setForTest(t, privatePTR, privatePTRMode)
+	zones := parseLocalZones(list, privatePTRMode)
+	setForTest(t, &localZones, func() []string { return zones })
+}
+
+func TestParseLocalZones(t *testing.T) {
+	zones := parseLocalZones("", "nxdomain")
+	for _, zone := range []string{"local", "254.169.in-addr.arpa", "168.192.in-addr.arpa", "20.172.in-addr.arpa", "d.f.ip6.arpa"} {
+		if !slices.Contains(zones, zone) {
+			t.Errorf("defaults lack %s", zone)
+		}
+	}
+	if zones := parseLocalZones(" corp.lan, ,home.arpa ", "upstream"); !slices.Equal(zones, []string{"corp.lan", "home.arpa"}) {
+		t.Errorf("list parsed as %v", zones)
+	}
+	if zones := parseLocalZones("none", "upstream"); len(zones) != 0 {
+		t.Errorf("none parsed as %v", zones)
+	}
+	// Private reverse zones stay unless sent upstream
+	if zones := parseLocalZones("none", "nxdomain"); !slices.Equal(zones, privateReverseZones()) {
+		t.Errorf("none with -private-ptr nxdomain parsed as %v", zones)
+	}
+}
+
+func TestLocalZonesAnsweredLocally(t *testing.T) {
+	resetUpstreamState(t)
+	useLocalZones(t, "", "nxdomain")
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	public := startMockPublic(t, answerA(60, [4]byte{192, 0, 2, 1}))
+	config := &Config{Server: upstream.addr(), Type: "service", PublicDNS: []string{public.addr}}
+
+	for name, apex := range map[string]string{
+		"printer.local":            "local",
+		"1.1.254.169.in-addr.arpa": "254.169.in-addr.arpa",
+		"7.0.168.192.in-addr.arpa": "168.192.in-addr.arpa",
+		"9.9.20.172.in-addr.arpa":  "20.172.in-addr.arpa",
+		"Office-PC.Local.":         "local",
+	} {
+		w := &queryWriter{}
+		handleDNSQuery(context.Background(), w, buildTestQuery(1, name, typePTR), config, p.clientTLS(t))
+		if w.response == nil || msgRcode(w.response) != rcodeNXDomain {
+			t.Errorf("%s: answered %v, want NXDOMAIN", name, w.response)
+			continue
+		}
+		var soa string
+		forEachRecord(w.response, func(rr resourceRecord) bool {
+			if rr.Section == sectionAuthority && rr.Type == typeSOA {
+				soa, _, _ = readName(w.response, rr.Offset)
+			}
+			return true
+		})
+		if soa != apex {
+			t.Errorf("%s: SOA for %q, want %q", name, soa, apex)
+		}
+	}
+	if n := upstream.queries.Load() + public.queries.Load(); n != 0 {
+		t.Fatalf("%d local zone queries forwarded", n)
+	}
+
+	// Public reverse zones and names the config routes upstream still go out
+	w := &queryWriter{}
+	handleDNSQuery(context.Background(), w, buildTestQuery(1, "8.8.8.8.in-addr.arpa", typePTR), config, p.clientTLS(t))
+	if public.queries.Load() != 1 {
+		t.Errorf("public reverse lookup not forwarded: %v", w.response)
+	}
+	config = &Config{Server: upstream.addr(), Domains: []string{"corp.local"}, NoPublicDNS: true}
+	handleDNSQuery(context.Background(), &queryWriter{}, buildTestQuery(1, "wiki.corp.local", typeA), config, p.clientTLS(t))
+	if upstream.queries.Load() != 1 {
+		t.Error("provisioned .local domain not forwarded")
+	}
+}
+
+func TestPrivateReverseUpstream(t *testing.T) {
+	resetUpstreamState(t)
+	useLocalZones(t, "", "upstream")
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	public := startMockPublic(t, answerA(60, [4]byte{192, 0, 2, 1}))
+	config := &Config{Server: upstream.addr(), Type: "service", PublicDNS: []string{public.addr}}
+
+	resp, path, err := resolveQuery(context.Background(), buildTestQuery(1, "7.0.168.192.in-addr.arpa", typeA), config, p.clientTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != pathUpstream || !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 1)) || public.queries.Load() != 0 {
+		t.Fatalf("private reverse lookup answered via %s, %d public queries", path, public.queries.Load())
+	}
+	// .local is still answered locally
+	w := &queryWriter{}
+	handleDNSQuery(context.Background(), w, buildTestQuery(1, "printer.local", typeA), config, p.clientTLS(t))
+	if w.response == nil || msgRcode(w.response) != rcodeNXDomain {
+		t.Fatalf("printer.local answered %v, want NXDOMAIN", w.response)
+	}
+}
+
+func TestPrivatePTR(t *testing.T) {
+	for _, mode := range []string{"nxdomain", "upstream"} {
+		t.Run(mode, func(t *testing.T) {
+			resetUpstreamState(t)
+			// No -local-zones list lets private reverse lookups out
+			useLocalZones(t, "none", mode)
+			p := newTestPKI(t)
+			upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+			public := startMockPublic(t, answerA(60, [4]byte{192, 0, 2, 1}))
+			config := &Config{Server: upstream.addr(), Type: "service", PublicDNS: []string{public.addr}}
+			query := func(name string) []byte {
+				w := &queryWriter{}
+				handleDNSQuery(context.Background(), w, buildTestQuery(1, name, typePTR), config, p.clientTLS(t))
+				return w.response
+			}
+
+			for _, name := range []string{"4.3.2.10.in-addr.arpa", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa"} {
+				resp := query(name)
+				switch {
+				case resp == nil:
+					t.Errorf("%s: no answer", name)
+				case mode == "nxdomain" && msgRcode(resp) != rcodeNXDomain:
+					t.Errorf("%s: rcode %d, want NXDOMAIN", name, msgRcode(resp))
+				case mode == "upstream" && msgRcode(resp) != rcodeSuccess:
+					t.Errorf("%s: rcode %d from the upstream", name, msgRcode(resp))
+				}
+			}
+			wantUpstream := int32(0)
+			if mode == "upstream" {
+				wantUpstream = 2
+			}
+			if got := upstream.queries.Load(); got != wantUpstream || public.queries.Load() != 0 {
+				t.Fatalf("private PTRs sent %d upstream, %d to public DNS, want %d and none", got, public.queries.Load(), wantUpstream)
+			}
+
+			// A public address's PTR goes to public DNS as before
+			if resp := query("8.8.8.8.in-addr.arpa"); resp == nil || public.queries.Load() != 1 || upstream.queries.Load() != wantUpstream {
+				t.Errorf("public PTR answered %v, %d public queries", resp, public.queries.Load())
+			}
+		})
+	}
+}
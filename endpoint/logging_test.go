@@ -0,0 +1,71 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// captureLogs installs the default logger at level writing JSON to the
+// returned buffer for the rest of the test.
+func captureLogs(t *testing.T, level string) *bytes.Buffer {
+	t.Helper()
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+	var buf bytes.Buffer
+	if err := setupLogging(&buf, level, "json"); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestQueryLogLevel(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+	tlsConfig := p.clientTLS(t)
+
+	logs := captureLogs(t, "info")
+	handleDNSQuery(context.Background(), &queryWriter{}, buildTestQuery(1, "quiet.example", typeA), config, tlsConfig)
+	if strings.Contains(logs.String(), "Query answered") {
+		t.Fatalf("debug query log written at info level:\n%s", logs)
+	}
+
+	logs = captureLogs(t, "debug")
+	handleDNSQuery(context.Background(), &queryWriter{}, buildTestQuery(2, "loud.example", typeA), config, tlsConfig)
+	var entry map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q isn't JSON: %v", line, err)
+		}
+		if entry["msg"] == "Query answered" {
+			break
+		}
+		entry = nil
+	}
+	if entry == nil {
+		t.Fatalf("no query log at debug level:\n%s", logs)
+	}
+	if entry["level"] != "DEBUG" || entry["name"] != "loud.example" || entry["type"] != "A" || entry["path"] != pathUpstream || entry["latency"] == nil {
+		t.Errorf("query logged as %v", entry)
+	}
+}
+
+func TestSetupLoggingInvalid(t *testing.T) {
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+	var buf bytes.Buffer
+	if err := setupLogging(&buf, "verbose", "text"); err == nil {
+		t.Error("unknown level accepted")
+	}
+	if err := setupLogging(&buf, "info", "xml"); err == nil {
+		t.Error("unknown format accepted")
+	}
+	if err := setupLogging(&buf, "WARN", "JSON"); err != nil {
+		t.Errorf("level and format in upper case refused: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package endpoint
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The endpoint becomes a resolver loop when an upstream or public resolver
+// is the endpoint itself, e.g. public_dns pointing at 127.0.0.1 on a host
+// whose system resolver is this endpoint. Obvious cases are refused when
+// the config is loaded; the rest are caught per query by recognising our
+// own outbound sockets as clients.
+
+// checkResolverLoop returns an error when one of config's upstream or
+// public resolver addresses is one of listenAddrs, where the endpoint
+// itself listens. Only IP literals and localhost are checked, so doing it
+// never needs DNS.
+func checkResolverLoop(config *Config, listenAddrs []*net.UDPAddr) error {
+	var targets []string
+	servers := slices.Clone(config.upstreams())
+	for _, server := range config.DomainUpstreams {
+		servers = append(servers, server)
+	}
+	for _, server := range servers {
+		if u, err := url.Parse(server); err == nil && u.Scheme == "https" {
+			server = withDefaultPort(u.Host, "443")
+		}
+		targets = append(targets, withDefaultPort(server, "853"))
+	}
+	targets = append(targets, config.publicResolvers()...)
+
+	for _, target := range targets {
+		host, portStr, err := net.SplitHostPort(target)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			continue
+		}
+		var ips []net.IP
+		if strings.EqualFold(host, "localhost") {
+			ips = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+		} else if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		}
+		for _, ip := range ips {
+			for _, listen := range listenAddrs {
+				if port == listen.Port && sameHost(ip, listen.IP) {
+					return fmt.Errorf("resolver %s is the endpoint's own listen address %s", target, listen)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sameHost reports whether dialing ip reaches a socket bound to listenIP.
+func sameHost(ip, listenIP net.IP) bool {
+	switch {
+	case ip.Equal(listenIP):
+		return true
+	case listenIP == nil || listenIP.IsUnspecified():
+		return ip.IsLoopback() || ip.IsUnspecified()
+	case ip.IsUnspecified():
+		return listenIP.IsLoopback()
+	}
+	return false
+}
+
+// outboundAddrs holds the local addresses of in-flight plain DNS queries
+// to public resolvers.
+var outboundAddrs sync.Map
+
+// trackOutbound tags conn as one of the endpoint's own queries until the
+// returned function is called.
+func trackOutbound(conn net.Conn) (untrack func()) {
+	addr := conn.LocalAddr().String()
+	outboundAddrs.Store(addr, struct{}{})
+	return func() { outboundAddrs.Delete(addr) }
+}
+
+// isOwnQuery reports whether a query from addr was sent by the endpoint.
+func isOwnQuery(addr net.Addr) bool {
+	_, ok := outboundAddrs.Load(addr.String())
+	return ok
+}
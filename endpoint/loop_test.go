@@ -0,0 +1,72 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCheckResolverLoop(t *testing.T) {
+	listening := []*net.UDPAddr{
+		{IP: net.IPv4(127, 0, 0, 1), Port: 53},
+		{IP: net.IPv6loopback, Port: 53},
+		{IP: net.IPv4zero, Port: 5353},
+	}
+	for name, tc := range map[string]struct {
+		config *Config
+		loop   bool
+	}{
+		"upstream elsewhere":       {config: &Config{Server: "10.0.0.1:853", PublicDNS: []string{"1.1.1.1"}}},
+		"upstream is the listener": {config: &Config{Server: "127.0.0.1:53"}, loop: true},
+		"localhost":                {config: &Config{Server: "localhost:53"}, loop: true},
+		"IPv6 loopback":            {config: &Config{Servers: []string{"10.0.0.1:853", "[::1]:53"}}, loop: true},
+		"same host, other port":    {config: &Config{Server: "127.0.0.1:853"}},
+		"public DNS default port":  {config: &Config{Server: "10.0.0.1:853", PublicDNS: []string{"127.0.0.1"}}, loop: true},
+		"wildcard listener":        {config: &Config{Server: "127.0.0.2:5353"}, loop: true},
+		"domain upstream":          {config: &Config{Server: "10.0.0.1:853", DomainUpstreams: map[string]string{"corp": "127.0.0.1:53"}}, loop: true},
+		"DoH URL":                  {config: &Config{Server: "https://127.0.0.1:53/dns-query", Transport: "doh"}, loop: true},
+		"DoH URL default port":     {config: &Config{Server: "https://127.0.0.1/dns-query", Transport: "doh"}},
+		"public DNS disabled":      {config: &Config{Server: "10.0.0.1:853", PublicDNS: []string{"127.0.0.1"}, NoPublicDNS: true}},
+	} {
+		err := checkResolverLoop(tc.config, listening)
+		if tc.loop && err == nil {
+			t.Errorf("%s: loop not detected", name)
+		}
+		if !tc.loop && err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestOwnQueryRefused(t *testing.T) {
+	resetUpstreamState(t)
+	initQuerySlots()
+	bound, err := bindSpec("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer discardListeners(bound)
+	// A config the startup check would refuse: public DNS is the endpoint
+	// itself
+	state := &endpointState{config: &Config{
+		Type:      "service",
+		Server:    "127.0.0.1:1",
+		PublicDNS: []string{bound[0].addr().String()},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bound[0].serve(ctx, func() *endpointState { return state })
+
+	loops := testutil.ToFloat64(droppedQueries.WithLabelValues("loop"))
+	resp := exchangeTestUDP(t, bound[0].addr().String(), buildTestQuery(1, "loop.example", typeA))
+	if n := testutil.ToFloat64(droppedQueries.WithLabelValues("loop")) - loops; n != 1 {
+		t.Fatalf("%v looped queries caught, want 1", n)
+	}
+	// The endpoint refused its own query rather than sending it round
+	// again, and relayed that refusal
+	if msgRcode(resp) != rcodeRefused {
+		t.Fatalf("rcode %d, want REFUSED", msgRcode(resp))
+	}
+}
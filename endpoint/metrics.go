@@ -0,0 +1,94 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	queriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ztdns_queries_total",
+		Help: "DNS queries received from local clients.",
+	})
+	droppedQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ztdns_queries_dropped_total",
+		Help: "DNS queries dropped without an answer, by reason.",
+	}, []string{"reason"})
+	blockedQueries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ztdns_queries_blocked_total",
+		Help: "DNS queries answered locally because the name is on the denylist.",
+	})
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ztdns_cache_lookups_total",
+		Help: "Response cache lookups by result (hit or miss).",
+	}, []string{"result"})
+	staleAnswers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ztdns_stale_answers_total",
+		Help: "Queries answered with an expired cache entry because the upstreams failed (-serve-stale).",
+	})
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ztdns_upstream_errors_total",
+		Help: "Failed upstream exchanges by path (dot, doh, doq or public).",
+	}, []string{"path"})
+	upstreamConnectErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ztdns_upstream_connect_errors_total",
+		Help: "Failed connections to ZeroTrust upstreams by reason, e.g. unknown_authority, hostname_mismatch, timeout or refused.",
+	}, []string{"reason"})
+	upstreamMalformed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ztdns_upstream_malformed_total",
+		Help: "Upstream exchanges that returned an unusable response, by path. Also counted in ztdns_upstream_errors_total.",
+	}, []string{"path"})
+	breakerOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ztdns_upstream_breaker_open",
+		Help: "1 while an upstream's circuit breaker is open and queries skip it.",
+	}, []string{"upstream"})
+	upstreamProbeHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ztdns_upstream_healthy",
+		Help: "1 if an upstream passed its last health probe (-probe-interval), 0 if it failed it.",
+	}, []string{"upstream"})
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ztdns_upstream_duration_seconds",
+		Help:    "Round-trip time of successful upstream exchanges by path.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"path"})
+)
+
+// startMetricsServer exposes /metrics on addr in the background.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		slog.Info("Metrics listening", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Metrics server stopped", "error", err)
+		}
+	}()
+}
+
+// observeUpstream records the outcome of one upstream exchange on path
+// that started at start. Exchanges abandoned because ctx was cancelled,
+// e.g. the losing side of a race, aren't failures and aren't counted.
+func observeUpstream(ctx context.Context, path string, start time.Time, err error) {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	if path != "public" {
+		recordUpstreamOutcome(err == nil, time.Now())
+	}
+	if err != nil {
+		upstreamErrors.WithLabelValues(path).Inc()
+		if errors.Is(err, errMalformed) {
+			upstreamMalformed.WithLabelValues(path).Inc()
+		}
+		return
+	}
+	upstreamDuration.WithLabelValues(path).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,95 @@
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics returns the samples served at url, keyed by the series as
+// written, e.g. ztdns_cache_lookups_total{result="hit"}.
+func scrapeMetrics(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(line[i+1:], 64); err == nil {
+			samples[line[:i]] = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+func TestMetricsServerCountsQueries(t *testing.T) {
+	resetUpstreamState(t)
+	// Bind and release a port for the metrics server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	startMetricsServer(addr)
+	url := "http://" + addr + "/metrics"
+	for try := 0; ; try++ {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if try == 20 {
+			t.Fatalf("metrics server not up: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	tlsConfig := p.clientTLS(t)
+	query := func(server string) {
+		config := &Config{Server: server, NoPublicDNS: true}
+		handleDNSQuery(context.Background(), &queryWriter{}, buildTestQuery(1, "metrics.example", typeA), config, tlsConfig)
+	}
+
+	before := scrapeMetrics(t, url)
+	// A miss answered upstream, then a hit
+	query(upstream.addr())
+	query(upstream.addr())
+	responseCache.Flush()
+	// An upstream nothing listens on
+	query("127.0.0.1:1")
+	after := scrapeMetrics(t, url)
+
+	for series, want := range map[string]float64{
+		`ztdns_queries_total`:                               3,
+		`ztdns_cache_lookups_total{result="hit"}`:           1,
+		`ztdns_cache_lookups_total{result="miss"}`:          2,
+		`ztdns_upstream_errors_total{path="dot"}`:           1,
+		`ztdns_upstream_duration_seconds_count{path="dot"}`: 1,
+	} {
+		if got := after[series] - before[series]; got != want {
+			t.Errorf("%s went up by %v, want %v", series, got, want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package endpoint
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// checkStapledOCSP rejects a server whose stapled OCSP response says its
+// certificate is revoked, or is unknown to or stale at the responder. With
+// required set, a server that staples nothing is rejected too.
+func checkStapledOCSP(cs tls.ConnectionState, required bool, now time.Time) error {
+	if len(cs.OCSPResponse) == 0 {
+		if required {
+			return fmt.Errorf("server did not staple an OCSP response")
+		}
+		return nil
+	}
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) < 2 {
+		return fmt.Errorf("no verified issuer to check the OCSP response against")
+	}
+	leaf, issuer := cs.VerifiedChains[0][0], cs.VerifiedChains[0][1]
+
+	resp, err := ocsp.ParseResponseForCert(cs.OCSPResponse, leaf, issuer)
+	if err != nil {
+		return fmt.Errorf("invalid stapled OCSP response: %v", err)
+	}
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return fmt.Errorf("server certificate was revoked at %s", resp.RevokedAt.Format(time.RFC3339))
+	default:
+		return fmt.Errorf("server certificate status unknown to the OCSP responder")
+	}
+	if !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate) {
+		return fmt.Errorf("stapled OCSP response expired at %s", resp.NextUpdate.Format(time.RFC3339))
+	}
+	return nil
+}
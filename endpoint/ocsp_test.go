@@ -0,0 +1,123 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// startStapledDoT is startMockDoT with a server certificate stapling an
+// OCSP response from p's CA with status, valid until nextUpdate.
+func startStapledDoT(t *testing.T, p *testPKI, status int, nextUpdate time.Time) string {
+	t.Helper()
+	cert := p.issue(t, testServerName, testServerName)
+	template := ocsp.Response{
+		Status:       status,
+		SerialNumber: cert.Leaf.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   nextUpdate,
+	}
+	if status == ocsp.Revoked {
+		template.RevokedAt = time.Now().Add(-time.Minute)
+		template.RevocationReason = ocsp.KeyCompromise
+	}
+	staple, err := ocsp.CreateResponse(p.caCert, p.caCert, template, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.OCSPStaple = staple
+
+	config := p.serverTLS(t)
+	config.Certificates = []tls.Certificate{cert}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serveTestStream(conn, conn, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestStapledOCSP(t *testing.T) {
+	p := newTestPKI(t)
+	later := time.Now().Add(time.Hour)
+	good := startStapledDoT(t, p, ocsp.Good, later)
+	revoked := startStapledDoT(t, p, ocsp.Revoked, later)
+	unknown := startStapledDoT(t, p, ocsp.Unknown, later)
+	expired := startStapledDoT(t, p, ocsp.Good, time.Now().Add(-time.Minute))
+	unstapled := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1})).addr()
+
+	for _, tc := range []struct {
+		mode, server string
+		ok           bool
+	}{
+		{mode: "staple", server: good, ok: true},
+		{mode: "staple", server: revoked},
+		{mode: "staple", server: unknown},
+		{mode: "staple", server: expired},
+		{mode: "staple", server: unstapled, ok: true},
+		{mode: "require", server: good, ok: true},
+		{mode: "require", server: revoked},
+		{mode: "require", server: unstapled},
+		// Off trusts the chain alone
+		{mode: "off", server: revoked, ok: true},
+	} {
+		resetUpstreamState(t)
+		resetUpstreamPools()
+		setForTest(t, ocspMode, tc.mode)
+		tlsConfig, err := setupTestTLS(t, p, &Config{Server: tc.server, ServerName: testServerName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = forwardToServer(context.Background(), buildTestQuery(1, "ocsp.example", typeA), tc.server, tlsConfig)
+		if tc.ok && err != nil {
+			t.Errorf("-ocsp %s against %s: %v", tc.mode, tc.server, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("-ocsp %s against %s: connected", tc.mode, tc.server)
+		}
+		if tc.server == revoked && err != nil && !strings.Contains(err.Error(), "revoked") {
+			t.Errorf("-ocsp %s against the revoked server: %v", tc.mode, err)
+		}
+	}
+
+	setForTest(t, ocspMode, "always")
+	if _, err := setupTestTLS(t, p, &Config{Server: good}); err == nil {
+		t.Error("invalid -ocsp mode accepted")
+	}
+}
+
+func TestCheckStapledOCSPWrongIssuer(t *testing.T) {
+	p, other := newTestPKI(t), newTestPKI(t)
+	cert := p.issue(t, testServerName, testServerName)
+	// Signed by a CA that didn't issue the certificate
+	staple, err := ocsp.CreateResponse(other.caCert, other.caCert, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(1),
+		ThisUpdate:   time.Now(),
+	}, other.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := tls.ConnectionState{OCSPResponse: staple, VerifiedChains: [][]*x509.Certificate{{cert.Leaf, p.caCert}}}
+	if err := checkStapledOCSP(cs, false, time.Now()); err == nil {
+		t.Error("response from another CA accepted")
+	}
+}
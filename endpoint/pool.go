@@ -0,0 +1,181 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxIdleUpstreamConns caps how many idle mTLS connections are kept open
+// per upstream server.
+const maxIdleUpstreamConns = 4
+
+// connPool keeps idle DNS-over-TLS connections to one upstream so queries
+// can skip the handshake. The ZeroTrust server serves any number of
+// length-prefixed queries on a connection. Idle connections are closed
+// after -upstream-idle-timeout, before a NAT or firewall on the way drops
+// them silently and the next query writes into a dead connection.
+type connPool struct {
+	addr      string
+	tlsConfig *tls.Config
+	// route is the service the proxy/router is told to route new
+	// connections to, empty for a DoT server dialed directly
+	route string
+
+	mu   sync.Mutex
+	idle []idleConn
+}
+
+type idleConn struct {
+	conn  net.Conn
+	timer *time.Timer // closes conn once idle too long, nil without a timeout
+}
+
+type poolKey struct {
+	addr      string
+	tlsConfig *tls.Config
+	route     string
+}
+
+var (
+	upstreamPoolsMu sync.Mutex
+	upstreamPools   = make(map[poolKey]*connPool)
+)
+
+func upstreamPool(addr string, tlsConfig *tls.Config) *connPool {
+	upstreamPoolsMu.Lock()
+	defer upstreamPoolsMu.Unlock()
+
+	key := poolKey{addr: addr, tlsConfig: tlsConfig}
+	pool, ok := upstreamPools[key]
+	if !ok {
+		pool = &connPool{addr: addr, tlsConfig: dotTLSConfig(tlsConfig)}
+		upstreamPools[key] = pool
+	}
+	return pool
+}
+
+// proxyPool is upstreamPool for connections through the proxy/router at
+// addr that are routed to the DNS service route, see Config.DNSService.
+func proxyPool(addr, route string, tlsConfig *tls.Config) *connPool {
+	upstreamPoolsMu.Lock()
+	defer upstreamPoolsMu.Unlock()
+
+	key := poolKey{addr: addr, tlsConfig: tlsConfig, route: route}
+	pool, ok := upstreamPools[key]
+	if !ok {
+		// The router speaks mTLS but not DoT, so no DoT ALPN is offered
+		pool = &connPool{addr: addr, tlsConfig: tlsConfig, route: route}
+		upstreamPools[key] = pool
+	}
+	return pool
+}
+
+// get returns an idle connection if one is available, otherwise a freshly
+// dialed one. pooled reports which it was.
+func (p *connPool) get(ctx context.Context) (conn net.Conn, pooled bool, err error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		idle := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		if idle.timer != nil {
+			idle.timer.Stop()
+		}
+		return idle.conn, true, nil
+	}
+	p.mu.Unlock()
+
+	conn, err = p.dial(ctx)
+	return conn, false, err
+}
+
+func (p *connPool) dial(ctx context.Context) (net.Conn, error) {
+	// Connect to DNS server with mTLS
+	conn, err := newTLSDialer(p.tlsConfig).DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	state := conn.(*tls.Conn).ConnectionState()
+	slog.Debug("Connected to upstream", "server", p.addr, "tls", tls.VersionName(state.Version), "alpn", state.NegotiatedProtocol, "resumed", state.DidResume)
+	if p.route != "" {
+		// Sent once, the connection then carries DNS over TCP to the
+		// service for as long as it is pooled
+		release := bindContext(ctx, conn)
+		_, err := io.WriteString(conn, routePreamble+p.route+"\r\n")
+		release()
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// dotTLSConfig returns a copy of tlsConfig offering the -dot-alpn protocol
+// (RFC 7858 section 3.2), for servers that insist on it. crypto/tls
+// already fails the handshake if the server picks anything else.
+func dotTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig != nil && *dotALPN != "" {
+		tlsConfig.NextProtos = []string{*dotALPN}
+	}
+	return tlsConfig
+}
+
+// put returns a healthy connection to the pool, closing it if the pool is
+// already full.
+func (p *connPool) put(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) >= maxIdleUpstreamConns {
+		conn.Close()
+		return
+	}
+	idle := idleConn{conn: conn}
+	if *upstreamIdle > 0 {
+		idle.timer = time.AfterFunc(*upstreamIdle, func() { p.expire(conn) })
+	}
+	p.idle = append(p.idle, idle)
+}
+
+// expire closes conn if it is still idle in the pool.
+func (p *connPool) expire(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, idle := range p.idle {
+		if idle.conn == conn {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// resetUpstreamPools closes every idle upstream connection and forgets the
+// pools, so the next query dials with the current TLS config.
+func resetUpstreamPools() {
+	upstreamPoolsMu.Lock()
+	pools := upstreamPools
+	upstreamPools = make(map[poolKey]*connPool)
+	upstreamPoolsMu.Unlock()
+
+	for _, pool := range pools {
+		pool.mu.Lock()
+		for _, idle := range pool.idle {
+			if idle.timer != nil {
+				idle.timer.Stop()
+			}
+			idle.conn.Close()
+		}
+		pool.idle = nil
+		pool.mu.Unlock()
+	}
+}
@@ -0,0 +1,298 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestForwardToServerReusesConnection(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	server := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	tlsConfig := p.clientTLS(t)
+
+	for i := range 5 {
+		if _, err := forwardToServer(context.Background(), buildTestQuery(uint16(i), "pool.example", typeA), server.addr(), tlsConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := server.conns.Load(); n != 1 {
+		t.Fatalf("%d connections for 5 queries, want 1", n)
+	}
+}
+
+func TestForwardToServerRedialsBrokenConnection(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	// The server closes every connection after one answer, so each pooled
+	// connection is dead by the time it is reused
+	server := startMockDoT(t, p, 1, answerA(60, [4]byte{10, 0, 0, 2}))
+	tlsConfig := p.clientTLS(t)
+
+	for i := range 3 {
+		resp, err := forwardToServer(context.Background(), buildTestQuery(uint16(100+i), "redial.example", typeA), server.addr(), tlsConfig)
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if msgID(resp) != uint16(100+i) || !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 2)) {
+			t.Fatalf("query %d: unexpected response", i)
+		}
+	}
+	if n := server.conns.Load(); n != 3 {
+		t.Fatalf("%d connections, want one per query", n)
+	}
+}
+
+func TestIdleConnectionClosed(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, upstreamIdle, 200*time.Millisecond)
+	p := newTestPKI(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", p.serverTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	// Signalled when the endpoint hangs up a connection
+	hungUp := make(chan time.Time, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				serveTestStream(conn, conn, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+				conn.Close()
+				hungUp <- time.Now()
+			}()
+		}
+	}()
+	tlsConfig := p.clientTLS(t)
+	query := func(id uint16) {
+		t.Helper()
+		if _, err := forwardToServer(context.Background(), buildTestQuery(id, "idle.example", typeA), ln.Addr().String(), tlsConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query(1)
+	// Reused within the timeout, which starts the wait over
+	time.Sleep(100 * time.Millisecond)
+	query(2)
+	idleSince := time.Now()
+	select {
+	case at := <-hungUp:
+		if idle := at.Sub(idleSince); idle < 150*time.Millisecond {
+			t.Errorf("idle connection closed after %s, want -upstream-idle-timeout 200ms", idle)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection never closed")
+	}
+	if n := len(upstreamPool(ln.Addr().String(), tlsConfig).idle); n != 0 {
+		t.Errorf("%d connections left in the pool", n)
+	}
+
+	// The next query dials afresh rather than writing into the closed one
+	query(3)
+}
+
+func TestUpstreamDialerKeepAlive(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		if ka := newDialer(network).KeepAliveConfig; !ka.Enable || ka.Idle != upstreamKeepAlive || ka.Interval != upstreamKeepAlive {
+			t.Errorf("%s dialer keepalive %+v", network, ka)
+		}
+	}
+}
+
+func TestConnPoolKeepsAtMostMaxIdle(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	server := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 3}))
+	pool := upstreamPool(server.addr(), p.clientTLS(t))
+
+	var conns []net.Conn
+	for range maxIdleUpstreamConns + 2 {
+		conn, pooled, err := pool.get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pooled {
+			t.Fatal("connection from an empty pool")
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		pool.put(conn)
+	}
+	if n := len(pool.idle); n != maxIdleUpstreamConns {
+		t.Fatalf("%d idle connections, want %d", n, maxIdleUpstreamConns)
+	}
+	if _, pooled, _ := pool.get(context.Background()); !pooled {
+		t.Fatal("idle connection not reused")
+	}
+}
+
+func BenchmarkForwardPooled(b *testing.B) {
+	resetUpstreamState(b)
+	p := newTestPKI(b)
+	server := startMockDoT(b, p, 0, answerA(60, [4]byte{10, 0, 0, 4}))
+	tlsConfig := p.clientTLS(b)
+	query := buildTestQuery(1, "bench.example", typeA)
+
+	b.ResetTimer()
+	for range b.N {
+		if _, err := forwardToServer(context.Background(), query, server.addr(), tlsConfig); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkForwardPerQueryDial is BenchmarkForwardPooled with a new mTLS
+// connection for every query, as before pooling.
+func BenchmarkForwardPerQueryDial(b *testing.B) {
+	resetUpstreamState(b)
+	p := newTestPKI(b)
+	server := startMockDoT(b, p, 0, answerA(60, [4]byte{10, 0, 0, 4}))
+	pool := upstreamPool(server.addr(), p.clientTLS(b))
+	query := buildTestQuery(1, "bench.example", typeA)
+
+	b.ResetTimer()
+	for range b.N {
+		conn, err := pool.dial(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = exchangeTLS(context.Background(), conn, query)
+		conn.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// dialResumed dials pool, exchanges query on the new connection so the
+// session ticket the server sends after the handshake is read, and
+// reports whether the handshake resumed a session.
+func dialResumed(tb testing.TB, pool *connPool, query []byte) bool {
+	tb.Helper()
+	conn, err := pool.dial(context.Background())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := exchangeTLS(context.Background(), conn, query); err != nil {
+		tb.Fatal(err)
+	}
+	return conn.(*tls.Conn).ConnectionState().DidResume
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	server := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 4}))
+	tlsConfig, err := setupTestTLS(t, p, &Config{Server: server.addr(), ServerName: testServerName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := buildTestQuery(1, "resume.example", typeA)
+
+	pool := upstreamPool(server.addr(), tlsConfig)
+	if dialResumed(t, pool, query) {
+		t.Fatal("first connection resumed a session")
+	}
+	if !dialResumed(t, pool, query) {
+		t.Fatal("second connection did a full handshake")
+	}
+	// Clones, as made for DoH and DoQ, share the cache
+	if !dialResumed(t, upstreamPool(server.addr(), tlsConfig.Clone()), query) {
+		t.Fatal("connection from a cloned config did a full handshake")
+	}
+
+	// Without the cache every handshake is a full one
+	noCache := tlsConfig.Clone()
+	noCache.ClientSessionCache = nil
+	pool = upstreamPool(server.addr(), noCache)
+	dialResumed(t, pool, query)
+	if dialResumed(t, pool, query) {
+		t.Fatal("resumed without a session cache")
+	}
+}
+
+// BenchmarkDialResumed is BenchmarkForwardPerQueryDial with the session
+// cache setupTLS configures, so every dial after the first resumes.
+func BenchmarkDialResumed(b *testing.B) {
+	resetUpstreamState(b)
+	p := newTestPKI(b)
+	server := startMockDoT(b, p, 0, answerA(60, [4]byte{10, 0, 0, 4}))
+	tlsConfig, err := setupTestTLS(b, p, &Config{Server: server.addr(), ServerName: testServerName})
+	if err != nil {
+		b.Fatal(err)
+	}
+	pool := upstreamPool(server.addr(), tlsConfig)
+	query := buildTestQuery(1, "bench.example", typeA)
+	dialResumed(b, pool, query)
+
+	b.ResetTimer()
+	for range b.N {
+		if !dialResumed(b, pool, query) {
+			b.Fatal("full handshake")
+		}
+	}
+}
+
+func TestDoTALPNRequired(t *testing.T) {
+	p := newTestPKI(t)
+	// A server that refuses clients not offering dot
+	serverTLS := p.serverTLS(t)
+	serverTLS.NextProtos = []string{"dot"}
+	serverTLS.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !slices.Contains(hello.SupportedProtos, "dot") {
+			return nil, errors.New("dot ALPN required")
+		}
+		return nil, nil
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	negotiated := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tc := conn.(*tls.Conn)
+				if tc.Handshake() != nil {
+					return
+				}
+				negotiated <- tc.ConnectionState().NegotiatedProtocol
+				serveTestStream(conn, conn, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+			}()
+		}
+	}()
+	query := buildTestQuery(1, "alpn.example", typeA)
+
+	resetUpstreamState(t)
+	if _, err := forwardToServer(context.Background(), query, ln.Addr().String(), p.clientTLS(t)); err != nil {
+		t.Fatalf("offering dot: %v", err)
+	}
+	if proto := <-negotiated; proto != "dot" {
+		t.Errorf("negotiated %q, want dot", proto)
+	}
+
+	// Offering no ALPN, as before -dot-alpn, the server refuses
+	resetUpstreamState(t)
+	setForTest(t, dotALPN, "")
+	if _, err := forwardToServer(context.Background(), query, ln.Addr().String(), p.clientTLS(t)); err == nil {
+		t.Error("server requiring dot answered a client offering no ALPN")
+	}
+}
@@ -0,0 +1,150 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// With -probe-interval set, every upstream is sent a root SOA query at
+// that interval. A server that failed its last probe is skipped by the
+// forwarder while another is still healthy, so a dead server is found
+// before a client query waits on it.
+
+// probeStatus is the outcome of an upstream's most recent probe.
+type probeStatus struct {
+	Healthy bool      `json:"healthy"`
+	Probed  time.Time `json:"probed"`
+	Error   string    `json:"error,omitempty"`
+}
+
+var (
+	upstreamHealthMu sync.Mutex
+	upstreamHealth   = make(map[string]probeStatus)
+)
+
+// upstreamHealthy reports whether server passed its last probe. Servers
+// not probed yet count as healthy.
+func upstreamHealthy(server string) bool {
+	upstreamHealthMu.Lock()
+	defer upstreamHealthMu.Unlock()
+
+	status, ok := upstreamHealth[server]
+	return !ok || status.Healthy
+}
+
+// healthyUpstreams returns servers without those that failed their last
+// probe, or all of them if none passed.
+func healthyUpstreams(servers []string) []string {
+	healthy := slices.DeleteFunc(slices.Clone(servers), func(server string) bool {
+		return !upstreamHealthy(server)
+	})
+	if len(healthy) == 0 {
+		return servers
+	}
+	return healthy
+}
+
+// allUpstreamsUnhealthy reports whether every one of servers failed its
+// last probe.
+func allUpstreamsUnhealthy(servers []string) bool {
+	for _, server := range servers {
+		if upstreamHealthy(server) {
+			return false
+		}
+	}
+	return len(servers) > 0
+}
+
+// upstreamHealthStatus returns the probe outcome of every probed server.
+func upstreamHealthStatus() map[string]probeStatus {
+	upstreamHealthMu.Lock()
+	defer upstreamHealthMu.Unlock()
+
+	status := make(map[string]probeStatus, len(upstreamHealth))
+	for server, s := range upstreamHealth {
+		status[server] = s
+	}
+	return status
+}
+
+// resetUpstreamHealth forgets every probe outcome.
+func resetUpstreamHealth() {
+	upstreamHealthMu.Lock()
+	defer upstreamHealthMu.Unlock()
+
+	upstreamHealth = make(map[string]probeStatus)
+	upstreamProbeHealthy.Reset()
+}
+
+// watchUpstreamHealth probes the upstreams of the current config every
+// interval until shutdown.
+func watchUpstreamHealth(interval time.Duration) {
+	for {
+		if state := currentState(); state != nil {
+			probeUpstreams(state.config, state.tlsConfig)
+		}
+		select {
+		case <-shutdownCtx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// probeUpstreams probes every upstream of config at once and records the
+// outcomes.
+func probeUpstreams(config *Config, tlsConfig *tls.Config) {
+	servers := slices.Compact(slices.Sorted(slices.Values(config.allUpstreams())))
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := probeUpstream(server, config.Transport, tlsConfig)
+			recordProbe(server, err, time.Now())
+		}()
+	}
+	wg.Wait()
+}
+
+// probeUpstream asks server for the root SOA. Any response counts, even a
+// refusal shows the server is up and speaking DNS.
+func probeUpstream(server, transport string, tlsConfig *tls.Config) error {
+	query, err := newQuery(uint16(rand.N(1<<16)), ".", typeSOA)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(shutdownCtx, *upstreamTimeout)
+	defer cancel()
+	_, _, err = exchangeWithServer(ctx, query, server, transport, tlsConfig)
+	return err
+}
+
+func recordProbe(server string, err error, now time.Time) {
+	status := probeStatus{Healthy: err == nil, Probed: now}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	upstreamHealthMu.Lock()
+	previous, probed := upstreamHealth[server]
+	upstreamHealth[server] = status
+	upstreamHealthMu.Unlock()
+
+	switch {
+	case !status.Healthy && (!probed || previous.Healthy):
+		slog.Warn("Upstream failed its health probe, skipping it", "upstream", server, "error", err)
+	case status.Healthy && probed && !previous.Healthy:
+		slog.Info("Upstream passed its health probe again", "upstream", server)
+	}
+	if status.Healthy {
+		upstreamProbeHealthy.WithLabelValues(server).Set(1)
+	} else {
+		upstreamProbeHealthy.WithLabelValues(server).Set(0)
+	}
+}
@@ -0,0 +1,85 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeSkipsUnhealthyUpstream(t *testing.T) {
+	resetUpstreamState(t)
+	keepActiveState(t)
+	setForTest(t, upstreamTimeout, time.Second)
+	p := newTestPKI(t)
+	var broken atomic.Bool
+	broken.Store(true)
+	// Hangs up on every query while broken
+	flaky := startMockDoT(t, p, 0, func(query []byte) []byte {
+		if broken.Load() {
+			return nil
+		}
+		return answerA(60, [4]byte{10, 0, 0, 1})(query)
+	})
+	healthy := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 2}))
+	config := &Config{Servers: []string{flaky.addr(), healthy.addr()}, NoPublicDNS: true}
+	tlsConfig := p.clientTLS(t)
+	activeState.Store(&endpointState{config: config, tlsConfig: tlsConfig})
+	forward := func() []byte {
+		t.Helper()
+		resp, err := forwardToServers(context.Background(), buildTestQuery(1, "probe.example", typeA), config.Servers, "", tlsConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	probeUpstreams(config, tlsConfig)
+	if upstreamHealthy(flaky.addr()) || !upstreamHealthy(healthy.addr()) {
+		t.Fatalf("after probing status %+v, want only the first upstream unhealthy", upstreamHealthStatus())
+	}
+	// The first upstream is skipped rather than tried and failed over
+	probed := flaky.queries.Load()
+	if resp := forward(); !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 2)) || flaky.queries.Load() != probed {
+		t.Errorf("unhealthy upstream queried %d times after its probe", flaky.queries.Load()-probed)
+	}
+
+	// /healthz lists the outcomes
+	url := startTestHealthServer(t, time.Minute)
+	resp, err := http.Get(url + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "upstream "+flaky.addr()+" unhealthy") || !strings.Contains(string(body), "upstream "+healthy.addr()+" healthy") {
+		t.Errorf("/healthz said %q", body)
+	}
+
+	// Once it passes a probe again it is back first in line
+	broken.Store(false)
+	probeUpstreams(config, tlsConfig)
+	if resp := forward(); !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Error("recovered upstream still skipped")
+	}
+}
+
+func TestHealthyUpstreamsAllFailed(t *testing.T) {
+	resetUpstreamState(t)
+	servers := []string{"10.0.0.1:853", "10.0.0.2:853"}
+	for _, server := range servers {
+		recordProbe(server, errors.New("connection refused"), time.Now())
+	}
+	// With none healthy every server is still tried
+	if got := healthyUpstreams(servers); len(got) != 2 {
+		t.Errorf("healthy upstreams %v, want all when every probe failed", got)
+	}
+	if !allUpstreamsUnhealthy(servers) || allUpstreamsUnhealthy(append(servers, "10.0.0.3:853")) {
+		t.Error("unprobed server counted unhealthy")
+	}
+}
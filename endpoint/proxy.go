@@ -0,0 +1,116 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// Local TCP ports can be tunnelled to services behind the ZeroTrust
+// proxy/router (the provisioned proxy address, port 8443). Each accepted
+// connection is carried over its own mTLS connection to the proxy, which
+// is told the service to route to by a one-line preamble:
+//
+//	ZT-ROUTE <service name>\r\n
+//
+// after which the stream is passed through unchanged in both directions.
+
+const routePreamble = "ZT-ROUTE "
+
+// proxyForward is one local port tunnelled to a service name.
+type proxyForward struct {
+	listen  string
+	service string
+}
+
+// parseProxyForwards parses -proxy-forward, a comma-separated list of
+// listen=service pairs.
+func parseProxyForwards(spec string) ([]proxyForward, error) {
+	var forwards []proxyForward
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		listen, service, ok := strings.Cut(entry, "=")
+		if !ok || listen == "" || service == "" {
+			return nil, fmt.Errorf("%q is not listen=service", entry)
+		}
+		if strings.ContainsAny(service, " \r\n") {
+			return nil, fmt.Errorf("invalid service name %q", service)
+		}
+		forwards = append(forwards, proxyForward{listen: listen, service: service})
+	}
+	return forwards, nil
+}
+
+// startProxyForwards listens on every -proxy-forward address and tunnels
+// the connections in the background.
+func startProxyForwards(spec string) error {
+	forwards, err := parseProxyForwards(spec)
+	if err != nil {
+		return err
+	}
+	for _, forward := range forwards {
+		ln, err := net.Listen("tcp", forward.listen)
+		if err != nil {
+			return err
+		}
+		slog.Info("Proxy forward listening", "addr", ln.Addr().String(), "service", forward.service)
+		go serveProxyForward(ln, forward.service)
+	}
+	return nil
+}
+
+func serveProxyForward(ln net.Listener, service string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("Proxy forward stopped", "addr", ln.Addr().String(), "error", err)
+			return
+		}
+		go tunnelToProxy(conn, service)
+	}
+}
+
+// tunnelToProxy carries client's stream to service through the proxy of
+// the current config.
+func tunnelToProxy(client net.Conn, service string) {
+	defer client.Close()
+	logger := slog.With("client", client.RemoteAddr().String(), "service", service)
+
+	state := currentState()
+	if state.config.Proxy == "" {
+		logger.Error("Proxy forward refused, the config has no proxy")
+		return
+	}
+	ctx, cancel := context.WithTimeout(shutdownCtx, *upstreamTimeout)
+	defer cancel()
+	dialer := newTLSDialer(serverTLSConfig(state.tlsConfig, state.config.Proxy))
+	conn, err := dialer.DialContext(ctx, "tcp", state.config.Proxy)
+	if err != nil {
+		reason, hint := diagnoseConnectError(err)
+		logger.Warn("Failed to connect to proxy", "proxy", state.config.Proxy, "error", err, "reason", reason, "hint", hint)
+		return
+	}
+	upstream := conn.(*tls.Conn)
+	defer upstream.Close()
+
+	if _, err := io.WriteString(upstream, routePreamble+service+"\r\n"); err != nil {
+		logger.Warn("Failed to send route to proxy", "error", err)
+		return
+	}
+
+	// The client's end of input is passed on as a half-close. Once the
+	// service side is done, both connections are closed.
+	go func() {
+		io.Copy(upstream, client)
+		upstream.CloseWrite()
+	}()
+	io.Copy(client, upstream)
+	logger.Debug("Proxy forward closed")
+}
@@ -0,0 +1,99 @@
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// mockRouter is a ZeroTrust proxy/router that answers DNS itself on the
+// connections routed to it, recording the routes it was asked for.
+type mockRouter struct {
+	ln     net.Listener
+	routes chan string
+}
+
+func startMockRouter(t *testing.T, p *testPKI, answer func(query []byte) []byte) *mockRouter {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", p.serverTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	r := &mockRouter{ln: ln, routes: make(chan string, 16)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				r.routes <- line
+				serveTestStream(reader, conn, 0, answer)
+			}()
+		}
+	}()
+	return r
+}
+
+func TestForwardUpstreamViaProxy(t *testing.T) {
+	p := newTestPKI(t)
+	tlsConfig := p.clientTLS(t)
+	for name, tc := range map[string]struct {
+		service, route string
+	}{
+		"default service":    {"", "ZT-ROUTE dns\r\n"},
+		"configured service": {"dns.internal.corp", "ZT-ROUTE dns.internal.corp\r\n"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resetUpstreamState(t)
+			server := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+			router := startMockRouter(t, p, answerA(60, [4]byte{10, 0, 0, 2}))
+
+			config := &Config{Server: server.addr(), Proxy: router.ln.Addr().String(), DNSService: tc.service}
+			for id := range uint16(3) {
+				resp, err := forwardUpstream(context.Background(), buildTestQuery(id, "db.internal.corp", typeA), config, tlsConfig)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ip := firstA(t, resp); !ip.Equal(net.IPv4(10, 0, 0, 2)) {
+					t.Fatalf("answered %v, want the router's answer", ip)
+				}
+			}
+
+			if route := <-router.routes; route != tc.route {
+				t.Errorf("route preamble %q, want %q", route, tc.route)
+			}
+			if n := len(router.routes); n != 0 {
+				t.Errorf("%d more connections to the router, want the first one reused", n)
+			}
+			if n := server.queries.Load(); n != 0 {
+				t.Errorf("server got %d queries, want none", n)
+			}
+		})
+	}
+}
+
+func TestForwardUpstreamWithoutProxy(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	server := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+
+	query := buildTestQuery(1, "db.internal.corp", typeA)
+	resp, err := forwardUpstream(context.Background(), query, &Config{Server: server.addr()}, p.clientTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := firstA(t, resp); !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("answered %v, want the server's answer", ip)
+	}
+}
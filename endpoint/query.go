@@ -0,0 +1,192 @@
+package endpoint
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runQuery resolves name once through the same pipeline client queries
+// take (filters, local zones, cache, routing to public DNS or the ZeroTrust
+// upstream) and writes the response to w in dig's format, so operators can
+// test resolution without pointing system DNS at the endpoint.
+func runQuery(w io.Writer, name, qtypeName string, config *Config, tlsConfig *tls.Config) error {
+	qtype, err := parseQueryType(qtypeName)
+	if err != nil {
+		return err
+	}
+	query, err := newQuery(uint16(rand.N(1<<16)), name, qtype)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	qw := &queryWriter{}
+	handleDNSQuery(shutdownCtx, qw, query, config, tlsConfig)
+	if qw.response == nil {
+		return fmt.Errorf("query for %s was dropped, see the log", name)
+	}
+	return printResponse(w, qw.response, time.Since(start))
+}
+
+// queryWriter collects the response to a query made by runQuery.
+type queryWriter struct {
+	response []byte
+}
+
+func (w *queryWriter) WriteResponse(resp []byte) error {
+	w.response = resp
+	return nil
+}
+
+func (w *queryWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// parseQueryType parses a type name such as AAAA, a number or the generic
+// TYPE<n> form (RFC 3597), case-insensitively. Empty means A.
+func parseQueryType(s string) (uint16, error) {
+	if s == "" {
+		return typeA, nil
+	}
+	s = strings.ToUpper(s)
+	for qtype, name := range typeNames {
+		if name == s {
+			return qtype, nil
+		}
+	}
+	if n, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16); err == nil {
+		return uint16(n), nil
+	}
+	return 0, fmt.Errorf("unknown query type %q", s)
+}
+
+// newQuery builds a recursive query for name and qtype in class IN.
+func newQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	owner, err := encodeName(name)
+	if err != nil {
+		return nil, err
+	}
+	query := make([]byte, dnsHeaderLen, dnsHeaderLen+len(owner)+4)
+	setMsgID(query, id)
+	binary.BigEndian.PutUint16(query[2:4], flagRD)
+	binary.BigEndian.PutUint16(query[4:6], 1)
+	query = append(query, owner...)
+	query = binary.BigEndian.AppendUint16(query, qtype)
+	return binary.BigEndian.AppendUint16(query, classIN), nil
+}
+
+// printResponse writes msg the way dig prints it: the header, then each
+// section with one record per line.
+func printResponse(w io.Writer, msg []byte, elapsed time.Duration) error {
+	qname, qtype, qclass, err := parseQuestion(msg)
+	if err != nil {
+		return malformed("%v", err)
+	}
+	flags := msgFlags(msg)
+	var flagNames []string
+	for _, f := range []struct {
+		bit  uint16
+		name string
+	}{{flagQR, "qr"}, {flagAA, "aa"}, {flagTC, "tc"}, {flagRD, "rd"}, {flagRA, "ra"}, {flagAD, "ad"}, {flagCD, "cd"}} {
+		if flags&f.bit != 0 {
+			flagNames = append(flagNames, f.name)
+		}
+	}
+	qd, an, ns, ar := msgCounts(msg)
+	fmt.Fprintf(w, ";; ->>HEADER<<- opcode: QUERY, status: %s, id: %d\n", rcodeString(msgRcode(msg)), msgID(msg))
+	fmt.Fprintf(w, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n", strings.Join(flagNames, " "), qd, an, ns, ar)
+	fmt.Fprintf(w, "\n;; QUESTION SECTION:\n;%s.\t\t%s\t%s\n", qname, classString(qclass), typeString(qtype))
+
+	headings := [3]string{"ANSWER", "AUTHORITY", "ADDITIONAL"}
+	section := -1
+	err = forEachRecord(msg, func(rr resourceRecord) bool {
+		if rr.Type == typeOPT {
+			return true
+		}
+		if rr.Section != section {
+			section = rr.Section
+			fmt.Fprintf(w, "\n;; %s SECTION:\n", headings[section])
+		}
+		owner, _, err := readName(msg, rr.Offset)
+		if err != nil {
+			return true
+		}
+		fmt.Fprintf(w, "%s.\t%d\t%s\t%s\t%s\n", owner, rr.TTL, classString(rr.Class), typeString(rr.Type), formatRData(msg, rr))
+		return true
+	})
+	if err != nil {
+		return malformed("%v", err)
+	}
+	fmt.Fprintf(w, "\n;; Query time: %d msec\n", elapsed.Milliseconds())
+	return nil
+}
+
+// formatRData renders the data of rr in presentation format for the types
+// the endpoint commonly sees, and in the generic \# form (RFC 3597 section
+// 5) for the rest.
+func formatRData(msg []byte, rr resourceRecord) string {
+	rdata := msg[rr.RDataOffset : rr.RDataOffset+rr.RDataLen]
+	name := func(off int) (string, int, bool) {
+		n, next, err := readName(msg, off)
+		return n + ".", next, err == nil
+	}
+	switch rr.Type {
+	case typeA, typeAAAA:
+		if len(rdata) == net.IPv4len || len(rdata) == net.IPv6len {
+			return net.IP(rdata).String()
+		}
+	case typeCNAME, typeNS, typePTR:
+		if n, _, ok := name(rr.RDataOffset); ok {
+			return n
+		}
+	case typeMX:
+		if len(rdata) > 2 {
+			if n, _, ok := name(rr.RDataOffset + 2); ok {
+				return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rdata), n)
+			}
+		}
+	case typeSRV:
+		if len(rdata) > 6 {
+			if n, _, ok := name(rr.RDataOffset + 6); ok {
+				return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:]), binary.BigEndian.Uint16(rdata[4:]), n)
+			}
+		}
+	case typeSOA:
+		if mname, next, ok := name(rr.RDataOffset); ok {
+			if rname, next, ok := name(next); ok && next+20 <= rr.RDataOffset+rr.RDataLen {
+				var v [5]uint32
+				for i := range v {
+					v[i] = binary.BigEndian.Uint32(msg[next+4*i:])
+				}
+				return fmt.Sprintf("%s %s %d %d %d %d %d", mname, rname, v[0], v[1], v[2], v[3], v[4])
+			}
+		}
+	case typeTXT:
+		var strs []string
+		for rest := rdata; len(rest) > 0 && 1+int(rest[0]) <= len(rest); rest = rest[1+int(rest[0]):] {
+			strs = append(strs, strconv.Quote(string(rest[1:1+int(rest[0])])))
+		}
+		if strs != nil {
+			return strings.Join(strs, " ")
+		}
+	}
+	return fmt.Sprintf("\\# %d %s", len(rdata), hex.EncodeToString(rdata))
+}
+
+func classString(class uint16) string {
+	switch class {
+	case classIN:
+		return "IN"
+	case classCH:
+		return "CH"
+	}
+	return fmt.Sprintf("CLASS%d", class)
+}
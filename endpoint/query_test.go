@@ -0,0 +1,68 @@
+package endpoint
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseQueryType(t *testing.T) {
+	for s, want := range map[string]uint16{"": typeA, "aaaa": typeAAAA, "TXT": typeTXT, "65": 65, "TYPE65": 65} {
+		if got, err := parseQueryType(s); err != nil || got != want {
+			t.Errorf("%q parsed as %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"BOGUS", "TYPE70000", "-1"} {
+		if _, err := parseQueryType(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func TestRunQuery(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 7}))
+	public := startMockPublic(t, answerA(300, [4]byte{192, 0, 2, 1}))
+	config := &Config{Server: upstream.addr(), Type: "service", Domains: []string{"internal.corp"}, PublicDNS: []string{public.addr}}
+
+	// Routed like a client query: the internal name to the upstream, the
+	// rest to public DNS
+	for name, want := range map[string]string{
+		"app.internal.corp": "app.internal.corp.\t60\tIN\tA\t10.0.0.7\n",
+		"www.example":       "www.example.\t300\tIN\tA\t192.0.2.1\n",
+	} {
+		var out bytes.Buffer
+		if err := runQuery(&out, name, "A", config, p.clientTLS(t)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, line := range []string{
+			"status: NOERROR",
+			"flags: qr rd ra; QUERY: 1, ANSWER: 1, AUTHORITY: 0, ADDITIONAL: 0",
+			";; QUESTION SECTION:\n;" + name + ".\t\tIN\tA\n",
+			";; ANSWER SECTION:\n" + want,
+			";; Query time:",
+		} {
+			if !strings.Contains(out.String(), line) {
+				t.Errorf("%s: output lacks %q:\n%s", name, line, out.String())
+			}
+		}
+	}
+	if upstream.queries.Load() != 1 || public.queries.Load() != 1 {
+		t.Errorf("%d upstream and %d public queries, want one each", upstream.queries.Load(), public.queries.Load())
+	}
+
+	// Local zones answer NXDOMAIN with their SOA
+	useLocalZones(t, "", "nxdomain")
+	var out bytes.Buffer
+	if err := runQuery(&out, "printer.local", "aaaa", config, p.clientTLS(t)); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); !strings.Contains(got, "status: NXDOMAIN") || !strings.Contains(got, ";; AUTHORITY SECTION:\nlocal.\t3600\tIN\tSOA\tlocal. . 1 3600 600 86400 3600\n") {
+		t.Errorf("local zone answer printed as:\n%s", got)
+	}
+
+	if err := runQuery(&bytes.Buffer{}, "www.example", "BOGUS", config, p.clientTLS(t)); err == nil {
+		t.Error("unknown type queried")
+	}
+}
@@ -0,0 +1,123 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// queryLogEntry is one line of the query audit log.
+type queryLogEntry struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	// Path is how the query was answered, one of the path constants
+	Path  string `json:"path"`
+	Rcode string `json:"rcode,omitempty"`
+}
+
+// The paths a query can be answered by, as logged.
+const (
+	pathCache    = "cache"    // from the response cache
+	pathStale    = "stale"    // from an expired cache entry, see -serve-stale
+	pathPublic   = "public"   // by public DNS
+	pathUpstream = "upstream" // by a ZeroTrust upstream
+	pathLocal    = "local"    // by the endpoint itself: version probes and local zones
+	pathHosts    = "hosts"    // from the -hosts file
+	pathBlocked  = "blocked"  // by the denylist
+	pathFailed   = "failed"   // SERVFAIL, no answer could be obtained
+)
+
+// queryLogger appends JSONL entries to a file, rotating it to <path>.1 once
+// it grows past maxSize bytes.
+type queryLogger struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+// queryLog is nil unless --query-log is set.
+var queryLog *queryLogger
+
+func openQueryLog(path string, maxSize int64) (*queryLogger, error) {
+	l := &queryLogger{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *queryLogger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open query log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat query log: %v", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+func (l *queryLogger) rotate() error {
+	l.file.Close()
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate query log: %v", err)
+	}
+	return l.open()
+}
+
+func (l *queryLogger) Log(entry queryLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize && l.size > 0 {
+		if err := l.rotate(); err != nil {
+			slog.Error("Query log rotation failed", "error", err)
+			// Keep logging to the current file if it could be reopened
+			if l.open() != nil {
+				return
+			}
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		slog.Error("Failed to write query log", "error", err)
+	}
+}
+
+// logQuery records a query outcome in the audit log when it is enabled.
+// response may be nil for queries that failed.
+func logQuery(client, qname string, qtype uint16, path string, response []byte) {
+	if queryLog == nil {
+		return
+	}
+	entry := queryLogEntry{
+		Time:   time.Now().UTC(),
+		Client: client,
+		Name:   qname,
+		Type:   typeString(qtype),
+		Path:   path,
+	}
+	if len(response) >= dnsHeaderLen {
+		entry.Rcode = rcodeString(msgRcode(response))
+	}
+	queryLog.Log(entry)
+}
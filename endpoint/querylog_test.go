@@ -0,0 +1,90 @@
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTestQueryLog logs queries to a temporary file rotated past maxSize
+// for the rest of the test, and returns its path.
+func useTestQueryLog(t *testing.T, maxSize int64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "queries.jsonl")
+	l, err := openQueryLog(path, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.file.Close() })
+	setForTest(t, &queryLog, l)
+	return path
+}
+
+// readQueryLog returns the entries in the query log at path.
+func readQueryLog(t *testing.T, path string) []queryLogEntry {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []queryLogEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry queryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("malformed log line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestQueryLogLine(t *testing.T) {
+	resetUpstreamState(t)
+	path := useTestQueryLog(t, 0)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+
+	start := time.Now()
+	for range 2 {
+		handleDNSQuery(context.Background(), &queryWriter{}, buildTestQuery(1, "Audit.Example", typeAAAA), config, p.clientTLS(t))
+	}
+
+	entries := readQueryLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("%d log lines for 2 queries", len(entries))
+	}
+	for i, want := range []string{pathUpstream, pathCache} {
+		entry := entries[i]
+		if entry.Name != "audit.example" || entry.Type != "AAAA" || entry.Path != want || entry.Rcode != "NOERROR" || entry.Client == "" {
+			t.Errorf("query %d logged as %+v, want path %s", i, entry, want)
+		}
+		if entry.Time.Before(start.Add(-time.Second)) || entry.Time.After(time.Now()) {
+			t.Errorf("query %d logged at %s", i, entry.Time)
+		}
+	}
+}
+
+func TestQueryLogRotates(t *testing.T) {
+	path := useTestQueryLog(t, 300)
+	for range 10 {
+		logQuery("127.0.0.1:5000", "rotate.example", typeA, pathCache, nil)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 300 {
+		t.Errorf("log grew to %d bytes, past the 300 allowed", info.Size())
+	}
+	rotated := readQueryLog(t, path+".1")
+	if len(rotated) == 0 || len(rotated)+len(readQueryLog(t, path)) > 10 {
+		t.Errorf("%d lines in the rotated log", len(rotated))
+	}
+}
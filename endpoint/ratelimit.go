@@ -0,0 +1,98 @@
+package endpoint
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxRateLimitedClients bounds how many clients the rate limiter tracks.
+// Beyond it the least recently seen client is forgotten, which only resets
+// its bucket to full.
+const maxRateLimitedClients = 10000
+
+// clientLimiter is a token bucket per client IP: each client may send
+// burst queries at once, refilled at qps per second.
+type clientLimiter struct {
+	mu      sync.Mutex
+	qps     float64
+	burst   float64
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// clientRateLimit is nil unless -client-qps is set.
+var clientRateLimit *clientLimiter
+
+func newClientLimiter(qps float64, burst int) *clientLimiter {
+	if burst < 1 {
+		burst = max(1, int(qps))
+	}
+	return &clientLimiter{
+		qps:     qps,
+		burst:   float64(burst),
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// allow reports whether the client at ip may send a query at now, taking a
+// token if so.
+func (l *clientLimiter) allow(ip net.IP, now time.Time) bool {
+	key := string(ip.To16())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var bucket *tokenBucket
+	if elem, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(elem)
+		bucket = elem.Value.(*tokenBucket)
+		elapsed := now.Sub(bucket.last).Seconds()
+		bucket.tokens = min(l.burst, bucket.tokens+elapsed*l.qps)
+		bucket.last = now
+	} else {
+		bucket = &tokenBucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(bucket)
+		l.prune(now)
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// prune forgets clients idle long enough for their bucket to have refilled,
+// since a new bucket would be the same, and the least recently seen ones
+// beyond maxRateLimitedClients.
+func (l *clientLimiter) prune(now time.Time) {
+	refill := time.Duration(l.burst / l.qps * float64(time.Second))
+	for elem := l.lru.Back(); elem != nil; elem = l.lru.Back() {
+		bucket := elem.Value.(*tokenBucket)
+		if l.lru.Len() <= maxRateLimitedClients && now.Sub(bucket.last) < refill {
+			break
+		}
+		l.lru.Remove(elem)
+		delete(l.buckets, bucket.key)
+	}
+}
+
+// addrIP returns the IP of a UDP or TCP client address, or nil.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClientLimiter(t *testing.T) {
+	l := newClientLimiter(2, 3)
+	now := time.Now()
+	a, b := net.IPv4(203, 0, 113, 1), net.IPv4(203, 0, 113, 2)
+	for i := range 3 {
+		if !l.allow(a, now) {
+			t.Fatalf("query %d of the burst refused", i+1)
+		}
+	}
+	if l.allow(a, now) {
+		t.Fatal("query beyond the burst allowed")
+	}
+	// Other clients have their own bucket
+	if !l.allow(b, now) {
+		t.Error("second client limited by the first")
+	}
+	// Two tokens a second come back
+	if !l.allow(a, now.Add(500*time.Millisecond)) || l.allow(a, now.Add(500*time.Millisecond)) {
+		t.Error("want one query allowed after half a second")
+	}
+
+	// Clients long idle are forgotten, and the map stays bounded
+	for i := range maxRateLimitedClients + 10 {
+		l.allow(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), now.Add(time.Minute))
+	}
+	if n := len(l.buckets); n != maxRateLimitedClients {
+		t.Errorf("%d clients tracked, want %d", n, maxRateLimitedClients)
+	}
+	if _, ok := l.buckets[string(a.To16())]; ok {
+		t.Error("idle client still tracked")
+	}
+}
+
+func TestRateLimitRefuses(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, &clientRateLimit, newClientLimiter(1, 3))
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+	limited := testutil.ToFloat64(droppedQueries.WithLabelValues("ratelimit"))
+	query := func(host byte, i int) []byte {
+		w := &remoteWriter{addr: &net.UDPAddr{IP: net.IPv4(203, 0, 113, host), Port: 5353}}
+		handleDNSQuery(context.Background(), w, buildTestQuery(uint16(i), fmt.Sprintf("burst%d.example", i), typeA), config, p.clientTLS(t))
+		return w.response
+	}
+
+	refused := 0
+	for i := range 10 {
+		resp := query(1, i)
+		switch {
+		case resp == nil:
+			t.Fatalf("query %d unanswered", i)
+		case msgRcode(resp) == rcodeRefused:
+			refused++
+		case i >= 3:
+			t.Errorf("query %d beyond the burst answered %s", i, rcodeString(msgRcode(resp)))
+		}
+	}
+	if refused != 7 {
+		t.Errorf("%d of 10 queries refused, want the 7 beyond the burst", refused)
+	}
+	if n := upstream.queries.Load(); n != 3 {
+		t.Errorf("%d queries forwarded, want 3", n)
+	}
+	if got := testutil.ToFloat64(droppedQueries.WithLabelValues("ratelimit")) - limited; got != 7 {
+		t.Errorf("%v rate limited queries counted, want 7", got)
+	}
+	if resp := query(2, 99); msgRcode(resp) != rcodeSuccess {
+		t.Errorf("another client refused: %s", rcodeString(msgRcode(resp)))
+	}
+}
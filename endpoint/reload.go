@@ -0,0 +1,105 @@
+package endpoint
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// endpointState is what queries are served with. Config and TLS settings
+// are replaced together on reload so a handler never pairs a config with
+// TLS settings built for another.
+type endpointState struct {
+	config    *Config
+	tlsConfig *tls.Config
+}
+
+var activeState atomic.Pointer[endpointState]
+
+func currentState() *endpointState {
+	return activeState.Load()
+}
+
+// watchReload reloads config.zt, the TLS material and the domain lists
+// whenever the process receives SIGHUP.
+func watchReload() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	for range sighup {
+		slog.Info("Received SIGHUP, reloading config")
+		if err := reloadConfig(); err != nil {
+			slog.Error("Config reload failed, keeping current config", "error", err)
+		}
+	}
+}
+
+// reloadConfig loads and verifies a fresh config and swaps it in. On any
+// failure the active config is left untouched.
+func reloadConfig() error {
+	paths := flagPaths()
+
+	ca, err := loadCA(paths.CA, paths.ExtraCA)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig(paths, ca)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := setupTLS(config, paths, ca)
+	if err != nil {
+		return err
+	}
+
+	filter, err := loadDomainFilter(*allowlistPath, *denylistPath, *sinkholeAddr)
+	if err != nil {
+		return err
+	}
+	hosts, err := loadHosts(*hostsPath)
+	if err != nil {
+		return err
+	}
+
+	// New listen addresses are bound before anything is swapped, so a
+	// failed bind keeps the old listeners along with the old config
+	spec, rebind := listenChanged(config)
+	listening := currentListenAddrs()
+	var bound []*dnsListener
+	if rebind {
+		if bound, err = bindListeners(spec); err != nil {
+			return err
+		}
+		listening = listenerAddrs(bound)
+	}
+	if err := checkResolverLoop(config, listening); err != nil {
+		discardListeners(bound)
+		return err
+	}
+
+	activeState.Store(&endpointState{config: config, tlsConfig: tlsConfig})
+	activeFilter.Store(filter)
+	activeHosts.Store(hosts)
+	if rebind {
+		swapListeners(spec, bound)
+		slog.Info("DNS listeners moved", "addrs", listening)
+	}
+
+	// Idle upstream connections were made with the old TLS settings, and
+	// cached answers may have come from routing the new config changes
+	resetUpstreamPools()
+	resetServerTLSConfigs(tlsConfig)
+	resetDoHClients()
+	resetDoQConns()
+	resetBreakers()
+	resetUpstreamHealth()
+	responseCache.Flush()
+
+	slog.Info("Config reloaded", "type", config.Type, "upstreams", config.upstreams(), "expires", config.Expires)
+	return nil
+}
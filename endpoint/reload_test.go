@@ -0,0 +1,256 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// keepActiveState restores the active state, filter and hosts table when
+// the test ends.
+func keepActiveState(t *testing.T) {
+	state, filter, hosts := activeState.Load(), activeFilter.Load(), activeHosts.Load()
+	t.Cleanup(func() {
+		activeState.Store(state)
+		activeFilter.Store(filter)
+		activeHosts.Store(hosts)
+	})
+}
+
+func TestReloadConfigChangesRouting(t *testing.T) {
+	resetUpstreamState(t)
+	keepActiveState(t)
+	initQuerySlots()
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	public := startMockPublic(t, answerA(60, [4]byte{192, 0, 2, 1}))
+
+	// The first config sends only internal.corp upstream, the second
+	// everything
+	first := map[string]any{"server": upstream.addr(), "domains": []string{"internal.corp"}, "public_dns": []string{public.addr}}
+	second := map[string]any{"server": upstream.addr(), "no_public_dns": true}
+	config := writeTestToken(t, p, first, jwt.RegisteredClaims{})
+	useTestBundle(t, p, config)
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveUDP(context.Background(), conn, currentState)
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	resolve := func(id uint16) net.IP {
+		t.Helper()
+		client.Write(buildTestQuery(id, "www.example.com", typeA))
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, maxUDPSize)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return firstA(t, buf[:n])
+	}
+
+	if ip := resolve(1); !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("answered %v before the reload, want public DNS", ip)
+	}
+	rewriteToken(t, config, writeTestToken(t, p, second, jwt.RegisteredClaims{}))
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	// Same listener, new routing, and no answer cached under the old one
+	if ip := resolve(2); !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("answered %v after the reload, want the upstream", ip)
+	}
+}
+
+func TestReloadConfigKeepsStateOnFailure(t *testing.T) {
+	resetUpstreamState(t)
+	keepActiveState(t)
+	p := newTestPKI(t)
+	config := writeTestToken(t, p, map[string]any{"server": "10.0.0.1:853"}, jwt.RegisteredClaims{})
+	useTestBundle(t, p, config)
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	state := currentState()
+
+	for name, token := range map[string]string{
+		"expired":  writeTestToken(t, p, map[string]any{"server": "10.0.0.2:853", "expires": "2020-01-01T00:00:00Z"}, jwt.RegisteredClaims{}),
+		"other CA": writeTestToken(t, newTestPKI(t), map[string]any{"server": "10.0.0.2:853"}, jwt.RegisteredClaims{}),
+	} {
+		rewriteToken(t, config, token)
+		if err := reloadConfig(); err == nil {
+			t.Errorf("%s: reload succeeded", name)
+		}
+		if currentState() != state {
+			t.Errorf("%s: state replaced by a failed reload", name)
+		}
+	}
+}
+
+// rewriteToken replaces the token at path with the one at from.
+func rewriteToken(t *testing.T, path, from string) {
+	t.Helper()
+	token, err := os.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, token, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigPathFlags(t *testing.T) {
+	resetUpstreamState(t)
+	keepActiveState(t)
+	p := newTestPKI(t)
+	// Under a directory of its own, by a name other than config.zt
+	token, err := os.ReadFile(writeTestToken(t, p, map[string]any{"server": "10.9.9.9:853"}, jwt.RegisteredClaims{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "etc", "zerotrust")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "endpoint.jwt")
+	if err := os.WriteFile(config, token, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	useTestBundle(t, p, config)
+
+	if paths := flagPaths(); paths.Config != config || paths.CA != *caPath || paths.Cert != *certPath || paths.Key != *keyPath {
+		t.Fatalf("flag paths %+v", paths)
+	}
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if server := currentState().config.Server; server != "10.9.9.9:853" {
+		t.Fatalf("loaded server %q, want the one in %s", server, config)
+	}
+
+	setForTest(t, configPath, filepath.Join(dir, "missing.jwt"))
+	if err := reloadConfig(); err == nil || !strings.Contains(err.Error(), "missing.jwt") {
+		t.Fatalf("got %v, want an error naming the missing file", err)
+	}
+
+	// $ZT_CONFIG stands in for a -config-path not given
+	t.Setenv("ZT_CONFIG", string(token))
+	if paths := flagPaths(); paths.Config != envSourcePrefix+"ZT_CONFIG" {
+		t.Fatalf("config path %q with $ZT_CONFIG set", paths.Config)
+	}
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// keepListeners serves no listeners for the test, closing those it bound
+// and restoring the ones being served when it ends.
+func keepListeners(t *testing.T) {
+	listenersMu.Lock()
+	ls, spec := listeners, listenSpec
+	listeners, listenSpec = nil, ""
+	listenersMu.Unlock()
+	t.Cleanup(func() {
+		listenersMu.Lock()
+		defer listenersMu.Unlock()
+		for _, l := range listeners {
+			l.close()
+		}
+		listeners, listenSpec = ls, spec
+	})
+}
+
+func TestReloadMovesListener(t *testing.T) {
+	resetUpstreamState(t)
+	keepActiveState(t)
+	keepListeners(t)
+	initQuerySlots()
+	setForTest(t, listenAddr, "")
+	setForTest(t, queryTimeout, 100*time.Millisecond)
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	// Bind and release two ports to listen on
+	var addrs [2]string
+	for i := range addrs {
+		probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = probe.LocalAddr().String()
+		probe.Close()
+	}
+	listenOn := func(addr string) string {
+		return writeTestToken(t, p, map[string]any{"server": upstream.addr(), "no_public_dns": true, "listen": []string{addr}}, jwt.RegisteredClaims{})
+	}
+	resolves := func(addr string) bool {
+		t.Helper()
+		resp := exchangeTestUDP(t, addr, buildTestQuery(3, "moved.example", typeA))
+		return firstA(t, resp).Equal(net.IPv4(10, 0, 0, 1))
+	}
+
+	config := listenOn(addrs[0])
+	useTestBundle(t, p, config)
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !resolves(addrs[0]) {
+		t.Fatalf("no answer on %s", addrs[0])
+	}
+
+	rewriteToken(t, config, listenOn(addrs[1]))
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentListenAddrs(); len(got) != 1 || got[0].String() != addrs[1] {
+		t.Fatalf("listening on %v after the reload, want %s", got, addrs[1])
+	}
+	if !resolves(addrs[1]) {
+		t.Fatalf("no answer on %s after the reload", addrs[1])
+	}
+	// The old port is released once queries on it had time to finish
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		udpAddr, _ := net.ResolveUDPAddr("udp", addrs[0])
+		if conn, err := net.ListenUDP("udp", udpAddr); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s still bound after the move", addrs[0])
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// A port that can't be bound keeps the listener and the config
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	state := currentState()
+	rewriteToken(t, config, listenOn(taken.LocalAddr().String()))
+	if err := reloadConfig(); err == nil {
+		t.Fatalf("reload bound %s, already taken", taken.LocalAddr())
+	}
+	if currentState() != state {
+		t.Error("state replaced by a reload that failed to bind")
+	}
+	if got := currentListenAddrs(); len(got) != 1 || got[0].String() != addrs[1] || !resolves(addrs[1]) {
+		t.Errorf("listening on %v after a failed bind, want %s still", got, addrs[1])
+	}
+}
@@ -0,0 +1,109 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A Resolver answers DNS queries the way the endpoint answers its local
+// clients: hosts file, denylist, local zones, cache, then the ZeroTrust
+// upstream or public DNS. It lets other Go programs embed the endpoint.
+//
+// Settings the config doesn't carry, such as timeouts and cache bounds,
+// are the defaults of the endpoint's flags. The response cache, upstream
+// connections and breakers are package state, so a process can have only
+// one Resolver: NewResolver fails once one exists.
+type Resolver struct {
+	state *endpointState
+}
+
+// ResolverConfig locates the endpoint bundle a Resolver is built from, as
+// the endpoint's -config, -ca, -cert and -key flags do.
+type ResolverConfig struct {
+	// Config is the signed provisioning token, verified against CA
+	Config string
+	// CA is the CA certificate the token and upstreams are checked against
+	CA string
+	// Cert and Key are the client keypair upstreams require, re-read when
+	// the files are rotated
+	Cert string
+	Key  string
+}
+
+// resolverCreated records that NewResolver has returned a Resolver.
+var resolverCreated atomic.Bool
+
+// NewResolver returns a Resolver for the bundle cfg locates, with the
+// upstream TLS config derived from its CA, keypair and provisioned config
+// as the endpoint builds it at startup.
+func NewResolver(cfg ResolverConfig) (*Resolver, error) {
+	paths := filePaths{Config: cfg.Config, CA: cfg.CA, Cert: cfg.Cert, Key: cfg.Key}
+	ca, err := loadCA(paths.CA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA: %v", err)
+	}
+	config, err := loadConfig(paths, ca)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+	if config.Server == "" && len(config.Servers) == 0 {
+		return nil, errors.New("config has no server")
+	}
+	tlsConfig, err := setupTLS(config, paths, ca)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up TLS: %v", err)
+	}
+	if !resolverCreated.CompareAndSwap(false, true) {
+		return nil, errors.New("a Resolver already exists in this process")
+	}
+	initQuerySlots()
+	return &Resolver{state: &endpointState{config: config, tlsConfig: tlsConfig}}, nil
+}
+
+// Resolve returns the response to query, a DNS message in wire format.
+// ctx bounds the upstream exchanges. A query the endpoint would drop
+// without an answer, such as a malformed one, is an error; failures
+// resolving it are answered with SERVFAIL as clients get them.
+func (r *Resolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	if r.state.config.IsExpired(time.Now()) {
+		return nil, errors.New("config has expired")
+	}
+	if _, _, _, err := parseQuestion(query); err != nil {
+		return nil, fmt.Errorf("malformed query: %v", err)
+	}
+	w := &queryWriter{}
+	handleDNSQuery(ctx, w, query, r.state.config, r.state.tlsConfig)
+	if w.response == nil {
+		return nil, errors.New("query was dropped, see the log")
+	}
+	return w.response, nil
+}
+
+// ListenAndServe answers DNS over UDP and TCP on the config's listen
+// addresses, or the endpoint's default ones, until ctx is done. Queries
+// being resolved then are cancelled.
+func (r *Resolver) ListenAndServe(ctx context.Context) error {
+	bound, err := bindSpec(strings.Join(r.state.config.Listen, ","), nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, l := range bound {
+			l.close()
+		}
+	}()
+	if err := checkResolverLoop(r.state.config, listenerAddrs(bound)); err != nil {
+		return err
+	}
+
+	state := func() *endpointState { return r.state }
+	for _, l := range bound {
+		l.serve(ctx, state)
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
@@ -0,0 +1,174 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// resetResolverCreated lets the test's resolver be replaced by the next
+// test's, once it ends.
+func resetResolverCreated(t *testing.T) {
+	t.Cleanup(func() { resolverCreated.Store(false) })
+}
+
+// newTestResolver returns a Resolver for a bundle provisioned with config
+// and a mock upstream answering 10.0.0.7 for every name.
+func newTestResolver(t *testing.T, config map[string]any) (*Resolver, *mockDoT) {
+	t.Helper()
+	resetUpstreamState(t)
+	resetResolverCreated(t)
+	p := newTestPKI(t)
+	server := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 7}))
+	config["server"] = server.addr()
+	config["server_name"] = testServerName
+	config["no_public_dns"] = true
+	r, err := NewResolver(writeTestBundle(t, p, writeTestToken(t, p, config, jwt.RegisteredClaims{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, server
+}
+
+func TestResolverResolve(t *testing.T) {
+	r, server := newTestResolver(t, map[string]any{})
+
+	resp, err := r.Resolve(context.Background(), buildTestQuery(0x4242, "resolve.api.test", typeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgID(resp) != 0x4242 || msgRcode(resp) != rcodeSuccess {
+		t.Fatalf("response ID %#x rcode %d", msgID(resp), msgRcode(resp))
+	}
+	if ip := firstA(t, resp); !ip.Equal(net.IPv4(10, 0, 0, 7)) {
+		t.Fatalf("answered %v", ip)
+	}
+	if n := server.queries.Load(); n != 1 {
+		t.Fatalf("upstream got %d queries, want 1", n)
+	}
+}
+
+func TestResolverResolveErrors(t *testing.T) {
+	r, server := newTestResolver(t, map[string]any{})
+
+	if _, err := r.Resolve(context.Background(), []byte{1, 2, 3}); err == nil {
+		t.Error("malformed query resolved")
+	}
+	response := buildTestAnswer(buildTestQuery(1, "resolve.api.test", typeA), 60, [4]byte{1, 2, 3, 4})
+	if _, err := r.Resolve(context.Background(), response); err == nil {
+		t.Error("response resolved as a query")
+	}
+
+	// A cancelled context fails the upstream exchange, which clients see
+	// as SERVFAIL
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resp, err := r.Resolve(ctx, buildTestQuery(2, "cancelled.api.test", typeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgRcode(resp) != rcodeServFail {
+		t.Errorf("rcode %d under a cancelled context, want SERVFAIL", msgRcode(resp))
+	}
+	if n := server.queries.Load(); n != 0 {
+		t.Errorf("upstream got %d queries, want none", n)
+	}
+}
+
+func TestNewResolverErrors(t *testing.T) {
+	resetResolverCreated(t)
+	p := newTestPKI(t)
+	if _, err := NewResolver(writeTestBundle(t, p, writeTestToken(t, p, map[string]any{}, jwt.RegisteredClaims{}))); err == nil {
+		t.Error("config without a server accepted")
+	}
+	dir := t.TempDir()
+	if _, err := NewResolver(ResolverConfig{Config: filepath.Join(dir, "config.zt"), CA: filepath.Join(dir, "ca.crt"), Cert: filepath.Join(dir, "endpoint.crt"), Key: filepath.Join(dir, "endpoint.key")}); err == nil {
+		t.Error("missing bundle loaded")
+	}
+	if resolverCreated.Load() {
+		t.Error("failed NewResolver counts as the process's Resolver")
+	}
+}
+
+func TestNewResolverOnePerProcess(t *testing.T) {
+	r, _ := newTestResolver(t, map[string]any{})
+
+	// A second Resolver would share the first's cache and upstream state
+	p := newTestPKI(t)
+	bundle := writeTestBundle(t, p, writeTestToken(t, p, map[string]any{"server": "127.0.0.1:853", "server_name": testServerName}, jwt.RegisteredClaims{}))
+	if _, err := NewResolver(bundle); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("second NewResolver returned %v, want it refused", err)
+	}
+	// and the first still answers
+	resp, err := r.Resolve(context.Background(), buildTestQuery(3, "first.api.test", typeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := firstA(t, resp); !ip.Equal(net.IPv4(10, 0, 0, 7)) {
+		t.Fatalf("answered %v", ip)
+	}
+}
+
+func TestResolverListenAndServe(t *testing.T) {
+	// Bind and release a port for the resolver to listen on
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	r, _ := newTestResolver(t, map[string]any{"listen": []string{addr}})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- r.ListenAndServe(ctx) }()
+
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	buf := make([]byte, maxUDPSize)
+	var n int
+	// The listener may not be up yet, so ask until it answers
+	for try := 0; ; try++ {
+		client.Write(buildTestQuery(7, "listen.api.test", typeA))
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, err = client.Read(buf); err == nil {
+			break
+		}
+		if try == 20 {
+			t.Fatalf("no answer from %s: %v", addr, err)
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("ListenAndServe: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if ip := firstA(t, buf[:n]); !ip.Equal(net.IPv4(10, 0, 0, 7)) {
+		t.Fatalf("answered %v", ip)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("ListenAndServe returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe still running after cancel")
+	}
+	// The address is free again
+	conn, err = net.ListenUDP("udp", conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("listener not closed: %v", err)
+	}
+	conn.Close()
+}
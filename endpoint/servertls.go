@@ -0,0 +1,155 @@
+package endpoint
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Deployments routing to several ZeroTrust servers may need different TLS
+// settings for each. The config's upstream_tls can give an upstream its
+// own server name, CA and client keypair, and with -upstream-cert-dir set
+// an upstream whose host has a keypair there, <host>.crt and <host>.key,
+// is presented that one. Every other upstream, and every setting not
+// overridden, uses the config from setupTLS.
+
+// UpstreamTLS overrides the TLS settings for one upstream. The files are
+// read like the CA and keypair flags, see readSource.
+type UpstreamTLS struct {
+	// ServerName is the name the upstream's certificate is checked against
+	ServerName string `json:"server_name"`
+	// CA is a file of CA certificates trusted for the upstream instead of
+	// the endpoint's CA
+	CA string `json:"ca"`
+	// Cert and Key are a client keypair presented to the upstream instead
+	// of the endpoint's
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// serverTLSConfigs holds the copies of a TLS config from setupTLS made for
+// single upstreams, keyed by the upstream and the config they copy.
+var (
+	serverTLSConfigsMu sync.Mutex
+	serverTLSConfigs   = make(map[poolKey]*tls.Config)
+)
+
+// setupServerTLSConfigs registers a copy of tlsConfig for each of config's
+// upstreams and proxy that upstream_tls or a keypair in dir applies to.
+func setupServerTLSConfigs(dir string, config *Config, tlsConfig *tls.Config) error {
+	servers := config.allUpstreams()
+	if config.Proxy != "" {
+		servers = append(servers, config.Proxy)
+	}
+	for server := range config.UpstreamTLS {
+		if !slices.Contains(servers, server) {
+			return fmt.Errorf("upstream_tls lists %q, which is not an upstream or the proxy", server)
+		}
+	}
+
+	configs := make(map[poolKey]*tls.Config)
+	for _, server := range servers {
+		key := poolKey{addr: server, tlsConfig: tlsConfig}
+		if _, ok := configs[key]; ok {
+			continue
+		}
+		serverConfig, err := newServerTLSConfig(dir, server, config.UpstreamTLS[server], tlsConfig)
+		if err != nil {
+			return err
+		}
+		if serverConfig != tlsConfig {
+			configs[key] = serverConfig
+		}
+	}
+
+	serverTLSConfigsMu.Lock()
+	defer serverTLSConfigsMu.Unlock()
+	for key, serverConfig := range configs {
+		serverTLSConfigs[key] = serverConfig
+	}
+	return nil
+}
+
+// newServerTLSConfig returns tlsConfig with override and the keypair in dir
+// for server's host applied, or tlsConfig itself when neither changes it.
+func newServerTLSConfig(dir, server string, override UpstreamTLS, tlsConfig *tls.Config) (*tls.Config, error) {
+	serverConfig := tlsConfig
+	clone := func() {
+		if serverConfig == tlsConfig {
+			serverConfig = tlsConfig.Clone()
+		}
+	}
+
+	if dir != "" {
+		host := strings.ToLower(upstreamHost(server))
+		certFile := filepath.Join(dir, host+".crt")
+		if _, err := os.Stat(certFile); err == nil {
+			keypair, err := newKeypairLoader(certFile, filepath.Join(dir, host+".key"))
+			if err != nil {
+				return nil, err
+			}
+			clone()
+			serverConfig.GetClientCertificate = keypair.GetClientCertificate
+			slog.Info("Using a separate client certificate for upstream", "upstream", server, "cert", certFile)
+		}
+	}
+
+	if override.ServerName != "" {
+		clone()
+		serverConfig.ServerName = override.ServerName
+	}
+	if override.CA != "" {
+		ca, err := loadCA(override.CA)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream_tls for %s: %v", server, err)
+		}
+		clone()
+		serverConfig.RootCAs = ca.Pool
+	}
+	if (override.Cert == "") != (override.Key == "") {
+		return nil, fmt.Errorf("invalid upstream_tls for %s: cert and key must be given together", server)
+	}
+	if override.Cert != "" {
+		keypair, err := newKeypairLoader(override.Cert, override.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream_tls for %s: %v", server, err)
+		}
+		clone()
+		serverConfig.GetClientCertificate = keypair.GetClientCertificate
+	}
+	if override != (UpstreamTLS{}) {
+		slog.Info("Using separate TLS settings for upstream", "upstream", server, "server_name", serverConfig.ServerName)
+	}
+	return serverConfig, nil
+}
+
+// serverTLSConfig returns the TLS config to connect to server with: the
+// copy of tlsConfig made for server, or tlsConfig itself when there is
+// none.
+func serverTLSConfig(tlsConfig *tls.Config, server string) *tls.Config {
+	serverTLSConfigsMu.Lock()
+	defer serverTLSConfigsMu.Unlock()
+
+	if serverConfig, ok := serverTLSConfigs[poolKey{addr: server, tlsConfig: tlsConfig}]; ok {
+		return serverConfig
+	}
+	return tlsConfig
+}
+
+// resetServerTLSConfigs forgets the per-upstream copies of every TLS
+// config but current, once a reload has replaced them.
+func resetServerTLSConfigs(current *tls.Config) {
+	serverTLSConfigsMu.Lock()
+	defer serverTLSConfigsMu.Unlock()
+
+	for key := range serverTLSConfigs {
+		if key.tlsConfig != current {
+			delete(serverTLSConfigs, key)
+		}
+	}
+}
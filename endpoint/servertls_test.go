@@ -0,0 +1,179 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// startIdentityDoT is startMockDoT recording the common name of every
+// client certificate presented to it.
+func startIdentityDoT(t *testing.T, p *testPKI) (*mockDoT, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var seen []string
+	serverTLS := p.serverTLS(t)
+	serverTLS.VerifyConnection = func(state tls.ConnectionState) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, state.PeerCertificates[0].Subject.CommonName)
+		return nil
+	}
+	server := startMockDoTConfig(t, serverTLS, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), seen...)
+	}
+}
+
+func TestPerUpstreamClientCerts(t *testing.T) {
+	resetUpstreamState(t)
+	t.Cleanup(func() { resetServerTLSConfigs(nil) })
+	p := newTestPKI(t)
+	first, firstSeen := startIdentityDoT(t, p)
+	second, secondSeen := startIdentityDoT(t, p)
+	third, thirdSeen := startIdentityDoT(t, p)
+	// The third upstream is given by name, for -upstream-cert-dir to match
+	_, port, _ := net.SplitHostPort(third.addr())
+	byName := net.JoinHostPort("localhost", port)
+
+	dir := t.TempDir()
+	certPath, keyPath := writeTestKeypair(t, dir, "endpoint", p.issue(t, "default-identity"))
+	secondCert, secondKey := writeTestKeypair(t, t.TempDir(), "second", p.issue(t, "second-identity"))
+	certDir := t.TempDir()
+	writeTestKeypair(t, certDir, "localhost", p.issue(t, "localhost-identity"))
+	setForTest(t, upstreamCertDir, certDir)
+
+	config := &Config{
+		Servers:     []string{first.addr(), second.addr(), byName},
+		ServerName:  testServerName,
+		UpstreamTLS: map[string]UpstreamTLS{second.addr(): {Cert: secondCert, Key: secondKey}},
+		NoPublicDNS: true,
+	}
+	tlsConfig, err := setupTLS(config, filePaths{Cert: certPath, Key: keyPath}, p.caBundle())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range config.Servers {
+		if _, err := forwardToServers(context.Background(), buildTestQuery(1, "identity.example", typeA), []string{server}, "", tlsConfig); err != nil {
+			t.Fatalf("%s: %v", server, err)
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		seen []string
+		want string
+	}{
+		"first":  {firstSeen(), "default-identity"},
+		"second": {secondSeen(), "second-identity"},
+		"third":  {thirdSeen(), "localhost-identity"},
+	} {
+		if len(tc.seen) != 1 || tc.seen[0] != tc.want {
+			t.Errorf("%s upstream was presented %v, want %s", name, tc.seen, tc.want)
+		}
+	}
+
+	// upstream_tls for a server that isn't configured is an error
+	config.UpstreamTLS = map[string]UpstreamTLS{"10.9.9.9:853": {ServerName: "x"}}
+	if _, err := setupTLS(config, filePaths{Cert: certPath, Key: keyPath}, p.caBundle()); err == nil {
+		t.Error("upstream_tls for an unknown server accepted")
+	}
+}
+
+// startNamedDoT is startMockDoT presenting a certificate from issuer for
+// name, recording the SNI of every handshake.
+func startNamedDoT(t *testing.T, p, issuer *testPKI, name string) (*mockDoT, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var seen []string
+	serverTLS := p.serverTLS(t)
+	serverTLS.Certificates = []tls.Certificate{issuer.issue(t, name, name)}
+	serverTLS.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, hello.ServerName)
+		return nil, nil
+	}
+	server := startMockDoTConfig(t, serverTLS, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), seen...)
+	}
+}
+
+func TestPerUpstreamServerNames(t *testing.T) {
+	resetUpstreamState(t)
+	t.Cleanup(func() { resetServerTLSConfigs(nil) })
+	p := newTestPKI(t)
+	// The third upstream's certificate is from a CA only it is trusted by
+	other := newTestPKI(t)
+	first, firstSeen := startNamedDoT(t, p, p, "dns-a.corp")
+	second, secondSeen := startNamedDoT(t, p, p, "dns-b.corp")
+	third, thirdSeen := startNamedDoT(t, p, other, "dns-c.corp")
+	fallback, fallbackSeen := startNamedDoT(t, p, p, testServerName)
+	caFile := filepath.Join(t.TempDir(), "other-ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.caCert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	certPath, keyPath := writeTestKeypair(t, t.TempDir(), "endpoint", p.issue(t, "endpoint"))
+	config := &Config{
+		Servers:    []string{first.addr(), second.addr(), third.addr(), fallback.addr()},
+		ServerName: testServerName,
+		UpstreamTLS: map[string]UpstreamTLS{
+			first.addr():  {ServerName: "dns-a.corp"},
+			second.addr(): {ServerName: "dns-b.corp"},
+			third.addr():  {ServerName: "dns-c.corp", CA: caFile},
+		},
+		NoPublicDNS: true,
+	}
+	tlsConfig, err := setupTLS(config, filePaths{Cert: certPath, Key: keyPath}, p.caBundle())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range config.Servers {
+		if _, err := forwardToServers(context.Background(), buildTestQuery(1, "sni.example", typeA), []string{server}, "", tlsConfig); err != nil {
+			t.Fatalf("%s: %v", server, err)
+		}
+	}
+	for name, tc := range map[string]struct {
+		seen []string
+		want string
+	}{
+		"first":    {firstSeen(), "dns-a.corp"},
+		"second":   {secondSeen(), "dns-b.corp"},
+		"third":    {thirdSeen(), "dns-c.corp"},
+		"fallback": {fallbackSeen(), testServerName},
+	} {
+		if len(tc.seen) != 1 || tc.seen[0] != tc.want {
+			t.Errorf("%s upstream saw SNI %v, want %s", name, tc.seen, tc.want)
+		}
+	}
+	// The shared config is left as it was
+	if tlsConfig.ServerName != testServerName {
+		t.Errorf("shared server name changed to %q", tlsConfig.ServerName)
+	}
+
+	// Without its CA the third upstream's certificate isn't trusted
+	resetUpstreamState(t)
+	resetServerTLSConfigs(nil)
+	config.UpstreamTLS = map[string]UpstreamTLS{third.addr(): {ServerName: "dns-c.corp"}}
+	if tlsConfig, err = setupTLS(config, filePaths{Cert: certPath, Key: keyPath}, p.caBundle()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := forwardToServers(context.Background(), buildTestQuery(2, "sni.example", typeA), []string{third.addr()}, "", tlsConfig); err == nil {
+		t.Error("upstream trusted without its CA")
+	}
+
+	config.UpstreamTLS = map[string]UpstreamTLS{first.addr(): {Cert: certPath}}
+	if _, err := setupTLS(config, filePaths{Cert: certPath, Key: keyPath}, p.caBundle()); err == nil {
+		t.Error("upstream_tls cert accepted without its key")
+	}
+}
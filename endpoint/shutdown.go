@@ -0,0 +1,49 @@
+package endpoint
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownCtx is the parent of every query's context. Cancelling it on
+// shutdown aborts in-flight upstream dials and reads, so those queries
+// get a quick SERVFAIL instead of no answer at all.
+var shutdownCtx, cancelQueries = context.WithCancel(context.Background())
+
+// shutdownDrainTimeout bounds how long the endpoint waits for cancelled
+// queries to answer before exiting.
+const shutdownDrainTimeout = 2 * time.Second
+
+// watchShutdown exits cleanly on SIGINT or SIGTERM, first cancelling the
+// queries being resolved and waiting for them to finish.
+func watchShutdown() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	s := <-sig
+	slog.Info("Shutting down", "signal", s.String())
+	cancelQueries()
+
+	// Holding every slot means no query is still in flight
+	deadline := time.After(shutdownDrainTimeout)
+drain:
+	for range cap(querySlots) {
+		select {
+		case querySlots <- struct{}{}:
+		case <-deadline:
+			slog.Warn("Queries still in flight at exit")
+			break drain
+		}
+	}
+
+	if *cacheFile != "" {
+		if err := saveCacheFile(*cacheFile); err != nil {
+			slog.Error("Cache not saved", "error", err)
+		}
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,94 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// sourceIP is the local address outbound connections originate from, set
+// from -source-addr. nil lets the OS pick by route as usual.
+var sourceIP net.IP
+
+// parseSourceAddr validates -source-addr: an IP literal that a socket on
+// this host can actually bind to, so a typo fails at startup rather than on
+// every query.
+func parseSourceAddr(s string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", s)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return nil, fmt.Errorf("address %s is not usable on this host: %v", ip, err)
+	}
+	conn.Close()
+	return ip, nil
+}
+
+// upstreamKeepAlive is the TCP keepalive idle time and probe interval on
+// outbound connections, so a pooled connection that died behind a NAT is
+// noticed rather than written into.
+const upstreamKeepAlive = 15 * time.Second
+
+// newDialer returns a dialer for network ("tcp" or "udp") bound to
+// sourceIP when one is configured.
+func newDialer(network string) *net.Dialer {
+	dialer := &net.Dialer{
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     upstreamKeepAlive,
+			Interval: upstreamKeepAlive,
+			Count:    3,
+		},
+	}
+	if sourceIP == nil {
+		return dialer
+	}
+	switch network {
+	case "udp":
+		dialer.LocalAddr = &net.UDPAddr{IP: sourceIP}
+	default:
+		dialer.LocalAddr = &net.TCPAddr{IP: sourceIP}
+	}
+	return dialer
+}
+
+// newTLSDialer returns a TLS dialer over newDialer("tcp").
+func newTLSDialer(config *tls.Config) *tls.Dialer {
+	return &tls.Dialer{NetDialer: newDialer("tcp"), Config: config}
+}
+
+// dialQUIC opens a QUIC connection to server, from sourceIP when one is
+// configured. quic-go leaves a caller-supplied socket open, so it is
+// closed here once the connection ends.
+func dialQUIC(ctx context.Context, server string, tlsConf *tls.Config, config *quic.Config) (quic.Connection, error) {
+	if sourceIP == nil {
+		return quic.DialAddr(ctx, server, tlsConf, config)
+	}
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: sourceIP})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := quic.Dial(ctx, udpConn, addr, tlsConf, config)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	go func() {
+		<-conn.Context().Done()
+		udpConn.Close()
+	}()
+	return conn, nil
+}
@@ -0,0 +1,79 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestParseSourceAddr(t *testing.T) {
+	if ip, err := parseSourceAddr(""); ip != nil || err != nil {
+		t.Errorf("empty -source-addr parsed as %v, %v", ip, err)
+	}
+	if ip, err := parseSourceAddr("127.0.0.1"); err != nil || !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("loopback parsed as %v, %v", ip, err)
+	}
+	// Not an address, and an address this host doesn't have
+	for _, s := range []string{"eth0", "192.0.2.255:53", "192.0.2.254"} {
+		if _, err := parseSourceAddr(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func TestSourceAddrUsed(t *testing.T) {
+	// Linux routes all of 127/8 to the loopback, so a second loopback
+	// address is there to bind to
+	ip, err := parseSourceAddr("127.0.0.2")
+	if err != nil {
+		t.Skip(err)
+	}
+	setForTest(t, &sourceIP, ip)
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", p.serverTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	dotFrom := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dotFrom <- conn.RemoteAddr()
+		serveTestStream(conn, conn, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	}()
+	if _, err := forwardToServer(context.Background(), buildTestQuery(1, "source.example", typeA), ln.Addr().String(), p.clientTLS(t)); err != nil {
+		t.Fatal(err)
+	}
+	if from := (<-dotFrom).(*net.TCPAddr); !from.IP.Equal(ip) {
+		t.Errorf("upstream connection came from %v, want %v", from.IP, ip)
+	}
+
+	public, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { public.Close() })
+	publicFrom := make(chan net.Addr, 1)
+	go func() {
+		buf := make([]byte, 512)
+		n, from, err := public.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		publicFrom <- from
+		public.WriteToUDP(answerA(60, [4]byte{192, 0, 2, 1})(buf[:n]), from)
+	}()
+	if resp := tryPublicDNS(context.Background(), buildTestQuery(2, "source.example", typeA), []string{public.LocalAddr().String()}); resp == nil {
+		t.Fatal("no public DNS answer")
+	}
+	if from := (<-publicFrom).(*net.UDPAddr); !from.IP.Equal(ip) {
+		t.Errorf("public DNS query came from %v, want %v", from.IP, ip)
+	}
+}
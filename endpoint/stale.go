@@ -0,0 +1,57 @@
+package endpoint
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Serve-stale (RFC 8767): with -serve-stale set, cache entries are kept
+// that long past their expiry, and a query the upstreams fail to answer
+// gets the expired answer instead of SERVFAIL. Stale answers are never
+// served while an upstream answers, however old the entry.
+
+const (
+	// staleTTL is the TTL of every record in a stale answer, so clients
+	// ask again soon (RFC 8767 section 4)
+	staleTTL = 30
+
+	optionExtendedError = 15
+	// edeStaleAnswer is the Extended DNS Error marking a stale answer
+	// (RFC 8914 section 4.4)
+	edeStaleAnswer = 3
+)
+
+// GetStale returns a copy of the expired entry for key as a stale answer
+// to query, or nil if there is none within the -serve-stale window. Only
+// positive and negative answers are served stale, never a cached failure.
+func (c *dnsCache) GetStale(key string, query []byte, now time.Time) []byte {
+	s := c.shard(key)
+	s.mu.Lock()
+	elem, ok := s.entries[key]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if now.Before(entry.expires) || !now.Before(entry.expires.Add(*serveStale)) {
+		s.mu.Unlock()
+		return nil
+	}
+	response := make([]byte, len(entry.response))
+	copy(response, entry.response)
+	s.mu.Unlock()
+
+	if rcode := msgRcode(response); rcode != rcodeSuccess && rcode != rcodeNXDomain {
+		return nil
+	}
+	setMsgID(response, msgID(query))
+	flags := msgFlags(response)&^flagRD | msgFlags(query)&flagRD
+	binary.BigEndian.PutUint16(response[2:4], flags)
+	setTTLs(response, staleTTL)
+	// Only an EDNS client gets told, an OPT record in the response to a
+	// client that sent none would be a protocol error
+	if _, ok := findOPT(query); ok {
+		response = setEDNSOption(response, optionExtendedError, binary.BigEndian.AppendUint16(nil, edeStaleAnswer))
+	}
+	return response
+}
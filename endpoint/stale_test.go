@@ -0,0 +1,104 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetStale(t *testing.T) {
+	setForTest(t, serveStale, time.Hour)
+	c := newDNSCache(16)
+	now := time.Now()
+	key, resp := cacheTestAnswer(t, "stale.example", 60)
+	c.Set(key, resp, now)
+	query := buildTestQuery(9, "stale.example", typeA)
+
+	if c.GetStale(key, query, now.Add(30*time.Second)) != nil {
+		t.Error("fresh entry served stale")
+	}
+	stale := c.GetStale(key, query, now.Add(10*time.Minute))
+	if stale == nil || msgID(stale) != 9 {
+		t.Fatalf("stale answer %x within the window", stale)
+	}
+	if ttl := recordTTLs(t, stale)[sectionAnswer][0]; ttl != staleTTL {
+		t.Errorf("stale TTL %d, want %d", ttl, staleTTL)
+	}
+	if _, ok := findOPT(stale); ok {
+		t.Error("OPT record in the stale answer to a client without EDNS")
+	}
+	// An EDNS client is told the answer is stale
+	stale = c.GetStale(key, withTestOPT(query, 1232), now.Add(10*time.Minute))
+	if ede, ok := ednsOption(stale, optionExtendedError); !ok || !bytes.Equal(ede, []byte{0, edeStaleAnswer}) {
+		t.Errorf("extended error %x, want Stale Answer", ede)
+	}
+	if c.GetStale(key, query, now.Add(2*time.Hour)) != nil {
+		t.Error("entry served stale past the -serve-stale window")
+	}
+
+	// A cached failure is never served stale
+	failKey, _ := cacheTestAnswer(t, "fail.example", 60)
+	c.Set(failKey, errorResponse(buildTestQuery(1, "fail.example", typeA), rcodeServFail), now)
+	if c.GetStale(failKey, query, now.Add(time.Minute)) != nil {
+		t.Error("SERVFAIL served stale")
+	}
+}
+
+func TestServeStaleUpstreamDown(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, upstreamTimeout, 200*time.Millisecond)
+	p := newTestPKI(t)
+	var down atomic.Bool
+	upstream := startMockDoT(t, p, 0, func(query []byte) []byte {
+		if down.Load() {
+			return nil
+		}
+		return answerA(60, [4]byte{10, 0, 0, 1})(query)
+	})
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+	// The answer cached an hour after it expired
+	query := buildTestQuery(1, "down.example", typeA)
+	key, err := cacheKey(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := buildTestAnswer(query, 60, [4]byte{10, 0, 0, 9})
+	resolve := func() []byte {
+		t.Helper()
+		responseCache.Set(key, old, time.Now().Add(-time.Hour))
+		w := &queryWriter{}
+		handleDNSQuery(context.Background(), w, query, config, p.clientTLS(t))
+		if w.response == nil {
+			t.Fatal("no answer")
+		}
+		return w.response
+	}
+
+	down.Store(true)
+	setForTest(t, serveStale, 2*time.Hour)
+	resp := resolve()
+	if msgRcode(resp) != rcodeSuccess || !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 9)) {
+		t.Fatalf("upstream down answered %s, want the stale 10.0.0.9", rcodeString(msgRcode(resp)))
+	}
+	if ttl := recordTTLs(t, resp)[sectionAnswer][0]; ttl != staleTTL {
+		t.Errorf("stale TTL %d, want %d", ttl, staleTTL)
+	}
+
+	// Past the window, or with serve-stale off, the failure shows
+	for _, window := range []time.Duration{30 * time.Minute, 0} {
+		setForTest(t, serveStale, window)
+		if resp := resolve(); msgRcode(resp) != rcodeServFail {
+			t.Errorf("-serve-stale %s answered %s, want SERVFAIL", window, rcodeString(msgRcode(resp)))
+		}
+	}
+
+	// While the upstream answers, it is asked, not the stale entry served
+	down.Store(false)
+	setForTest(t, serveStale, 2*time.Hour)
+	if resp := resolve(); !firstA(t, resp).Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Error("stale answer served with the upstream up")
+	}
+}
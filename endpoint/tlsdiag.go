@@ -0,0 +1,100 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"reflect"
+	"syscall"
+)
+
+// TLS alerts a server sends when it refuses the handshake (RFC 8446 6.2)
+const (
+	alertBadCertificate        = 42
+	alertCertificateRevoked    = 44
+	alertCertificateExpired    = 45
+	alertUnknownCA             = 48
+	alertProtocolVersion       = 70
+	alertCertificateRequired   = 116
+	alertNoApplicationProtocol = 120
+)
+
+// diagnoseConnectError sorts a failed upstream connection into a reason,
+// used as a metric label, and a hint at what the operator should check.
+// The hint is empty when there is nothing more specific to say.
+func diagnoseConnectError(err error) (reason, hint string) {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		recordHeader     tls.RecordHeaderError
+		dnsErr           *net.DNSError
+		netErr           net.Error
+	)
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "unknown_authority", "the server certificate isn't signed by the CA in -ca-path, check the CA belongs to this deployment"
+	case errors.As(err, &hostname):
+		return "hostname_mismatch", "the server certificate doesn't cover the name checked, set server_name to one of its names"
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return "certificate_expired", "the server certificate is expired or not yet valid, check the clock on this host"
+	}
+	if alert, ok := remoteAlert(err); ok {
+		switch alert {
+		case alertBadCertificate, alertCertificateRevoked, alertCertificateExpired, alertUnknownCA, alertCertificateRequired:
+			return "client_rejected", "the server refused this endpoint's client certificate, re-provision the endpoint"
+		case alertProtocolVersion:
+			return "tls_version", "the server doesn't speak TLS 1.3, allow TLS 1.2 with -tls-min-version 1.2"
+		case alertNoApplicationProtocol:
+			return "alpn", "the server rejected the offered ALPN protocol, try -dot-alpn with another value or empty"
+		}
+		return "handshake_refused", ""
+	}
+	switch {
+	case errors.As(err, &recordHeader):
+		return "not_tls", "the server didn't answer with TLS, check the port is its DNS-over-TLS port"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused", "nothing is listening at that address, check the server address and port"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "no_route", "no route to the server, check the network and -source-addr"
+	case errors.As(err, &dnsErr):
+		return "dns", "the server's name didn't resolve"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout", "no answer within -upstream-timeout, check firewalls between here and the server"
+	}
+	return "other", ""
+}
+
+// remoteAlert returns the TLS alert the server sent, if err carries one.
+// crypto/tls reports alerts from the peer as a net.OpError with Op "remote
+// error" around an unexported uint8 alert type, and as a wrapped AlertError
+// only from QUIC.
+func remoteAlert(err error) (uint8, bool) {
+	var alert tls.AlertError
+	if errors.As(err, &alert) {
+		return uint8(alert), true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" && opErr.Err != nil {
+		if v := reflect.ValueOf(opErr.Err); v.Kind() == reflect.Uint8 {
+			return uint8(v.Uint()), true
+		}
+	}
+	return 0, false
+}
+
+// connectError wraps a failure to connect to an upstream with its
+// diagnosis and counts it. Connections abandoned through ctx aren't
+// counted, like in observeUpstream.
+func connectError(ctx context.Context, err error) error {
+	reason, hint := diagnoseConnectError(err)
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		upstreamConnectErrors.WithLabelValues(reason).Inc()
+	}
+	if hint == "" {
+		return unreachable("failed to connect: %v", err)
+	}
+	return unreachable("failed to connect: %v (%s)", err, hint)
+}
@@ -0,0 +1,145 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// startTestTLSServer accepts TLS connections on a loopback port with
+// config, completing the handshake and hanging up.
+func startTestTLSServer(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startTestTCPServer accepts plain TCP connections on a loopback port and
+// hands each to serve.
+func startTestTCPServer(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDiagnoseConnectError(t *testing.T) {
+	p := newTestPKI(t)
+	other := newTestPKI(t)
+	upstream := startTestTLSServer(t, p.serverTLS(t))
+	alpnOnly := p.serverTLS(t)
+	alpnOnly.NextProtos = []string{"h2"}
+	wrongALPN := startTestTLSServer(t, alpnOnly)
+	notTLS := startTestTCPServer(t, func(conn net.Conn) {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		conn.Close()
+	})
+	// Reads the ClientHello and never answers
+	silent := startTestTCPServer(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	})
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := probe.Addr().String()
+	probe.Close()
+
+	dial := func(addr string, config *tls.Config) error {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		conn, err := (&tls.Dialer{Config: config}).DialContext(ctx, "tcp", addr)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("%s: handshake succeeded", addr)
+		}
+		return err
+	}
+	otherName := p.clientTLS(t)
+	otherName.ServerName = "not-the-server"
+	withALPN := p.clientTLS(t)
+	withALPN.NextProtos = []string{"dot"}
+
+	for want, err := range map[string]error{
+		"unknown_authority": dial(upstream, other.clientTLS(t)),
+		"hostname_mismatch": dial(upstream, otherName),
+		"alpn":              dial(wrongALPN, withALPN),
+		"not_tls":           dial(notTLS, p.clientTLS(t)),
+		"refused":           dial(closed, p.clientTLS(t)),
+		"timeout":           dial(silent, p.clientTLS(t)),
+		// Failures not easily produced on the loopback
+		"certificate_expired": &tls.CertificateVerificationError{Err: x509.CertificateInvalidError{Reason: x509.Expired}},
+		"client_rejected":     fmt.Errorf("handshake: %w", tls.AlertError(alertBadCertificate)),
+		"tls_version":         tls.AlertError(alertProtocolVersion),
+		"handshake_refused":   tls.AlertError(40), // handshake_failure
+		"no_route":            &net.OpError{Op: "dial", Net: "tcp", Err: syscall.EHOSTUNREACH},
+		"dns":                 &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "dot.invalid"}},
+		"other":               errors.New("something else"),
+	} {
+		reason, hint := diagnoseConnectError(err)
+		if reason != want {
+			t.Errorf("%v: diagnosed %s, want %s", err, reason, want)
+		}
+		if hint == "" && want != "handshake_refused" && want != "other" {
+			t.Errorf("%s: no hint", want)
+		}
+	}
+}
+
+func TestConnectErrorCounted(t *testing.T) {
+	resetUpstreamState(t)
+	p := newTestPKI(t)
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := probe.Addr().String()
+	probe.Close()
+
+	refused := testutil.ToFloat64(upstreamConnectErrors.WithLabelValues("refused"))
+	_, err = forwardToServer(context.Background(), buildTestQuery(1, "diag.example", typeA), closed, p.clientTLS(t))
+	if !errors.Is(err, errUnreachable) || !strings.Contains(err.Error(), "nothing is listening") {
+		t.Errorf("got %v, want unreachable with the refused hint", err)
+	}
+	if got := testutil.ToFloat64(upstreamConnectErrors.WithLabelValues("refused")) - refused; got != 1 {
+		t.Errorf("%v refused connections counted, want 1", got)
+	}
+}
@@ -0,0 +1,29 @@
+package endpoint
+
+import (
+	"log/slog"
+	"net"
+)
+
+// setUDPBuffers asks the kernel for read and write buffers of the given
+// sizes on conn, so bursts of queries aren't dropped before they are read.
+// A size of 0 keeps the kernel's default. The kernel may grant less than
+// asked, up to its own limit (net.core.rmem_max and wmem_max on Linux),
+// which is logged since the flag then doesn't do what it says.
+func setUDPBuffers(conn *net.UDPConn, readSize, writeSize int) {
+	addr := conn.LocalAddr().String()
+	if readSize > 0 {
+		if err := conn.SetReadBuffer(readSize); err != nil {
+			slog.Warn("Could not set UDP read buffer size", "addr", addr, "size", readSize, "error", err)
+		} else if granted, ok := socketBufferSize(conn, false); ok && granted < readSize {
+			slog.Warn("Kernel limited the UDP read buffer size", "addr", addr, "requested", readSize, "granted", granted)
+		}
+	}
+	if writeSize > 0 {
+		if err := conn.SetWriteBuffer(writeSize); err != nil {
+			slog.Warn("Could not set UDP write buffer size", "addr", addr, "size", writeSize, "error", err)
+		} else if granted, ok := socketBufferSize(conn, true); ok && granted < writeSize {
+			slog.Warn("Kernel limited the UDP write buffer size", "addr", addr, "requested", writeSize, "granted", granted)
+		}
+	}
+}
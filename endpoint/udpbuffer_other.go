@@ -0,0 +1,11 @@
+//go:build !unix
+
+package endpoint
+
+import "net"
+
+// socketBufferSize can't read the granted size here, so clamping goes
+// unreported.
+func socketBufferSize(conn *net.UDPConn, write bool) (size int, ok bool) {
+	return 0, false
+}
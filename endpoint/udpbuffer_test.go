@@ -0,0 +1,56 @@
+package endpoint
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestUDPBuffersRequested(t *testing.T) {
+	setForTest(t, udpReadBuffer, 128<<10)
+	setForTest(t, udpWriteBuffer, 64<<10)
+	l, err := listenDNS(net.IPv4(127, 0, 0, 1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	read, ok := socketBufferSize(l.udp, false)
+	if !ok {
+		t.Skip("socket buffer sizes can't be read on this platform")
+	}
+	write, _ := socketBufferSize(l.udp, true)
+	if read != 128<<10 || write != 64<<10 {
+		t.Errorf("buffers of %d and %d bytes, want the %d and %d requested", read, write, 128<<10, 64<<10)
+	}
+}
+
+func TestUDPBufferClampLogged(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	logs := captureLogs(t, "warn")
+
+	// Far past any default limit of the kernel
+	const huge = 1 << 30
+	setUDPBuffers(conn, huge, 0)
+	granted, ok := socketBufferSize(conn, false)
+	if !ok {
+		t.Skip("socket buffer sizes can't be read on this platform")
+	}
+	if granted >= huge {
+		t.Skipf("kernel granted the %d bytes asked for", granted)
+	}
+	if !strings.Contains(logs.String(), "Kernel limited the UDP read buffer size") {
+		t.Errorf("clamp to %d bytes not logged:\n%s", granted, logs)
+	}
+
+	// Nothing is asked for, or logged, with the sizes unset
+	logs.Reset()
+	setUDPBuffers(conn, 0, 0)
+	if logs.Len() != 0 {
+		t.Errorf("logged with no sizes set:\n%s", logs)
+	}
+}
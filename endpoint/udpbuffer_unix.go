@@ -0,0 +1,34 @@
+//go:build unix
+
+package endpoint
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+)
+
+// socketBufferSize returns the size of conn's read or write buffer as the
+// kernel granted it.
+func socketBufferSize(conn *net.UDPConn, write bool) (size int, ok bool) {
+	opt := syscall.SO_RCVBUF
+	if write {
+		opt = syscall.SO_SNDBUF
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}); err != nil || sockErr != nil {
+		return 0, false
+	}
+	if runtime.GOOS == "linux" {
+		// Linux reports twice the size set, the rest is its own overhead
+		// (socket(7))
+		size /= 2
+	}
+	return size, true
+}
@@ -0,0 +1,17 @@
+package endpoint
+
+import "fmt"
+
+// Build metadata, set at link time with
+//
+//	-ldflags "-X zerotrust-dns/endpoint.version=... -X zerotrust-dns/endpoint.commit=...
+//	          -X zerotrust-dns/endpoint.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", version, commit, buildDate)
+}
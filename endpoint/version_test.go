@@ -0,0 +1,65 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestVersionString(t *testing.T) {
+	if s := versionString(); !strings.HasPrefix(s, "dev ") {
+		t.Errorf("unstamped version %q, want dev", s)
+	}
+
+	setForTest(t, &version, "1.4.2")
+	setForTest(t, &commit, "0f3bae1")
+	setForTest(t, &buildDate, "2026-10-14T09:00:00Z")
+	s := versionString()
+	for _, want := range []string{"1.4.2", "0f3bae1", "2026-10-14T09:00:00Z"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("version %q lacks %q", s, want)
+		}
+	}
+}
+
+func TestVersionBindAnsweredLocally(t *testing.T) {
+	resetUpstreamState(t)
+	setForTest(t, &version, "1.4.2")
+	p := newTestPKI(t)
+	upstream := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	config := &Config{Server: upstream.addr(), NoPublicDNS: true}
+
+	for _, name := range []string{"version.bind", "VERSION.Server"} {
+		query := buildTestQuery(1, name, typeTXT)
+		binary.BigEndian.PutUint16(query[len(query)-2:], classCH)
+		w := &queryWriter{}
+		handleDNSQuery(context.Background(), w, query, config, p.clientTLS(t))
+		if w.response == nil || msgRcode(w.response) != rcodeSuccess {
+			t.Fatalf("%s: answered %v", name, w.response)
+		}
+		var text string
+		err := forEachRecord(w.response, func(rr resourceRecord) bool {
+			if rr.Section == sectionAnswer && rr.Type == typeTXT && rr.Class == classCH {
+				rdata := w.response[rr.RDataOffset : rr.RDataOffset+rr.RDataLen]
+				text = string(rdata[1 : 1+int(rdata[0])])
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(text, versionString()) || !strings.Contains(text, "1.4.2") {
+			t.Errorf("%s: answered %q, want the version %q", name, text, versionString())
+		}
+	}
+	if n := upstream.queries.Load(); n != 0 {
+		t.Fatalf("upstream got %d queries, want none", n)
+	}
+
+	// The same name in class IN is an ordinary query
+	handleDNSQuery(context.Background(), &queryWriter{}, buildTestQuery(2, "version.bind", typeTXT), config, p.clientTLS(t))
+	if n := upstream.queries.Load(); n != 1 {
+		t.Fatalf("upstream got %d queries for IN version.bind, want 1", n)
+	}
+}
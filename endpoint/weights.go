@@ -0,0 +1,59 @@
+package endpoint
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+)
+
+// validateServerWeights checks that server_weights only names configured
+// upstreams and gives each a positive weight.
+func (c *Config) validateServerWeights() error {
+	for server, weight := range c.ServerWeights {
+		if !slices.Contains(c.upstreams(), server) {
+			return fmt.Errorf("server_weights names %q, which is not one of the servers", server)
+		}
+		if weight < 1 {
+			return fmt.Errorf("server_weights gives %q weight %d, want at least 1", server, weight)
+		}
+	}
+	return nil
+}
+
+// weightedUpstreams returns the upstreams in the order to try them for one
+// query. Without server_weights that is the configured order. With them
+// the order is a weighted random shuffle, so each server is tried first
+// in proportion to its weight and the rest remain as fallbacks. An
+// upstream's weight is halved for every consecutive failure it has had,
+// moving a struggling server to the back until it answers again.
+func (c *Config) weightedUpstreams() []string {
+	servers := c.upstreams()
+	if len(c.ServerWeights) == 0 || len(servers) < 2 {
+		return servers
+	}
+
+	// Efraimidis-Spirakis: sorting by u^(1/w) for uniform u draws servers
+	// in proportion to w without replacement
+	type keyed struct {
+		server string
+		key    float64
+	}
+	order := make([]keyed, len(servers))
+	for i, server := range servers {
+		weight := float64(c.ServerWeights[server])
+		if weight == 0 {
+			weight = 1
+		}
+		weight /= math.Exp2(float64(breakerFor(server).consecutiveFailures()))
+		order[i] = keyed{server: server, key: math.Pow(rand.Float64(), 1/weight)}
+	}
+	slices.SortStableFunc(order, func(a, b keyed) int { return cmp.Compare(b.key, a.key) })
+
+	weighted := make([]string, len(order))
+	for i, k := range order {
+		weighted[i] = k.server
+	}
+	return weighted
+}
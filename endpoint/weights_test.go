@@ -0,0 +1,85 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestValidateServerWeights(t *testing.T) {
+	servers := []string{"10.0.0.1:853", "10.0.0.2:853"}
+	for name, tc := range map[string]struct {
+		weights map[string]int
+		ok      bool
+	}{
+		"none":        {ok: true},
+		"some":        {weights: map[string]int{"10.0.0.1:853": 3}, ok: true},
+		"unknown":     {weights: map[string]int{"10.0.0.9:853": 1}},
+		"zero weight": {weights: map[string]int{"10.0.0.1:853": 0}},
+		"negative":    {weights: map[string]int{"10.0.0.2:853": -1}},
+	} {
+		config := &Config{Servers: servers, ServerWeights: tc.weights}
+		if err := config.validateServerWeights(); (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestWeightedUpstreams(t *testing.T) {
+	useTestBreakers(t, 100, time.Minute)
+	heavy, light := "10.0.0.1:853", "10.0.0.2:853"
+	config := &Config{Servers: []string{heavy, light}, ServerWeights: map[string]int{heavy: 4}}
+	firstShare := func() float64 {
+		first := 0
+		for range 4000 {
+			order := config.weightedUpstreams()
+			if len(order) != 2 {
+				t.Fatalf("order %v, want both servers", order)
+			}
+			if order[0] == heavy {
+				first++
+			}
+		}
+		return float64(first) / 4000
+	}
+
+	// Weights 4:1, the heavy server is first four times in five
+	if share := firstShare(); share < 0.75 || share > 0.85 {
+		t.Errorf("weight 4 server first in %.0f%% of orders, want about 80%%", 100*share)
+	}
+	// Two failures quarter its weight, leaving the servers even
+	failBreaker(t, breakerFor(heavy), time.Now())
+	failBreaker(t, breakerFor(heavy), time.Now())
+	if share := firstShare(); share < 0.45 || share > 0.55 {
+		t.Errorf("demoted server first in %.0f%% of orders, want about 50%%", 100*share)
+	}
+
+	// Without weights the configured order holds
+	config.ServerWeights = nil
+	if order := config.weightedUpstreams(); order[0] != heavy || order[1] != light {
+		t.Errorf("unweighted order %v", order)
+	}
+}
+
+func TestWeightedForwarding(t *testing.T) {
+	resetUpstreamState(t)
+	useTestBreakers(t, 100, time.Minute)
+	p := newTestPKI(t)
+	heavy := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 1}))
+	light := startMockDoT(t, p, 0, answerA(60, [4]byte{10, 0, 0, 2}))
+	config := &Config{
+		Servers:       []string{light.addr(), heavy.addr()},
+		ServerWeights: map[string]int{heavy.addr(): 4},
+		NoPublicDNS:   true,
+	}
+	for i := range 500 {
+		if _, _, err := resolveQuery(context.Background(), buildTestQuery(uint16(i), fmt.Sprintf("w%d.example", i), typeA), config, p.clientTLS(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Weights 4:1 split 500 queries about 400:100
+	if h, l := heavy.queries.Load(), light.queries.Load(); h+l != 500 || h < 360 || h > 440 {
+		t.Errorf("queries split %d:%d, want about 400:100", h, l)
+	}
+}
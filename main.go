@@ -0,0 +1,11 @@
+// Command endpoint is the ZeroTrust DNS endpoint client. It answers DNS for
+// the local machine, sending internal names to the ZeroTrust DNS server
+// over mTLS and everything else to public DNS. The resolver itself lives in
+// package endpoint, which other programs can embed.
+package main
+
+import "zerotrust-dns/endpoint"
+
+func main() {
+	endpoint.Main()
+}
@@ -490,6 +490,7 @@ async def start_dns():
     ctx.load_cert_chain(CERTS / "server.crt", CERTS / "server.key")
     ctx.load_verify_locations(CERTS / "ca.crt")
     ctx.verify_mode = ssl.CERT_REQUIRED
+    ctx.set_alpn_protocols(["dot"])
     server = await asyncio.start_server(dns_handler, "0.0.0.0", 853, ssl=ctx)
     print("✓ DNS over TLS server started on port 853")
     async with server:
@@ -542,27 +543,35 @@ async def proxy_handler(reader, writer):
         target_host = None
         target_port = None
 
-        # Parse HTTP request to find Host header
-        if b"Host:" in initial_data or b"host:" in initial_data:
+        # Endpoints tunnelling a local port (-proxy-forward) name the service
+        # in a "ZT-ROUTE <hostname>\r\n" preamble, which isn't passed on.
+        # Anything else is routed by its HTTP Host header.
+        hostname = None
+        if initial_data.startswith(b"ZT-ROUTE "):
+            line, _, initial_data = initial_data.partition(b"\r\n")
+            hostname = line[len(b"ZT-ROUTE ") :].strip().decode()
+        elif b"Host:" in initial_data or b"host:" in initial_data:
             lines = initial_data.split(b"\r\n")
             for line in lines:
                 if line.lower().startswith(b"host:"):
                     hostname = line.split(b":", 1)[1].strip().decode()
-                    # Find which service owns this domain
-                    for zone, zdata in zones.items():
-                        if hostname == zone or hostname.endswith("." + zone):
-                            if client_cn in zdata.get("allowed_endpoints", []):
-                                target_service_cn = zdata.get("service_cn")
-                                if target_service_cn and target_service_cn in routes:
-                                    route = routes[target_service_cn]
-                                    target_host = route["host"]
-                                    target_port = route["port"]
-                                    print(
-                                        f"Proxy: Routing {client_cn} → {target_service_cn} ({target_host}:{target_port})"
-                                    )
-                                    break
                     break
 
+        if hostname:
+            # Find which service owns this domain
+            for zone, zdata in zones.items():
+                if hostname == zone or hostname.endswith("." + zone):
+                    if client_cn in zdata.get("allowed_endpoints", []):
+                        target_service_cn = zdata.get("service_cn")
+                        if target_service_cn and target_service_cn in routes:
+                            route = routes[target_service_cn]
+                            target_host = route["host"]
+                            target_port = route["port"]
+                            print(
+                                f"Proxy: Routing {client_cn} → {target_service_cn} ({target_host}:{target_port})"
+                            )
+                            break
+
         if not target_host:
             print(f"Proxy: Could not determine target service for client {client_cn}")
             writer.write(b"HTTP/1.1 502 Bad Gateway\r\n\r\nNo route to service\r\n")
@@ -586,8 +595,9 @@ async def proxy_handler(reader, writer):
             return
 
         # Forward initial data to service
-        service_writer.write(initial_data)
-        await service_writer.drain()
+        if initial_data:
+            service_writer.write(initial_data)
+            await service_writer.drain()
 
         # Bidirectional proxy
         async def forward(src, dst, direction):